@@ -0,0 +1,463 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDNSResponder remembers challenge TXT records in a map.
+type testDNSResponder struct {
+	mutex   sync.Mutex
+	records map[string]string
+}
+
+func (responder *testDNSResponder) SetChallengeTXT(name, value string) {
+	responder.mutex.Lock()
+	responder.records[name] = value
+	responder.mutex.Unlock()
+}
+
+func (responder *testDNSResponder) RemoveChallengeTXT(name string) {
+	responder.mutex.Lock()
+	delete(responder.records, name)
+	responder.mutex.Unlock()
+}
+
+func (responder *testDNSResponder) get(name string) string {
+	responder.mutex.Lock()
+	defer responder.mutex.Unlock()
+	return responder.records[name]
+}
+
+// testAuthz is an authorisation kept by the stand-in ACME server.
+type testAuthz struct {
+	Authorization
+	token string
+}
+
+/*
+testACMEServer is a stand-in ACME server. It verifies JWS signatures, validates challenges against the certificate
+manager, and issues certificates signed by its own CA.
+*/
+type testACMEServer struct {
+	*httptest.Server
+	mutex           sync.Mutex
+	caKey           *ecdsa.PrivateKey
+	caCert          *x509.Certificate
+	accountKey      *ecdsa.PublicKey
+	nonce           int
+	rejectNonceOnce bool
+	authzs          []*testAuthz
+	orders          []*Order
+	certs           [][]byte
+	validity        time.Duration
+	httpAddr        string            // httpAddr serves HTTP challenge
+	tlsAddr         string            // tlsAddr serves TLS-ALPN challenge
+	dns             *testDNSResponder // dns serves DNS challenge
+}
+
+func newTestACMEServer(t *testing.T) *testACMEServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "laitos test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testACMEServer{caKey: caKey, caCert: caCert, validity: 90 * 24 * time.Hour}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+func (server *testACMEServer) handle(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", server.nonce))
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(Directory{NewNonce: server.URL + "/nonce", NewAccount: server.URL + "/account", NewOrder: server.URL + "/order"})
+		return
+	} else if r.URL.Path == "/nonce" {
+		return
+	}
+	payload, problem := server.verify(r)
+	if problem != nil {
+		w.WriteHeader(problem.Status)
+		json.NewEncoder(w).Encode(problem)
+		return
+	}
+	var id int
+	switch {
+	case r.URL.Path == "/account":
+		w.Header().Set("Location", server.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Path == "/order":
+		var req struct {
+			Identifiers []Identifier `json:"identifiers"`
+		}
+		json.Unmarshal(payload, &req)
+		order := &Order{Status: StatusPending, Identifiers: req.Identifiers}
+		id = len(server.orders)
+		for _, identifier := range req.Identifiers {
+			authzID := len(server.authzs)
+			authz := &testAuthz{token: fmt.Sprintf("token%d", authzID)}
+			authz.Identifier = identifier
+			authz.Status = StatusPending
+			for _, challengeType := range []string{ChallengeHTTP01, ChallengeTLSALPN01, ChallengeDNS01} {
+				authz.Challenges = append(authz.Challenges, Challenge{
+					Type:   challengeType,
+					URL:    fmt.Sprintf("%s/challenge/%d/%s", server.URL, authzID, challengeType),
+					Token:  authz.token,
+					Status: StatusPending,
+				})
+			}
+			server.authzs = append(server.authzs, authz)
+			order.Authorizations = append(order.Authorizations, fmt.Sprintf("%s/authz/%d", server.URL, authzID))
+		}
+		order.Finalize = fmt.Sprintf("%s/finalize/%d", server.URL, id)
+		server.orders = append(server.orders, order)
+		w.Header().Set("Location", fmt.Sprintf("%s/order/%d", server.URL, id))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(order)
+	case scan(r.URL.Path, "/authz/%d", &id):
+		json.NewEncoder(w).Encode(server.authzs[id].Authorization)
+	case strings.HasPrefix(r.URL.Path, "/challenge/"):
+		var challengeType string
+		fmt.Sscanf(r.URL.Path, "/challenge/%d/%s", &id, &challengeType)
+		authz := server.authzs[id]
+		for i, challenge := range authz.Challenges {
+			if challenge.Type == challengeType {
+				if err := server.validate(authz.Identifier.Value, challengeType, authz.token); err != nil {
+					authz.Challenges[i].Status = StatusInvalid
+					authz.Challenges[i].Error = &Problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: err.Error(), Status: http.StatusForbidden}
+					authz.Status = StatusInvalid
+				} else {
+					authz.Challenges[i].Status = StatusValid
+					authz.Status = StatusValid
+				}
+				json.NewEncoder(w).Encode(authz.Challenges[i])
+			}
+		}
+	case scan(r.URL.Path, "/finalize/%d", &id):
+		order := server.orders[id]
+		for _, authzURL := range order.Authorizations {
+			var authzID int
+			fmt.Sscanf(authzURL, server.URL+"/authz/%d", &authzID)
+			if server.authzs[authzID].Status != StatusValid {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(Problem{Type: "urn:ietf:params:acme:error:orderNotReady", Status: http.StatusForbidden})
+				return
+			}
+		}
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &req)
+		csrDER, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(csrDER)
+		if err != nil || csr.CheckSignature() != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Problem{Type: "urn:ietf:params:acme:error:badCSR", Status: http.StatusBadRequest})
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(server.validity),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, server.caCert, csr.PublicKey, server.caKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.caCert.Raw})...)
+		server.certs = append(server.certs, chain)
+		// Issuance takes a while, the client has to poll the order.
+		order.Status = StatusProcessing
+		json.NewEncoder(w).Encode(order)
+		order.Status = StatusValid
+		order.Certificate = fmt.Sprintf("%s/cert/%d", server.URL, len(server.certs)-1)
+	case scan(r.URL.Path, "/order/%d", &id):
+		json.NewEncoder(w).Encode(server.orders[id])
+	case scan(r.URL.Path, "/cert/%d", &id):
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(server.certs[id])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// scan returns true if the path matches the format, which has exactly one integer in it.
+func scan(path, format string, id *int) bool {
+	n, err := fmt.Sscanf(path, format, id)
+	return n == 1 && err == nil
+}
+
+// verify checks the nonce, URL, and signature of the flattened JWS, and returns its payload.
+func (server *testACMEServer) verify(r *http.Request) ([]byte, *Problem) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, &Problem{Type: "urn:ietf:params:acme:error:malformed", Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	protectedJSON, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg   string `json:"alg"`
+		Kid   string `json:"kid"`
+		Nonce string `json:"nonce"`
+		URL   string `json:"url"`
+		JWK   *struct {
+			X string `json:"x"`
+			Y string `json:"y"`
+		} `json:"jwk"`
+	}
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil || protected.Alg != "ES256" || protected.URL != server.URL+r.URL.Path {
+		return nil, &Problem{Type: "urn:ietf:params:acme:error:malformed", Detail: string(protectedJSON), Status: http.StatusBadRequest}
+	}
+	if server.rejectNonceOnce || protected.Nonce == "" {
+		server.rejectNonceOnce = false
+		return nil, &Problem{Type: "urn:ietf:params:acme:error:badNonce", Status: http.StatusBadRequest}
+	}
+	key := server.accountKey
+	if protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		server.accountKey = key
+	} else if protected.Kid != server.URL+"/account/1" {
+		return nil, &Problem{Type: "urn:ietf:params:acme:error:accountDoesNotExist", Status: http.StatusBadRequest}
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if key == nil || len(signature) != 64 ||
+		!ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, &Problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: "bad signature", Status: http.StatusUnauthorized}
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, nil
+}
+
+// validate checks the challenge response the way ACME server does.
+func (server *testACMEServer) validate(domain, challengeType, token string) error {
+	thumbprint := (&Client{AccountKey: &ecdsa.PrivateKey{PublicKey: *server.accountKey}}).Thumbprint()
+	keyAuth := token + "." + thumbprint
+	digest := sha256.Sum256([]byte(keyAuth))
+	switch challengeType {
+	case ChallengeHTTP01:
+		resp, err := http.Get("http://" + server.httpAddr + HTTPChallengePath + token)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != keyAuth {
+			return fmt.Errorf("unexpected HTTP response %d %s", resp.StatusCode, body)
+		}
+	case ChallengeTLSALPN01:
+		conn, err := tls.Dial("tcp", server.tlsAddr, &tls.Config{ServerName: domain, NextProtos: []string{ALPNProto}, InsecureSkipVerify: true})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.NegotiatedProtocol != ALPNProto || len(state.PeerCertificates) != 1 {
+			return fmt.Errorf("unexpected TLS state %+v", state)
+		}
+		expected, _ := asn1.Marshal(digest[:])
+		for _, ext := range state.PeerCertificates[0].Extensions {
+			if ext.Id.Equal(OIDACMEIdentifier) && ext.Critical && bytes.Equal(ext.Value, expected) {
+				return state.PeerCertificates[0].VerifyHostname(domain)
+			}
+		}
+		return fmt.Errorf("challenge certificate does not carry key authorisation digest")
+	case ChallengeDNS01:
+		if value := server.dns.get(DNSChallengePrefix + domain); value != base64.RawURLEncoding.EncodeToString(digest[:]) {
+			return fmt.Errorf("unexpected TXT record \"%s\"", value)
+		}
+	}
+	return nil
+}
+
+// serialOfServedCert makes a TLS connection to the address and returns the serial number of server certificate.
+func serialOfServedCert(t *testing.T, addr string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.String()
+}
+
+func TestCertManager_InvalidConfig(t *testing.T) {
+	mgr := &CertManager{}
+	if mgr.IsConfigured() || (*CertManager)(nil).IsConfigured() {
+		t.Fatal("should not be configured")
+	}
+	if err := mgr.Initialise(); err == nil || !strings.Contains(err.Error(), "must be present") {
+		t.Fatal(err)
+	}
+	mgr = &CertManager{Domains: []string{"example.com"}, CacheDir: "/tmp/test-laitos-acme-invalid", Challenge: "dns-01"}
+	defer os.RemoveAll(mgr.CacheDir)
+	if err := mgr.Initialise(); err == nil || !strings.Contains(err.Error(), "DNS daemon") {
+		t.Fatal(err)
+	}
+	mgr = &CertManager{Domains: []string{"example.com"}, CacheDir: "/tmp/test-laitos-acme-invalid", Challenge: "email"}
+	if err := mgr.Initialise(); err == nil || !strings.Contains(err.Error(), "unknown challenge") {
+		t.Fatal(err)
+	}
+	// Initialise remembers its first outcome
+	mgr.Challenge = ChallengeHTTP01
+	if err := mgr.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestCertManager_Obtain(t *testing.T) {
+	server := newTestACMEServer(t)
+	defer server.Close()
+	server.dns = &testDNSResponder{records: make(map[string]string)}
+
+	cacheDir := "/tmp/test-laitos-acme"
+	os.RemoveAll(cacheDir)
+	defer os.RemoveAll(cacheDir)
+	mgr := &CertManager{
+		DirectoryURL: server.URL + "/directory",
+		Email:        "admin@example.com",
+		Domains:      []string{"Example.com.", "www.example.com"},
+		CacheDir:     cacheDir,
+		DNSResponder: server.dns,
+		PollInterval: 10 * time.Millisecond,
+	}
+	if err := mgr.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if mgr.DirectoryURL != server.URL+"/directory" || mgr.Challenge != ChallengeHTTP01 || mgr.RenewBeforeDays != DefaultRenewBeforeDays ||
+		mgr.Domains[0] != "example.com" || !mgr.NotAfter().IsZero() {
+		t.Fatalf("%+v", mgr)
+	}
+	if _, err := mgr.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"}); err == nil {
+		t.Fatal("did not error")
+	}
+
+	// HTTP challenge is answered by HTTP server
+	httpServer := httptest.NewServer(http.HandlerFunc(mgr.HandleHTTPChallenge))
+	defer httpServer.Close()
+	server.httpAddr = strings.TrimPrefix(httpServer.URL, "http://")
+	// TLS-ALPN challenge is answered by TLS server, which also serves the obtained certificate.
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", mgr.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsListener.Close()
+	server.tlsAddr = tlsListener.Addr().String()
+	go func() {
+		for {
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}(conn)
+		}
+	}()
+
+	// Server rejects the first nonce, the client retries.
+	server.rejectNonceOnce = true
+	if err := mgr.ObtainCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(mgr.NotAfter()) < 89*24*time.Hour {
+		t.Fatal(mgr.NotAfter())
+	}
+	firstSerial := serialOfServedCert(t, server.tlsAddr)
+	// Fresh certificate is not renewed
+	if err := mgr.RenewIfDue(); err != nil || len(server.certs) != 1 {
+		t.Fatal(err, len(server.certs))
+	}
+	// Challenge tokens are withdrawn after validation
+	if resp, err := http.Get(httpServer.URL + HTTPChallengePath + "token0"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatal(err, resp)
+	}
+
+	// TLS-ALPN and DNS challenges; the new certificate replaces the old one without restarting TLS server.
+	for _, challengeType := range []string{ChallengeTLSALPN01, ChallengeDNS01} {
+		mgr.Challenge = challengeType
+		if err := mgr.ObtainCertificate(); err != nil {
+			t.Fatal(challengeType, err)
+		}
+	}
+	if len(server.certs) != 3 || len(server.dns.records) != 0 {
+		t.Fatal(len(server.certs), server.dns.records)
+	}
+	if serial := serialOfServedCert(t, server.tlsAddr); serial == firstSerial {
+		t.Fatal("certificate did not change")
+	}
+
+	// Failed challenge
+	server.httpAddr = "127.0.0.1:1"
+	mgr.Challenge = ChallengeHTTP01
+	if err := mgr.ObtainCertificate(); err == nil || !strings.Contains(err.Error(), "http-01 challenge of example.com failed") {
+		t.Fatal(err)
+	}
+
+	// Another manager picks up the certificate from cache directory, and renews it as it is about to expire.
+	cachedMgr := &CertManager{DirectoryURL: server.URL + "/directory", Domains: []string{"example.com", "www.example.com"}, CacheDir: cacheDir, Challenge: ChallengeDNS01, DNSResponder: server.dns, PollInterval: 10 * time.Millisecond}
+	if err := cachedMgr.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if !cachedMgr.NotAfter().Equal(mgr.NotAfter()) {
+		t.Fatal(cachedMgr.NotAfter(), mgr.NotAfter())
+	}
+	cachedMgr.RenewBeforeDays = 100
+	if err := cachedMgr.RenewIfDue(); err != nil || len(server.certs) != 4 {
+		t.Fatal(err, len(server.certs))
+	}
+	// Cached certificate that does not cover all domain names is not used
+	otherMgr := &CertManager{Domains: []string{"example.net"}, CacheDir: cacheDir}
+	if err := otherMgr.Initialise(); err != nil || !otherMgr.NotAfter().IsZero() {
+		t.Fatal(err, otherMgr.NotAfter())
+	}
+}
@@ -0,0 +1,326 @@
+// Obtain and renew TLS certificates from certificate authorities that implement ACME (RFC 8555), e.g. Let's Encrypt.
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	LetsEncryptDirectoryURL = "https://acme-v02.api.letsencrypt.org/directory" // LetsEncryptDirectoryURL is the directory of Let's Encrypt production service.
+	IOTimeoutSec            = 30                                               // IOTimeoutSec is the timeout of each request made to ACME server.
+	PollIntervalSec         = 3                                                // PollIntervalSec is the interval between checks of pending authorisation and order.
+	MaxPollAttempts         = 40                                               // MaxPollAttempts is the number of checks made before giving up on pending authorisation and order.
+	MaxResponseSize         = 1024 * 1024                                      // MaxResponseSize is the maximum size of response read from ACME server.
+
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusValid      = "valid"
+	StatusInvalid    = "invalid"
+	StatusReady      = "ready"
+)
+
+// Directory tells the locations of ACME server resources.
+type Directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// Problem is an error document returned by ACME server.
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (problem *Problem) Error() string {
+	return fmt.Sprintf("ACME server responded with %d %s - %s", problem.Status, problem.Type, problem.Detail)
+}
+
+// Identifier is a domain name that a certificate is going to be issued for.
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Order is a request for certificate of one or more domain names.
+type Order struct {
+	URL            string       `json:"-"`
+	Status         string       `json:"status"`
+	Identifiers    []Identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *Problem     `json:"error"`
+}
+
+// Authorization proves the ownership of a domain name by completing one of its challenges.
+type Authorization struct {
+	Identifier Identifier  `json:"identifier"`
+	Status     string      `json:"status"`
+	Challenges []Challenge `json:"challenges"`
+}
+
+// Challenge is a means of proving the ownership of a domain name, e.g. via HTTP, TLS, or DNS.
+type Challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *Problem `json:"error"`
+}
+
+// Client talks to ACME server on behalf of an account identified by its key.
+type Client struct {
+	DirectoryURL string            // DirectoryURL is the location of ACME server directory.
+	AccountKey   *ecdsa.PrivateKey // AccountKey is the P-256 key that identifies the account.
+	PollInterval time.Duration     // PollInterval is the interval between checks of pending authorisation and order.
+
+	httpClient *http.Client
+	directory  Directory
+	accountURL string
+	nonce      string
+}
+
+// b64 encodes the input in URL-safe base64 without padding, as required by JWS.
+func b64(in []byte) string {
+	return base64.RawURLEncoding.EncodeToString(in)
+}
+
+// jwk returns the JSON web key of the public account key, its members are in lexical order required by thumbprint.
+func (client *Client) jwk() string {
+	pub := client.AccountKey.PublicKey
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, b64(padInt(pub.X.Bytes())), b64(padInt(pub.Y.Bytes())))
+}
+
+// padInt pads a big-endian integer to 32 bytes, the size of P-256 coordinates and signature components.
+func padInt(in []byte) []byte {
+	if len(in) >= 32 {
+		return in
+	}
+	return append(make([]byte, 32-len(in)), in...)
+}
+
+// Thumbprint returns the JWK thumbprint (RFC 7638) of account key.
+func (client *Client) Thumbprint() string {
+	digest := sha256.Sum256([]byte(client.jwk()))
+	return b64(digest[:])
+}
+
+// KeyAuthorization returns the key authorisation of a challenge token, which proves the ownership of account key.
+func (client *Client) KeyAuthorization(token string) string {
+	return token + "." + client.Thumbprint()
+}
+
+// Register retrieves ACME server directory and then creates an account (or finds the existing account) of the key.
+func (client *Client) Register(email string) error {
+	if client.PollInterval == 0 {
+		client.PollInterval = PollIntervalSec * time.Second
+	}
+	client.httpClient = &http.Client{Timeout: IOTimeoutSec * time.Second}
+	resp, err := client.httpClient.Get(client.DirectoryURL)
+	if err != nil {
+		return fmt.Errorf("ACME.Register: failed to retrieve directory - %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("ACME.Register: failed to retrieve directory - HTTP %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&client.directory); err != nil {
+		return fmt.Errorf("ACME.Register: failed to decode directory - %v", err)
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	respHeader, _, err := client.post(client.directory.NewAccount, account, nil)
+	if err != nil {
+		return fmt.Errorf("ACME.Register: %v", err)
+	}
+	if client.accountURL = respHeader.Get("Location"); client.accountURL == "" {
+		return errors.New("ACME.Register: server did not tell account URL")
+	}
+	return nil
+}
+
+// getNonce returns a fresh anti-replay nonce, either left over from the previous response or retrieved from server.
+func (client *Client) getNonce() (string, error) {
+	if nonce := client.nonce; nonce != "" {
+		client.nonce = ""
+		return nonce, nil
+	}
+	resp, err := client.httpClient.Head(client.directory.NewNonce)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve nonce - %v", err)
+	}
+	resp.Body.Close()
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		return nonce, nil
+	}
+	return "", errors.New("server did not give a nonce")
+}
+
+/*
+sign wraps the payload in a flattened JWS signed by account key. Account creation identifies the key by its JWK, and
+all other requests identify the key by account URL. A nil payload makes an empty payload for POST-as-GET requests.
+*/
+func (client *Client) sign(url string, payload []byte) ([]byte, error) {
+	nonce, err := client.getNonce()
+	if err != nil {
+		return nil, err
+	}
+	keyID := fmt.Sprintf(`"kid":%q`, client.accountURL)
+	if client.accountURL == "" {
+		keyID = `"jwk":` + client.jwk()
+	}
+	protected := b64([]byte(fmt.Sprintf(`{"alg":"ES256",%s,"nonce":%q,"url":%q}`, keyID, nonce, url)))
+	encodedPayload := ""
+	if payload != nil {
+		encodedPayload = b64(payload)
+	}
+	digest := sha256.Sum256([]byte(protected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, client.AccountKey, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := append(padInt(r.Bytes()), padInt(s.Bytes())...)
+	return json.Marshal(map[string]string{"protected": protected, "payload": encodedPayload, "signature": b64(signature)})
+}
+
+/*
+post sends a signed request to the URL and decodes JSON response into result (if it is not nil). A nil payload makes a
+POST-as-GET request. If server rejects the nonce, the request is retried once with a fresh nonce.
+*/
+func (client *Client) post(url string, payload interface{}, result interface{}) (http.Header, []byte, error) {
+	var payloadJSON []byte
+	if payload != nil {
+		var err error
+		if payloadJSON, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		body, err := client.sign(url, payloadJSON)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := client.httpClient.Post(url, "application/jose+json", bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxResponseSize))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		client.nonce = resp.Header.Get("Replay-Nonce")
+		if resp.StatusCode/100 != 2 {
+			problem := &Problem{Status: resp.StatusCode}
+			json.Unmarshal(respBody, problem)
+			if strings.HasSuffix(problem.Type, ":badNonce") && attempt == 0 {
+				continue
+			}
+			return nil, nil, problem
+		}
+		if result != nil {
+			if err := json.Unmarshal(respBody, result); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode response from %s - %v", url, err)
+			}
+		}
+		return resp.Header, respBody, nil
+	}
+}
+
+// NewOrder asks for a new certificate for the domain names.
+func (client *Client) NewOrder(domains []string) (*Order, error) {
+	identifiers := make([]Identifier, 0, len(domains))
+	for _, domain := range domains {
+		identifiers = append(identifiers, Identifier{Type: "dns", Value: domain})
+	}
+	order := new(Order)
+	respHeader, _, err := client.post(client.directory.NewOrder, map[string]interface{}{"identifiers": identifiers}, order)
+	if err != nil {
+		return nil, fmt.Errorf("ACME.NewOrder: %v", err)
+	}
+	order.URL = respHeader.Get("Location")
+	return order, nil
+}
+
+// GetAuthorization retrieves the authorisation and its challenges.
+func (client *Client) GetAuthorization(url string) (*Authorization, error) {
+	authz := new(Authorization)
+	if _, _, err := client.post(url, nil, authz); err != nil {
+		return nil, fmt.Errorf("ACME.GetAuthorization: %v", err)
+	}
+	return authz, nil
+}
+
+// Accept tells server that the challenge is ready for validation, and then waits until the authorisation is valid.
+func (client *Client) Accept(authzURL string, challenge Challenge) error {
+	if _, _, err := client.post(challenge.URL, struct{}{}, nil); err != nil {
+		return fmt.Errorf("ACME.Accept: %v", err)
+	}
+	for i := 0; i < MaxPollAttempts; i++ {
+		authz, err := client.GetAuthorization(authzURL)
+		if err != nil {
+			return err
+		}
+		switch authz.Status {
+		case StatusValid:
+			return nil
+		case StatusInvalid:
+			for _, chal := range authz.Challenges {
+				if chal.Error != nil {
+					return fmt.Errorf("ACME.Accept: %s challenge of %s failed - %v", chal.Type, authz.Identifier.Value, chal.Error)
+				}
+			}
+			return fmt.Errorf("ACME.Accept: authorisation of %s is invalid", authz.Identifier.Value)
+		}
+		time.Sleep(client.PollInterval)
+	}
+	return errors.New("ACME.Accept: timed out waiting for authorisation")
+}
+
+/*
+Finalize submits certificate signing request (in DER) of an order that has all of its authorisations completed, waits
+for the certificate to be issued, and then downloads the certificate chain in PEM.
+*/
+func (client *Client) Finalize(order *Order, csrDER []byte) ([]byte, error) {
+	if _, _, err := client.post(order.Finalize, map[string]string{"csr": b64(csrDER)}, order); err != nil {
+		return nil, fmt.Errorf("ACME.Finalize: %v", err)
+	}
+	for i := 0; order.Status != StatusValid; i++ {
+		if order.Status == StatusInvalid {
+			return nil, fmt.Errorf("ACME.Finalize: order is invalid - %v", order.Error)
+		} else if i == MaxPollAttempts {
+			return nil, errors.New("ACME.Finalize: timed out waiting for certificate")
+		}
+		time.Sleep(client.PollInterval)
+		if _, _, err := client.post(order.URL, nil, order); err != nil {
+			return nil, fmt.Errorf("ACME.Finalize: %v", err)
+		}
+	}
+	_, certPEM, err := client.post(order.Certificate, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ACME.Finalize: failed to download certificate - %v", err)
+	}
+	return certPEM, nil
+}
+
+// hashKeyAuthorization returns the SHA-256 digest of key authorisation, used by TLS-ALPN and DNS challenges.
+func hashKeyAuthorization(keyAuth string) []byte {
+	digest := sha256.Sum256([]byte(keyAuth))
+	return digest[:]
+}
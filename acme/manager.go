@@ -0,0 +1,417 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/global"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ChallengeHTTP01    = "http-01"     // ChallengeHTTP01 proves domain ownership via HTTP daemon on port 80.
+	ChallengeTLSALPN01 = "tls-alpn-01" // ChallengeTLSALPN01 proves domain ownership via HTTPS daemon on port 443.
+	ChallengeDNS01     = "dns-01"      // ChallengeDNS01 proves domain ownership via TXT record served by DNS daemon that is authoritative for the domain.
+
+	ALPNProto                = "acme-tls/1"                   // ALPNProto is the application protocol negotiated by TLS-ALPN challenge.
+	HTTPChallengePath        = "/.well-known/acme-challenge/" // HTTPChallengePath is the URL path prefix of HTTP challenge tokens.
+	DNSChallengePrefix       = "_acme-challenge."             // DNSChallengePrefix is prepended to domain name to make the name of DNS challenge TXT record.
+	DefaultRenewBeforeDays   = 30                             // DefaultRenewBeforeDays is the number of days before expiry at which certificate is renewed.
+	RenewalCheckIntervalSec  = 6 * 3600                       // RenewalCheckIntervalSec is the interval between checks of certificate expiry.
+	AccountKeyFileName       = "account.key"                  // AccountKeyFileName is the name of account key file in cache directory.
+	CertificateFileName      = "certificate.crt"              // CertificateFileName is the name of certificate chain file in cache directory.
+	CertificateKeyFileName   = "certificate.key"              // CertificateKeyFileName is the name of certificate key file in cache directory.
+	challengeCertValidityHrs = 24                             // challengeCertValidityHrs is the validity of self-signed TLS-ALPN challenge certificate.
+)
+
+// OIDACMEIdentifier is the critical certificate extension that carries key authorisation digest in TLS-ALPN challenge.
+var OIDACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// DNSChallengeResponder publishes and withdraws TXT records of DNS challenges, e.g. a DNS daemon that is authoritative for the domains.
+type DNSChallengeResponder interface {
+	SetChallengeTXT(name, value string) // SetChallengeTXT answers TXT queries of the name with the value.
+	RemoveChallengeTXT(name string)     // RemoveChallengeTXT stops answering TXT queries of the name.
+}
+
+/*
+CertManager obtains a TLS certificate for the domain names from ACME server, keeps it in cache directory, and renews it
+before it expires. Daemons use GetCertificate in their TLS configuration, so that they pick up renewed certificate
+without restarting.
+*/
+type CertManager struct {
+	DirectoryURL    string   `json:"DirectoryURL"`    // (Optional) ACME server directory URL, by default Let's Encrypt.
+	Email           string   `json:"Email"`           // (Optional) contact Email address of the ACME account.
+	Domains         []string `json:"Domains"`         // The certificate is issued for these domain names
+	CacheDir        string   `json:"CacheDir"`        // Keep account key, certificate, and certificate key in this directory
+	Challenge       string   `json:"Challenge"`       // (Optional) "http-01", "tls-alpn-01", or "dns-01", by default "http-01".
+	RenewBeforeDays int      `json:"RenewBeforeDays"` // (Optional) renew certificate this many days before it expires, by default 30.
+
+	DNSResponder DNSChallengeResponder `json:"-"` // DNSResponder publishes TXT records for DNS challenges
+	PollInterval time.Duration         `json:"-"` // PollInterval is the interval between checks of pending authorisation and order, by default 3 seconds.
+	Logger       global.Logger         `json:"-"` // Logger
+
+	initOnce    *sync.Once
+	initErr     error
+	mutex       *sync.Mutex
+	obtainMutex *sync.Mutex
+	certificate *tls.Certificate
+	httpTokens  map[string]string           // httpTokens are key authorisations of HTTP challenge tokens.
+	alpnCerts   map[string]*tls.Certificate // alpnCerts are TLS-ALPN challenge certificates of domain names.
+	notAfter    time.Time                   // notAfter is the expiry time of the current certificate
+}
+
+// IsConfigured returns true only if domain names and cache directory are present.
+func (mgr *CertManager) IsConfigured() bool {
+	return mgr != nil && len(mgr.Domains) > 0 && mgr.CacheDir != ""
+}
+
+// Initialise checks configuration and loads certificate from cache directory. Calling it more than once does nothing.
+func (mgr *CertManager) Initialise() error {
+	if mgr.initOnce == nil {
+		mgr.initOnce = new(sync.Once)
+	}
+	mgr.initOnce.Do(func() {
+		mgr.initErr = mgr.initialise()
+	})
+	return mgr.initErr
+}
+
+func (mgr *CertManager) initialise() error {
+	for i, domain := range mgr.Domains {
+		mgr.Domains[i] = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+	}
+	mgr.Logger = global.Logger{ComponentName: "ACME", ComponentID: strings.Join(mgr.Domains, ",")}
+	if !mgr.IsConfigured() {
+		return errors.New("CertManager.Initialise: domain names and cache directory must be present")
+	}
+	if mgr.DirectoryURL == "" {
+		mgr.DirectoryURL = LetsEncryptDirectoryURL
+	}
+	if mgr.Challenge == "" {
+		mgr.Challenge = ChallengeHTTP01
+	}
+	switch mgr.Challenge {
+	case ChallengeHTTP01, ChallengeTLSALPN01:
+	case ChallengeDNS01:
+		if mgr.DNSResponder == nil {
+			return errors.New("CertManager.Initialise: DNS challenge requires DNS daemon to be authoritative for the domains")
+		}
+	default:
+		return fmt.Errorf("CertManager.Initialise: unknown challenge type \"%s\"", mgr.Challenge)
+	}
+	if mgr.RenewBeforeDays < 1 {
+		mgr.RenewBeforeDays = DefaultRenewBeforeDays
+	}
+	mgr.mutex = new(sync.Mutex)
+	mgr.obtainMutex = new(sync.Mutex)
+	mgr.httpTokens = make(map[string]string)
+	mgr.alpnCerts = make(map[string]*tls.Certificate)
+	if err := os.MkdirAll(mgr.CacheDir, 0700); err != nil {
+		return fmt.Errorf("CertManager.Initialise: failed to create cache directory - %v", err)
+	}
+	// Start serving the cached certificate right away, even if it is about to expire.
+	if err := mgr.loadCachedCertificate(); err != nil && !os.IsNotExist(err) {
+		mgr.Logger.Warningf("Initialise", mgr.CacheDir, err, "ignored unusable cached certificate")
+	}
+	return nil
+}
+
+// loadCachedCertificate reads certificate and key from cache directory, and uses it if it covers all domain names.
+func (mgr *CertManager) loadCachedCertificate() error {
+	cert, err := tls.LoadX509KeyPair(path.Join(mgr.CacheDir, CertificateFileName), path.Join(mgr.CacheDir, CertificateKeyFileName))
+	if err != nil {
+		return err
+	}
+	return mgr.useCertificate(&cert)
+}
+
+// useCertificate makes the certificate available to TLS handshakes if it covers all of the domain names.
+func (mgr *CertManager) useCertificate(cert *tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	for _, domain := range mgr.Domains {
+		if err := leaf.VerifyHostname(domain); err != nil {
+			return err
+		}
+	}
+	cert.Leaf = leaf
+	mgr.mutex.Lock()
+	mgr.certificate = cert
+	mgr.notAfter = leaf.NotAfter
+	mgr.mutex.Unlock()
+	return nil
+}
+
+// NotAfter returns the expiry time of the current certificate, or zero time if there is no certificate yet.
+func (mgr *CertManager) NotAfter() time.Time {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	return mgr.notAfter
+}
+
+/*
+GetCertificate returns the current certificate to TLS handshakes. If the client is an ACME server validating TLS-ALPN
+challenge, the function returns the challenge certificate instead.
+*/
+func (mgr *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	for _, proto := range hello.SupportedProtos {
+		if proto == ALPNProto {
+			if cert, exists := mgr.alpnCerts[strings.ToLower(hello.ServerName)]; exists {
+				return cert, nil
+			}
+			return nil, fmt.Errorf("CertManager.GetCertificate: no TLS-ALPN challenge for \"%s\"", hello.ServerName)
+		}
+	}
+	if mgr.certificate == nil {
+		return nil, errors.New("CertManager.GetCertificate: certificate has not yet been obtained")
+	}
+	return mgr.certificate, nil
+}
+
+// TLSConfig returns a TLS configuration that uses the current certificate and answers TLS-ALPN challenges.
+func (mgr *CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: mgr.GetCertificate, NextProtos: []string{"h2", "http/1.1", ALPNProto}}
+}
+
+// HandleHTTPChallenge responds to ACME server's request for HTTP challenge token with its key authorisation.
+func (mgr *CertManager) HandleHTTPChallenge(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, HTTPChallengePath)
+	mgr.mutex.Lock()
+	keyAuth, exists := mgr.httpTokens[token]
+	mgr.mutex.Unlock()
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write([]byte(keyAuth))
+}
+
+// makeChallengeCert makes a self-signed TLS-ALPN challenge certificate that carries digest of the key authorisation.
+func makeChallengeCert(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	extValue, err := asn1.Marshal(hashKeyAuthorization(keyAuth))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: domain},
+		DNSNames:        []string{domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(challengeCertValidityHrs * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: OIDACMEIdentifier, Critical: true, Value: extValue}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+/*
+prepareChallenge makes the challenge response available to ACME server, and returns a function that withdraws the
+response after validation.
+*/
+func (mgr *CertManager) prepareChallenge(client *Client, domain string, challenge Challenge) (cleanUp func(), err error) {
+	keyAuth := client.KeyAuthorization(challenge.Token)
+	switch challenge.Type {
+	case ChallengeHTTP01:
+		mgr.mutex.Lock()
+		mgr.httpTokens[challenge.Token] = keyAuth
+		mgr.mutex.Unlock()
+		return func() {
+			mgr.mutex.Lock()
+			delete(mgr.httpTokens, challenge.Token)
+			mgr.mutex.Unlock()
+		}, nil
+	case ChallengeTLSALPN01:
+		cert, err := makeChallengeCert(domain, keyAuth)
+		if err != nil {
+			return nil, err
+		}
+		mgr.mutex.Lock()
+		mgr.alpnCerts[domain] = cert
+		mgr.mutex.Unlock()
+		return func() {
+			mgr.mutex.Lock()
+			delete(mgr.alpnCerts, domain)
+			mgr.mutex.Unlock()
+		}, nil
+	case ChallengeDNS01:
+		txtName := DNSChallengePrefix + domain
+		mgr.DNSResponder.SetChallengeTXT(txtName, b64(hashKeyAuthorization(keyAuth)))
+		return func() {
+			mgr.DNSResponder.RemoveChallengeTXT(txtName)
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported challenge type \"%s\"", challenge.Type)
+}
+
+// loadOrCreateKey reads an EC private key from the PEM file, or generates a new P-256 key and saves it into the file.
+func loadOrCreateKey(keyPath string) (*ecdsa.PrivateKey, error) {
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return nil, fmt.Errorf("%s does not contain a PEM key", keyPath)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKey(keyPath, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeKey saves the EC private key into the file in PEM.
+func writeKey(keyPath string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+/*
+ObtainCertificate asks ACME server for a new certificate, completes the challenges of all domain names, saves the
+certificate into cache directory, and then uses the certificate for new TLS handshakes.
+*/
+func (mgr *CertManager) ObtainCertificate() error {
+	mgr.obtainMutex.Lock()
+	defer mgr.obtainMutex.Unlock()
+	accountKey, err := loadOrCreateKey(path.Join(mgr.CacheDir, AccountKeyFileName))
+	if err != nil {
+		return fmt.Errorf("CertManager.ObtainCertificate: failed to read account key - %v", err)
+	}
+	client := &Client{DirectoryURL: mgr.DirectoryURL, AccountKey: accountKey, PollInterval: mgr.PollInterval}
+	if err := client.Register(mgr.Email); err != nil {
+		return err
+	}
+	order, err := client.NewOrder(mgr.Domains)
+	if err != nil {
+		return err
+	}
+	for _, authzURL := range order.Authorizations {
+		authz, err := client.GetAuthorization(authzURL)
+		if err != nil {
+			return err
+		}
+		if authz.Status == StatusValid {
+			// The domain name was recently validated
+			continue
+		}
+		var challenge *Challenge
+		for i, candidate := range authz.Challenges {
+			if candidate.Type == mgr.Challenge {
+				challenge = &authz.Challenges[i]
+			}
+		}
+		if challenge == nil {
+			return fmt.Errorf("CertManager.ObtainCertificate: server does not offer %s challenge for %s", mgr.Challenge, authz.Identifier.Value)
+		}
+		cleanUp, err := mgr.prepareChallenge(client, authz.Identifier.Value, *challenge)
+		if err != nil {
+			return fmt.Errorf("CertManager.ObtainCertificate: failed to prepare challenge - %v", err)
+		}
+		err = client.Accept(authzURL, *challenge)
+		cleanUp()
+		if err != nil {
+			return err
+		}
+		mgr.Logger.Printf("ObtainCertificate", authz.Identifier.Value, nil, "completed %s challenge", mgr.Challenge)
+	}
+	// Every certificate gets a new key
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: mgr.Domains[0]},
+		DNSNames: mgr.Domains,
+	}, certKey)
+	if err != nil {
+		return err
+	}
+	certPEM, err := client.Finalize(order, csr)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		return fmt.Errorf("CertManager.ObtainCertificate: server issued an unusable certificate - %v", err)
+	}
+	if err := mgr.useCertificate(&cert); err != nil {
+		return fmt.Errorf("CertManager.ObtainCertificate: server issued an unusable certificate - %v", err)
+	}
+	// Save key before certificate, so that a half saved cache is never mistaken for a good one.
+	if err := writeKey(path.Join(mgr.CacheDir, CertificateKeyFileName), certKey); err != nil {
+		return fmt.Errorf("CertManager.ObtainCertificate: failed to save certificate key - %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(mgr.CacheDir, CertificateFileName), certPEM, 0600); err != nil {
+		return fmt.Errorf("CertManager.ObtainCertificate: failed to save certificate - %v", err)
+	}
+	mgr.Logger.Printf("ObtainCertificate", "", nil, "obtained certificate that expires on %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// RenewIfDue obtains a new certificate if there is none yet or the current one is about to expire.
+func (mgr *CertManager) RenewIfDue() error {
+	notAfter := mgr.NotAfter()
+	if !notAfter.IsZero() && time.Until(notAfter) > time.Duration(mgr.RenewBeforeDays)*24*time.Hour {
+		return nil
+	}
+	err := mgr.ObtainCertificate()
+	if err != nil && !notAfter.IsZero() {
+		return fmt.Errorf("%v (current certificate expires in %s)", err, time.Until(notAfter).Truncate(time.Hour))
+	}
+	return err
+}
+
+/*
+KeepRenewed renews certificate right away if it is due, and then checks it at regular interval until a value arrives
+from the stop channel. If the channel is nil, the checks carry on indefinitely. Renewal failures are logged as warnings.
+*/
+func (mgr *CertManager) KeepRenewed(stop chan bool) {
+	for {
+		if err := mgr.RenewIfDue(); err != nil {
+			mgr.Logger.Warningf("KeepRenewed", "", err, "failed to renew certificate")
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(RenewalCheckIntervalSec * time.Second):
+		}
+	}
+}
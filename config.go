@@ -4,8 +4,12 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/acme"
 	"github.com/HouzuoGuo/laitos/bridge"
 	"github.com/HouzuoGuo/laitos/email"
+	"github.com/HouzuoGuo/laitos/env"
 	"github.com/HouzuoGuo/laitos/feature"
 	"github.com/HouzuoGuo/laitos/frontend/common"
 	"github.com/HouzuoGuo/laitos/frontend/dnsd"
@@ -41,8 +45,23 @@ type HTTPHandlers struct {
 	BrowserEndpoint       string            `json:"BrowserEndpoint"`
 	BrowserEndpointConfig api.HandleBrowser `json:"BrowserEndpointConfig"`
 
+	CommandAPIEndpoint       string               `json:"CommandAPIEndpoint"`
+	CommandAPIEndpointConfig api.HandleCommandAPI `json:"CommandAPIEndpointConfig"`
+
+	CommandConsoleEndpoint       string                   `json:"CommandConsoleEndpoint"`
+	CommandConsoleEndpointConfig api.HandleCommandConsole `json:"CommandConsoleEndpointConfig"`
+
 	CommandFormEndpoint string `json:"CommandFormEndpoint"`
 
+	DashboardEndpoint       string              `json:"DashboardEndpoint"`
+	DashboardEndpointConfig api.HandleDashboard `json:"DashboardEndpointConfig"`
+
+	DNSOverHTTPSEndpoint  string `json:"DNSOverHTTPSEndpoint"`
+	DNSQueryStatsEndpoint string `json:"DNSQueryStatsEndpoint"`
+
+	FileUploadEndpoint       string               `json:"FileUploadEndpoint"`
+	FileUploadEndpointConfig api.HandleFileUpload `json:"FileUploadEndpointConfig"`
+
 	GitlabBrowserEndpoint       string                  `json:"GitlabBrowserEndpoint"`
 	GitlabBrowserEndpointConfig api.HandleGitlabBrowser `json:"GitlabBrowserEndpointConfig"`
 
@@ -52,6 +71,13 @@ type HTTPHandlers struct {
 	MailMeEndpoint       string           `json:"MailMeEndpoint"`
 	MailMeEndpointConfig api.HandleMailMe `json:"MailMeEndpointConfig"`
 
+	PrometheusMetricsEndpoint string `json:"PrometheusMetricsEndpoint"`
+
+	ReverseProxyEndpoints map[string]api.HandleReverseProxy `json:"ReverseProxyEndpoints"` // Forward requests under these path prefixes (key) to upstream servers
+
+	ShellStreamEndpoint       string                `json:"ShellStreamEndpoint"`
+	ShellStreamEndpointConfig api.HandleShellStream `json:"ShellStreamEndpointConfig"`
+
 	WebProxyEndpoint string `json:"WebProxyEndpoint"`
 
 	TwilioSMSEndpoint        string                   `json:"TwilioSMSEndpoint"`
@@ -66,7 +92,8 @@ type Config struct {
 
 	Maintenance maintenance.Maintenance `json:"Maintenance"` // Maintenance configures behaviour of periodic health-check/system maintenance
 
-	DNSDaemon dnsd.DNSD `json:"DNSDaemon"` // DNS daemon configuration
+	DNSDaemon  dnsd.DNSD       `json:"DNSDaemon"`  // DNS daemon configuration
+	DNSBridges StandardBridges `json:"DNSBridges"` // DNS daemon bridge configuration for feature commands in TXT queries
 
 	HTTPDaemon   httpd.HTTPD     `json:"HTTPDaemon"`   // HTTP daemon configuration
 	HTTPBridges  StandardBridges `json:"HTTPBridges"`  // HTTP daemon bridge configuration
@@ -74,6 +101,10 @@ type Config struct {
 
 	HTTPIndexOnlyOn80 bool `json:"HTTPHomepageOn80"` // If TLS is enabled in HTTP daemon, serve only index pages via HTTP on port 80.
 
+	ACME *acme.CertManager `json:"ACME"` // (Optional) obtain and renew TLS certificate for HTTP, mail, and DNS-over-TLS daemons via ACME
+
+	BruteForceProtection *env.BanManager `json:"BruteForceProtection"` // (Optional) ban clients of all daemons that fail PIN/shortcut match too many times
+
 	MailDaemon    smtpd.SMTPD         `json:"MailDaemon"`    // SMTP daemon configuration
 	MailProcessor mailp.MailProcessor `json:"MailProcessor"` // Incoming mail processor configuration
 	MailBridges   StandardBridges     `json:"MailBridges"`   // Incoming mail processor bridge configuration
@@ -87,6 +118,70 @@ type Config struct {
 	TelegramBridges StandardBridges         `json:"TelegramBridges"` // Telegram bot bridge configuration
 
 	Logger global.Logger `json:"-"` // Log config related messages
+
+	validating bool // validating is true while a configuration is being validated, in which case errors do not exit the program.
+}
+
+// configValidationError carries the error that made a daemon getter abort while validating a configuration.
+type configValidationError struct {
+	err error
+}
+
+/*
+abort exits the program with a fatal error message. While validating a configuration, it panics with the error instead,
+and Validate function recovers it.
+*/
+func (config Config) abort(functionName string, err error, template string, values ...interface{}) {
+	if config.validating {
+		panic(configValidationError{errors.New(config.Logger.Format(functionName, "", err, template, values...))})
+	}
+	config.Logger.Fatalf(functionName, "", err, template, values...)
+}
+
+/*
+Validate constructs and initialises daemons of the frontends from configuration, without starting them. Unlike the
+individual getters, an invalid configuration results in an error rather than terminating the program. HTTP daemons are
+only checked, and their handlers are left for HTTPD.Reinitialise to construct, as handlers have side effects on running
+daemons. Return the daemons keyed by frontend name.
+*/
+func (config Config) Validate(frontends []string) (daemons map[string]interface{}, err error) {
+	config.validating = true
+	defer func() {
+		if r := recover(); r != nil {
+			validationErr, ok := r.(configValidationError)
+			if !ok {
+				panic(r)
+			}
+			daemons = nil
+			err = validationErr.err
+		}
+	}()
+	daemons = make(map[string]interface{})
+	for _, frontendName := range frontends {
+		switch frontendName {
+		case "dnsd":
+			daemons[frontendName] = config.GetDNSD()
+		case "httpd":
+			daemons[frontendName] = config.GetHTTPD()
+		case "insecurehttpd":
+			daemons[frontendName] = config.GetInsecureHTTPD()
+		case "mailp":
+			daemons[frontendName] = config.GetMailProcessor()
+		case "maintenance":
+			daemons[frontendName] = config.GetMaintenance()
+		case "plaintext":
+			daemons[frontendName] = config.GetPlainTextDaemon()
+		case "smtpd":
+			daemons[frontendName] = config.GetMailDaemon()
+		case "sockd":
+			daemons[frontendName] = config.GetSockDaemon()
+		case "telegram":
+			daemons[frontendName] = config.GetTelegramBot()
+		default:
+			return nil, fmt.Errorf("Config.Validate: unknown frontend name \"%s\"", frontendName)
+		}
+	}
+	return
 }
 
 // Deserialise JSON data into config structures.
@@ -98,13 +193,91 @@ func (config *Config) DeserialiseFromJSON(in []byte) error {
 	return nil
 }
 
+/*
+Initialise and return the ACME certificate manager shared by HTTP, mail, and DNS daemons, or nil if ACME is not
+configured. DNS challenges are answered by laitos' own DNS daemon.
+*/
+func (config Config) GetCertManager() *acme.CertManager {
+	if !config.ACME.IsConfigured() {
+		return nil
+	}
+	if config.validating {
+		// Reloaded configuration carries on with the certificate manager that is already in use
+		return config.ACME
+	}
+	if config.ACME.Challenge == acme.ChallengeDNS01 {
+		config.ACME.DNSResponder = dnsd.ACMEChallenges
+	}
+	if err := config.ACME.Initialise(); err != nil {
+		config.abort("GetCertManager", err, "failed to initialise")
+		return nil
+	}
+	return config.ACME
+}
+
+// Construct the ban manager of brute-force protection from configuration and return, or nil if it is not configured.
+func (config Config) GetBanManager() *env.BanManager {
+	if config.BruteForceProtection == nil {
+		return nil
+	}
+	if err := config.BruteForceProtection.Initialise(); err != nil {
+		config.abort("GetBanManager", err, "failed to initialise")
+		return nil
+	}
+	return config.BruteForceProtection
+}
+
 // Construct a DNS daemon from configuration and return.
 func (config Config) GetDNSD() *dnsd.DNSD {
 	ret := config.DNSDaemon
+	// DNS-over-TLS uses the same certificate as HTTP daemon
+	ret.TLSCertPath = config.HTTPDaemon.TLSCertPath
+	ret.TLSKeyPath = config.HTTPDaemon.TLSKeyPath
+	ret.CertManager = config.GetCertManager()
+	if ret.CommandSubdomain != "" {
+		mailNotification := config.DNSBridges.NotifyViaEmail
+		mailNotification.Mailer = config.Mailer
+
+		features := config.Features
+		if err := features.Initialise(); err != nil {
+			config.abort("GetDNSD", err, "failed to initialise features")
+			return nil
+		}
+		// Assemble command processor from features and bridges
+		ret.Processor = &common.CommandProcessor{
+			Features: &features,
+			Bans:     config.GetBanManager(),
+			CommandBridges: []bridge.CommandBridge{
+				&config.DNSBridges.PINAndShortcuts,
+				&config.DNSBridges.TranslateSequences,
+			},
+			ResultBridges: []bridge.ResultBridge{
+				&bridge.ResetCombinedText{}, // this is mandatory but not configured by user's config file
+				&config.DNSBridges.LintText,
+				&bridge.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&mailNotification,
+			},
+		}
+	}
 	if err := ret.Initialise(); err != nil {
-		config.Logger.Fatalf("GetDNSD", "", err, "failed to initialise")
+		config.abort("GetDNSD", err, "failed to initialise")
 		return nil
 	}
+	// A laitos server that is name server of its own domains usually receives mails for them too
+	if len(ret.AuthoritativeZones) > 0 {
+		for _, mailDomain := range config.MailDaemon.MyDomains {
+			var found bool
+			for _, zone := range ret.AuthoritativeZones {
+				if zone.Contains(mailDomain) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				config.Logger.Warningf("GetDNSD", "", nil, "mail domain %s does not belong to any of the authoritative zones", mailDomain)
+			}
+		}
+	}
 	return &ret
 }
 
@@ -115,17 +288,32 @@ func (config Config) GetMaintenance() *maintenance.Maintenance {
 	// Caller is not going to manipulate with acquired mail processor, so my instance is going to be identical to caller's.
 	ret.MailpToCheck = config.GetMailProcessor()
 	if err := ret.FeaturesToCheck.Initialise(); err != nil {
-		config.Logger.Fatalf("GetMaintenance", "", err, "failed to initialise features")
+		config.abort("GetMaintenance", err, "failed to initialise features")
 		return nil
 	}
 	ret.Mailer = config.Mailer
 	if err := ret.Initialise(); err != nil {
-		config.Logger.Fatalf("GetMaintenance", "", err, "failed to initialise")
+		config.abort("GetMaintenance", err, "failed to initialise")
 		return nil
 	}
 	return &ret
 }
 
+/*
+Browser image and Twilio call callback endpoints are generated from random bytes. They are generated only once, so that
+they remain the same after configuration is reloaded, and browser pages and phone calls in progress carry on working.
+*/
+var browserImageEndpoint, twilioCallbackEndpoint = randomEndpoint(), randomEndpoint()
+
+// randomEndpoint returns a URL path that consists of random bytes.
+func randomEndpoint() string {
+	randBytes := make([]byte, 32)
+	if _, err := rand.Read(randBytes); err != nil {
+		panic("randomEndpoint: failed to read random number - " + err.Error())
+	}
+	return "/" + hex.EncodeToString(randBytes)
+}
+
 // Construct an HTTP daemon from configuration and return.
 func (config Config) GetHTTPD() *httpd.HTTPD {
 	ret := config.HTTPDaemon
@@ -135,13 +323,14 @@ func (config Config) GetHTTPD() *httpd.HTTPD {
 
 	features := config.Features
 	if err := features.Initialise(); err != nil {
-		config.Logger.Fatalf("GetHTTPD", "", err, "failed to initialise features")
+		config.abort("GetHTTPD", err, "failed to initialise features")
 		return nil
 	}
 	config.Logger.Printf("GetHTTPD", "", nil, "enabled features are - %v", features.GetTriggers())
 	// Assemble command processor from features and bridges
 	ret.Processor = &common.CommandProcessor{
 		Features: &features,
+		Bans:     config.GetBanManager(),
 		CommandBridges: []bridge.CommandBridge{
 			&config.HTTPBridges.PINAndShortcuts,
 			&config.HTTPBridges.TranslateSequences,
@@ -155,6 +344,10 @@ func (config Config) GetHTTPD() *httpd.HTTPD {
 	}
 	// Make handler factories
 	handlers := map[string]api.HandlerFactory{}
+	if certManager := config.GetCertManager(); certManager != nil {
+		ret.CertManager = certManager
+		handlers[acme.HTTPChallengePath] = &api.HandleACMEChallenge{CertManager: certManager}
+	}
 	if config.HTTPHandlers.InformationEndpoint != "" {
 		handlers[config.HTTPHandlers.InformationEndpoint] = &api.HandleSystemInfo{
 			FeaturesToCheck: &config.Features,
@@ -163,29 +356,46 @@ func (config Config) GetHTTPD() *httpd.HTTPD {
 		}
 	}
 	if config.HTTPHandlers.BrowserEndpoint != "" {
-		/*
-		 Configure a browser image endpoint for browser page.
-		 The endpoint name is automatically generated from random bytes.
-		*/
-		randBytes := make([]byte, 32)
-		_, err := rand.Read(randBytes)
-		if err != nil {
-			config.Logger.Panicf("GetHTTPD", "", err, "failed to read random number")
-			return nil
-		}
+		// Configure a browser image endpoint for browser page.
 		// Image handler needs to operate on browser handler's browser instances
 		browserImageHandler := &api.HandleBrowserImage{}
 		browserHandler := config.HTTPHandlers.BrowserEndpointConfig
-		imageEndpoint := "/" + hex.EncodeToString(randBytes)
+		imageEndpoint := browserImageEndpoint
 		handlers[imageEndpoint] = browserImageHandler
 		// Browser handler needs to use image handler's path
 		browserHandler.ImageEndpoint = imageEndpoint
 		browserImageHandler.Browsers = &browserHandler.Browsers
 		handlers[config.HTTPHandlers.BrowserEndpoint] = &browserHandler
 	}
+	if config.HTTPHandlers.CommandAPIEndpoint != "" {
+		handler := config.HTTPHandlers.CommandAPIEndpointConfig
+		handlers[config.HTTPHandlers.CommandAPIEndpoint] = &handler
+	}
+	if config.HTTPHandlers.CommandConsoleEndpoint != "" {
+		handler := config.HTTPHandlers.CommandConsoleEndpointConfig
+		handlers[config.HTTPHandlers.CommandConsoleEndpoint] = &handler
+	}
 	if config.HTTPHandlers.CommandFormEndpoint != "" {
 		handlers[config.HTTPHandlers.CommandFormEndpoint] = &api.HandleCommandForm{}
 	}
+	if config.HTTPHandlers.DashboardEndpoint != "" {
+		config.HTTPHandlers.DashboardEndpointConfig.FeaturesToCheck = &config.Features
+		config.HTTPHandlers.DashboardEndpointConfig.MailpToCheck = config.GetMailProcessor()
+		handlers[config.HTTPHandlers.DashboardEndpoint] = &config.HTTPHandlers.DashboardEndpointConfig
+	}
+	if dohEndpoint := config.HTTPHandlers.DNSOverHTTPSEndpoint; dohEndpoint != "" {
+		// Client presents its secure token in the path following the endpoint, e.g. /dns-query/mytoken
+		dohEndpoint = strings.TrimSuffix(dohEndpoint, "/") + "/"
+		// Queries are answered by the running DNS daemon
+		handlers[dohEndpoint] = &api.HandleDNSOverHTTPS{MyEndpoint: dohEndpoint}
+	}
+	if config.HTTPHandlers.DNSQueryStatsEndpoint != "" {
+		handlers[config.HTTPHandlers.DNSQueryStatsEndpoint] = &api.HandleDNSQueryStats{}
+	}
+	if config.HTTPHandlers.FileUploadEndpoint != "" {
+		config.HTTPHandlers.FileUploadEndpointConfig.Mailer = config.Mailer
+		handlers[config.HTTPHandlers.FileUploadEndpoint] = &config.HTTPHandlers.FileUploadEndpointConfig
+	}
 	if config.HTTPHandlers.GitlabBrowserEndpoint != "" {
 		config.HTTPHandlers.GitlabBrowserEndpointConfig.Mailer = config.Mailer
 		handlers[config.HTTPHandlers.GitlabBrowserEndpoint] = &config.HTTPHandlers.GitlabBrowserEndpointConfig
@@ -200,6 +410,20 @@ func (config Config) GetHTTPD() *httpd.HTTPD {
 		handler.Mailer = config.Mailer
 		handlers[config.HTTPHandlers.MailMeEndpoint] = &handler
 	}
+	if config.HTTPHandlers.PrometheusMetricsEndpoint != "" {
+		handlers[config.HTTPHandlers.PrometheusMetricsEndpoint] = &api.HandlePrometheus{}
+	}
+	for proxyEndpoint, proxyConfig := range config.HTTPHandlers.ReverseProxyEndpoints {
+		// Requests to all paths under the prefix are forwarded
+		proxyEndpoint = strings.TrimSuffix(proxyEndpoint, "/") + "/"
+		handler := proxyConfig
+		handler.MyEndpoint = proxyEndpoint
+		handlers[proxyEndpoint] = &handler
+	}
+	if config.HTTPHandlers.ShellStreamEndpoint != "" {
+		handler := config.HTTPHandlers.ShellStreamEndpointConfig
+		handlers[config.HTTPHandlers.ShellStreamEndpoint] = &handler
+	}
 	if proxyEndpoint := config.HTTPHandlers.WebProxyEndpoint; proxyEndpoint != "" {
 		handlers[proxyEndpoint] = &api.HandleWebProxy{MyEndpoint: proxyEndpoint}
 	}
@@ -207,17 +431,8 @@ func (config Config) GetHTTPD() *httpd.HTTPD {
 		handlers[config.HTTPHandlers.TwilioSMSEndpoint] = &api.HandleTwilioSMSHook{}
 	}
 	if config.HTTPHandlers.TwilioCallEndpoint != "" {
-		/*
-		 Configure a callback endpoint for Twilio call's callback.
-		 The endpoint name is automatically generated from random bytes.
-		*/
-		randBytes := make([]byte, 32)
-		_, err := rand.Read(randBytes)
-		if err != nil {
-			config.Logger.Panicf("GetHTTPD", "", err, "failed to read random number")
-			return nil
-		}
-		callbackEndpoint := "/" + hex.EncodeToString(randBytes)
+		// Configure a callback endpoint for Twilio call's callback.
+		callbackEndpoint := twilioCallbackEndpoint
 		// The greeting handler will use the callback endpoint to handle command
 		config.HTTPHandlers.TwilioCallEndpointConfig.CallbackEndpoint = callbackEndpoint
 		callEndpointConfig := config.HTTPHandlers.TwilioCallEndpointConfig
@@ -227,9 +442,18 @@ func (config Config) GetHTTPD() *httpd.HTTPD {
 		handlers[callbackEndpoint] = &api.HandleTwilioCallCallback{MyEndpoint: callbackEndpoint}
 	}
 	ret.SpecialHandlers = handlers
+	// Virtual hosts are initialised in a copy, leaving configuration intact.
+	ret.VirtualHosts = append([]httpd.VirtualHost{}, config.HTTPDaemon.VirtualHosts...)
+	if config.validating {
+		// Handlers are constructed after the configuration is found valid, see HTTPD.Reinitialise.
+		if err := ret.Check(); err != nil {
+			config.abort("GetHTTPD", err, "failed to check")
+		}
+		return &ret
+	}
 	// Call initialise and print out prefixes of installed routes
 	if err := ret.Initialise(); err != nil {
-		config.Logger.Fatalf("GetHTTPD", "", err, "failed to initialise")
+		config.abort("GetHTTPD", err, "failed to initialise")
 		return nil
 	}
 	for route := range ret.AllRateLimits {
@@ -250,19 +474,32 @@ func (config Config) GetInsecureHTTPD() *httpd.HTTPD {
 	ret := config.GetHTTPD()
 	ret.TLSCertPath = ""
 	ret.TLSKeyPath = ""
+	// HTTP challenges of ACME are still answered on the insecure port
+	ret.CertManager = nil
+	ret.VirtualHosts = append([]httpd.VirtualHost{}, ret.VirtualHosts...)
+	for i := range ret.VirtualHosts {
+		ret.VirtualHosts[i].TLSCertPath = ""
+		ret.VirtualHosts[i].TLSKeyPath = ""
+	}
 	if envPort := strings.TrimSpace(os.Getenv("PORT")); envPort == "" {
 		ret.Port = 80
 	} else {
 		iPort, err := strconv.Atoi(envPort)
 		if err != nil {
-			config.Logger.Fatalf("GetInsecureHTTPD", "", err, "environment variable PORT value is not an integer")
+			config.abort("GetInsecureHTTPD", err, "environment variable PORT value is not an integer")
 			return nil
 		}
 		ret.Port = iPort
 	}
+	if config.validating {
+		if err := ret.Check(); err != nil {
+			config.abort("GetInsecureHTTPD", err, "failed to check")
+		}
+		return ret
+	}
 	// Call initialise and print out prefixes of installed routes
 	if err := ret.Initialise(); err != nil {
-		config.Logger.Fatalf("GetInsecureHTTPD", "", err, "failed to initialise")
+		config.abort("GetInsecureHTTPD", err, "failed to initialise")
 		return nil
 	}
 	for route := range ret.AllRateLimits {
@@ -289,13 +526,14 @@ func (config Config) GetMailProcessor() *mailp.MailProcessor {
 
 	features := config.Features
 	if err := features.Initialise(); err != nil {
-		config.Logger.Fatalf("GetMailProcessor", "", err, "failed to initialise features")
+		config.abort("GetMailProcessor", err, "failed to initialise features")
 		return nil
 	}
 	config.Logger.Printf("GetMailProcessor", "", nil, "enabled features are - %v", features.GetTriggers())
 	// Assemble command processor from features and bridges
 	ret.Processor = &common.CommandProcessor{
 		Features: &features,
+		Bans:     config.GetBanManager(),
 		CommandBridges: []bridge.CommandBridge{
 			&config.MailBridges.PINAndShortcuts,
 			&config.MailBridges.TranslateSequences,
@@ -319,8 +557,9 @@ func (config Config) GetMailDaemon() *smtpd.SMTPD {
 	ret := config.MailDaemon
 	ret.MailProcessor = config.GetMailProcessor()
 	ret.ForwardMailer = config.Mailer
+	ret.CertManager = config.GetCertManager()
 	if err := ret.Initialise(); err != nil {
-		config.Logger.Fatalf("GetMailDaemon", "", err, "failed to initialise")
+		config.abort("GetMailDaemon", err, "failed to initialise")
 		return nil
 	}
 	return &ret
@@ -338,13 +577,14 @@ func (config Config) GetPlainTextDaemon() *plain.PlainTextDaemon {
 
 	features := config.Features
 	if err := features.Initialise(); err != nil {
-		config.Logger.Fatalf("GetPlainTextDaemon", "", err, "failed to initialise features")
+		config.abort("GetPlainTextDaemon", err, "failed to initialise features")
 		return nil
 	}
 	config.Logger.Printf("GetPlainTextDaemon", "", nil, "enabled features are - %v", features.GetTriggers())
 	// Assemble command processor from features and bridges
 	ret.Processor = &common.CommandProcessor{
 		Features: &features,
+		Bans:     config.GetBanManager(),
 		CommandBridges: []bridge.CommandBridge{
 			&config.PlainTextBridges.PINAndShortcuts,
 			&config.PlainTextBridges.TranslateSequences,
@@ -358,7 +598,7 @@ func (config Config) GetPlainTextDaemon() *plain.PlainTextDaemon {
 	}
 	// Call initialise so that daemon is ready to start
 	if err := ret.Initialise(); err != nil {
-		config.Logger.Fatalf("GetPlainTextDaemon", "", err, "failed to initialise")
+		config.abort("GetPlainTextDaemon", err, "failed to initialise")
 		return nil
 	}
 	return &ret
@@ -368,7 +608,7 @@ func (config Config) GetPlainTextDaemon() *plain.PlainTextDaemon {
 func (config Config) GetSockDaemon() *sockd.Sockd {
 	ret := config.SockDaemon
 	if err := ret.Initialise(); err != nil {
-		config.Logger.Fatalf("GetSockDaemon", "", err, "failed to initialise")
+		config.abort("GetSockDaemon", err, "failed to initialise")
 		return nil
 	}
 	return &ret
@@ -383,13 +623,14 @@ func (config Config) GetTelegramBot() *telegrambot.TelegramBot {
 
 	features := config.Features
 	if err := features.Initialise(); err != nil {
-		config.Logger.Fatalf("GetTelegramBot", "", err, "failed to initialise features")
+		config.abort("GetTelegramBot", err, "failed to initialise features")
 		return nil
 	}
 	config.Logger.Printf("GetTelegramBot", "", nil, "enabled features are - %v", features.GetTriggers())
 	// Assemble telegram bot from features and bridges
 	ret.Processor = &common.CommandProcessor{
 		Features: &features,
+		Bans:     config.GetBanManager(),
 		CommandBridges: []bridge.CommandBridge{
 			&config.TelegramBridges.PINAndShortcuts,
 			&config.TelegramBridges.TranslateSequences,
@@ -402,7 +643,7 @@ func (config Config) GetTelegramBot() *telegrambot.TelegramBot {
 		},
 	}
 	if err := ret.Initialise(); err != nil {
-		config.Logger.Fatalf("GetTelegramBot", "", err, "failed to initialise")
+		config.abort("GetTelegramBot", err, "failed to initialise")
 		return nil
 	}
 	return &ret
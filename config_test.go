@@ -17,12 +17,30 @@ import (
 func TestConfig(t *testing.T) {
 	js := `
 {
+  "BruteForceProtection": {
+    "MaxFailures": 10,
+    "AllowNetworks": ["127.0.0.0/8"]
+  },
+  "DNSBridges": {
+    "LintText": {
+      "CompressToSingleLine": true,
+      "MaxLength": 1000,
+      "TrimSpaces": true
+    },
+    "PINAndShortcuts": {
+      "PIN": "verysecret"
+    }
+  },
   "DNSDaemon": {
     "Address": "127.0.0.1",
     "AllowQueryIPPrefixes": [
       "127.0"
     ],
+    "CommandSubdomain": "cmd.example.com",
     "PerIPLimit": 10,
+    "SecureTokens": [
+      "verysecrettoken"
+    ],
     "TCPForwarder": "8.8.8.8:53",
     "TCPPort": 45115,
     "UDPForwarder": "8.8.8.8:53",
@@ -68,10 +86,48 @@ func TestConfig(t *testing.T) {
     "ServeDirectories": {
       "/my/dir": "/tmp/test-laitos-dir",
       "/dir": "/tmp/test-laitos-dir"
+    },
+    "DirectoryOptions": {
+      "/my/dir": {
+        "CacheControl": "no-cache",
+        "ETag": true,
+        "Precompressed": true
+      }
+    },
+    "VirtualHosts": [
+      {
+        "HostNames": ["site.localhost"],
+        "ServeDirectories": {"/dir": "/tmp/test-laitos-dir"}
+      }
+    ],
+    "AccessLog": {
+      "FilePath": "/tmp/test-laitos-access.log",
+      "Format": "combined"
     }
   },
   "HTTPHandlers": {
+    "CommandAPIEndpoint": "/api/v1/cmd",
+    "CommandAPIEndpointConfig": {
+      "BearerTokens": ["verysecrettoken"],
+      "HMACSecret": "verysecrethmac"
+    },
+    "CommandConsoleEndpoint": "/console",
+    "CommandConsoleEndpointConfig": {
+      "IdleTimeoutSec": 60
+    },
     "CommandFormEndpoint": "/cmd_form",
+    "DashboardEndpoint": "/dashboard",
+    "DashboardEndpointConfig": {
+      "RefreshIntervalSec": 10
+    },
+    "DNSOverHTTPSEndpoint": "/dns-query",
+    "DNSQueryStatsEndpoint": "/dns_stats",
+    "FileUploadEndpoint": "/upload",
+    "FileUploadEndpointConfig": {
+      "UploadDir": "/tmp/test-laitos-upload",
+      "MaxFileSizeMB": 10,
+      "Recipients": ["howard@localhost"]
+    },
     "GitlabBrowserEndpoint": "/gitlab",
     "GitlabBrowserEndpointConfig": {
       "PrivateToken": "just a dummy token"
@@ -90,6 +146,17 @@ func TestConfig(t *testing.T) {
         "howard@localhost"
       ]
     },
+    "PrometheusMetricsEndpoint": "/metrics",
+    "ReverseProxyEndpoints": {
+      "/reverse_proxy": {
+        "Upstreams": ["http://127.0.0.1:23486"],
+        "StripPrefix": true
+      }
+    },
+    "ShellStreamEndpoint": "/shell_stream",
+    "ShellStreamEndpointConfig": {
+      "TimeoutSec": 60
+    },
     "TwilioCallEndpoint": "/call_greeting",
     "TwilioCallEndpointConfig": {
       "CallGreeting": "Hi there"
@@ -230,6 +297,13 @@ func TestConfig(t *testing.T) {
 	}
 
 	dnsDaemon := config.GetDNSD()
+	if dnsDaemon.Processor == nil {
+		t.Fatal("did not assemble command processor")
+	}
+	// All daemons share the same brute-force protection
+	if bans := config.GetBanManager(); bans == nil || dnsDaemon.Processor.Bans != bans || bans.MaxFailures != 10 || !bans.IsAllowed("127.0.0.1") {
+		t.Fatalf("%+v", bans)
+	}
 	dnsd.TestUDPQueries(dnsDaemon, t)
 	dnsd.TestTCPQueries(dnsDaemon, t)
 
@@ -0,0 +1,281 @@
+package env
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/global"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BanDefaultMaxFailures      = 5             // BanDefaultMaxFailures is the default number of failures that get a client banned.
+	BanDefaultFailureWindowSec = 10 * 60       // BanDefaultFailureWindowSec is the default duration in which failures are counted toward a ban.
+	BanDefaultInitialBanSec    = 10 * 60       // BanDefaultInitialBanSec is the default duration of the first ban of a client.
+	BanDefaultMaxBanSec        = 7 * 24 * 3600 // BanDefaultMaxBanSec is the default upper limit of ban duration.
+	banPersistFileMode         = os.FileMode(0600)
+)
+
+// ErrClientBanned is returned to a client that is banned due to too many failures. It is short enough for SMS reply.
+var ErrClientBanned = errors.New("Too many failures, try later")
+
+// BanEntry describes a client that has been banned.
+type BanEntry struct {
+	ClientID    string    `json:"ClientID"`    // ClientID is the client IP, or frontend name and user name for frontends that do not see client IP.
+	NumBans     int       `json:"NumBans"`     // NumBans is the number of times the client has been banned, each ban lasts twice as long as the previous one.
+	BannedUntil time.Time `json:"BannedUntil"` // BannedUntil is the moment at which the latest ban expires.
+}
+
+// banRecord remembers the recent failures and bans of a client.
+type banRecord struct {
+	BanEntry
+	failures []time.Time // failures are the moments of failures within the latest window
+}
+
+/*
+BanManager protects frontends against brute-force guessing of password PIN. It counts failures of each client, and bans
+a client that fails too many times within a short period. A client that gets banned again is banned for twice as long
+as the previous time. Bans are optionally saved into a file so that they survive restart.
+*/
+type BanManager struct {
+	MaxFailures      int      `json:"MaxFailures"`      // (Optional) ban a client after this many failures, by default 5.
+	FailureWindowSec int      `json:"FailureWindowSec"` // (Optional) only count failures that occurred within this many seconds, by default 600.
+	InitialBanSec    int      `json:"InitialBanSec"`    // (Optional) the first ban of a client lasts this many seconds, by default 600.
+	MaxBanSec        int      `json:"MaxBanSec"`        // (Optional) a ban lasts no longer than this many seconds, by default 7 days.
+	AllowNetworks    []string `json:"AllowNetworks"`    // (Optional) clients of these networks (CIDR notation or IP address) are never banned.
+	PersistFilePath  string   `json:"PersistFilePath"`  // (Optional) save bans into this file so that they survive restart.
+
+	Logger global.Logger `json:"-"`
+
+	initOnce      *sync.Once
+	initErr       error
+	mutex         *sync.Mutex
+	allowNetworks []*net.IPNet
+	records       map[string]*banRecord
+}
+
+// Initialise checks and applies default configuration values, and loads saved bans from file. It is safe to call it more than once.
+func (bans *BanManager) Initialise() error {
+	if bans.initOnce == nil {
+		bans.initOnce = new(sync.Once)
+	}
+	bans.initOnce.Do(func() {
+		bans.initErr = bans.initialise()
+	})
+	return bans.initErr
+}
+
+func (bans *BanManager) initialise() error {
+	bans.Logger = global.Logger{ComponentName: "BanManager", ComponentID: fmt.Sprint(bans.MaxFailures)}
+	if bans.MaxFailures < 1 {
+		bans.MaxFailures = BanDefaultMaxFailures
+	}
+	if bans.FailureWindowSec < 1 {
+		bans.FailureWindowSec = BanDefaultFailureWindowSec
+	}
+	if bans.InitialBanSec < 1 {
+		bans.InitialBanSec = BanDefaultInitialBanSec
+	}
+	if bans.MaxBanSec < 1 {
+		bans.MaxBanSec = BanDefaultMaxBanSec
+	}
+	if bans.MaxBanSec < bans.InitialBanSec {
+		return errors.New("BanManager.Initialise: MaxBanSec must not be less than InitialBanSec")
+	}
+	bans.allowNetworks = make([]*net.IPNet, 0, len(bans.AllowNetworks))
+	for _, network := range bans.AllowNetworks {
+		if !strings.Contains(network, "/") {
+			// A single IP address is a network of its own
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return fmt.Errorf("BanManager.Initialise: failed to parse allowed network \"%s\" - %v", network, err)
+		}
+		bans.allowNetworks = append(bans.allowNetworks, ipNet)
+	}
+	bans.mutex = new(sync.Mutex)
+	bans.records = make(map[string]*banRecord)
+	if bans.PersistFilePath != "" {
+		content, err := ioutil.ReadFile(bans.PersistFilePath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("BanManager.Initialise: failed to read file \"%s\" - %v", bans.PersistFilePath, err)
+		}
+		if len(content) > 0 {
+			var entries []BanEntry
+			if err := json.Unmarshal(content, &entries); err != nil {
+				return fmt.Errorf("BanManager.Initialise: failed to parse file \"%s\" - %v", bans.PersistFilePath, err)
+			}
+			for _, entry := range entries {
+				bans.records[entry.ClientID] = &banRecord{BanEntry: entry}
+			}
+		}
+	}
+	return nil
+}
+
+// IsAllowed returns true if the client belongs to an allowed network, and hence must never be banned.
+func (bans *BanManager) IsAllowed(clientID string) bool {
+	ip := net.ParseIP(clientID)
+	if ip == nil {
+		return false
+	}
+	for _, network := range bans.allowNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBanned returns true if the client is currently banned. A nil ban manager bans nobody.
+func (bans *BanManager) IsBanned(clientID string) bool {
+	if bans == nil || bans.records == nil || clientID == "" {
+		return false
+	}
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+	record, found := bans.records[clientID]
+	return found && time.Now().Before(record.BannedUntil)
+}
+
+/*
+AddFailure counts a failure of the client, and bans the client if it has failed too many times within the window.
+Return the moment at which the ban expires, or zero time if the client is not banned. A nil ban manager does nothing.
+*/
+func (bans *BanManager) AddFailure(clientID string) time.Time {
+	if bans == nil || bans.records == nil || clientID == "" || bans.IsAllowed(clientID) {
+		return time.Time{}
+	}
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+	now := time.Now()
+	bans.forgetExpired(now)
+	record, found := bans.records[clientID]
+	if !found {
+		record = &banRecord{BanEntry: BanEntry{ClientID: clientID}}
+		bans.records[clientID] = record
+	}
+	if now.Before(record.BannedUntil) {
+		return record.BannedUntil
+	}
+	// Only count the failures that occurred within the window
+	windowStart := now.Add(-time.Duration(bans.FailureWindowSec) * time.Second)
+	recentFailures := record.failures[:0]
+	for _, failure := range record.failures {
+		if failure.After(windowStart) {
+			recentFailures = append(recentFailures, failure)
+		}
+	}
+	record.failures = append(recentFailures, now)
+	if len(record.failures) < bans.MaxFailures {
+		return time.Time{}
+	}
+	// Each ban lasts twice as long as the previous one
+	banDuration := time.Duration(bans.InitialBanSec) * time.Second
+	for i := 0; i < record.NumBans && banDuration < time.Duration(bans.MaxBanSec)*time.Second; i++ {
+		banDuration *= 2
+	}
+	if banDuration > time.Duration(bans.MaxBanSec)*time.Second {
+		banDuration = time.Duration(bans.MaxBanSec) * time.Second
+	}
+	record.NumBans++
+	record.BannedUntil = now.Add(banDuration)
+	record.failures = nil
+	bans.Logger.Warningf("AddFailure", clientID, nil, "banned until %s after %d failures, this is ban number %d",
+		record.BannedUntil.Format(time.RFC3339), bans.MaxFailures, record.NumBans)
+	bans.save()
+	return record.BannedUntil
+}
+
+// Unban lifts the ban of the client and forgets its past failures and bans. Return false if the client was not banned.
+func (bans *BanManager) Unban(clientID string) bool {
+	if bans == nil || bans.records == nil {
+		return false
+	}
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+	record, found := bans.records[clientID]
+	if !found {
+		return false
+	}
+	delete(bans.records, clientID)
+	bans.Logger.Printf("Unban", clientID, nil, "lifted ban")
+	bans.save()
+	return time.Now().Before(record.BannedUntil)
+}
+
+// GetBans returns the clients that are currently banned, sorted by ban expiry.
+func (bans *BanManager) GetBans() []BanEntry {
+	ret := make([]BanEntry, 0, 0)
+	if bans == nil || bans.records == nil {
+		return ret
+	}
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+	now := time.Now()
+	for _, record := range bans.records {
+		if now.Before(record.BannedUntil) {
+			ret = append(ret, record.BanEntry)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].BannedUntil.Before(ret[j].BannedUntil)
+	})
+	return ret
+}
+
+/*
+forgetExpired removes clients that have neither recent failures nor a ban that expired recently. Clients are
+remembered for the maximum ban duration after their ban expires, so that their next ban lasts longer. Caller must
+hold the mutex.
+*/
+func (bans *BanManager) forgetExpired(now time.Time) {
+	windowStart := now.Add(-time.Duration(bans.FailureWindowSec) * time.Second)
+	for clientID, record := range bans.records {
+		if len(record.failures) > 0 && record.failures[len(record.failures)-1].After(windowStart) {
+			continue
+		}
+		if record.NumBans > 0 && now.Before(record.BannedUntil.Add(time.Duration(bans.MaxBanSec)*time.Second)) {
+			continue
+		}
+		delete(bans.records, clientID)
+	}
+}
+
+// save writes clients that have been banned into the persist file. Caller must hold the mutex.
+func (bans *BanManager) save() {
+	if bans.PersistFilePath == "" {
+		return
+	}
+	entries := make([]BanEntry, 0, len(bans.records))
+	for _, record := range bans.records {
+		if record.NumBans > 0 {
+			entries = append(entries, record.BanEntry)
+		}
+	}
+	content, err := json.Marshal(entries)
+	if err != nil {
+		bans.Logger.Warningf("save", bans.PersistFilePath, err, "failed to serialise bans")
+		return
+	}
+	// Write into a temporary file first to avoid leaving behind a half-written file
+	tmpPath := bans.PersistFilePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, banPersistFileMode); err != nil {
+		bans.Logger.Warningf("save", bans.PersistFilePath, err, "failed to write file")
+		return
+	}
+	if err := os.Rename(tmpPath, bans.PersistFilePath); err != nil {
+		bans.Logger.Warningf("save", bans.PersistFilePath, err, "failed to write file")
+	}
+}
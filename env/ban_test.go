@@ -0,0 +1,122 @@
+package env
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestBanManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestBanManager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	persistPath := path.Join(dir, "bans.json")
+
+	// Nil ban manager bans nobody
+	var nilBans *BanManager
+	if nilBans.IsBanned("1.2.3.4") || !nilBans.AddFailure("1.2.3.4").IsZero() || nilBans.Unban("1.2.3.4") || len(nilBans.GetBans()) != 0 {
+		t.Fatal("nil ban manager should do nothing")
+	}
+	if err := (&BanManager{AllowNetworks: []string{"not a network"}}).Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := (&BanManager{InitialBanSec: 10, MaxBanSec: 5}).Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+
+	bans := &BanManager{
+		MaxFailures:     3,
+		InitialBanSec:   100,
+		MaxBanSec:       250,
+		AllowNetworks:   []string{"10.0.0.0/8", "192.168.1.1", "fd00::1"},
+		PersistFilePath: persistPath,
+	}
+	if err := bans.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if bans.FailureWindowSec != BanDefaultFailureWindowSec {
+		t.Fatal(bans.FailureWindowSec)
+	}
+	// Client is banned upon reaching maximum number of failures
+	for i := 0; i < 2; i++ {
+		if until := bans.AddFailure("1.2.3.4"); !until.IsZero() || bans.IsBanned("1.2.3.4") {
+			t.Fatal(i, until)
+		}
+	}
+	until := bans.AddFailure("1.2.3.4")
+	if duration := time.Until(until); duration < 99*time.Second || duration > 100*time.Second || !bans.IsBanned("1.2.3.4") {
+		t.Fatal(duration)
+	}
+	// Further failures do not extend the ban
+	if again := bans.AddFailure("1.2.3.4"); !again.Equal(until) {
+		t.Fatal(again, until)
+	}
+	// Other clients are not affected
+	if bans.IsBanned("telegram:123") || bans.IsBanned("") || !bans.AddFailure("").IsZero() {
+		t.Fatal("wrong client is banned")
+	}
+	// Clients of allowed networks are never banned
+	for _, clientID := range []string{"10.1.2.3", "192.168.1.1", "fd00::1"} {
+		if !bans.IsAllowed(clientID) {
+			t.Fatal(clientID)
+		}
+		for i := 0; i < 10; i++ {
+			bans.AddFailure(clientID)
+		}
+		if bans.IsBanned(clientID) {
+			t.Fatal(clientID)
+		}
+	}
+	if bans.IsAllowed("192.168.1.2") || bans.IsAllowed("telegram:123") {
+		t.Fatal("should not have been allowed")
+	}
+	// The next ban lasts twice as long, but no longer than the maximum
+	bans.mutex.Lock()
+	bans.records["1.2.3.4"].BannedUntil = time.Now()
+	bans.mutex.Unlock()
+	for i := 0; i < 3; i++ {
+		until = bans.AddFailure("1.2.3.4")
+	}
+	if duration := time.Until(until); duration < 199*time.Second || duration > 200*time.Second {
+		t.Fatal(duration)
+	}
+	bans.mutex.Lock()
+	bans.records["1.2.3.4"].BannedUntil = time.Now()
+	bans.mutex.Unlock()
+	for i := 0; i < 3; i++ {
+		until = bans.AddFailure("1.2.3.4")
+	}
+	if duration := time.Until(until); duration < 249*time.Second || duration > 250*time.Second {
+		t.Fatal(duration)
+	}
+	for i := 0; i < 3; i++ {
+		bans.AddFailure("telegram:123")
+	}
+	if entries := bans.GetBans(); len(entries) != 2 || entries[0].ClientID != "telegram:123" || entries[0].NumBans != 1 ||
+		entries[1].ClientID != "1.2.3.4" || entries[1].NumBans != 3 {
+		t.Fatalf("%+v", entries)
+	}
+	// Bans survive restart
+	restarted := &BanManager{PersistFilePath: persistPath}
+	if err := restarted.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.IsBanned("1.2.3.4") || !restarted.IsBanned("telegram:123") || len(restarted.GetBans()) != 2 {
+		t.Fatalf("%+v", restarted.GetBans())
+	}
+	// Lift a ban
+	if !restarted.Unban("telegram:123") || restarted.Unban("telegram:123") || restarted.IsBanned("telegram:123") {
+		t.Fatal("failed to unban")
+	}
+	restarted = &BanManager{PersistFilePath: persistPath}
+	if err := restarted.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if entries := restarted.GetBans(); len(entries) != 1 || entries[0].ClientID != "1.2.3.4" {
+		t.Fatalf("%+v", entries)
+	}
+}
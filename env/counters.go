@@ -0,0 +1,54 @@
+package env
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// counterLabelSeparator joins label values into a single map key, it never appears in a label value.
+const counterLabelSeparator = "\x00"
+
+// Counters keep a separate monotonically increasing count for each combination of label values.
+type Counters struct {
+	counts map[string]uint64
+	mutex  *sync.Mutex
+}
+
+// NewCounters returns an initialised counters structure.
+func NewCounters() *Counters {
+	return &Counters{counts: make(map[string]uint64), mutex: new(sync.Mutex)}
+}
+
+// Add increases the count of the label values by n.
+func (c *Counters) Add(n uint64, labelValues ...string) {
+	key := strings.Join(labelValues, counterLabelSeparator)
+	c.mutex.Lock()
+	c.counts[key] += n
+	c.mutex.Unlock()
+}
+
+// Get returns the count of the label values.
+func (c *Counters) Get(labelValues ...string) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[strings.Join(labelValues, counterLabelSeparator)]
+}
+
+// Each calls the function with every combination of label values and its count, sorted by label values.
+func (c *Counters) Each(fun func(labelValues []string, count uint64)) {
+	c.mutex.Lock()
+	keys := make([]string, 0, len(c.counts))
+	for key := range c.counts {
+		keys = append(keys, key)
+	}
+	counts := make(map[string]uint64, len(c.counts))
+	for key, count := range c.counts {
+		counts[key] = count
+	}
+	c.mutex.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		fun(strings.Split(key, counterLabelSeparator), counts[key])
+	}
+}
@@ -0,0 +1,29 @@
+package env
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	c := NewCounters()
+	if count := c.Get("a", "b"); count != 0 {
+		t.Fatal(count)
+	}
+	c.Add(1, "b", "ok")
+	c.Add(2, "a", "error")
+	c.Add(3, "b", "ok")
+	c.Add(4)
+	if count := c.Get("b", "ok"); count != 4 {
+		t.Fatal(count)
+	}
+	var labels [][]string
+	var counts []uint64
+	c.Each(func(labelValues []string, count uint64) {
+		labels = append(labels, labelValues)
+		counts = append(counts, count)
+	})
+	if !reflect.DeepEqual(labels, [][]string{{""}, {"a", "error"}, {"b", "ok"}}) || !reflect.DeepEqual(counts, []uint64{4, 2, 4}) {
+		t.Fatal(labels, counts)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"time"
 )
 
+// RateLimitRejections counts the actions refused by all rate limits, keyed by component name of the rate limit's logger.
+var RateLimitRejections = NewCounters()
+
 // Allow an actor to perform no more than certain specified number of actions per unit of time.
 type RateLimit struct {
 	UnitSecs      int64
@@ -27,6 +30,13 @@ func (limit *RateLimit) Initialise() {
 	}
 }
 
+// SetMaxCount changes the max limit, usually to apply a freshly loaded configuration. Counters carry on as they are.
+func (limit *RateLimit) SetMaxCount(maxCount int) {
+	limit.counterMutex.Lock()
+	defer limit.counterMutex.Unlock()
+	limit.MaxCount = maxCount
+}
+
 // Increase counter of the actor by one. If the counter exceeds max limit, return false, otherwise return true.
 func (limit *RateLimit) Add(actor string, logIfLimitHit bool) bool {
 	limit.counterMutex.Lock()
@@ -42,6 +52,7 @@ func (limit *RateLimit) Add(actor string, logIfLimitHit bool) bool {
 				limit.Logger.Warningf("Add", "RateLimit", nil, "%s exceeded limit of %d hits per %d seconds", actor, limit.MaxCount, limit.UnitSecs)
 				limit.logged[actor] = struct{}{}
 			}
+			RateLimitRejections.Add(1, limit.Logger.ComponentName)
 			limit.counterMutex.Unlock()
 			return false
 		} else {
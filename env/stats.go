@@ -2,48 +2,247 @@ package env
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
-// Stats collect counter and aggregated numeric data from a stream of triggers.
-type Stats struct {
-	count uint64      // count is the number of times trigger has occurred.
-	mutex *sync.Mutex // mutex protects structure from concurrent modifications.
+/*
+StatsBucketBounds are the inclusive upper bounds of histogram buckets. They suit durations in milliseconds, ranging from
+instant to a minute. Quantities larger than the last bound fall into an extra bucket.
+*/
+var StatsBucketBounds = [...]float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 30000, 60000}
+
+// statsNumBuckets is the number of histogram buckets, including the extra bucket for quantities beyond the last bound.
+const statsNumBuckets = len(StatsBucketBounds) + 1
+
+// StatsWindows are the periods of time over which recent quantities are summarised, in addition to the lifetime summary.
+var StatsWindows = [...]time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+
+// statsWindowSlots is the number of slots each window is divided into. A window slides forward one slot at a time.
+var statsWindowSlots = [len(StatsWindows)]int{6, 10, 12}
+
+// StatsSnapshot summarises the quantities collected over a period of time.
+type StatsSnapshot struct {
+	Count   uint64  `json:"Count"`
+	Lowest  float64 `json:"Lowest"`
+	Highest float64 `json:"Highest"`
+	Average float64 `json:"Average"`
+	Total   float64 `json:"Total"`
+	P50     float64 `json:"P50"` // P50 is the median estimated from histogram buckets.
+	P90     float64 `json:"P90"`
+	P99     float64 `json:"P99"`
+}
+
+// statsSummary aggregates quantities into numeric statistics and histogram buckets. It is a value type that never allocates memory.
+type statsSummary struct {
+	count                  uint64
+	lowest, highest, total float64
+	buckets                [statsNumBuckets]uint64
+}
+
+// add places the quantity into the summary.
+func (sum *statsSummary) add(qty float64, bucket int) {
+	if sum.count == 0 || qty < sum.lowest {
+		sum.lowest = qty
+	}
+	if sum.count == 0 || qty > sum.highest {
+		sum.highest = qty
+	}
+	sum.total += qty
+	sum.count++
+	sum.buckets[bucket]++
+}
+
+// merge places all quantities of the other summary into this summary.
+func (sum *statsSummary) merge(other *statsSummary) {
+	if other.count == 0 {
+		return
+	}
+	if sum.count == 0 || other.lowest < sum.lowest {
+		sum.lowest = other.lowest
+	}
+	if sum.count == 0 || other.highest > sum.highest {
+		sum.highest = other.highest
+	}
+	sum.total += other.total
+	sum.count += other.count
+	for i, count := range other.buckets {
+		sum.buckets[i] += count
+	}
+}
 
-	lowest, highest, average, total float64
+/*
+percentile estimates the quantity below which the fraction (e.g. 0.9) of quantities fall, by linear interpolation
+within the histogram bucket that holds the percentile.
+*/
+func (sum *statsSummary) percentile(fraction float64) float64 {
+	if sum.count == 0 {
+		return 0
+	}
+	rank := fraction * float64(sum.count)
+	var cumulative uint64
+	for i, count := range sum.buckets {
+		if count == 0 || float64(cumulative+count) < rank {
+			cumulative += count
+			continue
+		}
+		lower, upper := sum.lowest, sum.highest
+		if i > 0 && StatsBucketBounds[i-1] > lower {
+			lower = StatsBucketBounds[i-1]
+		}
+		if i < len(StatsBucketBounds) && StatsBucketBounds[i] < upper {
+			upper = StatsBucketBounds[i]
+		}
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(count)
+	}
+	return sum.highest
+}
+
+// snapshot returns the summarised statistics.
+func (sum *statsSummary) snapshot() StatsSnapshot {
+	ret := StatsSnapshot{
+		Count:   sum.count,
+		Lowest:  sum.lowest,
+		Highest: sum.highest,
+		Total:   sum.total,
+		P50:     sum.percentile(0.5),
+		P90:     sum.percentile(0.9),
+		P99:     sum.percentile(0.99),
+	}
+	if sum.count > 0 {
+		ret.Average = sum.total / float64(sum.count)
+	}
+	return ret
+}
+
+// statsSlot summarises the quantities that arrived during one slot of a sliding window.
+type statsSlot struct {
+	index int64 // index is the moment of the slot, counted in number of slot durations since unix epoch.
+	statsSummary
+}
+
+// statsWindow summarises the quantities that arrived recently, using a ring of slots.
+type statsWindow struct {
+	slotNanos int64
+	slots     []statsSlot
+}
+
+// add places the quantity into the slot of the moment.
+func (win *statsWindow) add(nowNano int64, qty float64, bucket int) {
+	index := nowNano / win.slotNanos
+	slot := &win.slots[index%int64(len(win.slots))]
+	if slot.index != index {
+		// The slot has fallen out of the window, reuse it.
+		*slot = statsSlot{index: index}
+	}
+	slot.add(qty, bucket)
+}
+
+// summary returns the summary of quantities that arrived within the window.
+func (win *statsWindow) summary(nowNano int64) (ret statsSummary) {
+	oldestIndex := nowNano/win.slotNanos - int64(len(win.slots)) + 1
+	for i := range win.slots {
+		if win.slots[i].index >= oldestIndex {
+			ret.merge(&win.slots[i].statsSummary)
+		}
+	}
+	return
+}
+
+// Stats collect counter and aggregated numeric data from a stream of triggers, over lifetime and sliding windows.
+type Stats struct {
+	lifetime statsSummary                   // lifetime summarises all quantities since the stats were created.
+	windows  [len(StatsWindows)]statsWindow // windows summarise the recent quantities of each of StatsWindows.
+	mutex    *sync.Mutex                    // mutex protects structure from concurrent modifications.
 }
 
 // NewStats returns an initialised stats structure.
 func NewStats() *Stats {
-	return &Stats{mutex: new(sync.Mutex)}
+	s := &Stats{mutex: new(sync.Mutex)}
+	for i, period := range StatsWindows {
+		s.windows[i] = statsWindow{
+			slotNanos: period.Nanoseconds() / int64(statsWindowSlots[i]),
+			slots:     make([]statsSlot, statsWindowSlots[i]),
+		}
+	}
+	return s
 }
 
-// Trigger increases counter by one and places the input quantity into numeric statistics.
+// Trigger increases counter by one and places the input quantity into numeric statistics. It does not allocate memory.
 func (s *Stats) Trigger(qty float64) {
-	if qty <= 0 {
+	if qty < 0 {
 		// Other than discarding the value, there's not much to do.
 		return
 	}
+	bucket := sort.SearchFloat64s(StatsBucketBounds[:], qty)
+	nowNano := time.Now().UnixNano()
 	s.mutex.Lock()
-	if s.highest == 0 || s.highest < qty {
-		s.highest = qty
+	s.lifetime.add(qty, bucket)
+	for i := range s.windows {
+		s.windows[i].add(nowNano, qty, bucket)
 	}
-	if s.lowest == 0 || s.lowest > qty {
-		s.lowest = qty
-	}
-	s.average = (s.average*float64(s.count) + qty) / (float64(s.count) + 1.0)
-	s.total += qty
-	s.count++
 	s.mutex.Unlock()
 }
 
 // GetStats returns the latest counter and stats numbers.
 func (s *Stats) GetStats() (lowest, highest, average, total float64, count uint64) {
-	return s.lowest, s.highest, s.average, s.total, s.count
+	snapshot := s.GetSnapshot()
+	return snapshot.Lowest, snapshot.Highest, snapshot.Average, snapshot.Total, snapshot.Count
+}
+
+// GetSnapshot returns the summary of all quantities since the stats were created.
+func (s *Stats) GetSnapshot() StatsSnapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lifetime.snapshot()
+}
+
+// GetWindowSnapshot returns the summary of quantities that arrived within the latest period, which is one of StatsWindows.
+func (s *Stats) GetWindowSnapshot(period time.Duration) StatsSnapshot {
+	for i, window := range StatsWindows {
+		if window == period {
+			s.mutex.Lock()
+			summary := s.windows[i].summary(time.Now().UnixNano())
+			s.mutex.Unlock()
+			return summary.snapshot()
+		}
+	}
+	return StatsSnapshot{}
+}
+
+/*
+GetHistogram returns the cumulative number of quantities that are less than or equal to each of StatsBucketBounds, as
+well as the total and count of all quantities.
+*/
+func (s *Stats) GetHistogram() (cumulativeCounts []uint64, total float64, count uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cumulativeCounts = make([]uint64, len(StatsBucketBounds))
+	var cumulative uint64
+	for i := range StatsBucketBounds {
+		cumulative += s.lifetime.buckets[i]
+		cumulativeCounts[i] = cumulative
+	}
+	return cumulativeCounts, s.lifetime.total, s.lifetime.count
 }
 
-// Format returns all stats formatted into a single line of string.
+/*
+Format returns all stats formatted into a single line of string: lowest/average/highest/total(count) of all time,
+followed by percentiles of all time, and 99th percentile(count) of each of StatsWindows.
+*/
 func (s *Stats) Format(numDecimals int) string {
-	format := fmt.Sprintf("%%.%df/%%.%df/%%.%df/%%.%df(%%d)", numDecimals, numDecimals, numDecimals, numDecimals)
-	return fmt.Sprintf(format, s.lowest, s.average, s.highest, s.total, s.count)
+	lifetime := s.GetSnapshot()
+	format := fmt.Sprintf("%%.%df/%%.%df/%%.%df/%%.%df(%%d) p50/p90/p99 %%.%df/%%.%df/%%.%df 1m/5m/1h p99 ",
+		numDecimals, numDecimals, numDecimals, numDecimals, numDecimals, numDecimals, numDecimals)
+	ret := fmt.Sprintf(format, lifetime.Lowest, lifetime.Average, lifetime.Highest, lifetime.Total, lifetime.Count, lifetime.P50, lifetime.P90, lifetime.P99)
+	windowFormat := fmt.Sprintf("%%.%df(%%d)", numDecimals)
+	for i, period := range StatsWindows {
+		if i > 0 {
+			ret += "/"
+		}
+		window := s.GetWindowSnapshot(period)
+		ret += fmt.Sprintf(windowFormat, window.P99, window.Count)
+	}
+	return ret
 }
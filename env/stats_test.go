@@ -2,6 +2,7 @@ package env
 
 import (
 	"testing"
+	"time"
 )
 
 func TestStats(t *testing.T) {
@@ -9,12 +10,17 @@ func TestStats(t *testing.T) {
 	if l, h, a, to, c := s.GetStats(); l != 0 || h != 0 || a != 0 || to != 0 || c != 0 {
 		t.Fatal(l, h, a, to, c)
 	}
-	// Invalid trigger quantity should not affect stats
+	// Negative trigger quantity should not affect stats
 	s.Trigger(-1.0)
-	s.Trigger(0.0)
 	if l, h, a, to, c := s.GetStats(); l != 0 || h != 0 || a != 0 || to != 0 || c != 0 {
 		t.Fatal(l, h, a, to, c)
 	}
+	// Zero is a valid quantity, e.g. a sub-millisecond DNS answer.
+	s.Trigger(0.0)
+	if l, h, a, to, c := s.GetStats(); l != 0 || h != 0 || a != 0 || to != 0 || c != 1 {
+		t.Fatal(l, h, a, to, c)
+	}
+	s = NewStats()
 	// Three valid trigger quantities
 	s.Trigger(1.0)
 	if l, h, a, to, c := s.GetStats(); l != 1 || h != 1 || a != 1 || to != 1 || c != 1 {
@@ -28,4 +34,89 @@ func TestStats(t *testing.T) {
 	if l, h, a, to, c := s.GetStats(); l != 1 || h != 9 || a != 4 || to != 12 || c != 3 {
 		t.Fatal(l, h, a, to, c)
 	}
+	if formatted := s.Format(2); formatted != "1.00/4.00/9.00/12.00(3) p50/p90/p99 1.50/7.80/8.88 1m/5m/1h p99 8.88(3)/8.88(3)/8.88(3)" {
+		t.Fatal(formatted)
+	}
+}
+
+func TestStats_Percentiles(t *testing.T) {
+	s := NewStats()
+	if snapshot := s.GetSnapshot(); snapshot != (StatsSnapshot{}) {
+		t.Fatalf("%+v", snapshot)
+	}
+	// 100 quantities evenly spread across 1..100
+	for i := 1; i <= 100; i++ {
+		s.Trigger(float64(i))
+	}
+	snapshot := s.GetSnapshot()
+	if snapshot.Count != 100 || snapshot.Lowest != 1 || snapshot.Highest != 100 || snapshot.Average != 50.5 {
+		t.Fatalf("%+v", snapshot)
+	}
+	// Percentiles are estimated within bucket boundaries
+	if snapshot.P50 < 20 || snapshot.P50 > 50 || snapshot.P90 < 50 || snapshot.P90 > 100 || snapshot.P99 < snapshot.P90 || snapshot.P99 > 100 {
+		t.Fatalf("%+v", snapshot)
+	}
+	// A single quantity is its own percentiles
+	s = NewStats()
+	s.Trigger(70000)
+	if snapshot := s.GetSnapshot(); snapshot.P50 != 70000 || snapshot.P99 != 70000 {
+		t.Fatalf("%+v", snapshot)
+	}
+}
+
+func TestStats_Windows(t *testing.T) {
+	s := NewStats()
+	for _, period := range StatsWindows {
+		if snapshot := s.GetWindowSnapshot(period); snapshot.Count != 0 {
+			t.Fatal(period, snapshot)
+		}
+	}
+	if snapshot := s.GetWindowSnapshot(time.Second); snapshot != (StatsSnapshot{}) {
+		t.Fatalf("%+v", snapshot)
+	}
+	s.Trigger(5)
+	s.Trigger(15)
+	for _, period := range StatsWindows {
+		if snapshot := s.GetWindowSnapshot(period); snapshot.Count != 2 || snapshot.Highest != 15 || snapshot.Average != 10 {
+			t.Fatalf("%v %+v", period, snapshot)
+		}
+	}
+	// Age the slots of the quantities so that they fall out of the shorter windows
+	s.mutex.Lock()
+	for i := range s.windows {
+		for j := range s.windows[i].slots {
+			if s.windows[i].slots[j].count > 0 {
+				s.windows[i].slots[j].index -= int64((2 * time.Minute).Nanoseconds() / s.windows[i].slotNanos)
+			}
+		}
+	}
+	s.mutex.Unlock()
+	if snapshot := s.GetWindowSnapshot(time.Minute); snapshot.Count != 0 {
+		t.Fatalf("%+v", snapshot)
+	}
+	if snapshot := s.GetWindowSnapshot(time.Hour); snapshot.Count != 2 {
+		t.Fatalf("%+v", snapshot)
+	}
+	if snapshot := s.GetSnapshot(); snapshot.Count != 2 {
+		t.Fatalf("%+v", snapshot)
+	}
+	// Hot path does not allocate memory
+	if allocs := testing.AllocsPerRun(100, func() { s.Trigger(3) }); allocs != 0 {
+		t.Fatal(allocs)
+	}
+}
+
+func TestStats_GetHistogram(t *testing.T) {
+	s := NewStats()
+	for _, qty := range []float64{0.5, 1, 3, 5, 70000} {
+		s.Trigger(qty)
+	}
+	cumulative, total, count := s.GetHistogram()
+	if len(cumulative) != len(StatsBucketBounds) || total != 70009.5 || count != 5 {
+		t.Fatal(cumulative, total, count)
+	}
+	// Bounds are inclusive: 1, 2, 5, 10, ... 60000
+	if cumulative[0] != 2 || cumulative[1] != 2 || cumulative[2] != 4 || cumulative[len(cumulative)-1] != 4 {
+		t.Fatal(cumulative)
+	}
 }
@@ -2,13 +2,17 @@ package env
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"io"
 	"io/ioutil"
 	"os/exec"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -115,6 +119,96 @@ func InvokeShell(timeoutSec int, interpreter string, content string) (out string
 	return InvokeProgram(nil, timeoutSec, interpreter, "-c", content)
 }
 
+// ErrOutputTooLong is returned by StreamProgram if program output exceeds the byte limit.
+var ErrOutputTooLong = errors.New("Program output exceeds the limit")
+
+/*
+cappedWriter passes output to the underlying writer until the byte limit is reached, and then stops the program. Once
+closed, it no longer writes into the underlying writer.
+*/
+type cappedWriter struct {
+	out       io.Writer
+	remaining int
+	exceeded  bool
+	closed    bool
+	stop      func()
+	mutex     *sync.Mutex
+}
+
+func (capped *cappedWriter) Write(p []byte) (int, error) {
+	capped.mutex.Lock()
+	defer capped.mutex.Unlock()
+	if capped.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) <= capped.remaining {
+		n, err := capped.out.Write(p)
+		capped.remaining -= n
+		return n, err
+	}
+	capped.out.Write(p[:capped.remaining])
+	capped.remaining = 0
+	capped.exceeded = true
+	capped.stop()
+	return 0, ErrOutputTooLong
+}
+
+// close stops further writes into the underlying writer, and returns true if the output exceeded the byte limit.
+func (capped *cappedWriter) close() (exceeded bool) {
+	capped.mutex.Lock()
+	defer capped.mutex.Unlock()
+	capped.closed = true
+	return capped.exceeded
+}
+
+/*
+StreamProgram launches an external program and writes its stdout+stderr output into the writer as the output arrives.
+The program is killed if it runs past the timeout, if its output exceeds the byte limit, or if the context is cancelled
+(e.g. HTTP client disconnects).
+*/
+func StreamProgram(ctx context.Context, envVars []string, timeoutSec int, maxOutputBytes int, out io.Writer, program string, args ...string) error {
+	procCtx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSec)*time.Second)
+	defer cancel()
+	capped := &cappedWriter{out: out, remaining: maxOutputBytes, stop: cancel, mutex: new(sync.Mutex)}
+	proc := exec.Command(program, args...)
+	proc.Env = envVars
+	proc.Stdout = capped
+	proc.Stderr = capped
+	// Run the program in its own process group, so that its child processes are killed along with it.
+	proc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	procRunChan := make(chan error, 1)
+	go func() {
+		procRunChan <- proc.Wait()
+	}()
+	var err error
+	select {
+	case err = <-procRunChan:
+	case <-procCtx.Done():
+		syscall.Kill(-proc.Process.Pid, syscall.SIGKILL)
+		// Do not wait indefinitely for processes that left the group yet still hold the output pipe
+		select {
+		case err = <-procRunChan:
+		case <-time.After(time.Second):
+		}
+	}
+	if capped.close() {
+		return ErrOutputTooLong
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	} else if procCtx.Err() == context.DeadlineExceeded {
+		return errors.New("Program timed out")
+	}
+	return err
+}
+
+// StreamShell launches an external shell process to run a piece of code and streams its output, see StreamProgram.
+func StreamShell(ctx context.Context, timeoutSec int, maxOutputBytes int, out io.Writer, interpreter string, content string) error {
+	return StreamProgram(ctx, nil, timeoutSec, maxOutputBytes, out, interpreter, "-c", content)
+}
+
 // GetSysctlStr returns string value of a sysctl parameter corresponding to the input key.
 func GetSysctlStr(key string) (string, error) {
 	content, err := ioutil.ReadFile(path.Join("/proc/sys/", strings.Replace(key, ".", "/", -1)))
@@ -1,9 +1,12 @@
 package env
 
 import (
+	"bytes"
+	"context"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetProgramMemUsageKB(t *testing.T) {
@@ -72,3 +75,42 @@ func TestGetSysctl(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestStreamShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	var out bytes.Buffer
+	if err := StreamShell(context.Background(), 3, 100, &out, "/bin/sh", "echo a; echo b >&2"); err != nil || out.String() != "a\nb\n" {
+		t.Fatal(err, out.String())
+	}
+	// Timeout
+	out.Reset()
+	start := time.Now()
+	if err := StreamShell(context.Background(), 1, 100, &out, "/bin/sh", "echo a; sleep 10"); err == nil || err.Error() != "Program timed out" ||
+		out.String() != "a\n" || time.Since(start) > 5*time.Second {
+		t.Fatal(err, out.String())
+	}
+	// Output exceeds limit
+	out.Reset()
+	if err := StreamShell(context.Background(), 3, 5, &out, "/bin/sh", "while true; do echo 0123456789; done"); err != ErrOutputTooLong || out.String() != "01234" {
+		t.Fatal(err, out.String())
+	}
+	// Cancellation
+	out.Reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	if err := StreamShell(ctx, 10, 100, &out, "/bin/sh", "sleep 10"); err != context.Canceled || time.Since(start) > 5*time.Second {
+		t.Fatal(err)
+	}
+	// Child process that inherited the output pipe is killed along with the program
+	out.Reset()
+	start = time.Now()
+	if err := StreamShell(context.Background(), 1, 100, &out, "/bin/sh", "sleep 10 & echo a"); err == nil || out.String() != "a\n" || time.Since(start) > 5*time.Second {
+		t.Fatal(err, out.String())
+	}
+}
@@ -0,0 +1,88 @@
+package feature
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadDNSControlChoice = errors.New(`check name | allow name [minutes] | deny name [minutes] | remove name | refresh | info`)
+	ErrDNSDNotRunning      = errors.New("DNS daemon is not running")
+)
+
+// DNSBlockListManager manipulates the black list of a running DNS daemon.
+type DNSBlockListManager interface {
+	ExplainBlock(name string) string                                       // ExplainBlock tells whether the name is blocked, and by which list.
+	SetRuntimeEntry(name string, allow bool, duration time.Duration) error // SetRuntimeEntry allows or denies the name and its sub-domains, zero duration means no expiry.
+	RemoveRuntimeEntry(name string) bool                                   // RemoveRuntimeEntry removes the name from run-time allow and deny entries.
+	UpdatedAdBlockLists()                                                  // UpdatedAdBlockLists retrieves black list from all sources right away.
+	GetBlockListInfo() string                                              // GetBlockListInfo describes black list size, sources, update time, and run-time entries.
+}
+
+/*
+RunningDNSD is the DNS daemon whose black list is managed by DNSControl. DNS daemon depends on this package, therefore
+the daemon assigns itself when it starts, to avoid cyclic import.
+*/
+var RunningDNSD DNSBlockListManager
+
+// Check and manage black list of the running DNS daemon, e.g. to unblock a site that is blocked by mistake.
+type DNSControl struct {
+}
+
+func (ctl *DNSControl) IsConfigured() bool {
+	return true
+}
+
+func (ctl *DNSControl) SelfTest() error {
+	return nil
+}
+
+func (ctl *DNSControl) Initialise() error {
+	return nil
+}
+
+func (ctl *DNSControl) Trigger() Trigger {
+	return ".d"
+}
+
+func (ctl *DNSControl) Execute(cmd Command) *Result {
+	if errResult := cmd.Trim(); errResult != nil {
+		return errResult
+	}
+	if RunningDNSD == nil {
+		return &Result{Error: ErrDNSDNotRunning}
+	}
+	params := strings.Fields(strings.ToLower(cmd.Content))
+	switch {
+	case len(params) == 1 && params[0] == "refresh":
+		RunningDNSD.UpdatedAdBlockLists()
+		return &Result{Output: RunningDNSD.GetBlockListInfo()}
+	case len(params) == 1 && params[0] == "info":
+		return &Result{Output: RunningDNSD.GetBlockListInfo()}
+	case len(params) == 2 && params[0] == "check":
+		return &Result{Output: RunningDNSD.ExplainBlock(params[1])}
+	case len(params) == 2 && params[0] == "remove":
+		if !RunningDNSD.RemoveRuntimeEntry(params[1]) {
+			return &Result{Error: fmt.Errorf("%s is not among run-time entries", params[1])}
+		}
+		return &Result{Output: RunningDNSD.ExplainBlock(params[1])}
+	case (len(params) == 2 || len(params) == 3) && (params[0] == "allow" || params[0] == "deny"):
+		var duration time.Duration
+		if len(params) == 3 {
+			minutes, err := strconv.Atoi(params[2])
+			if err != nil || minutes < 1 {
+				return &Result{Error: ErrBadDNSControlChoice}
+			}
+			duration = time.Duration(minutes) * time.Minute
+		}
+		if err := RunningDNSD.SetRuntimeEntry(params[1], params[0] == "allow", duration); err != nil {
+			return &Result{Error: err}
+		}
+		return &Result{Output: RunningDNSD.ExplainBlock(params[1])}
+	default:
+		return &Result{Error: ErrBadDNSControlChoice}
+	}
+}
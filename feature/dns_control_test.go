@@ -0,0 +1,91 @@
+package feature
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeDNSD struct {
+	entries   map[string]string
+	refreshed bool
+}
+
+func (fake *fakeDNSD) ExplainBlock(name string) string {
+	return name + ":" + fake.entries[name]
+}
+
+func (fake *fakeDNSD) SetRuntimeEntry(name string, allow bool, duration time.Duration) error {
+	if name == "bad" {
+		return errors.New("bad name")
+	}
+	fake.entries[name] = fmt.Sprintf("%v %v", allow, duration)
+	return nil
+}
+
+func (fake *fakeDNSD) RemoveRuntimeEntry(name string) bool {
+	_, exists := fake.entries[name]
+	delete(fake.entries, name)
+	return exists
+}
+
+func (fake *fakeDNSD) UpdatedAdBlockLists() {
+	fake.refreshed = true
+}
+
+func (fake *fakeDNSD) GetBlockListInfo() string {
+	return fmt.Sprintf("refreshed %v", fake.refreshed)
+}
+
+func TestDNSControl_Execute(t *testing.T) {
+	ctl := DNSControl{}
+	if !ctl.IsConfigured() {
+		t.Fatal("not configured")
+	}
+	if err := ctl.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	RunningDNSD = nil
+	if ret := ctl.Execute(Command{Content: "info"}); ret.Error != ErrDNSDNotRunning {
+		t.Fatal(ret)
+	}
+	fake := &fakeDNSD{entries: make(map[string]string)}
+	RunningDNSD = fake
+	defer func() {
+		RunningDNSD = nil
+	}()
+	for _, bad := range []string{"wrong", "check", "allow a.com 0", "deny a.com x", "allow a.com 1 2", "remove"} {
+		if ret := ctl.Execute(Command{Content: bad}); ret.Error != ErrBadDNSControlChoice {
+			t.Fatal(bad, ret)
+		}
+	}
+	if ret := ctl.Execute(Command{Content: "info"}); ret.Error != nil || ret.Output != "refreshed false" {
+		t.Fatal(ret)
+	}
+	if ret := ctl.Execute(Command{Content: " Allow  A.com  "}); ret.Error != nil || ret.Output != "a.com:true 0s" {
+		t.Fatal(ret)
+	}
+	if ret := ctl.Execute(Command{Content: "deny b.com 30"}); ret.Error != nil || ret.Output != "b.com:false 30m0s" {
+		t.Fatal(ret)
+	}
+	if ret := ctl.Execute(Command{Content: "deny bad"}); ret.Error == nil || ret.Error.Error() != "bad name" {
+		t.Fatal(ret)
+	}
+	if ret := ctl.Execute(Command{Content: "check b.com"}); ret.Error != nil || ret.Output != "b.com:false 30m0s" {
+		t.Fatal(ret)
+	}
+	if ret := ctl.Execute(Command{Content: "remove b.com"}); ret.Error != nil || ret.Output != "b.com:" {
+		t.Fatal(ret)
+	}
+	if ret := ctl.Execute(Command{Content: "remove b.com"}); ret.Error == nil || !strings.Contains(ret.Error.Error(), "not among") {
+		t.Fatal(ret)
+	}
+	if ret := ctl.Execute(Command{Content: "refresh"}); ret.Error != nil || ret.Output != "refreshed true" {
+		t.Fatal(ret)
+	}
+}
@@ -12,7 +12,29 @@ import (
 	"time"
 )
 
-var ErrBadEnvInfoChoice = errors.New(`elock | estop | log | warn | runtime | stack | tune`)
+var ErrBadEnvInfoChoice = errors.New(`elock | estop | log | warn | runtime | stack | tune | dns | reload | bans | unban ClientID`)
+
+/*
+GetDNSQueryStats returns statistics of the latest DNS queries in a multi-line text. DNS daemon depends on this package,
+therefore the daemon assigns the function during package initialisation to avoid cyclic import.
+*/
+var GetDNSQueryStats = func() string {
+	return "DNS query statistics are not available"
+}
+
+/*
+ReloadConfig re-reads configuration file and applies it to the running daemons. The main program assigns the function
+after daemons have started.
+*/
+var ReloadConfig = func() error {
+	return errors.New("configuration reload is not available")
+}
+
+/*
+Bans is the ban manager that protects all daemons against brute-force guessing of PIN. The main program assigns it
+when brute-force protection is configured.
+*/
+var Bans *env.BanManager
 
 // Retrieve environment information and trigger emergency stop upon request.
 type EnvControl struct {
@@ -38,6 +60,13 @@ func (info *EnvControl) Execute(cmd Command) *Result {
 	if errResult := cmd.Trim(); errResult != nil {
 		return errResult
 	}
+	if strings.HasPrefix(strings.ToLower(cmd.Content), "unban ") {
+		clientID := strings.TrimSpace(cmd.Content[len("unban "):])
+		if !Bans.Unban(clientID) {
+			return &Result{Error: fmt.Errorf("%s is not banned", clientID)}
+		}
+		return &Result{Output: fmt.Sprintf("successfully lifted ban of %s", clientID)}
+	}
 	switch strings.ToLower(cmd.Content) {
 	case "elock":
 		global.TriggerEmergencyLockDown()
@@ -55,6 +84,15 @@ func (info *EnvControl) Execute(cmd Command) *Result {
 		return &Result{Output: GetGoroutineStacktraces()}
 	case "tune":
 		return &Result{Output: TuneLinux()}
+	case "dns":
+		return &Result{Output: GetDNSQueryStats()}
+	case "reload":
+		if err := ReloadConfig(); err != nil {
+			return &Result{Error: err}
+		}
+		return &Result{Output: "successfully reloaded configuration"}
+	case "bans":
+		return &Result{Output: GetBans()}
 	default:
 		return &Result{Error: ErrBadEnvInfoChoice}
 	}
@@ -78,6 +116,22 @@ Num CPU/GOMAXPROCS/goroutines: %d / %d / %d
 		runtime.NumCPU(), runtime.GOMAXPROCS(0), runtime.NumGoroutine())
 }
 
+// Return clients that are currently banned in a multi-line text, one client per line. The ban that expires first comes first.
+func GetBans() string {
+	if Bans == nil {
+		return "brute-force protection is not configured"
+	}
+	entries := Bans.GetBans()
+	if len(entries) == 0 {
+		return "no client is banned"
+	}
+	var ret bytes.Buffer
+	for _, entry := range entries {
+		ret.WriteString(fmt.Sprintf("%s until %s (ban #%d)\n", entry.ClientID, entry.BannedUntil.Format(time.RFC3339), entry.NumBans))
+	}
+	return ret.String()
+}
+
 // Return latest log entry of all kinds in a multi-line text, one log entry per line. Latest log entry comes first.
 func GetLatestLog() string {
 	buf := new(bytes.Buffer)
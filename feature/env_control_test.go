@@ -2,6 +2,7 @@ package feature
 
 import (
 	"fmt"
+	"github.com/HouzuoGuo/laitos/env"
 	"github.com/HouzuoGuo/laitos/global"
 	"strings"
 	"testing"
@@ -36,6 +37,36 @@ func TestEnvControl_Execute(t *testing.T) {
 	if ret := info.Execute(Command{Content: "stack"}); ret.Error != nil || strings.Index(ret.Output, "routine") == -1 {
 		t.Fatal(ret)
 	}
+	if ret := info.Execute(Command{Content: "dns"}); ret.Error != nil || ret.Output != GetDNSQueryStats() {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "reload"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	// Brute-force protection is not configured by default
+	if ret := info.Execute(Command{Content: "bans"}); ret.Error != nil || !strings.Contains(ret.Output, "not configured") {
+		t.Fatal(ret)
+	}
+	Bans = &env.BanManager{MaxFailures: 1}
+	defer func() {
+		Bans = nil
+	}()
+	if err := Bans.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if ret := info.Execute(Command{Content: "bans"}); ret.Error != nil || ret.Output != "no client is banned" {
+		t.Fatal(ret)
+	}
+	Bans.AddFailure("1.2.3.4")
+	if ret := info.Execute(Command{Content: "bans"}); ret.Error != nil || !strings.HasPrefix(ret.Output, "1.2.3.4 until ") || !strings.Contains(ret.Output, "(ban #1)") {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "unban 1.2.3.4"}); ret.Error != nil || Bans.IsBanned("1.2.3.4") {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "unban 1.2.3.4"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
 	ret := info.Execute(Command{Content: "tune"})
 	fmt.Println(ret.Output)
 	if ret.Error != nil {
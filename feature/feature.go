@@ -22,6 +22,7 @@ var (
 type Command struct {
 	TimeoutSec int
 	Content    string
+	ClientID   string // ClientID identifies the origin of the command (e.g. client IP) for brute-force protection, it may be empty.
 }
 
 // Modify command content to remove leading and trailing white spaces. Return error result if command becomes empty afterwards.
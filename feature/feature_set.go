@@ -11,6 +11,7 @@ import (
 type FeatureSet struct {
 	AESDecrypt         AESDecrypt          `json:"AESDecrypt"`
 	Browser            Browser             `json:"Browser"`
+	DNSControl         DNSControl          `json:"DNSControl"`
 	EnvControl         EnvControl          `json:"EnvControl"`
 	Facebook           Facebook            `json:"Facebook"`
 	IMAPAccounts       IMAPAccounts        `json:"IMAPAccounts"`
@@ -31,6 +32,7 @@ func (fs *FeatureSet) Initialise() error {
 	triggers := map[Trigger]Feature{
 		fs.AESDecrypt.Trigger():         &fs.AESDecrypt,
 		fs.Browser.Trigger():            &fs.Browser,
+		fs.DNSControl.Trigger():         &fs.DNSControl,
 		fs.EnvControl.Trigger():         &fs.EnvControl,
 		fs.Facebook.Trigger():           &fs.Facebook,
 		fs.IMAPAccounts.Trigger():       &fs.IMAPAccounts,
@@ -84,6 +86,7 @@ func (fs *FeatureSet) DeserialiseFromJSON(configJSON json.RawMessage) error {
 	features := map[string]Feature{
 		"AESDecrypt":         &fs.AESDecrypt,
 		"Browser":            &fs.Browser,
+		"DNSControl":         &fs.DNSControl,
 		"EnvControl":         &fs.EnvControl,
 		"Facebook":           &fs.Facebook,
 		"IMAPAccounts":       &fs.IMAPAccounts,
@@ -6,12 +6,12 @@ import (
 )
 
 func TestFeatureSet_SelfTest(t *testing.T) {
-	// Initially, no feature other than shell and EnvControl are available from an empty feature set
+	// Initially, no feature other than shell, DNSControl, and EnvControl are available from an empty feature set
 	features := FeatureSet{}
 	if err := features.Initialise(); err != nil {
 		t.Fatal(err)
 	}
-	if len(features.LookupByTrigger) != 2 || features.LookupByTrigger[".s"] == nil || features.LookupByTrigger[".e"] == nil {
+	if len(features.LookupByTrigger) != 3 || features.LookupByTrigger[".s"] == nil || features.LookupByTrigger[".d"] == nil || features.LookupByTrigger[".e"] == nil {
 		t.Fatal(features.LookupByTrigger)
 	}
 	// Configure AES decrypt and 2fa code generator
@@ -19,27 +19,27 @@ func TestFeatureSet_SelfTest(t *testing.T) {
 	if err := features.Initialise(); err != nil {
 		t.Fatal(err)
 	}
-	// EnvControl, Shell, AESDecrypt, TwoFACodeGenerator
-	if len(features.LookupByTrigger) != 4 {
+	// DNSControl, EnvControl, Shell, AESDecrypt, TwoFACodeGenerator
+	if len(features.LookupByTrigger) != 5 {
 		t.Fatal(features.LookupByTrigger)
 	}
 	if errs := features.SelfTest(); len(errs) != 0 {
 		t.Fatal(errs)
 	}
-	// Get triggers of configured features (EnvControl, Shell, AESDecrypt, TwoFACodeGenerator)
-	if triggers := features.GetTriggers(); !reflect.DeepEqual(triggers, []string{".2", ".a", ".e", ".s"}) {
+	// Get triggers of configured features (DNSControl, EnvControl, Shell, AESDecrypt, TwoFACodeGenerator)
+	if triggers := features.GetTriggers(); !reflect.DeepEqual(triggers, []string{".2", ".a", ".d", ".e", ".s"}) {
 		t.Fatal(triggers)
 	}
 	// Configure all features via JSON and verify via self test
 	features = TestFeatureSet
 	features.Initialise()
-	if len(features.LookupByTrigger) != 11 {
+	if len(features.LookupByTrigger) != 12 {
 		t.Skip(features.LookupByTrigger)
 	}
 	if err := features.Initialise(); err != nil {
 		t.Fatal(err)
 	}
-	if len(features.LookupByTrigger) != 11 {
+	if len(features.LookupByTrigger) != 12 {
 		t.Fatal(features.LookupByTrigger)
 	}
 	if errs := features.SelfTest(); len(errs) != 0 {
@@ -1,15 +1,20 @@
 package common
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/HouzuoGuo/laitos/bridge"
 	"github.com/HouzuoGuo/laitos/env"
 	"github.com/HouzuoGuo/laitos/feature"
 	"github.com/HouzuoGuo/laitos/global"
+	"io"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,16 +25,95 @@ const (
 
 var ErrBadPrefix = errors.New("Bad prefix or feature is not configured")              // Returned if input command does not contain valid feature trigger
 var ErrBadPLT = errors.New(PrefixCommandPLT + " P L T command")                       // Return PLT invocation example in an error
+var ErrNotStreamable = errors.New("Only shell commands may be streamed")              // Returned by ProcessStreaming if command does not call upon shell
 var RegexCommandWithPLT = regexp.MustCompile(`[^\d]*(\d+)[^\d]+(\d+)[^\d]*(\d+)(.*)`) // Parse PLT and command content
 
 var DurationStats = env.NewStats() // DurationStats stores statistics of duration of all executed commands.
 
+// Outcome of a processed command.
+const (
+	CommandOutcomeOK           = "ok"           // CommandOutcomeOK means that the feature ran the command successfully.
+	CommandOutcomeError        = "error"        // CommandOutcomeError means that the feature ran the command and ran into an error.
+	CommandOutcomeInvalid      = "invalid"      // CommandOutcomeInvalid means that the command does not call upon a configured feature.
+	CommandOutcomeUnauthorised = "unauthorised" // CommandOutcomeUnauthorised means that the command does not carry the correct PIN or shortcut.
+	CommandOutcomeBanned       = "banned"       // CommandOutcomeBanned means that the command came from a banned client.
+	CommandOutcomeLockDown     = "lockdown"     // CommandOutcomeLockDown means that the command arrived during emergency lock down.
+)
+
+// CommandCounts counts the commands processed by all command processors, keyed by feature trigger and one of the CommandOutcome* values.
+var CommandCounts = env.NewCounters()
+
 // Pre-configured environment and configuration for processing feature commands.
 type CommandProcessor struct {
 	Features       *feature.FeatureSet
 	CommandBridges []bridge.CommandBridge
 	ResultBridges  []bridge.ResultBridge
 	Logger         global.Logger
+	Bans           *env.BanManager // (Optional) Bans refuses commands from clients that have failed PIN/shortcut match too many times
+
+	reloadMutex sync.RWMutex // reloadMutex protects features and bridges from being replaced while a command runs.
+}
+
+/*
+ReplaceWith atomically replaces features and bridges with those of another processor, which usually comes from a
+freshly loaded configuration. Commands that are already running carry on with the old features and bridges.
+*/
+func (proc *CommandProcessor) ReplaceWith(other *CommandProcessor) {
+	other.reloadMutex.RLock()
+	features, cmdBridges, resultBridges := other.Features, other.CommandBridges, other.ResultBridges
+	other.reloadMutex.RUnlock()
+	for _, b := range resultBridges {
+		b.SetLogger(proc.Logger)
+	}
+	proc.reloadMutex.Lock()
+	proc.Features = features
+	proc.CommandBridges = cmdBridges
+	proc.ResultBridges = resultBridges
+	proc.reloadMutex.Unlock()
+}
+
+// snapshot returns features and bridges that are in effect at the moment.
+func (proc *CommandProcessor) snapshot() (*feature.FeatureSet, []bridge.CommandBridge, []bridge.ResultBridge) {
+	proc.reloadMutex.RLock()
+	defer proc.reloadMutex.RUnlock()
+	return proc.Features, proc.CommandBridges, proc.ResultBridges
+}
+
+// GetPIN returns the PIN of the PIN bridge in effect, or empty string if there is none.
+func (proc *CommandProcessor) GetPIN() string {
+	_, cmdBridges, _ := proc.snapshot()
+	for _, cmdBridge := range cmdBridges {
+		if pin, isPIN := cmdBridge.(*bridge.PINAndShortcuts); isPIN {
+			return pin.PIN
+		}
+	}
+	return ""
+}
+
+// GetLintText returns the LintText bridge in effect, or nil if there is none.
+func (proc *CommandProcessor) GetLintText() *bridge.LintText {
+	_, _, resultBridges := proc.snapshot()
+	for _, resultBridge := range resultBridges {
+		if lintText, isLintText := resultBridge.(*bridge.LintText); isLintText {
+			return lintText
+		}
+	}
+	return nil
+}
+
+// FindTrigger returns the longest trigger among features in effect that the command starts with, or empty if there is none.
+func (proc *CommandProcessor) FindTrigger(command string) (ret feature.Trigger) {
+	features, _, _ := proc.snapshot()
+	if features == nil {
+		return
+	}
+	command = strings.TrimSpace(command)
+	for trigger := range features.LookupByTrigger {
+		if strings.HasPrefix(command, string(trigger)) && len(trigger) > len(ret) {
+			ret = trigger
+		}
+	}
+	return
 }
 
 // Assign a logger to command processor itself as well as all bridges that use a logger.
@@ -99,22 +183,32 @@ func (proc *CommandProcessor) IsSaneForInternet() (errs []error) {
 func (proc *CommandProcessor) Process(cmd feature.Command) (ret *feature.Result) {
 	// Put execution duration into statistics
 	beginTimeNano := time.Now().UnixNano()
+	var matchedTrigger feature.Trigger
 	defer func() {
-		DurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+		DurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
+		CommandCounts.Add(1, string(matchedTrigger), commandOutcome(matchedTrigger, ret))
 	}()
 	// Do not execute a command if global lock down is effective
 	if global.EmergencyLockDown {
 		return &feature.Result{Error: global.ErrEmergencyLockDown}
 	}
+	// Do not execute a command from a client that has failed too many times
+	if proc.Bans.IsBanned(cmd.ClientID) {
+		return &feature.Result{Command: feature.Command{ClientID: cmd.ClientID}, Error: env.ErrClientBanned, CombinedOutput: env.ErrClientBanned.Error()}
+	}
+	features, cmdBridges, resultBridges := proc.snapshot()
 	var bridgeErr error
 	var matchedFeature feature.Feature
 	var overrideLintText bridge.LintText
 	var hasOverrideLintText bool
 	logCommandContent := cmd.Content
 	// Walk the command through all bridges
-	for _, cmdBridge := range proc.CommandBridges {
+	for _, cmdBridge := range cmdBridges {
 		cmd, bridgeErr = cmdBridge.Transform(cmd)
 		if bridgeErr != nil {
+			if bridgeErr == bridge.ErrPINAndShortcutNotFound {
+				proc.Bans.AddFailure(cmd.ClientID)
+			}
 			ret = &feature.Result{Error: bridgeErr}
 			goto result
 		}
@@ -128,7 +222,7 @@ func (proc *CommandProcessor) Process(cmd feature.Command) (ret *feature.Result)
 	// Look for PLT (position, length, timeout) override, it is going to affect LintText bridge.
 	if cmd.FindAndRemovePrefix(PrefixCommandPLT) {
 		// Find the configured LintText bridge
-		for _, resultBridge := range proc.ResultBridges {
+		for _, resultBridge := range resultBridges {
 			if aBridge, isLintText := resultBridge.(*bridge.LintText); isLintText {
 				overrideLintText = *aBridge
 				hasOverrideLintText = true
@@ -165,9 +259,10 @@ func (proc *CommandProcessor) Process(cmd feature.Command) (ret *feature.Result)
 		}
 	}
 	// Look for command's prefix among configured features
-	for prefix, configuredFeature := range proc.Features.LookupByTrigger {
+	for prefix, configuredFeature := range features.LookupByTrigger {
 		if cmd.FindAndRemovePrefix(string(prefix)) {
 			matchedFeature = configuredFeature
+			matchedTrigger = prefix
 			break
 		}
 	}
@@ -193,7 +288,7 @@ result:
 	*/
 	ret.Command.Content = logCommandContent
 	// Walk through result bridges
-	for _, resultBridge := range proc.ResultBridges {
+	for _, resultBridge := range resultBridges {
 		// LintText bridge may have been manipulated by override
 		if _, isLintText := resultBridge.(*bridge.LintText); isLintText && hasOverrideLintText {
 			resultBridge = &overrideLintText
@@ -205,6 +300,115 @@ result:
 	return
 }
 
+// countingWriter counts the bytes written into the underlying writer.
+type countingWriter struct {
+	out   io.Writer
+	count int
+}
+
+func (counting *countingWriter) Write(p []byte) (int, error) {
+	n, err := counting.out.Write(p)
+	counting.count += n
+	return n, err
+}
+
+/*
+ProcessStreaming runs a shell command and writes its output into the sink as the output arrives. Like Process, the
+command must pass PIN check and other command bridges, and counts toward command statistics. Function begin is called
+right before the command starts, so that caller may prepare the sink; if the command is rejected, begin is not called
+and nothing is written into the sink. The command is killed when it runs past its timeout, when its output exceeds the
+byte limit, or when the context is cancelled. Once the command finishes, result bridges receive a summary of the run,
+e.g. to notify by email, and the summary is returned.
+*/
+func (proc *CommandProcessor) ProcessStreaming(ctx context.Context, cmd feature.Command, maxOutputBytes int, begin func(), sink io.Writer) (ret *feature.Result) {
+	// Put execution duration into statistics
+	beginTimeNano := time.Now().UnixNano()
+	var matchedTrigger feature.Trigger
+	defer func() {
+		DurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
+		CommandCounts.Add(1, string(matchedTrigger), commandOutcome(matchedTrigger, ret))
+	}()
+	// Do not execute a command if global lock down is effective
+	if global.EmergencyLockDown {
+		return &feature.Result{Error: global.ErrEmergencyLockDown}
+	}
+	// Do not execute a command from a client that has failed too many times
+	if proc.Bans.IsBanned(cmd.ClientID) {
+		return &feature.Result{Command: feature.Command{ClientID: cmd.ClientID}, Error: env.ErrClientBanned, CombinedOutput: env.ErrClientBanned.Error()}
+	}
+	features, cmdBridges, resultBridges := proc.snapshot()
+	var bridgeErr error
+	var shell *feature.Shell
+	var isShell bool
+	var counting *countingWriter
+	logCommandContent := cmd.Content
+	// Walk the command through all bridges
+	for _, cmdBridge := range cmdBridges {
+		cmd, bridgeErr = cmdBridge.Transform(cmd)
+		if bridgeErr != nil {
+			if bridgeErr == bridge.ErrPINAndShortcutNotFound {
+				proc.Bans.AddFailure(cmd.ClientID)
+			}
+			ret = &feature.Result{Error: bridgeErr}
+			goto result
+		}
+	}
+	// Trim spaces and expect non-empty command
+	if ret = cmd.Trim(); ret != nil {
+		goto result
+	}
+	logCommandContent = cmd.Content
+	// Only shell is able to stream its output
+	shell, isShell = features.LookupByTrigger[(&feature.Shell{}).Trigger()].(*feature.Shell)
+	if !isShell || !cmd.FindAndRemovePrefix(string(shell.Trigger())) {
+		ret = &feature.Result{Error: ErrNotStreamable}
+		goto result
+	}
+	if ret = cmd.Trim(); ret != nil {
+		goto result
+	}
+	matchedTrigger = shell.Trigger()
+	// Run the shell command
+	proc.Logger.Printf("ProcessStreaming", "CommandProcessor", nil, "going to run %+v", cmd)
+	defer func() {
+		proc.Logger.Printf("ProcessStreaming", "CommandProcessor", nil, "finished running %+v - %s", cmd, ret.CombinedOutput)
+	}()
+	begin()
+	counting = &countingWriter{out: sink}
+	ret = &feature.Result{Error: env.StreamShell(ctx, cmd.TimeoutSec, maxOutputBytes, counting, shell.InterpreterPath, cmd.Content)}
+	// The output has already gone to the sink, result bridges (e.g. notification) only get to see a summary.
+	ret.Output = fmt.Sprintf("Streamed %d bytes of output", counting.count)
+
+result:
+	ret.Command = cmd
+	ret.Command.Content = logCommandContent
+	// Walk through result bridges
+	for _, resultBridge := range resultBridges {
+		if err := resultBridge.Transform(ret); err != nil {
+			return &feature.Result{Command: ret.Command, Error: err}
+		}
+	}
+	return
+}
+
+// commandOutcome returns one of the CommandOutcome* values that describes the result of a command.
+func commandOutcome(matchedTrigger feature.Trigger, result *feature.Result) string {
+	switch {
+	case result == nil || result.Error == nil:
+		return CommandOutcomeOK
+	case result.Error == env.ErrClientBanned:
+		return CommandOutcomeBanned
+	case result.Error == global.ErrEmergencyLockDown:
+		return CommandOutcomeLockDown
+	case result.Error == bridge.ErrPINAndShortcutNotFound:
+		return CommandOutcomeUnauthorised
+	case matchedTrigger == "":
+		return CommandOutcomeInvalid
+	default:
+		return CommandOutcomeError
+	}
+}
+
 // Return a realistic command processor for test cases. The only feature made available and initialised is shell execution.
 func GetTestCommandProcessor() *CommandProcessor {
 	// Prepare feature set - the shell execution feature should be available even without configuration
@@ -1,7 +1,10 @@
 package common
 
 import (
+	"bytes"
+	"context"
 	"github.com/HouzuoGuo/laitos/bridge"
+	"github.com/HouzuoGuo/laitos/env"
 	"github.com/HouzuoGuo/laitos/feature"
 	"github.com/HouzuoGuo/laitos/global"
 	"reflect"
@@ -96,6 +99,86 @@ func TestCommandProcessor_Process(t *testing.T) {
 	global.EmergencyLockDown = false
 }
 
+func TestCommandProcessor_Bans(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	proc.Bans = &env.BanManager{MaxFailures: 2}
+	if err := proc.Bans.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Client is banned after failing PIN match too many times
+	for i := 0; i < 2; i++ {
+		if result := proc.Process(feature.Command{Content: "badpin.s echo hi", TimeoutSec: 5, ClientID: "1.2.3.4"}); result.Error != bridge.ErrPINAndShortcutNotFound {
+			t.Fatal(result)
+		}
+	}
+	if result := proc.Process(feature.Command{Content: "verysecret.s echo hi", TimeoutSec: 5, ClientID: "1.2.3.4"}); result.Error != env.ErrClientBanned ||
+		result.CombinedOutput != env.ErrClientBanned.Error() {
+		t.Fatal(result)
+	}
+	// Other clients are unaffected
+	if result := proc.Process(feature.Command{Content: "verysecret.s echo hi", TimeoutSec: 5, ClientID: "5.6.7.8"}); result.Error != nil {
+		t.Fatal(result)
+	}
+	if result := proc.Process(feature.Command{Content: "verysecret.s echo hi", TimeoutSec: 5}); result.Error != nil {
+		t.Fatal(result)
+	}
+	proc.Bans.Unban("1.2.3.4")
+	if result := proc.Process(feature.Command{Content: "verysecret.s echo hi", TimeoutSec: 5, ClientID: "1.2.3.4"}); result.Error != nil {
+		t.Fatal(result)
+	}
+}
+
+func TestCommandProcessor_CommandCounts(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	okBefore := CommandCounts.Get(".s", CommandOutcomeOK)
+	invalidBefore := CommandCounts.Get("", CommandOutcomeInvalid)
+	unauthorisedBefore := CommandCounts.Get("", CommandOutcomeUnauthorised)
+	proc.Process(feature.Command{Content: "verysecret.s echo hi", TimeoutSec: 5})
+	proc.Process(feature.Command{Content: "verysecret.nonexistent", TimeoutSec: 5})
+	proc.Process(feature.Command{Content: "badpin.s echo hi", TimeoutSec: 5})
+	if CommandCounts.Get(".s", CommandOutcomeOK) != okBefore+1 || CommandCounts.Get("", CommandOutcomeInvalid) != invalidBefore+1 ||
+		CommandCounts.Get("", CommandOutcomeUnauthorised) != unauthorisedBefore+1 {
+		t.Fatal(CommandCounts.Get(".s", CommandOutcomeOK), CommandCounts.Get("", CommandOutcomeInvalid), CommandCounts.Get("", CommandOutcomeUnauthorised))
+	}
+}
+
+func TestCommandProcessor_ProcessStreaming(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	proc.Bans = &env.BanManager{MaxFailures: 2}
+	if err := proc.Bans.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	var began bool
+	begin := func() {
+		began = true
+	}
+	// Rejected commands do not begin
+	var out bytes.Buffer
+	if result := proc.ProcessStreaming(context.Background(), feature.Command{Content: "badpin.s echo hi", TimeoutSec: 5, ClientID: "1.2.3.4"}, 100, begin, &out); result.Error != bridge.ErrPINAndShortcutNotFound || began || out.Len() != 0 {
+		t.Fatal(result, began, out.String())
+	}
+	if result := proc.ProcessStreaming(context.Background(), feature.Command{Content: "verysecret.elog", TimeoutSec: 5}, 100, begin, &out); result.Error != ErrNotStreamable || began || out.Len() != 0 {
+		t.Fatal(result, began, out.String())
+	}
+	if result := proc.ProcessStreaming(context.Background(), feature.Command{Content: "verysecret.s ", TimeoutSec: 5}, 100, begin, &out); result.Error != feature.ErrEmptyCommand || began || out.Len() != 0 {
+		t.Fatal(result, began, out.String())
+	}
+	// Output goes to the sink, and result bridges see a summary
+	okBefore := CommandCounts.Get(".s", CommandOutcomeOK)
+	result := proc.ProcessStreaming(context.Background(), feature.Command{Content: "verysecret.s echo hi", TimeoutSec: 5}, 100, begin, &out)
+	if result.Error != nil || !began || out.String() != "hi\n" || result.CombinedOutput != "Streamed 3 bytes of output" || result.Command.Content != ".s echo hi" {
+		t.Fatal(result, began, out.String())
+	}
+	if CommandCounts.Get(".s", CommandOutcomeOK) != okBefore+1 {
+		t.Fatal(CommandCounts.Get(".s", CommandOutcomeOK))
+	}
+	// Client is banned after failing PIN match too many times
+	proc.ProcessStreaming(context.Background(), feature.Command{Content: "badpin.s echo hi", TimeoutSec: 5, ClientID: "1.2.3.4"}, 100, begin, &out)
+	if result := proc.ProcessStreaming(context.Background(), feature.Command{Content: "verysecret.s echo hi", TimeoutSec: 5, ClientID: "1.2.3.4"}, 100, begin, &out); result.Error != env.ErrClientBanned {
+		t.Fatal(result)
+	}
+}
+
 func TestCommandProcessor_IsSane(t *testing.T) {
 	proc := CommandProcessor{
 		Features:       nil,
@@ -154,6 +237,27 @@ func TestCommandProcessor_IsSane(t *testing.T) {
 	}
 }
 
+func TestCommandProcessor_GetBridgesAndTriggers(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	if pin := proc.GetPIN(); pin != "verysecret" {
+		t.Fatal(pin)
+	}
+	if lintText := proc.GetLintText(); lintText == nil || lintText.MaxLength != 35 {
+		t.Fatal(lintText)
+	}
+	if trigger := proc.FindTrigger(" .s echo hi"); trigger != ".s" {
+		t.Fatal(trigger)
+	}
+	if trigger := proc.FindTrigger("echo hi"); trigger != "" {
+		t.Fatal(trigger)
+	}
+	// Bridges of a reloaded processor are in effect right away
+	proc.ReplaceWith(&CommandProcessor{Features: proc.Features, CommandBridges: []bridge.CommandBridge{}, ResultBridges: []bridge.ResultBridge{}})
+	if pin, lintText := proc.GetPIN(), proc.GetLintText(); pin != "" || lintText != nil {
+		t.Fatal(pin, lintText)
+	}
+}
+
 func TestGetTestCommandProcessor(t *testing.T) {
 	if proc := GetTestCommandProcessor(); proc == nil {
 		t.Fatal("did not return")
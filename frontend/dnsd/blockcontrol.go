@@ -0,0 +1,244 @@
+package dnsd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Descriptions of the lists that allow or block a name.
+const (
+	ListRuntimeAllow = "run-time allow entry" // ListRuntimeAllow is the list of allowed names added at run-time.
+	ListRuntimeDeny  = "run-time deny entry"  // ListRuntimeDeny is the list of denied names added at run-time.
+	ListAllow        = "AllowList"            // ListAllow is the allow list from configuration.
+	ListDeny         = "DenyList"             // ListDeny is the deny list from configuration.
+)
+
+// domainAndParents returns the domain name followed by all of its parent domains, e.g. "a.b.com", "b.com", "com".
+func domainAndParents(name string) (ret []string) {
+	name = strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")
+	ret = make([]string, 0, 8)
+	for name != "" {
+		ret = append(ret, name)
+		index := strings.IndexRune(name, '.')
+		if index < 0 {
+			break
+		}
+		name = name[index+1:]
+	}
+	return
+}
+
+// isRuntimeEntry returns true only if the name is among the run-time entries and the entry has not yet expired.
+func isRuntimeEntry(entries map[string]time.Time, name string, now time.Time) bool {
+	expiry, exists := entries[name]
+	if !exists {
+		return false
+	}
+	if !expiry.IsZero() && now.After(expiry) {
+		delete(entries, name)
+		return false
+	}
+	return true
+}
+
+/*
+matchBlockLists looks for the first of the domain names that is allowed or blocked, and returns the matched name along
+with the description of the list that contains it. Allowed names take precedence over blocked names. Caller must hold
+black list mutex.
+*/
+func (dnsd *DNSD) matchBlockLists(names []string) (blocked bool, matchedName, list string) {
+	now := time.Now()
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if isRuntimeEntry(dnsd.runtimeAllow, name, now) {
+			return false, name, ListRuntimeAllow
+		}
+		if _, allowed := dnsd.allowListHash[name]; allowed {
+			return false, name, ListAllow
+		}
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if isRuntimeEntry(dnsd.runtimeDeny, name, now) {
+			return true, name, ListRuntimeDeny
+		}
+		if _, blacklisted := dnsd.BlackList[name]; blacklisted {
+			origin := dnsd.blackListOrigin[name]
+			if origin == "" {
+				origin = "black list"
+			}
+			return true, name, origin
+		}
+		if _, denied := dnsd.denyListHash[name]; denied {
+			return true, name, ListDeny
+		}
+	}
+	return false, "", ""
+}
+
+// ExplainBlock tells whether the domain name is blocked, and which list allows or blocks it.
+func (dnsd *DNSD) ExplainBlock(name string) string {
+	names := domainAndParents(name)
+	if len(names) == 0 {
+		return "the name is empty"
+	}
+	dnsd.BlackListMutex.Lock()
+	blocked, matchedName, list := dnsd.matchBlockLists(names)
+	dnsd.BlackListMutex.Unlock()
+	if list == "" {
+		return fmt.Sprintf("%s is not blocked", names[0])
+	} else if blocked {
+		return fmt.Sprintf("%s is blocked by %s (%s)", names[0], list, matchedName)
+	}
+	return fmt.Sprintf("%s is allowed by %s (%s)", names[0], list, matchedName)
+}
+
+/*
+loadRuntimeEntries reads run-time entries that do not expire from RuntimeEntryPath. Each line of the file consists of
+either "allow" or "deny" followed by a domain name. It does nothing if the file is absent.
+*/
+func (dnsd *DNSD) loadRuntimeEntries() error {
+	content, err := ioutil.ReadFile(dnsd.RuntimeEntryPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !IsValidDomainName(fields[1]) {
+			continue
+		}
+		switch fields[0] {
+		case "allow":
+			dnsd.runtimeAllow[fields[1]] = time.Time{}
+		case "deny":
+			dnsd.runtimeDeny[fields[1]] = time.Time{}
+		}
+	}
+	return nil
+}
+
+// saveRuntimeEntries writes run-time entries that do not expire into RuntimeEntryPath. Caller must hold black list mutex.
+func (dnsd *DNSD) saveRuntimeEntries() {
+	if dnsd.RuntimeEntryPath == "" {
+		return
+	}
+	lines := make([]string, 0, len(dnsd.runtimeAllow)+len(dnsd.runtimeDeny))
+	for name, expiry := range dnsd.runtimeAllow {
+		if expiry.IsZero() {
+			lines = append(lines, "allow "+name)
+		}
+	}
+	for name, expiry := range dnsd.runtimeDeny {
+		if expiry.IsZero() {
+			lines = append(lines, "deny "+name)
+		}
+	}
+	sort.Strings(lines)
+	// Write into a temporary file first so that the entries are never left half written
+	tmpPath := dnsd.RuntimeEntryPath + ".tmp"
+	err := ioutil.WriteFile(tmpPath, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, dnsd.RuntimeEntryPath)
+	}
+	if err != nil {
+		dnsd.Logger.Warningf("saveRuntimeEntries", dnsd.RuntimeEntryPath, err, "failed to save run-time entries")
+	}
+}
+
+/*
+SetRuntimeEntry allows or denies the domain name and its sub-domains until the duration elapses. Zero duration means the
+entry does not expire, such entries are kept in RuntimeEntryPath (if configured) to survive a restart. Allowing a name
+removes its run-time deny entry, and vice versa.
+*/
+func (dnsd *DNSD) SetRuntimeEntry(name string, allow bool, duration time.Duration) error {
+	name = strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")
+	if !IsValidDomainName(name) {
+		return fmt.Errorf("DNSD.SetRuntimeEntry: \"%s\" is not a valid domain name", name)
+	}
+	var expiry time.Time
+	if duration > 0 {
+		expiry = time.Now().Add(duration)
+	}
+	dnsd.BlackListMutex.Lock()
+	defer dnsd.BlackListMutex.Unlock()
+	if allow {
+		delete(dnsd.runtimeDeny, name)
+		dnsd.runtimeAllow[name] = expiry
+	} else {
+		delete(dnsd.runtimeAllow, name)
+		dnsd.runtimeDeny[name] = expiry
+	}
+	dnsd.saveRuntimeEntries()
+	dnsd.Logger.Printf("SetRuntimeEntry", name, nil, "allow: %v, expiry: %v", allow, expiry)
+	return nil
+}
+
+// RemoveRuntimeEntry removes the domain name from run-time allow and deny entries. It returns false if there was none.
+func (dnsd *DNSD) RemoveRuntimeEntry(name string) bool {
+	name = strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")
+	dnsd.BlackListMutex.Lock()
+	defer dnsd.BlackListMutex.Unlock()
+	_, allowed := dnsd.runtimeAllow[name]
+	_, denied := dnsd.runtimeDeny[name]
+	delete(dnsd.runtimeAllow, name)
+	delete(dnsd.runtimeDeny, name)
+	if allowed || denied {
+		dnsd.saveRuntimeEntries()
+	}
+	return allowed || denied
+}
+
+// GetBlockListInfo describes black list size of each source, last update time, and run-time entries in a multi-line text.
+func (dnsd *DNSD) GetBlockListInfo() string {
+	dnsd.BlackListMutex.Lock()
+	defer dnsd.BlackListMutex.Unlock()
+	var buf bytes.Buffer
+	lastUpdate := "never"
+	if !dnsd.blackListUpdateTime.IsZero() {
+		lastUpdate = dnsd.blackListUpdateTime.Format(time.RFC3339)
+	}
+	fmt.Fprintf(&buf, "Black list: %d entries, last updated: %s\n", len(dnsd.BlackList), lastUpdate)
+	originCounts := make(map[string]int)
+	for _, origin := range dnsd.blackListOrigin {
+		originCounts[origin]++
+	}
+	origins := make([]string, 0, len(originCounts))
+	for origin := range originCounts {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	for _, origin := range origins {
+		fmt.Fprintf(&buf, "  %s: %d\n", origin, originCounts[origin])
+	}
+	fmt.Fprintf(&buf, "%s: %d entries, %s: %d entries\n", ListAllow, len(dnsd.allowListHash), ListDeny, len(dnsd.denyListHash))
+	now := time.Now()
+	for _, section := range []struct {
+		title   string
+		entries map[string]time.Time
+	}{{"Run-time allow", dnsd.runtimeAllow}, {"Run-time deny", dnsd.runtimeDeny}} {
+		names := make([]string, 0, len(section.entries))
+		for name := range section.entries {
+			if isRuntimeEntry(section.entries, name, now) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		buf.WriteString(section.title + ":")
+		for _, name := range names {
+			if expiry := section.entries[name]; expiry.IsZero() {
+				fmt.Fprintf(&buf, " %s(no expiry)", name)
+			} else {
+				fmt.Fprintf(&buf, " %s(%s left)", name, expiry.Sub(now).Truncate(time.Second))
+			}
+		}
+		buf.WriteRune('\n')
+	}
+	return buf.String()
+}
@@ -0,0 +1,138 @@
+package dnsd
+
+import (
+	"github.com/HouzuoGuo/laitos/feature"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDomainAndParents(t *testing.T) {
+	if names := domainAndParents(" A.B.Example.COM. "); !reflect.DeepEqual(names, []string{"a.b.example.com", "b.example.com", "example.com", "com"}) {
+		t.Fatal(names)
+	}
+	if names := domainAndParents(""); len(names) != 0 {
+		t.Fatal(names)
+	}
+}
+
+func TestDNSD_RuntimeBlockList(t *testing.T) {
+	listFile := "/tmp/test-laitos-dnsd-blockcontrol.txt"
+	defer os.Remove(listFile)
+	entryFile := "/tmp/test-laitos-dnsd-blockcontrol-entries.txt"
+	os.Remove(entryFile)
+	defer os.Remove(entryFile)
+	if err := ioutil.WriteFile(listFile, []byte("0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	daemon := DNSD{
+		Address:              "127.0.0.1",
+		UDPPort:              61261,
+		UDPForwarder:         "8.8.8.8:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		BlockListSources:     []BlockListSource{{FilePath: listFile, Format: BlockListFormatHosts}},
+		AllowList:            []string{"tracker.example.com"},
+		DenyList:             []string{"denied.example.com"},
+		RuntimeEntryPath:     entryFile,
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if info := daemon.GetBlockListInfo(); !strings.Contains(info, "Black list: 0 entries, last updated: never") {
+		t.Fatal(info)
+	}
+	daemon.UpdatedAdBlockLists()
+	if info := daemon.GetBlockListInfo(); !strings.Contains(info, "Black list: 2 entries") || !strings.Contains(info, listFile+": 2") {
+		t.Fatal(info)
+	}
+	// Explain which list blocks or allows a name
+	for name, expected := range map[string]string{
+		"WWW.ads.example.com":   "www.ads.example.com is blocked by " + listFile + " (ads.example.com)",
+		"a.tracker.example.com": "a.tracker.example.com is allowed by AllowList (tracker.example.com)",
+		"denied.example.com":    "denied.example.com is blocked by DenyList (denied.example.com)",
+		"github.com":            "github.com is not blocked",
+	} {
+		if explanation := daemon.ExplainBlock(name); explanation != expected {
+			t.Fatal(explanation)
+		}
+	}
+
+	// Run-time entries
+	if err := daemon.SetRuntimeEntry("not a name", true, 0); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := daemon.SetRuntimeEntry("Ads.Example.com", true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if daemon.NamesAreBlackListed([]string{"a.ads.example.com", "ads.example.com", "example.com"}) {
+		t.Fatal("run-time allow entry is not effective")
+	}
+	if err := daemon.SetRuntimeEntry("github.com", false, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !daemon.NamesAreBlackListed([]string{"api.github.com", "github.com"}) ||
+		daemon.ExplainBlock("api.github.com") != "api.github.com is blocked by run-time deny entry (github.com)" {
+		t.Fatal("run-time deny entry is not effective")
+	}
+	info := daemon.GetBlockListInfo()
+	if !strings.Contains(info, "Run-time allow: ads.example.com(no expiry)") || !strings.Contains(info, "Run-time deny: github.com(5") {
+		t.Fatal(info)
+	}
+	// Deny replaces allow of the same name
+	if err := daemon.SetRuntimeEntry("ads.example.com", false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if daemon.ExplainBlock("ads.example.com") != "ads.example.com is blocked by run-time deny entry (ads.example.com)" {
+		t.Fatal(daemon.ExplainBlock("ads.example.com"))
+	}
+	if !daemon.RemoveRuntimeEntry("ads.example.com") || daemon.RemoveRuntimeEntry("ads.example.com") {
+		t.Fatal("failed to remove")
+	}
+	// Expired entries no longer take effect
+	daemon.runtimeDeny["github.com"] = time.Now().Add(-time.Second)
+	if daemon.NamesAreBlackListed([]string{"github.com"}) || len(daemon.runtimeDeny) != 0 {
+		t.Fatal("expired entry is still effective")
+	}
+	// Entries that do not expire survive a restart
+	if err := daemon.SetRuntimeEntry("permanent.example.com", false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.SetRuntimeEntry("temporary.example.com", false, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(entryFile); err != nil || string(content) != "deny permanent.example.com\n" {
+		t.Fatal(string(content), err)
+	}
+	restarted := DNSD{
+		Address:              "127.0.0.1",
+		UDPPort:              61261,
+		UDPForwarder:         "8.8.8.8:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		RuntimeEntryPath:     entryFile,
+	}
+	if err := restarted.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if explanation := restarted.ExplainBlock("permanent.example.com"); explanation != "permanent.example.com is blocked by run-time deny entry (permanent.example.com)" {
+		t.Fatal(explanation)
+	}
+	if explanation := restarted.ExplainBlock("temporary.example.com"); explanation != "temporary.example.com is not blocked" {
+		t.Fatal(explanation)
+	}
+
+	// Feature command manages the running daemon
+	feature.RunningDNSD = &daemon
+	defer func() {
+		feature.RunningDNSD = nil
+	}()
+	ctl := feature.DNSControl{}
+	if ret := ctl.Execute(feature.Command{Content: "allow ads.example.com 10"}); ret.Error != nil ||
+		ret.Output != "ads.example.com is allowed by run-time allow entry (ads.example.com)" {
+		t.Fatal(ret)
+	}
+}
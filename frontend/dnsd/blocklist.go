@@ -0,0 +1,187 @@
+package dnsd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/httpclient"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Formats of block list sources.
+const (
+	BlockListFormatHosts   = "hosts"   // BlockListFormatHosts is hosts file, e.g. "0.0.0.0 ads.example.com".
+	BlockListFormatDomains = "domains" // BlockListFormatDomains has one domain name on each line.
+	BlockListFormatAdBlock = "adblock" // BlockListFormatAdBlock is AdBlock filter list, only "||ads.example.com^" rules are used.
+	BlockListFormatRPZ     = "rpz"     // BlockListFormatRPZ is DNS response policy zone, only "ads.example.com CNAME ." style rules are used.
+)
+
+var (
+	PGLBlockListSource = BlockListSource{
+		URL:    "https://pgl.yoyo.org/adservers/serverlist.php?hostformat=nohtml&showintro=0&mimetype=plaintext",
+		Format: BlockListFormatDomains,
+	}
+	MVPSBlockListSource = BlockListSource{
+		URL:    "http://winhelp2002.mvps.org/hosts.txt",
+		Format: BlockListFormatHosts,
+	}
+	// DefaultBlockListSources are used when no block list source is configured.
+	DefaultBlockListSources = []BlockListSource{PGLBlockListSource, MVPSBlockListSource}
+)
+
+// BlockListSource is a list of advertisement and malicious domain names, retrieved from the Internet or a local file.
+type BlockListSource struct {
+	URL      string `json:"URL"`      // Download the list from this HTTP(S) URL
+	FilePath string `json:"FilePath"` // Read the list from this local file, in place of URL.
+	Format   string `json:"Format"`   // "hosts", "domains", "adblock", or "rpz"
+}
+
+// String returns the URL or file path of the source.
+func (src BlockListSource) String() string {
+	if src.URL != "" {
+		return src.URL
+	}
+	return src.FilePath
+}
+
+// Check returns an error if the source does not have a location or its format is unknown.
+func (src BlockListSource) Check() error {
+	if (src.URL == "") == (src.FilePath == "") {
+		return errors.New("block list source must have either URL or file path")
+	}
+	switch src.Format {
+	case BlockListFormatHosts, BlockListFormatDomains, BlockListFormatAdBlock, BlockListFormatRPZ:
+		return nil
+	}
+	return fmt.Errorf("block list source %s has unknown format \"%s\"", src, src.Format)
+}
+
+// GetBlockList downloads or reads the block list from the source and returns domain names found on it.
+func (src BlockListSource) GetBlockList() ([]string, error) {
+	var content []byte
+	if src.URL != "" {
+		// The URL is not a template, hence escape the template placeholders.
+		resp, err := httpclient.DoHTTP(httpclient.Request{TimeoutSec: 30}, strings.Replace(src.URL, "%", "%%", -1))
+		if err != nil {
+			return nil, err
+		}
+		if statusErr := resp.Non2xxToError(); statusErr != nil {
+			return nil, statusErr
+		}
+		content = resp.Body
+	} else {
+		var err error
+		if content, err = ioutil.ReadFile(src.FilePath); err != nil {
+			return nil, err
+		}
+	}
+	names := ParseBlockList(src.Format, string(content))
+	if len(names) == 0 {
+		return nil, fmt.Errorf("block list %s does not contain a domain name", src)
+	}
+	return names, nil
+}
+
+// IsValidDomainName returns true only if the name looks like a domain name that may be blocked.
+func IsValidDomainName(name string) bool {
+	if len(name) < 3 || len(name) > 253 || !strings.Contains(name, ".") || name[0] == '.' || name[len(name)-1] == '.' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	// An IP address is not a domain name
+	return !strings.Contains(name, "..") && net.ParseIP(name) == nil
+}
+
+// ParseBlockList extracts domain names from block list content of the format. Unsupported lines are skipped.
+func ParseBlockList(format, content string) []string {
+	names := make([]string, 0, 16384)
+	rpzOrigin := ""
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		var candidates []string
+		switch format {
+		case BlockListFormatHosts:
+			if hash := strings.IndexRune(line, '#'); hash != -1 {
+				line = line[:hash]
+			}
+			// The first field is an IP address, the remaining fields are host names.
+			if fields := strings.Fields(line); len(fields) > 1 {
+				candidates = fields[1:]
+			}
+		case BlockListFormatDomains:
+			if hash := strings.IndexRune(line, '#'); hash != -1 {
+				line = line[:hash]
+			}
+			candidates = strings.Fields(line)
+		case BlockListFormatAdBlock:
+			// Only use rules that block a domain entirely, e.g. "||ads.example.com^" or "||ads.example.com^$third-party".
+			if strings.HasPrefix(line, "||") {
+				if caret := strings.IndexRune(line, '^'); caret != -1 && (caret == len(line)-1 || line[caret+1] == '$') {
+					candidates = []string{line[2:caret]}
+				}
+			}
+		case BlockListFormatRPZ:
+			if semicolon := strings.IndexRune(line, ';'); semicolon != -1 {
+				line = line[:semicolon]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 2 && strings.ToUpper(fields[0]) == "$ORIGIN" {
+				rpzOrigin = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+				continue
+			}
+			// Only use rules that answer NXDOMAIN (CNAME .) or NODATA (CNAME *.), e.g. "ads.example.com CNAME .".
+			if len(fields) < 3 || strings.ToUpper(fields[len(fields)-2]) != "CNAME" {
+				continue
+			}
+			if target := fields[len(fields)-1]; target != "." && target != "*." {
+				continue
+			}
+			name := strings.ToLower(fields[0])
+			if strings.HasSuffix(name, ".") {
+				name = strings.TrimSuffix(strings.TrimSuffix(name, "."), "."+rpzOrigin)
+			}
+			// A wildcard rule blocks the domain and its sub-domains, which is what the block list does to all names.
+			candidates = []string{strings.TrimPrefix(name, "*.")}
+		}
+		for _, name := range candidates {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if IsValidDomainName(name) && name != "localhost.localdomain" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// LoadBlockListCache reads the last good block list from cache file. It returns an empty list if the file is absent.
+func LoadBlockListCache(cachePath string) ([]string, error) {
+	content, err := ioutil.ReadFile(cachePath)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseBlockList(BlockListFormatDomains, string(content)), nil
+}
+
+// SaveBlockListCache writes the block list into cache file, one name per line.
+func SaveBlockListCache(cachePath string, blackList map[string]struct{}) error {
+	names := make([]string, 0, len(blackList))
+	for name := range blackList {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Write into a temporary file first so that the cache is never left half written
+	tmpPath := cachePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(strings.Join(names, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, cachePath)
+}
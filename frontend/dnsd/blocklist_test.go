@@ -0,0 +1,129 @@
+package dnsd
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBlockList(t *testing.T) {
+	hosts := `# comment
+127.0.0.1 localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 Ads.example.com tracker.example.com # trailing comment
+0.0.0.0 bad..example.com
+`
+	if names := ParseBlockList(BlockListFormatHosts, hosts); !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com"}) {
+		t.Fatal(names)
+	}
+	domains := "# comment\nads.example.com\n\n  tracker.example.com.  \nnot-a-domain\n"
+	if names := ParseBlockList(BlockListFormatDomains, domains); !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com"}) {
+		t.Fatal(names)
+	}
+	adblock := `[Adblock Plus 2.0]
+! comment
+||ads.example.com^
+||tracker.example.com^$third-party
+||example.com/path^
+@@||allowed.example.com^
+example.net##.banner
+`
+	if names := ParseBlockList(BlockListFormatAdBlock, adblock); !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com"}) {
+		t.Fatal(names)
+	}
+	rpz := `$TTL 300
+@ SOA localhost. root.localhost. 1 3600 600 86400 300
+  NS localhost.
+$ORIGIN rpz.example.
+ads.example.com CNAME . ; comment
+*.tracker.example.com 300 IN CNAME *.
+passthru.example.com CNAME rpz-passthru.
+absolute.example.com.rpz.example. CNAME .
+`
+	if names := ParseBlockList(BlockListFormatRPZ, rpz); !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com", "absolute.example.com"}) {
+		t.Fatal(names)
+	}
+}
+
+func TestBlockListSource(t *testing.T) {
+	if err := (BlockListSource{Format: BlockListFormatHosts}).Check(); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := (BlockListSource{URL: "a", FilePath: "b", Format: BlockListFormatHosts}).Check(); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := (BlockListSource{FilePath: "b", Format: "hello"}).Check(); err == nil || !strings.Contains(err.Error(), "unknown format") {
+		t.Fatal(err)
+	}
+	listFile := "/tmp/test-laitos-dnsd-blocklist.txt"
+	if err := ioutil.WriteFile(listFile, []byte("||ads.example.com^\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(listFile)
+	if names, err := (BlockListSource{FilePath: listFile, Format: BlockListFormatAdBlock}).GetBlockList(); err != nil || len(names) != 1 {
+		t.Fatal(names, err)
+	}
+	// A list without any domain name is considered a failure
+	if names, err := (BlockListSource{FilePath: listFile, Format: BlockListFormatHosts}).GetBlockList(); err == nil {
+		t.Fatal(names)
+	}
+}
+
+func TestDNSD_UpdatedAdBlockLists(t *testing.T) {
+	listFile := "/tmp/test-laitos-dnsd-blocklist.txt"
+	cacheFile := "/tmp/test-laitos-dnsd-blocklist-cache.txt"
+	defer os.Remove(listFile)
+	defer os.Remove(cacheFile)
+	os.Remove(cacheFile)
+	if err := ioutil.WriteFile(listFile, []byte("0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	daemon := DNSD{
+		Address:              "127.0.0.1",
+		UDPPort:              61255,
+		UDPForwarder:         "8.8.8.8:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		BlockListSources:     []BlockListSource{{FilePath: listFile, Format: "bad format"}},
+		BlockListCachePath:   cacheFile,
+		AllowList:            []string{"tracker.example.com"},
+		DenyList:             []string{"Denied.Example.com"},
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "unknown format") {
+		t.Fatal(err)
+	}
+	daemon.BlockListSources[0].Format = BlockListFormatHosts
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Deny list is effective without black list
+	if !daemon.NamesAreBlackListed([]string{"a.denied.example.com", "denied.example.com", "example.com"}) {
+		t.Fatal("deny list is not effective")
+	}
+	daemon.UpdatedAdBlockLists()
+	if !daemon.NamesAreBlackListed([]string{"a.ads.example.com", "ads.example.com", "example.com"}) {
+		t.Fatal("black list is not effective")
+	}
+	// Allow list takes precedence over black list
+	if daemon.NamesAreBlackListed([]string{"a.tracker.example.com", "tracker.example.com", "example.com"}) {
+		t.Fatal("allow list is not effective")
+	}
+	if daemon.NamesAreBlackListed([]string{"github.com"}) {
+		t.Fatal("should not have blocked")
+	}
+	// When source fails, the previous black list remains in effect
+	os.Remove(listFile)
+	daemon.UpdatedAdBlockLists()
+	if !daemon.NamesAreBlackListed([]string{"ads.example.com"}) {
+		t.Fatal("black list should have remained")
+	}
+	// A restart without network still uses the last good black list from cache
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if len(daemon.BlackList) != 2 || !daemon.NamesAreBlackListed([]string{"ads.example.com"}) {
+		t.Fatal(daemon.BlackList)
+	}
+}
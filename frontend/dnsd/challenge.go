@@ -0,0 +1,55 @@
+package dnsd
+
+import (
+	"strings"
+	"sync"
+)
+
+/*
+ChallengeTXTRecords are the TXT records that prove domain ownership to ACME server (DNS challenge). Any DNS daemon that
+is authoritative for the domain answers them, regardless of zone records.
+*/
+type ChallengeTXTRecords struct {
+	mutex   *sync.Mutex
+	records map[string]string
+}
+
+// ACMEChallenges are the DNS challenge records of ACME certificate manager, answered by all DNS daemons.
+var ACMEChallenges = &ChallengeTXTRecords{mutex: new(sync.Mutex), records: make(map[string]string)}
+
+// SetChallengeTXT answers TXT queries of the name with the value.
+func (challenges *ChallengeTXTRecords) SetChallengeTXT(name, value string) {
+	challenges.mutex.Lock()
+	challenges.records[strings.Trim(strings.ToLower(name), ".")] = value
+	challenges.mutex.Unlock()
+}
+
+// RemoveChallengeTXT stops answering TXT queries of the name.
+func (challenges *ChallengeTXTRecords) RemoveChallengeTXT(name string) {
+	challenges.mutex.Lock()
+	delete(challenges.records, strings.Trim(strings.ToLower(name), "."))
+	challenges.mutex.Unlock()
+}
+
+// answer fills the response with the challenge record if the question asks for one. It returns false if there is none.
+func (challenges *ChallengeTXTRecords) answer(question Question, response *Message) bool {
+	if question.Type != TypeTXT {
+		return false
+	}
+	challenges.mutex.Lock()
+	value, exists := challenges.records[strings.ToLower(question.Name)]
+	challenges.mutex.Unlock()
+	if !exists {
+		return false
+	}
+	response.Flags |= FlagAA
+	// ACME server must not see a cached challenge from an earlier attempt
+	response.Answers = append(response.Answers, ResourceRecord{
+		Name:  question.Name,
+		Type:  TypeTXT,
+		Class: ClassIN,
+		TTL:   0,
+		Data:  append([]byte{byte(len(value))}, value...),
+	})
+	return true
+}
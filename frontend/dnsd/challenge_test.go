@@ -0,0 +1,51 @@
+package dnsd
+
+import (
+	"testing"
+)
+
+func TestChallengeTXTRecords(t *testing.T) {
+	daemon := DNSD{
+		Address:              "127.0.0.1",
+		UDPPort:              61262,
+		UDPForwarder:         "8.8.8.8:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		AuthoritativeZones: []Zone{{
+			Origin: "example.com",
+			Records: []ZoneRecord{
+				{Name: "@", Type: "SOA", Value: "ns1 hostmaster 2017010101 7200 3600 1209600 300"},
+				{Name: "@", Type: "NS", Value: "ns1"},
+				{Name: "ns1", Type: "A", Value: "192.0.2.1"},
+			},
+		}},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := askZones(t, &daemon, false, "_acme-challenge.www.example.com", TypeTXT); resp.Rcode() != RcodeNXDomain {
+		t.Fatalf("%+v", resp)
+	}
+	ACMEChallenges.SetChallengeTXT("_acme-challenge.WWW.example.com.", "digest")
+	defer ACMEChallenges.RemoveChallengeTXT("_acme-challenge.www.example.com")
+	resp := askZones(t, &daemon, false, "_acme-challenge.www.example.com", TypeTXT)
+	if resp.Flags&FlagAA == 0 || resp.Rcode() != RcodeNoError || len(resp.Answers) != 1 || resp.Answers[0].TTL != 0 ||
+		string(resp.Answers[0].Data) != "\x06digest" {
+		t.Fatalf("%+v", resp)
+	}
+	// Other types of the same name are still answered from zone
+	if resp := askZones(t, &daemon, false, "_acme-challenge.www.example.com", TypeA); resp.Rcode() != RcodeNXDomain {
+		t.Fatalf("%+v", resp)
+	}
+	// Challenges outside of authoritative zones are not answered
+	ACMEChallenges.SetChallengeTXT("_acme-challenge.example.net", "digest")
+	defer ACMEChallenges.RemoveChallengeTXT("_acme-challenge.example.net")
+	query := &Message{ID: 1234, Questions: []Question{{Name: "_acme-challenge.example.net", Type: TypeTXT, Class: ClassIN}}}
+	if packet := daemon.AnswerFromZones("test", "127.0.0.1", false, query.Pack()); packet != nil {
+		t.Fatal(packet)
+	}
+	ACMEChallenges.RemoveChallengeTXT("_acme-challenge.www.example.com")
+	if resp := askZones(t, &daemon, false, "_acme-challenge.www.example.com", TypeTXT); resp.Rcode() != RcodeNXDomain {
+		t.Fatalf("%+v", resp)
+	}
+}
@@ -0,0 +1,162 @@
+package dnsd
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/feature"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CommandTimeoutSec         = 29  // CommandTimeoutSec is the timeout of feature commands that arrive in DNS queries.
+	CommandResultRetentionSec = 120 // CommandResultRetentionSec is how long a command result is kept for retrieving its chunks.
+	CommandChunkSize          = 200 // CommandChunkSize is the maximum number of bytes of command result carried by each TXT answer.
+	MaxLabelLength            = 63  // MaxLabelLength is the maximum length of a label in domain name.
+	MaxNameLength             = 253 // MaxNameLength is the maximum length of a domain name in presentation format.
+)
+
+/*
+commandResult is the result of a feature command that arrived in DNS query, it is kept for a short while so that
+client can retrieve the result chunk by chunk, and resolver's retries do not execute the command once again.
+*/
+type commandResult struct {
+	ready  chan struct{} // ready is closed when the command has finished
+	chunks []string      // chunks are command result split into TXT answers
+	expiry time.Time     // expiry is the moment the result is no longer kept
+}
+
+/*
+EncodeCommandQueryName returns the domain name of a query that asks for a chunk of feature command result. The name
+is "<chunk>.<encoded PIN and command>.<subdomain>", the encoding is base32 in lower case split into labels, hence it
+survives resolvers that alter letter case of names.
+*/
+func EncodeCommandQueryName(command, subdomain string, chunk int) (string, error) {
+	encoded := strings.ToLower(strings.TrimRight(base32.StdEncoding.EncodeToString([]byte(command)), "="))
+	labels := []string{strconv.Itoa(chunk)}
+	for len(encoded) > MaxLabelLength {
+		labels = append(labels, encoded[:MaxLabelLength])
+		encoded = encoded[MaxLabelLength:]
+	}
+	if encoded != "" {
+		labels = append(labels, encoded)
+	}
+	name := strings.Join(append(labels, strings.Trim(subdomain, ".")), ".")
+	if len(name) > MaxNameLength {
+		return "", fmt.Errorf("DNSD.EncodeCommandQueryName: command is too long to fit in domain name of %d characters", MaxNameLength)
+	}
+	return name, nil
+}
+
+// decodeCommandQueryName returns the chunk number and feature command (PIN included) encoded in the name.
+func (dnsd *DNSD) decodeCommandQueryName(name string) (chunk int, command string, err error) {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."+dnsd.CommandSubdomain), ".")
+	if len(labels) < 2 {
+		return 0, "", errors.New("missing chunk number or command")
+	}
+	if chunk, err = strconv.Atoi(labels[0]); err != nil || chunk < 0 {
+		return 0, "", errors.New("bad chunk number")
+	}
+	encoded := strings.ToUpper(strings.Join(labels[1:], ""))
+	if padding := len(encoded) % 8; padding != 0 {
+		encoded += strings.Repeat("=", 8-padding)
+	}
+	decoded, err := base32.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, "", errors.New("bad command encoding")
+	}
+	return chunk, string(decoded), nil
+}
+
+// commandQuery returns the parsed query if it asks for a name under command subdomain, or nil otherwise.
+func (dnsd *DNSD) commandQuery(queryNoLength []byte) *Message {
+	if dnsd.CommandSubdomain == "" {
+		return nil
+	}
+	query, err := ParseMessage(queryNoLength)
+	if err != nil || query.Flags&FlagQR != 0 || len(query.Questions) != 1 {
+		return nil
+	}
+	if name := strings.ToLower(query.Questions[0].Name); !strings.HasSuffix(name, "."+dnsd.CommandSubdomain) {
+		return nil
+	}
+	return query
+}
+
+/*
+AnswerCommand runs the feature command encoded in TXT query name (see EncodeCommandQueryName) and answers a chunk of the
+command result. Each answer carries two character strings - chunk number and total number of chunks in "N/M", and the
+chunk itself. The result is kept for a short while, and further queries for the same command only retrieve the kept
+result instead of executing the command once again.
+*/
+func (dnsd *DNSD) AnswerCommand(functionName, clientIP string, query *Message) []byte {
+	response := MakeResponse(query)
+	response.Flags |= FlagAA
+	question := query.Questions[0]
+	if question.Type != TypeTXT {
+		// The name exists but there is no record of other types
+		return response.Pack()
+	}
+	chunk, command, err := dnsd.decodeCommandQueryName(question.Name)
+	if err != nil {
+		dnsd.Logger.Warningf(functionName, clientIP, err, "failed to decode command query")
+		response.SetRcode(RcodeNXDomain)
+		return response.Pack()
+	}
+	result := dnsd.getCommandResult(functionName, clientIP, command)
+	select {
+	case <-result.ready:
+	case <-time.After(CommandTimeoutSec * time.Second):
+		response.SetRcode(RcodeServFail)
+		return response.Pack()
+	}
+	if chunk >= len(result.chunks) {
+		response.SetRcode(RcodeNXDomain)
+		return response.Pack()
+	}
+	header := fmt.Sprintf("%d/%d", chunk, len(result.chunks))
+	data := append([]byte{byte(len(header))}, header...)
+	data = append(data, byte(len(result.chunks[chunk])))
+	data = append(data, result.chunks[chunk]...)
+	// Resolvers should not cache the answer, so that a command repeated later on will execute again.
+	response.Answers = []ResourceRecord{{Name: question.Name, Type: TypeTXT, Class: ClassIN, TTL: 0, Data: data}}
+	return response.Pack()
+}
+
+/*
+getCommandResult returns the kept result of the command if there is one, or begins to execute the command in background
+and returns its pending result. Every execution counts toward the client's rate limit once more.
+*/
+func (dnsd *DNSD) getCommandResult(functionName, clientIP, command string) *commandResult {
+	dnsd.commandMutex.Lock()
+	defer dnsd.commandMutex.Unlock()
+	now := time.Now()
+	for key, result := range dnsd.commandResults {
+		if result.expiry.Before(now) {
+			delete(dnsd.commandResults, key)
+		}
+	}
+	if result, found := dnsd.commandResults[command]; found {
+		return result
+	}
+	result := &commandResult{ready: make(chan struct{}), expiry: now.Add(CommandResultRetentionSec * time.Second)}
+	if !dnsd.RateLimit.Add(clientIP, true) {
+		result.chunks = []string{"rate limit exceeded"}
+		close(result.ready)
+		return result
+	}
+	dnsd.commandResults[command] = result
+	go func() {
+		dnsd.Logger.Printf(functionName, clientIP, nil, "going to run a command")
+		output := dnsd.Processor.Process(feature.Command{Content: command, TimeoutSec: CommandTimeoutSec, ClientID: clientIP}).CombinedOutput
+		for len(output) > CommandChunkSize {
+			result.chunks = append(result.chunks, output[:CommandChunkSize])
+			output = output[CommandChunkSize:]
+		}
+		result.chunks = append(result.chunks, output)
+		close(result.ready)
+	}()
+	return result
+}
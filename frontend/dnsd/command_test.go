@@ -0,0 +1,127 @@
+package dnsd
+
+import (
+	"github.com/HouzuoGuo/laitos/bridge"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// queryCommand sends a TXT query for a chunk of command result to the daemon, and returns the response.
+func queryCommand(t *testing.T, daemon *DNSD, name string, qtype uint16) *Message {
+	query := &Message{ID: 1234, Flags: FlagRD, Questions: []Question{{Name: name, Type: qtype, Class: ClassIN}}}
+	// Anyone may run commands, the PIN authorises them.
+	packet, err := daemon.ProcessQuery("test", "192.0.2.100", false, query.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := ParseMessage(packet)
+	if err != nil || response.ID != 1234 || response.Flags&FlagAA == 0 {
+		t.Fatalf("%+v %v", response, err)
+	}
+	return response
+}
+
+// getTXTStrings returns the character strings of a TXT answer.
+func getTXTStrings(data []byte) (ret []string) {
+	for len(data) > 0 && int(data[0]) < len(data) {
+		ret = append(ret, string(data[1:1+data[0]]))
+		data = data[1+data[0]:]
+	}
+	return
+}
+
+func TestDNSD_AnswerCommand(t *testing.T) {
+	daemon := DNSD{
+		Address:              "127.0.0.1",
+		UDPPort:              61257,
+		UDPForwarder:         "8.8.8.8:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		CommandSubdomain:     "Cmd.Example.Com.",
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "command processor") {
+		t.Fatal(err)
+	}
+	daemon.Processor = common.GetTestCommandProcessor()
+	daemon.Processor.ResultBridges[1].(*bridge.LintText).MaxLength = 1000
+	if err := daemon.Initialise(); err != nil || daemon.CommandSubdomain != "cmd.example.com" {
+		t.Fatal(err, daemon.CommandSubdomain)
+	}
+
+	// Resolvers may alter letter case of names
+	name, err := EncodeCommandQueryName("verysecret .s echo hi", daemon.CommandSubdomain, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := queryCommand(t, &daemon, strings.ToUpper(name), TypeTXT)
+	if len(response.Answers) != 1 || response.Answers[0].TTL != 0 ||
+		strings.Join(getTXTStrings(response.Answers[0].Data), "|") != "0/1|hi" {
+		t.Fatalf("%+v", response)
+	}
+	// Query log must not reveal PIN
+	if latest := LatestQueries.GetLatest(1); latest[0].Name != "cmd.example.com" || latest[0].Result != QueryResultCommand {
+		t.Fatal(latest)
+	}
+	// Bad PIN
+	name, _ = EncodeCommandQueryName("badpin .s echo hi", daemon.CommandSubdomain, 0)
+	if response = queryCommand(t, &daemon, name, TypeTXT); len(response.Answers) != 1 ||
+		getTXTStrings(response.Answers[0].Data)[1] != bridge.ErrPINAndShortcutNotFound.Error() {
+		t.Fatalf("%+v", response)
+	}
+
+	// Retrieve long output chunk by chunk
+	name, _ = EncodeCommandQueryName("verysecret .s seq 1 200", daemon.CommandSubdomain, 0)
+	response = queryCommand(t, &daemon, name, TypeTXT)
+	if len(response.Answers) != 1 {
+		t.Fatalf("%+v", response)
+	}
+	numChunks, err := strconv.Atoi(strings.Split(getTXTStrings(response.Answers[0].Data)[0], "/")[1])
+	if err != nil || numChunks != 4 {
+		t.Fatal(numChunks, err)
+	}
+	output := getTXTStrings(response.Answers[0].Data)[1]
+	for i := 1; i < numChunks; i++ {
+		name, _ = EncodeCommandQueryName("verysecret .s seq 1 200", daemon.CommandSubdomain, i)
+		response = queryCommand(t, &daemon, name, TypeTXT)
+		texts := getTXTStrings(response.Answers[0].Data)
+		if texts[0] != strconv.Itoa(i)+"/4" || len(texts[1]) > CommandChunkSize {
+			t.Fatal(texts)
+		}
+		output += texts[1]
+	}
+	var expected []string
+	for i := 1; i <= 200; i++ {
+		expected = append(expected, strconv.Itoa(i))
+	}
+	if output != strings.Join(expected, "\n") {
+		t.Fatal(output)
+	}
+	// Chunk number out of range
+	name, _ = EncodeCommandQueryName("verysecret .s seq 1 200", daemon.CommandSubdomain, 4)
+	if response = queryCommand(t, &daemon, name, TypeTXT); response.Rcode() != RcodeNXDomain || len(response.Answers) != 0 {
+		t.Fatalf("%+v", response)
+	}
+	// Other record types have no answer
+	if response = queryCommand(t, &daemon, name, TypeA); response.Rcode() != RcodeNoError || len(response.Answers) != 0 {
+		t.Fatalf("%+v", response)
+	}
+	// Bad encoding
+	if response = queryCommand(t, &daemon, "0.1.cmd.example.com", TypeTXT); response.Rcode() != RcodeNXDomain {
+		t.Fatalf("%+v", response)
+	}
+	// Command does not fit in domain name
+	if _, err := EncodeCommandQueryName("verysecret .s echo "+strings.Repeat("a", 200), daemon.CommandSubdomain, 0); err == nil {
+		t.Fatal("did not error")
+	}
+
+	// Each command execution counts toward rate limit
+	for i := 0; i < 10; i++ {
+		name, _ = EncodeCommandQueryName("verysecret .s echo "+strconv.Itoa(i), daemon.CommandSubdomain, 0)
+		response = queryCommand(t, &daemon, name, TypeTXT)
+	}
+	if texts := getTXTStrings(response.Answers[0].Data); texts[1] != "rate limit exceeded" {
+		t.Fatal(texts)
+	}
+}
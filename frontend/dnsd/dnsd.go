@@ -2,12 +2,18 @@ package dnsd
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/HouzuoGuo/laitos/acme"
 	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/feature"
+	"github.com/HouzuoGuo/laitos/frontend/common"
 	"github.com/HouzuoGuo/laitos/global"
-	"github.com/HouzuoGuo/laitos/httpclient"
+	"io"
+	"io/ioutil"
 	"net"
 	"strings"
 	"sync"
@@ -22,6 +28,7 @@ const (
 	BlacklistUpdateIntervalSec = 7200 // Update ad-server blacklist at this interval
 	MinNameQuerySize           = 14   // If a query packet is shorter than this length, it cannot possibly be a name query.
 	PublicIPRefreshIntervalSec = 1800 // PublicIPRefreshIntervalSec is how often the program places its latest public IP address into array of IPs that may query the server.
+	MinSecureTokenLength       = 7    // MinSecureTokenLength is the minimum length of tokens that authorise DNS-over-TLS/HTTPS clients.
 	MVPSLicense                = `Disclaimer: this file is free to use for personal use only. Furthermore it is NOT permitted to ` +
 		`copy any of the contents or host on any other site without permission or meeting the full criteria of the below license ` +
 		` terms. This work is licensed under the Creative Commons Attribution-NonCommercial-ShareAlike License. ` +
@@ -55,15 +62,60 @@ type DNSD struct {
 	TCPForwarder string       `json:"TCPForwarder"` // Forward TCP DNS queries to this address (IP:Port)
 	TCPListener  net.Listener `json:"-"`            // Once TCP daemon is started, this is its listener.
 
+	ForwardRules []ForwardRule `json:"ForwardRules"` // (Optional) forward queries of these domain suffixes to dedicated forwarders instead of UDPForwarder and TCPForwarder.
+
+	TLSPort         int                 `json:"TLSPort"`         // (Optional) DNS-over-TLS port to listen on, usually 853
+	TLSClientCAPath string              `json:"TLSClientCAPath"` // (Optional) authorise DNS-over-TLS clients that present a certificate signed by this CA, DNS-over-TLS requires it.
+	TLSCertPath     string              `json:"-"`               // DNS-over-TLS certificate, borrowed from HTTP daemon
+	TLSKeyPath      string              `json:"-"`               // DNS-over-TLS certificate key, borrowed from HTTP daemon
+	CertManager     *acme.CertManager   `json:"-"`               // DNS-over-TLS certificate obtained via ACME, borrowed from HTTP daemon in place of certificate and key
+	TLSConfig       *tls.Config         `json:"-"`               // TLS configuration assembled from certificate, key, and client CA
+	TLSListener     net.Listener        `json:"-"`               // Once DNS-over-TLS daemon is started, this is its listener.
+	SecureTokens    []string            `json:"SecureTokens"`    // Authorise DNS-over-HTTPS clients that present any of these tokens in URL path, regardless of their IP.
+	secureTokenHash map[string]struct{} `json:"-"`               // SecureTokens values in map keys
+
+	AuthoritativeZones []Zone       `json:"AuthoritativeZones"` // (Optional) answer authoritatively to anyone for these zones, e.g. the domains that mail daemon receives mails for.
+	LocalRecords       []ZoneRecord `json:"LocalRecords"`       // (Optional) answer these records (names are absolute, e.g. "nas.home") to allowed clients instead of forwarding their queries.
+	localZone          *Zone        `json:"-"`                  // localZone holds local records
+
 	AllowQueryIPPrefixes []string    `json:"AllowQueryIPPrefixes"` // Only allow queries from IP addresses that carry any of the prefixes
 	allowQueryMutex      *sync.Mutex `json:"-"`                    // allowQueryMutex guards against concurrent access to AllowQueryIPPrefixes.
 	allowQueryLastUpdate int64       `json:"-"`                    // allowQueryLastUpdate is the Unix timestamp of the very latest automatic placement of computer's public IP into the array of AllowQueryIPPrefixes.
 
-	PerIPLimit     int                 `json:"PerIPLimit"` // How many times in 10 seconds interval an IP may send DNS request
-	RateLimit      *env.RateLimit      `json:"-"`          // Rate limit counter
-	BlackListMutex *sync.Mutex         `json:"-"`          // Protect against concurrent access to black list
-	BlackList      map[string]struct{} `json:"-"`          // Do not answer to type A queries made toward these domains
-	Logger         global.Logger       `json:"-"`          // Logger
+	BlockListSources   []BlockListSource   `json:"BlockListSources"`   // (Optional) retrieve black list from these sources, by default the lists from PGL and MVPS.
+	BlockListCachePath string              `json:"BlockListCachePath"` // (Optional) keep the last good black list in this file, so that the daemon still blocks ads after a restart without network.
+	RuntimeEntryPath   string              `json:"RuntimeEntryPath"`   // (Optional) keep run-time allow and deny entries that do not expire in this file, so that they survive a restart.
+	AllowList          []string            `json:"AllowList"`          // (Optional) never block these domains and their sub-domains, even if they are black listed.
+	DenyList           []string            `json:"DenyList"`           // (Optional) always block these domains and their sub-domains in addition to black list.
+	allowListHash      map[string]struct{} `json:"-"`                  // AllowList values in map keys
+	denyListHash       map[string]struct{} `json:"-"`                  // DenyList values in map keys
+
+	DNSSECValidation   bool             `json:"DNSSECValidation"`   // (Optional) validate DNSSEC signatures of forwarded answers, answer SERVFAIL to bogus answers.
+	DNSSECTrustAnchors []string         `json:"DNSSECTrustAnchors"` // (Optional) DS records of DNSSEC trust anchors in zone file format, by default the root zone keys.
+	dnssecValidator    *DNSSECValidator `json:"-"`                  // dnssecValidator validates forwarded answers if DNSSEC validation is enabled.
+
+	RebindingProtection string              `json:"RebindingProtection"` // (Optional) "strip" or "refuse" forwarded answers of private, loopback, and link-local addresses to protect against DNS rebinding.
+	RebindingAllowList  []string            `json:"RebindingAllowList"`  // (Optional) local domains (and their sub-domains) that may resolve to private addresses.
+	rebindingAllowHash  map[string]struct{} `json:"-"`                   // RebindingAllowList values in map keys
+
+	QueryLogPath string `json:"QueryLogPath"` // (Optional) write all queries into this file in JSON, one query per line, the file is rotated when it grows large.
+
+	CommandSubdomain string                    `json:"CommandSubdomain"` // (Optional) run feature commands that arrive in TXT queries for names under this subdomain, e.g. "cmd.example.com".
+	Processor        *common.CommandProcessor  `json:"-"`                // Feature command processor for TXT queries under command subdomain
+	commandMutex     *sync.Mutex               `json:"-"`                // commandMutex guards against concurrent access to commandResults.
+	commandResults   map[string]*commandResult `json:"-"`                // commandResults are the latest command results, keyed by command content.
+
+	PerIPLimit               int                  `json:"PerIPLimit"`               // How many times in 10 seconds interval an IP may send DNS request
+	PerNetblockResponseBytes int                  `json:"PerNetblockResponseBytes"` // (Optional) how many bytes of UDP responses in 10 seconds interval a netblock (IPv4 /24 or IPv6 /56) may receive, by default PerIPLimit*4096.
+	RateLimit                *env.RateLimit       `json:"-"`                        // Rate limit counter
+	ResponseRateLimit        *ResponseRateLimit   `json:"-"`                        // Response rate limit counter of UDP responses
+	BlackListMutex           *sync.Mutex          `json:"-"`                        // Protect against concurrent access to black list, allow list, and deny list
+	BlackList                map[string]struct{}  `json:"-"`                        // Do not answer to type A queries made toward these domains
+	blackListOrigin          map[string]string    `json:"-"`                        // blackListOrigin is the block list source (or cache file) of each black listed name.
+	blackListUpdateTime      time.Time            `json:"-"`                        // blackListUpdateTime is the moment black list was last successfully updated.
+	runtimeAllow             map[string]time.Time `json:"-"`                        // runtimeAllow are allowed names added at run-time, mapped to their expiry time (zero means no expiry).
+	runtimeDeny              map[string]time.Time `json:"-"`                        // runtimeDeny are denied names added at run-time, mapped to their expiry time (zero means no expiry).
+	Logger                   global.Logger        `json:"-"`                        // Logger
 }
 
 // Check configuration and initialise internal states.
@@ -72,7 +124,7 @@ func (dnsd *DNSD) Initialise() error {
 	if dnsd.Address == "" {
 		return errors.New("DNSD.Initialise: listen address must not be empty")
 	}
-	if dnsd.UDPPort < 1 && dnsd.TCPPort < 1 {
+	if dnsd.UDPPort < 1 && dnsd.TCPPort < 1 && dnsd.TLSPort < 1 {
 		return errors.New("DNSD.Initialise: listen port must be greater than 0")
 	}
 	if dnsd.UDPForwarder == "" && dnsd.TCPForwarder == "" {
@@ -89,10 +141,104 @@ func (dnsd *DNSD) Initialise() error {
 			return errors.New("DNSD.Initialise: any allowable IP prefixes must not be empty string")
 		}
 	}
+	ruleSuffixes := make(map[string]struct{})
+	for i := range dnsd.ForwardRules {
+		rule := &dnsd.ForwardRules[i]
+		if err := rule.Initialise(); err != nil {
+			return fmt.Errorf("DNSD.Initialise: %v", err)
+		}
+		if _, exists := ruleSuffixes[rule.Suffix]; exists {
+			return fmt.Errorf("DNSD.Initialise: forward rule \"%s\" is defined more than once", rule.Suffix)
+		}
+		ruleSuffixes[rule.Suffix] = struct{}{}
+	}
+	dnsd.secureTokenHash = make(map[string]struct{})
+	for _, token := range dnsd.SecureTokens {
+		if len(token) < MinSecureTokenLength {
+			return fmt.Errorf("DNSD.Initialise: each secure token must be at least %d characters long", MinSecureTokenLength)
+		}
+		dnsd.secureTokenHash[token] = struct{}{}
+	}
+	zoneOrigins := make(map[string]struct{})
+	for i := range dnsd.AuthoritativeZones {
+		zone := &dnsd.AuthoritativeZones[i]
+		if err := zone.Initialise(true); err != nil {
+			return fmt.Errorf("DNSD.Initialise: %v", err)
+		}
+		if _, exists := zoneOrigins[zone.origin]; exists {
+			return fmt.Errorf("DNSD.Initialise: zone \"%s\" is defined more than once", zone.Origin)
+		}
+		zoneOrigins[zone.origin] = struct{}{}
+	}
+	dnsd.localZone = nil
+	if len(dnsd.LocalRecords) > 0 {
+		dnsd.localZone = &Zone{Records: dnsd.LocalRecords}
+		if err := dnsd.localZone.Initialise(false); err != nil {
+			return fmt.Errorf("DNSD.Initialise: %v", err)
+		}
+	}
+	if dnsd.TLSPort > 0 {
+		if err := dnsd.initialiseTLS(); err != nil {
+			return err
+		}
+	}
+
+	for _, src := range dnsd.BlockListSources {
+		if err := src.Check(); err != nil {
+			return fmt.Errorf("DNSD.Initialise: %v", err)
+		}
+	}
+	dnsd.allowListHash = make(map[string]struct{})
+	for _, name := range dnsd.AllowList {
+		dnsd.allowListHash[strings.ToLower(strings.TrimSpace(name))] = struct{}{}
+	}
+	dnsd.denyListHash = make(map[string]struct{})
+	for _, name := range dnsd.DenyList {
+		dnsd.denyListHash[strings.ToLower(strings.TrimSpace(name))] = struct{}{}
+	}
 
 	dnsd.allowQueryMutex = new(sync.Mutex)
 	dnsd.BlackListMutex = new(sync.Mutex)
 	dnsd.BlackList = make(map[string]struct{})
+	dnsd.blackListOrigin = make(map[string]string)
+	dnsd.runtimeAllow = make(map[string]time.Time)
+	dnsd.runtimeDeny = make(map[string]time.Time)
+	// Start blocking right away using the last good black list
+	if dnsd.BlockListCachePath != "" {
+		cachedNames, err := LoadBlockListCache(dnsd.BlockListCachePath)
+		if err != nil {
+			return fmt.Errorf("DNSD.Initialise: failed to read black list cache - %v", err)
+		}
+		for _, name := range cachedNames {
+			dnsd.BlackList[name] = struct{}{}
+			dnsd.blackListOrigin[name] = dnsd.BlockListCachePath
+		}
+	}
+	if dnsd.RuntimeEntryPath != "" {
+		if err := dnsd.loadRuntimeEntries(); err != nil {
+			return fmt.Errorf("DNSD.Initialise: failed to read run-time entries - %v", err)
+		}
+	}
+	if err := dnsd.initialiseRebinding(); err != nil {
+		return err
+	}
+	if dnsd.DNSSECValidation {
+		if err := dnsd.initialiseDNSSEC(); err != nil {
+			return err
+		}
+	}
+	dnsd.CommandSubdomain = strings.Trim(strings.ToLower(dnsd.CommandSubdomain), ".")
+	if dnsd.CommandSubdomain != "" {
+		if dnsd.Processor == nil {
+			return errors.New("DNSD.Initialise: command subdomain requires a command processor")
+		}
+		dnsd.Processor.SetLogger(dnsd.Logger)
+		if errs := dnsd.Processor.IsSaneForInternet(); len(errs) > 0 {
+			return fmt.Errorf("DNSD.Initialise: %+v", errs)
+		}
+	}
+	dnsd.commandMutex = new(sync.Mutex)
+	dnsd.commandResults = make(map[string]*commandResult)
 
 	dnsd.RateLimit = &env.RateLimit{
 		MaxCount: dnsd.PerIPLimit,
@@ -100,27 +246,30 @@ func (dnsd *DNSD) Initialise() error {
 		Logger:   dnsd.Logger,
 	}
 	dnsd.RateLimit.Initialise()
+	if dnsd.PerNetblockResponseBytes < 1 {
+		dnsd.PerNetblockResponseBytes = dnsd.PerIPLimit * EDNSBufferSize
+	}
+	dnsd.ResponseRateLimit = &ResponseRateLimit{
+		MaxBytes: dnsd.PerNetblockResponseBytes,
+		UnitSecs: RateLimitIntervalSec,
+		Logger:   dnsd.Logger,
+	}
+	dnsd.ResponseRateLimit.Initialise()
 	// Create a number of forwarder queues to handle incoming UDP DNS queries
 	numQueues := dnsd.PerIPLimit / NumQueueRatio
 	dnsd.UDPForwarderConns = make([]net.Conn, numQueues)
 	dnsd.UDPForwarderQueues = make([]chan *UDPQuery, numQueues)
 	dnsd.UDPBlackHoleQueues = make([]chan *UDPQuery, numQueues)
+	if _, err := net.ResolveUDPAddr("udp", dnsd.UDPForwarder); err != nil {
+		return fmt.Errorf("DNSD.Initialise: failed to resolve address - %v", err)
+	}
 	for i := 0; i < numQueues; i++ {
-		forwarderAddr, err := net.ResolveUDPAddr("udp", dnsd.UDPForwarder)
-		if err != nil {
-			return fmt.Errorf("DNSD.Initialise: failed to resolve address - %v", err)
-		}
-		forwarderConn, err := net.DialTimeout("udp", forwarderAddr.String(), IOTimeoutSec*time.Second)
-		if err != nil {
-			return fmt.Errorf("DNSD.Initialise: failed to connect to forwarder - %v", err)
-		}
-		dnsd.UDPForwarderConns[i] = forwarderConn
 		dnsd.UDPForwarderQueues[i] = make(chan *UDPQuery, 16) // there really is no need for a deeper queue
 		dnsd.UDPBlackHoleQueues[i] = make(chan *UDPQuery, 4)  // there is also no need for a deeper queue here
 	}
 	// TCP queries are not handled by queues
-	// Always allow server to query itself via public IP
-	dnsd.allowMyPublicIP()
+	// Forwarder connections, query log file, and public IP are taken care of by StartAndBlock, so that a daemon that is
+	// initialised only to validate configuration leaves no trace.
 	return nil
 }
 
@@ -170,56 +319,218 @@ func (dnsd *DNSD) checkAllowClientIP(clientIP string) bool {
 	return false
 }
 
-// Download ad-servers list from pgl.yoyo.org and return those domain names.
-func (dnsd *DNSD) GetAdBlacklistPGL() ([]string, error) {
-	yoyo := "https://pgl.yoyo.org/adservers/serverlist.php?hostformat=nohtml&showintro=0&mimetype=plaintext"
-	resp, err := httpclient.DoHTTP(httpclient.Request{TimeoutSec: 30}, yoyo)
+/*
+ReplaceAllowQueryIPPrefixes replaces the IP prefixes that are allowed to query the server, usually by those of a freshly
+loaded configuration. The computer's public IP will be allowed again upon the next query.
+*/
+func (dnsd *DNSD) ReplaceAllowQueryIPPrefixes(prefixes []string) {
+	dnsd.allowQueryMutex.Lock()
+	defer dnsd.allowQueryMutex.Unlock()
+	dnsd.AllowQueryIPPrefixes = append([]string{}, prefixes...)
+	dnsd.allowQueryLastUpdate = 0
+}
+
+// initialiseTLS reads DNS-over-TLS certificate, key, and client CA, and then assembles TLS configuration.
+func (dnsd *DNSD) initialiseTLS() error {
+	if (dnsd.TLSCertPath == "" || dnsd.TLSKeyPath == "") && dnsd.CertManager == nil {
+		return errors.New("DNSD.Initialise: DNS-over-TLS requires HTTP daemon's TLS certificate and key")
+	}
+	// Server name indication travels in clear text, hence DNS-over-TLS clients cannot present a secret token in it.
+	if dnsd.TLSClientCAPath == "" {
+		return errors.New("DNSD.Initialise: DNS-over-TLS requires client CA to authorise clients")
+	}
+	if dnsd.TLSCertPath == "" {
+		dnsd.TLSConfig = &tls.Config{GetCertificate: dnsd.CertManager.GetCertificate}
+	} else {
+		cert, err := tls.LoadX509KeyPair(dnsd.TLSCertPath, dnsd.TLSKeyPath)
+		if err != nil {
+			return fmt.Errorf("DNSD.Initialise: failed to read TLS certificate - %v", err)
+		}
+		dnsd.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	caPEM, err := ioutil.ReadFile(dnsd.TLSClientCAPath)
+	if err != nil {
+		return fmt.Errorf("DNSD.Initialise: failed to read TLS client CA - %v", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPEM) {
+		return errors.New("DNSD.Initialise: TLS client CA file does not contain a PEM certificate")
+	}
+	dnsd.TLSConfig.ClientCAs = caPool
+	dnsd.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+/*
+CheckSecureClient returns true only if a DNS-over-TLS or DNS-over-HTTPS client presents a valid secure token, or has
+presented a certificate verified against client CA. Source IP of the client is irrelevant.
+*/
+func (dnsd *DNSD) CheckSecureClient(token string, connState *tls.ConnectionState) bool {
+	if token != "" {
+		if _, found := dnsd.secureTokenHash[token]; found {
+			return true
+		}
+	}
+	return connState != nil && len(connState.VerifiedChains) > 0
+}
+
+/*
+ProcessQuery answers a DNS query packet that does not carry the length prefix. Queries under command subdomain run
+feature commands, queries of authoritative zones and local records are answered from zone data. If the queried name is
+black listed, the answer will be a black hole; if a forward rule applies to the name, the query is forwarded to the
+rule's forwarders over TCP; otherwise, the query is forwarded to TCP forwarder (or UDP forwarder if TCP forwarder is
+absent). The forwarder's response is returned, and the response does not carry length prefix either.
+Untrusted clients may only query authoritative zones and command subdomain, a nil response is returned to them for
+other queries. The caller is responsible for checking the client against rate limit and determining whether it is
+trusted.
+*/
+func (dnsd *DNSD) ProcessQuery(functionName, clientIP string, isTrusted bool, queryNoLength []byte) ([]byte, error) {
+	beginTime := time.Now()
+	if query := dnsd.commandQuery(queryNoLength); query != nil {
+		response := dnsd.AnswerCommand(functionName, clientIP, query)
+		dnsd.logQuery(clientIP, queryNoLength, QueryResultCommand, "", beginTime)
+		return response, nil
+	}
+	if response := dnsd.AnswerFromZones(functionName, clientIP, isTrusted, queryNoLength); response != nil {
+		dnsd.logQuery(clientIP, queryNoLength, QueryResultZone, "", beginTime)
+		return response, nil
+	}
+	if !isTrusted {
+		dnsd.Logger.Warningf(functionName, clientIP, nil, "client IP is not allowed to query")
+		dnsd.logQuery(clientIP, queryNoLength, QueryResultRefused, "", beginTime)
+		return nil, nil
+	}
+	domainName := ExtractDomainName(queryNoLength)
+	if len(domainName) == 0 {
+		// If I cannot figure out what domain is from the query, simply forward it without much concern.
+		dnsd.Logger.Printf(functionName, clientIP, nil, "handle non-name query")
+	} else if dnsd.NamesAreBlackListed(domainName) {
+		dnsd.Logger.Printf(functionName, clientIP, nil, "handle black-listed domain \"%s\"", domainName[0])
+		dnsd.logQuery(clientIP, queryNoLength, QueryResultBlocked, "", beginTime)
+		return RespondWith0(queryNoLength), nil
+	} else {
+		dnsd.Logger.Printf(functionName, clientIP, nil, "handle domain \"%s\"", domainName[0])
+	}
+	if rule := dnsd.forwardRuleOf(queryNoLength); rule != nil {
+		response, forwarder, err := rule.Forward(queryNoLength, true)
+		if err != nil {
+			dnsd.logQuery(clientIP, queryNoLength, QueryResultFailed, forwarder, beginTime)
+			return nil, err
+		}
+		response = dnsd.checkRebinding(functionName, clientIP, response)
+		dnsd.logQuery(clientIP, queryNoLength, QueryResultForwarded, forwarder, beginTime)
+		return response, nil
+	}
+	upstream := dnsd.TCPForwarder
+	if upstream == "" {
+		upstream = dnsd.UDPForwarder
+	}
+	forwardQuery, clientQuery := dnsd.prepareForwardQuery(queryNoLength)
+	response, err := dnsd.ForwardQuery(forwardQuery)
+	if err != nil {
+		dnsd.logQuery(clientIP, queryNoLength, QueryResultFailed, upstream, beginTime)
+		return nil, err
+	}
+	result := QueryResultForwarded
+	if clientQuery != nil {
+		var status string
+		if response, status = dnsd.validateResponse(functionName, clientIP, clientQuery, response, false); status == DNSSECBogus {
+			result = QueryResultBogus
+		}
+	}
+	response = dnsd.checkRebinding(functionName, clientIP, response)
+	dnsd.logQuery(clientIP, queryNoLength, result, upstream, beginTime)
+	return response, nil
+}
+
+/*
+ForwardQuery sends a query packet (without length prefix) to TCP forwarder and returns its response (without length
+prefix). If TCP forwarder is not configured, the query goes to UDP forwarder instead.
+*/
+func (dnsd *DNSD) ForwardQuery(queryNoLength []byte) ([]byte, error) {
+	if dnsd.TCPForwarder == "" {
+		return forwardQueryUDP(dnsd.UDPForwarder, queryNoLength, IOTimeoutSec*time.Second)
+	}
+	return forwardQueryTCP(dnsd.TCPForwarder, queryNoLength, IOTimeoutSec*time.Second)
+}
+
+// forwardQueryUDP sends a query packet to the forwarder over UDP and returns its response.
+func forwardQueryUDP(forwarder string, queryNoLength []byte, timeout time.Duration) ([]byte, error) {
+	myForwarder, err := net.DialTimeout("udp", forwarder, timeout)
 	if err != nil {
 		return nil, err
 	}
-	if statusErr := resp.Non2xxToError(); statusErr != nil {
-		return nil, statusErr
+	defer myForwarder.Close()
+	myForwarder.SetDeadline(time.Now().Add(timeout))
+	if _, err := myForwarder.Write(queryNoLength); err != nil {
+		return nil, err
 	}
-	lines := strings.Split(string(resp.Body), "\n")
-	if len(lines) < 100 {
-		return nil, fmt.Errorf("DNSD.GetAdBlacklistPGL: PGL's ad-server list is suspiciously short at only %d lines", len(lines))
+	respBuf := make([]byte, MaxPacketSize)
+	respLen, err := myForwarder.Read(respBuf)
+	if err != nil {
+		return nil, err
 	}
-	names := make([]string, 0, len(lines))
-	for _, line := range lines {
-		names = append(names, strings.TrimSpace(line))
+	return respBuf[:respLen], nil
+}
+
+// forwardQueryTCP sends a query packet (without length prefix) to the forwarder over TCP and returns its response.
+func forwardQueryTCP(forwarder string, queryNoLength []byte, timeout time.Duration) ([]byte, error) {
+	myForwarder, err := net.DialTimeout("tcp", forwarder, timeout)
+	if err != nil {
+		return nil, err
 	}
-	return names, nil
+	defer myForwarder.Close()
+	myForwarder.SetDeadline(time.Now().Add(timeout))
+	if err := WriteTCPPacket(myForwarder, queryNoLength); err != nil {
+		return nil, err
+	}
+	return ReadTCPPacket(myForwarder)
 }
 
-// Download ad-servers list from winhelp2002.mvps.org and return those domain names.
-func (dnsd *DNSD) GetAdBlacklistMVPS() ([]string, error) {
-	yoyo := "http://winhelp2002.mvps.org/hosts.txt"
-	resp, err := httpclient.DoHTTP(httpclient.Request{TimeoutSec: 30}, yoyo)
+// ReadTCPPacket reads a length-prefixed DNS packet from TCP (or TLS) stream and returns the packet without length prefix.
+func ReadTCPPacket(conn io.Reader) ([]byte, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return nil, err
+	}
+	packetLen := int(lenBuf[0])*256 + int(lenBuf[1])
+	if packetLen > MaxPacketSize || packetLen < 1 {
+		return nil, fmt.Errorf("DNSD.ReadTCPPacket: bad packet length %d", packetLen)
+	}
+	packet := make([]byte, packetLen)
+	if _, err := io.ReadFull(conn, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// WriteTCPPacket writes length prefix and then the DNS packet into TCP (or TLS) stream.
+func WriteTCPPacket(conn io.Writer, packetNoLength []byte) error {
+	packet := make([]byte, 2+len(packetNoLength))
+	packet[0] = byte(len(packetNoLength) / 256)
+	packet[1] = byte(len(packetNoLength) % 256)
+	copy(packet[2:], packetNoLength)
+	_, err := conn.Write(packet)
+	return err
+}
+
+// Download ad-servers list from pgl.yoyo.org and return those domain names.
+func (dnsd *DNSD) GetAdBlacklistPGL() ([]string, error) {
+	names, err := PGLBlockListSource.GetBlockList()
 	if err != nil {
 		return nil, err
 	}
-	if statusErr := resp.Non2xxToError(); statusErr != nil {
-		return nil, statusErr
+	if len(names) < 100 {
+		return nil, fmt.Errorf("DNSD.GetAdBlacklistPGL: PGL's ad-server list is suspiciously short at only %d lines", len(names))
 	}
-	// Collect host names from the hosts file content
-	names := make([]string, 0, 16384)
-	for _, line := range strings.Split(string(resp.Body), "\n") {
-		indexZero := strings.Index(line, "0.0.0.0")
-		nameEnd := strings.IndexRune(line, '#')
-		if indexZero == -1 {
-			// Skip lines that do not have a host name
-			continue
-		}
-		if nameEnd == -1 {
-			nameEnd = len(line)
-		}
-		nameBegin := indexZero + len("0.0.0.0")
-		if nameBegin >= nameEnd {
-			// The line looks like # this is a comment 0.0.0.0
+	return names, nil
+}
 
-			continue
-		}
-		names = append(names, strings.TrimSpace(line[nameBegin:nameEnd]))
+// Download ad-servers list from winhelp2002.mvps.org and return those domain names.
+func (dnsd *DNSD) GetAdBlacklistMVPS() ([]string, error) {
+	names, err := MVPSBlockListSource.GetBlockList()
+	if err != nil {
+		return nil, err
 	}
 	if len(names) < 100 {
 		return nil, fmt.Errorf("DNSD.GetAdBlacklistMVPS: MVPS' ad-server list is suspiciously short at only %d lines", len(names))
@@ -302,34 +613,76 @@ func ExtractDomainName(packet []byte) (ret []string) {
 	return
 }
 
+/*
+UpdatedAdBlockLists retrieves black list from all sources. If some sources fail, their entries from the previous black
+list are kept; if all sources fail, the previous black list remains in effect. The new black list is saved into cache
+file.
+*/
 func (dnsd *DNSD) UpdatedAdBlockLists() {
-	pglEntries, pglErr := dnsd.GetAdBlacklistPGL()
-	if pglErr == nil {
-		dnsd.Logger.Printf("GetAdBlacklistPGL", "", nil, "successfully retrieved ad-blacklist with %d entries", len(pglEntries))
-	} else {
-		dnsd.Logger.Warningf("GetAdBlacklistPGL", "", pglErr, "failed to update ad-blacklist")
+	sources := dnsd.BlockListSources
+	if len(sources) == 0 {
+		sources = DefaultBlockListSources
+	}
+	newBlackList := make(map[string]struct{})
+	newOrigin := make(map[string]string)
+	numFailed := 0
+	for _, src := range sources {
+		names, err := src.GetBlockList()
+		if err != nil {
+			numFailed++
+			dnsd.Logger.Warningf("UpdatedAdBlockLists", src.String(), err, "failed to update ad-blacklist")
+			continue
+		}
+		dnsd.Logger.Printf("UpdatedAdBlockLists", src.String(), nil, "successfully retrieved ad-blacklist with %d entries", len(names))
+		if src == MVPSBlockListSource {
+			dnsd.Logger.Printf("UpdatedAdBlockLists", "", nil, "Please comply with the following liences for your usage of http://winhelp2002.mvps.org/hosts.txt: %s", MVPSLicense)
+		}
+		origin := src.String()
+		for _, name := range names {
+			newBlackList[name] = struct{}{}
+			newOrigin[name] = origin
+		}
 	}
-	mvpsEntries, mvpsErr := dnsd.GetAdBlacklistMVPS()
-	if mvpsErr == nil {
-		dnsd.Logger.Printf("GetAdBlacklistMVPS", "", nil, "successfully retrieved ad-blacklist with %d entries", len(mvpsEntries))
-		dnsd.Logger.Printf("GetAdBlacklistMVPS", "", nil, "Please comply with the following liences for your usage of http://winhelp2002.mvps.org/hosts.txt: %s", MVPSLicense)
-	} else {
-		dnsd.Logger.Warningf("GetAdBlacklistMVPS", "", mvpsErr, "failed to update ad-blacklist")
+	if numFailed == len(sources) {
+		dnsd.Logger.Warningf("UpdatedAdBlockLists", "", nil, "all sources failed, ad-blacklist remains at %d entries", len(dnsd.BlackList))
+		return
 	}
 	dnsd.BlackListMutex.Lock()
-	dnsd.BlackList = make(map[string]struct{})
-	if pglErr == nil {
-		for _, name := range pglEntries {
-			dnsd.BlackList[name] = struct{}{}
+	if numFailed > 0 {
+		// Keep blocking the names that came from failed sources
+		for name := range dnsd.BlackList {
+			if _, exists := newBlackList[name]; !exists {
+				newBlackList[name] = struct{}{}
+				newOrigin[name] = dnsd.blackListOrigin[name]
+			}
 		}
 	}
-	if mvpsErr == nil {
-		for _, name := range mvpsEntries {
-			dnsd.BlackList[name] = struct{}{}
+	dnsd.BlackList = newBlackList
+	dnsd.blackListOrigin = newOrigin
+	dnsd.blackListUpdateTime = time.Now()
+	dnsd.BlackListMutex.Unlock()
+	dnsd.Logger.Printf("UpdatedAdBlockLists", "", nil, "ad-blacklist now has %d entries", len(newBlackList))
+	if dnsd.BlockListCachePath != "" {
+		if err := SaveBlockListCache(dnsd.BlockListCachePath, newBlackList); err != nil {
+			dnsd.Logger.Warningf("UpdatedAdBlockLists", dnsd.BlockListCachePath, err, "failed to save ad-blacklist cache")
+		}
+	}
+}
+
+/*
+KeepAdBlockListsUpdated updates ad-block black list right away, and then at regular interval until a value arrives
+from the stop channel. If the channel is nil, the updates carry on indefinitely.
+*/
+func (dnsd *DNSD) KeepAdBlockListsUpdated(stop chan bool) {
+	dnsd.UpdatedAdBlockLists()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(BlacklistUpdateIntervalSec * time.Second):
+			dnsd.UpdatedAdBlockLists()
 		}
 	}
-	dnsd.BlackListMutex.Unlock()
-	dnsd.Logger.Printf("UpdatedAdBlockLists", "", nil, "ad-blacklist now has %d entries", len(dnsd.BlackList))
 }
 
 /*
@@ -338,21 +691,20 @@ Start DNS daemon on configured TCP and UDP ports. Block caller until both listen
 If either TCP or UDP port fails to listen, all listeners are closed and an error is returned.
 */
 func (dnsd *DNSD) StartAndBlock() error {
-	// Keep updating ad-block black list in background
-	stopAdBlockUpdater := make(chan bool, 1)
-	go func() {
-		dnsd.UpdatedAdBlockLists()
-		for {
-			select {
-			case <-stopAdBlockUpdater:
-				return
-			case <-time.After(BlacklistUpdateIntervalSec * time.Second):
-				dnsd.UpdatedAdBlockLists()
-			}
+	if dnsd.QueryLogPath != "" {
+		if err := LatestQueries.SetFilePath(dnsd.QueryLogPath); err != nil {
+			return fmt.Errorf("DNSD.StartAndBlock: failed to open query log file - %v", err)
 		}
-	}()
+	}
+	// Always allow server to query itself via public IP
+	dnsd.allowMyPublicIP()
+	// Let feature commands manage black list of the running daemon
+	feature.RunningDNSD = dnsd
+	// Keep updating ad-block black list in background
+	stopAdBlockUpdater := make(chan bool, 3)
+	go dnsd.KeepAdBlockListsUpdated(stopAdBlockUpdater)
 	numListeners := 0
-	errChan := make(chan error, 2)
+	errChan := make(chan error, 3)
 	if dnsd.UDPPort != 0 {
 		numListeners++
 		go func() {
@@ -369,8 +721,16 @@ func (dnsd *DNSD) StartAndBlock() error {
 			stopAdBlockUpdater <- true
 		}()
 	}
+	if dnsd.TLSPort != 0 {
+		numListeners++
+		go func() {
+			err := dnsd.StartAndBlockTLS()
+			errChan <- err
+			stopAdBlockUpdater <- true
+		}()
+	}
 	if numListeners == 0 {
-		return fmt.Errorf("DNSD.StartAndBlock: neither UDP nor TCP listen port is defined, the daemon will not start.")
+		return fmt.Errorf("DNSD.StartAndBlock: none of UDP, TCP, or TLS listen port is defined, the daemon will not start.")
 	}
 	for i := 0; i < numListeners; i++ {
 		if err := <-errChan; err != nil {
@@ -393,20 +753,23 @@ func (dnsd *DNSD) Stop() {
 			dnsd.Logger.Warningf("Stop", "", err, "failed to close UDP listener")
 		}
 	}
+	if listener := dnsd.TLSListener; listener != nil {
+		if err := listener.Close(); err != nil {
+			dnsd.Logger.Warningf("Stop", "", err, "failed to close TLS listener")
+		}
+		dnsd.TLSListener = nil
+	}
 }
 
-// Return true if any of the input domain names is black listed.
+/*
+Return true if any of the input domain names is black listed or on deny list. Allow list takes precedence over both of
+them, hence the function returns false if any of the names is on allow list.
+*/
 func (dnsd *DNSD) NamesAreBlackListed(names []string) bool {
 	dnsd.BlackListMutex.Lock()
 	defer dnsd.BlackListMutex.Unlock()
-	var blacklisted bool
-	for _, name := range names {
-		_, blacklisted = dnsd.BlackList[name]
-		if blacklisted {
-			return true
-		}
-	}
-	return false
+	blocked, _, _ := dnsd.matchBlockLists(names)
+	return blocked
 }
 
 var githubComTCPQuery, githubComUDPQuery []byte // Sample queries for composing test cases
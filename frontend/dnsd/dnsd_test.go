@@ -1,13 +1,60 @@
 package dnsd
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
+// Write a self-signed certificate and its key into temporary files, return paths to the files. The certificate is also its own client CA.
+func writeTestCertificate(t *testing.T) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "*.example.com"},
+		DNSNames:     []string{"*.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = "/tmp/test-laitos-dnsd-cert.pem"
+	keyPath = "/tmp/test-laitos-dnsd-key.pem"
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
 func TestExtractDomainName(t *testing.T) {
 	if name := ExtractDomainName(nil); !reflect.DeepEqual(name, []string{}) {
 		t.Fatal(name)
@@ -75,11 +122,11 @@ func TestDNSD_StartAndBlockUDP(t *testing.T) {
 	if err := daemon.Initialise(); err != nil {
 		t.Fatal(err)
 	}
+	TestUDPQueries(&daemon, t)
 	// If run on Travis, my own IP won't be put into allowed query prefixes.
 	if os.Getenv("TRAVIS") == "" && len(daemon.AllowQueryIPPrefixes) != 2 {
 		t.Fatal("did not put my own IP into prefixes")
 	}
-	TestUDPQueries(&daemon, t)
 }
 
 func TestDNSD_StartAndBlockTCP(t *testing.T) {
@@ -111,9 +158,47 @@ func TestDNSD_StartAndBlockTCP(t *testing.T) {
 	if err := daemon.Initialise(); err != nil {
 		t.Fatal(err)
 	}
+	TestTCPQueries(&daemon, t)
 	// If run on Travis, my own IP won't be put into allowed query prefixes.
 	if os.Getenv("TRAVIS") == "" && len(daemon.AllowQueryIPPrefixes) != 2 {
 		t.Fatal("did not put my own IP into prefixes", daemon.AllowQueryIPPrefixes)
 	}
-	TestTCPQueries(&daemon, t)
+}
+
+func TestDNSD_StartAndBlockTLS(t *testing.T) {
+	certPath, keyPath := writeTestCertificate(t)
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+	daemon := DNSD{
+		Address:              "127.0.0.1",
+		TLSPort:              21853,
+		UDPForwarder:         "8.8.8.8:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+	}
+	if err := daemon.Initialise(); err == nil || strings.Index(err.Error(), "certificate and key") == -1 {
+		t.Fatal(err)
+	}
+	daemon.TLSCertPath = certPath
+	daemon.TLSKeyPath = keyPath
+	if err := daemon.Initialise(); err == nil || strings.Index(err.Error(), "client CA") == -1 {
+		t.Fatal(err)
+	}
+	daemon.TLSClientCAPath = certPath
+	daemon.SecureTokens = []string{"short"}
+	if err := daemon.Initialise(); err == nil || strings.Index(err.Error(), "at least") == -1 {
+		t.Fatal(err)
+	}
+	daemon.SecureTokens = []string{"verysecrettoken"}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if !daemon.CheckSecureClient("verysecrettoken", nil) || daemon.CheckSecureClient("bad-token", nil) || daemon.CheckSecureClient("", nil) {
+		t.Fatal("secure client check failure")
+	}
+	clientCert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	TestTLSQueries(&daemon, clientCert, t)
 }
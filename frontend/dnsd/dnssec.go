@@ -0,0 +1,1095 @@
+package dnsd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSSEC algorithms and DS digest types understood by the validator.
+const (
+	AlgorithmRSASHA256       = 8
+	AlgorithmRSASHA512       = 10
+	AlgorithmECDSAP256SHA256 = 13
+	AlgorithmECDSAP384SHA384 = 14
+	DigestSHA1               = 1
+	DigestSHA256             = 2
+	DigestSHA384             = 4
+)
+
+const (
+	DNSKEYFlagZone     = 1 << 8  // DNSKEYFlagZone marks a key that signs zone data.
+	NSEC3FlagOptOut    = 1       // NSEC3FlagOptOut marks an NSEC3 record that may cover unsigned delegations.
+	EDNSFlagDO         = 1 << 15 // EDNSFlagDO is the "DNSSEC OK" bit in TTL of OPT record.
+	EDNSBufferSize     = 4096    // EDNSBufferSize is the UDP payload size advertised in queries made toward forwarder.
+	MaxUDPResponseSize = 512     // MaxUDPResponseSize is the size limit of UDP response to clients that do not use EDNS.
+	MaxNSEC3Iterations = 150     // MaxNSEC3Iterations is the number of NSEC3 hash iterations beyond which the zone is treated as insecure.
+	DNSSECMaxCacheSec  = 3600    // DNSSECMaxCacheSec caps the duration for which keys and delegations are cached.
+)
+
+// Outcomes of DNSSEC validation.
+const (
+	DNSSECSecure   = "secure"   // DNSSECSecure means that all records are signed along an unbroken chain of trust.
+	DNSSECInsecure = "insecure" // DNSSECInsecure means that some records belong to a zone that is proven to be unsigned.
+	DNSSECBogus    = "bogus"    // DNSSECBogus means that records fail validation, they must not reach client.
+)
+
+// DefaultTrustAnchors are DS records of root zone key-signing keys (KSK-2017 and KSK-2024), used when no anchor is configured.
+var DefaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// NSEC3Encoding is the base32 encoding (extended hex alphabet, no padding) of hashed owner names in NSEC3 records.
+var NSEC3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// RRSIG is the decoded data of an RRSIG record.
+type RRSIG struct {
+	TypeCovered  uint16
+	Algorithm    uint8
+	Labels       uint8
+	OriginalTTL  uint32
+	Expiration   uint32
+	Inception    uint32
+	KeyTag       uint16
+	SignerName   string // SignerName is the lower case zone name without trailing full-stop.
+	Signature    []byte
+	signedPrefix []byte // signedPrefix is the RRSIG data without signature, it begins the data covered by signature.
+}
+
+// ParseRRSIG decodes data of an RRSIG record.
+func ParseRRSIG(data []byte) (sig RRSIG, err error) {
+	if len(data) < 19 {
+		return sig, ErrMalformedMessage
+	}
+	sig.TypeCovered = binary.BigEndian.Uint16(data[0:2])
+	sig.Algorithm = data[2]
+	sig.Labels = data[3]
+	sig.OriginalTTL = binary.BigEndian.Uint32(data[4:8])
+	sig.Expiration = binary.BigEndian.Uint32(data[8:12])
+	sig.Inception = binary.BigEndian.Uint32(data[12:16])
+	sig.KeyTag = binary.BigEndian.Uint16(data[16:18])
+	signer, offset, err := readName(data, 18)
+	if err != nil {
+		return
+	}
+	sig.SignerName = strings.ToLower(signer)
+	sig.Signature = data[offset:]
+	sig.signedPrefix = append(append([]byte{}, data[:18]...), PackName(sig.SignerName)...)
+	return
+}
+
+// KeyTag calculates the key tag of DNSKEY record data.
+func KeyTag(dnskey []byte) uint16 {
+	var sum uint32
+	for i, octet := range dnskey {
+		if i&1 == 0 {
+			sum += uint32(octet) << 8
+		} else {
+			sum += uint32(octet)
+		}
+	}
+	sum += sum >> 16 & 0xffff
+	return uint16(sum)
+}
+
+// splitLabels returns labels of a domain name, the root domain (empty name) does not have a label.
+func splitLabels(name string) []string {
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// isSubdomain returns true if the name is identical to the zone or is a sub-domain of the zone.
+func isSubdomain(name, zone string) bool {
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// canonicalRecordData returns the record data in which embedded domain names are in lower case (RFC 4034 section 6.2).
+func canonicalRecordData(rr ResourceRecord) []byte {
+	var begin, end int
+	switch rr.Type {
+	case TypeNS, TypeCNAME, TypePTR:
+		begin, end = 0, len(rr.Data)
+	case TypeMX:
+		begin, end = 2, len(rr.Data)
+	case TypeSRV:
+		begin, end = 6, len(rr.Data)
+	case TypeSOA:
+		begin, end = 0, len(rr.Data)-20
+	default:
+		return rr.Data
+	}
+	if begin > end || end < 0 {
+		return rr.Data
+	}
+	// Label length never falls into the range of upper case letters
+	return append(append(append([]byte{}, rr.Data[:begin]...), bytes.ToLower(rr.Data[begin:end])...), rr.Data[end:]...)
+}
+
+// SignedData returns the data covered by the signature of the record set, in canonical form (RFC 4034 section 3.1.8.1).
+func SignedData(rrset []ResourceRecord, sig RRSIG) []byte {
+	owner := strings.ToLower(rrset[0].Name)
+	// Reconstruct the wildcard owner of records that are expanded from wildcard
+	if labels := splitLabels(owner); int(sig.Labels) < len(labels) {
+		owner = strings.Join(append([]string{"*"}, labels[len(labels)-int(sig.Labels):]...), ".")
+	}
+	ownerWire := PackName(owner)
+	datas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		datas = append(datas, canonicalRecordData(rr))
+	}
+	sort.Slice(datas, func(i, j int) bool {
+		return bytes.Compare(datas[i], datas[j]) < 0
+	})
+	signed := append([]byte{}, sig.signedPrefix...)
+	for i, data := range datas {
+		// Duplicated records are only signed once
+		if i > 0 && bytes.Equal(data, datas[i-1]) {
+			continue
+		}
+		signed = append(signed, ownerWire...)
+		signed = append(signed, byte(rrset[0].Type>>8), byte(rrset[0].Type), byte(rrset[0].Class>>8), byte(rrset[0].Class))
+		signed = append(signed, byte(sig.OriginalTTL>>24), byte(sig.OriginalTTL>>16), byte(sig.OriginalTTL>>8), byte(sig.OriginalTTL))
+		signed = append(signed, byte(len(data)>>8), byte(len(data)))
+		signed = append(signed, data...)
+	}
+	return signed
+}
+
+// verifySignature verifies the signature over signed data using the public key of DNSKEY record data.
+func verifySignature(dnskey []byte, signature, signed []byte) error {
+	if len(dnskey) < 5 {
+		return ErrMalformedMessage
+	}
+	publicKey := dnskey[4:]
+	switch dnskey[3] {
+	case AlgorithmRSASHA256, AlgorithmRSASHA512:
+		hashFunc := crypto.SHA256
+		if dnskey[3] == AlgorithmRSASHA512 {
+			hashFunc = crypto.SHA512
+		}
+		// Public key is exponent length, exponent, and modulus
+		expLen, offset := int(publicKey[0]), 1
+		if expLen == 0 {
+			if len(publicKey) < 3 {
+				return ErrMalformedMessage
+			}
+			expLen, offset = int(binary.BigEndian.Uint16(publicKey[1:3])), 3
+		}
+		if expLen == 0 || expLen > 4 || len(publicKey) <= offset+expLen {
+			return errors.New("unsupported RSA public key")
+		}
+		exponent := 0
+		for _, octet := range publicKey[offset : offset+expLen] {
+			exponent = exponent<<8 | int(octet)
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(publicKey[offset+expLen:]), E: exponent}
+		hasher := hashFunc.New()
+		hasher.Write(signed)
+		return rsa.VerifyPKCS1v15(key, hashFunc, hasher.Sum(nil), signature)
+	case AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384:
+		curve, size, hasher := elliptic.P256(), 32, hash.Hash(sha256.New())
+		if dnskey[3] == AlgorithmECDSAP384SHA384 {
+			curve, size, hasher = elliptic.P384(), 48, sha512.New384()
+		}
+		if len(publicKey) != 2*size || len(signature) != 2*size {
+			return ErrMalformedMessage
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(publicKey[:size]),
+			Y:     new(big.Int).SetBytes(publicKey[size:]),
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return errors.New("ECDSA public key is not on curve")
+		}
+		hasher.Write(signed)
+		if !ecdsa.Verify(key, hasher.Sum(nil), new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])) {
+			return errors.New("ECDSA signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %d", dnskey[3])
+}
+
+// isSupportedDS returns true only if the validator understands both algorithm and digest type of DS record data.
+func isSupportedDS(ds []byte) bool {
+	if len(ds) < 5 {
+		return false
+	}
+	switch ds[2] {
+	case AlgorithmRSASHA256, AlgorithmRSASHA512, AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384:
+	default:
+		return false
+	}
+	switch ds[3] {
+	case DigestSHA1, DigestSHA256, DigestSHA384:
+		return true
+	}
+	return false
+}
+
+// DSMatchesKey returns true only if DS record data is the digest of DNSKEY record data owned by the zone.
+func DSMatchesKey(ds []byte, zone string, dnskey []byte) bool {
+	if !isSupportedDS(ds) || len(dnskey) < 4 || binary.BigEndian.Uint16(ds[0:2]) != KeyTag(dnskey) || ds[2] != dnskey[3] {
+		return false
+	}
+	var hasher hash.Hash
+	switch ds[3] {
+	case DigestSHA1:
+		hasher = sha1.New()
+	case DigestSHA256:
+		hasher = sha256.New()
+	case DigestSHA384:
+		hasher = sha512.New384()
+	}
+	hasher.Write(PackName(strings.ToLower(zone)))
+	hasher.Write(dnskey)
+	return bytes.Equal(hasher.Sum(nil), ds[4:])
+}
+
+// VerifyRRSet returns nil only if any of the signatures of the record set is made by any of the zone's keys and is in effect.
+func VerifyRRSet(rrset, sigs, keys []ResourceRecord, zone string) error {
+	if len(rrset) == 0 {
+		return errors.New("empty record set")
+	}
+	now := uint32(time.Now().Unix())
+	ownerLabels := splitLabels(strings.ToLower(rrset[0].Name))
+	if len(ownerLabels) > 0 && ownerLabels[0] == "*" {
+		ownerLabels = ownerLabels[1:]
+	}
+	lastErr := fmt.Errorf("%s %s record does not have a signature made by %s", rrset[0].Name, RecordTypeName(rrset[0].Type), zone)
+	for _, sigRR := range sigs {
+		sig, err := ParseRRSIG(sigRR.Data)
+		if err != nil || sig.TypeCovered != rrset[0].Type || sig.SignerName != zone || int(sig.Labels) > len(ownerLabels) {
+			continue
+		}
+		if now < sig.Inception || now > sig.Expiration {
+			lastErr = fmt.Errorf("signature of %s %s record is not in effect", rrset[0].Name, RecordTypeName(rrset[0].Type))
+			continue
+		}
+		signed := SignedData(rrset, sig)
+		for _, key := range keys {
+			if len(key.Data) < 5 || binary.BigEndian.Uint16(key.Data[0:2])&DNSKEYFlagZone == 0 || key.Data[2] != 3 ||
+				key.Data[3] != sig.Algorithm || KeyTag(key.Data) != sig.KeyTag {
+				continue
+			}
+			if err := verifySignature(key.Data, sig.Signature, signed); err != nil {
+				lastErr = fmt.Errorf("signature of %s %s record is invalid - %v", rrset[0].Name, RecordTypeName(rrset[0].Type), err)
+				continue
+			}
+			return nil
+		}
+	}
+	return lastErr
+}
+
+// NSEC3Hash calculates the hashed owner name (RFC 5155 section 5) using SHA-1, the only hash algorithm defined for NSEC3.
+func NSEC3Hash(name string, salt []byte, iterations int) []byte {
+	hasher := sha1.New()
+	hasher.Write(PackName(strings.ToLower(name)))
+	hasher.Write(salt)
+	digest := hasher.Sum(nil)
+	for i := 0; i < iterations; i++ {
+		hasher.Reset()
+		hasher.Write(digest)
+		hasher.Write(salt)
+		digest = hasher.Sum(nil)
+	}
+	return digest
+}
+
+// compareCanonical compares two domain names in canonical order (RFC 4034 section 6.1), it returns -1, 0, or 1.
+func compareCanonical(a, b string) int {
+	labelsA, labelsB := splitLabels(strings.ToLower(a)), splitLabels(strings.ToLower(b))
+	for i := 1; i <= len(labelsA) && i <= len(labelsB); i++ {
+		if cmp := strings.Compare(labelsA[len(labelsA)-i], labelsB[len(labelsB)-i]); cmp != 0 {
+			return cmp
+		}
+	}
+	switch {
+	case len(labelsA) < len(labelsB):
+		return -1
+	case len(labelsA) > len(labelsB):
+		return 1
+	}
+	return 0
+}
+
+// commonAncestor returns the deepest domain name that encloses both names.
+func commonAncestor(a, b string) string {
+	labelsA, labelsB := splitLabels(a), splitLabels(b)
+	i := 0
+	for i < len(labelsA) && i < len(labelsB) && labelsA[len(labelsA)-1-i] == labelsB[len(labelsB)-1-i] {
+		i++
+	}
+	return strings.Join(labelsA[len(labelsA)-i:], ".")
+}
+
+// wildcardOf returns the wildcard name immediately beneath the domain name.
+func wildcardOf(name string) string {
+	if name == "" {
+		return "*"
+	}
+	return "*." + name
+}
+
+// nsecRecord is the parsed data of an NSEC record.
+type nsecRecord struct {
+	owner string
+	next  string
+	types map[uint16]bool
+}
+
+// parseNSEC parses the data of an NSEC record.
+func parseNSEC(rr ResourceRecord) (ret nsecRecord, err error) {
+	ret.owner = strings.ToLower(rr.Name)
+	var offset int
+	if ret.next, offset, err = readName(rr.Data, 0); err != nil {
+		return
+	}
+	ret.next = strings.ToLower(ret.next)
+	ret.types, err = unpackTypeBitmap(rr.Data[offset:])
+	return
+}
+
+// covers returns true if the name falls strictly between the owner and next name, the last record wraps around to zone apex.
+func (nsec nsecRecord) covers(name string) bool {
+	if compareCanonical(nsec.owner, nsec.next) < 0 {
+		return compareCanonical(nsec.owner, name) < 0 && compareCanonical(name, nsec.next) < 0
+	}
+	return compareCanonical(nsec.owner, name) < 0 || compareCanonical(name, nsec.next) < 0
+}
+
+// nsec3Record is the parsed data of an NSEC3 record, along with the hash decoded from its owner name.
+type nsec3Record struct {
+	flags      byte
+	iterations int
+	salt       []byte
+	ownerHash  []byte
+	nextHash   []byte
+	types      map[uint16]bool
+}
+
+// parseNSEC3 parses the data of an NSEC3 record.
+func parseNSEC3(rr ResourceRecord) (ret nsec3Record, err error) {
+	if len(rr.Data) < 5 || int(rr.Data[4])+6 > len(rr.Data) {
+		return ret, ErrMalformedMessage
+	}
+	ret.flags, ret.iterations = rr.Data[1], int(binary.BigEndian.Uint16(rr.Data[2:4]))
+	saltLen := int(rr.Data[4])
+	ret.salt = rr.Data[5 : 5+saltLen]
+	hashLen := int(rr.Data[5+saltLen])
+	if 6+saltLen+hashLen > len(rr.Data) {
+		return ret, ErrMalformedMessage
+	}
+	ret.nextHash = rr.Data[6+saltLen : 6+saltLen+hashLen]
+	if ret.types, err = unpackTypeBitmap(rr.Data[6+saltLen+hashLen:]); err != nil {
+		return
+	}
+	labels := splitLabels(rr.Name)
+	if len(labels) == 0 {
+		return ret, ErrMalformedMessage
+	}
+	ret.ownerHash, err = NSEC3Encoding.DecodeString(strings.ToUpper(labels[0]))
+	return
+}
+
+// matches returns true if the hash of the name is the owner hash.
+func (nsec3 nsec3Record) matches(name string) bool {
+	return bytes.Equal(nsec3.ownerHash, NSEC3Hash(name, nsec3.salt, nsec3.iterations))
+}
+
+// covers returns true if the hash of the name falls strictly between the owner hash and next hash, the last record wraps around.
+func (nsec3 nsec3Record) covers(name string) bool {
+	hash := NSEC3Hash(name, nsec3.salt, nsec3.iterations)
+	if bytes.Compare(nsec3.ownerHash, nsec3.nextHash) < 0 {
+		return bytes.Compare(nsec3.ownerHash, hash) < 0 && bytes.Compare(hash, nsec3.nextHash) < 0
+	}
+	return bytes.Compare(nsec3.ownerHash, hash) < 0 || bytes.Compare(hash, nsec3.nextHash) < 0
+}
+
+// recordsOf returns the records of the owner name and type, as well as the signatures that cover them.
+func recordsOf(section []ResourceRecord, owner string, recordType uint16) (records, sigs []ResourceRecord) {
+	for _, rr := range section {
+		if strings.ToLower(rr.Name) != owner {
+			continue
+		}
+		if rr.Type == recordType {
+			records = append(records, rr)
+		} else if rr.Type == TypeRRSIG && len(rr.Data) >= 2 && binary.BigEndian.Uint16(rr.Data[0:2]) == recordType {
+			sigs = append(sigs, rr)
+		}
+	}
+	return
+}
+
+// RRSet is a set of records that share owner name and type, along with the signatures that cover them.
+type RRSet struct {
+	Records []ResourceRecord
+	Sigs    []ResourceRecord
+}
+
+// GroupRRSets groups records of a message section into record sets, in the order of their appearance.
+func GroupRRSets(section []ResourceRecord) []*RRSet {
+	sets := make([]*RRSet, 0, 4)
+	index := make(map[string]*RRSet)
+	for _, rr := range section {
+		recordType := rr.Type
+		if rr.Type == TypeRRSIG {
+			if len(rr.Data) < 2 {
+				continue
+			}
+			recordType = binary.BigEndian.Uint16(rr.Data[0:2])
+		} else if rr.Type == TypeOPT {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", strings.ToLower(rr.Name), recordType)
+		set, found := index[key]
+		if !found {
+			set = &RRSet{}
+			index[key] = set
+			sets = append(sets, set)
+		}
+		if rr.Type == TypeRRSIG {
+			set.Sigs = append(set.Sigs, rr)
+		} else {
+			set.Records = append(set.Records, rr)
+		}
+	}
+	// Signatures alone do not make a record set
+	ret := make([]*RRSet, 0, len(sets))
+	for _, set := range sets {
+		if len(set.Records) > 0 {
+			ret = append(ret, set)
+		}
+	}
+	return ret
+}
+
+// minTTL returns the smallest TTL among the records of answer and authority sections, capped by DNSSECMaxCacheSec.
+func minTTL(msg *Message) uint32 {
+	ttl := uint32(DNSSECMaxCacheSec)
+	for _, section := range [][]ResourceRecord{msg.Answers, msg.Authorities} {
+		for _, rr := range section {
+			if rr.TTL < ttl {
+				ttl = rr.TTL
+			}
+		}
+	}
+	return ttl
+}
+
+// delegation is the DNSSEC status of a domain name along the chain of trust.
+type delegation struct {
+	isZone   bool             // isZone is true if the name is the apex of a secure zone.
+	insecure bool             // insecure is true if the name is an insecure delegation.
+	keys     []ResourceRecord // keys are the validated DNSKEY records of a secure zone.
+	expiry   time.Time
+}
+
+/*
+DNSSECValidator validates DNSSEC signatures of DNS responses. It follows the chain of trust from the trust anchors down
+to the signer of each record set, the DS and DNSKEY records along the chain are retrieved by the lookup function.
+Signatures of denial-of-existence records (NSEC and NSEC3) are validated, and a negative response is only secure if the
+records prove the denial.
+*/
+type DNSSECValidator struct {
+	TrustAnchors []ResourceRecord                                  // TrustAnchors are DS records of the trusted keys.
+	Lookup       func(name string, qtype uint16) (*Message, error) // Lookup retrieves records along with their signatures.
+	mutex        *sync.Mutex
+	cache        map[string]delegation
+}
+
+// NewDNSSECValidator returns an initialised validator.
+func NewDNSSECValidator(trustAnchors []ResourceRecord, lookup func(name string, qtype uint16) (*Message, error)) *DNSSECValidator {
+	return &DNSSECValidator{
+		TrustAnchors: trustAnchors,
+		Lookup:       lookup,
+		mutex:        new(sync.Mutex),
+		cache:        make(map[string]delegation),
+	}
+}
+
+// lookup calls the lookup function and makes sure that the response is not a failure.
+func (v *DNSSECValidator) lookup(name string, qtype uint16) (*Message, error) {
+	resp, err := v.Lookup(name, qtype)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s %s - %v", name, RecordTypeName(qtype), err)
+	}
+	if rcode := resp.Rcode(); rcode != RcodeNoError && rcode != RcodeNXDomain {
+		return nil, fmt.Errorf("failed to look up %s %s - response code %d", name, RecordTypeName(qtype), rcode)
+	}
+	return resp, nil
+}
+
+// getCache returns the cached delegation of the name if it has not yet expired.
+func (v *DNSSECValidator) getCache(name string) (delegation, bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	d, found := v.cache[name]
+	if !found || time.Now().After(d.expiry) {
+		return delegation{}, false
+	}
+	return d, true
+}
+
+// putCache remembers the delegation of the name for the duration.
+func (v *DNSSECValidator) putCache(name string, d delegation, ttl uint32) {
+	d.expiry = time.Now().Add(time.Duration(ttl) * time.Second)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.cache[name] = d
+}
+
+/*
+zoneKeys retrieves DNSKEY records of the zone and validates them against the DS records. If none of the DS records
+is understood by the validator, the zone is treated as insecure and the returned keys are empty.
+*/
+func (v *DNSSECValidator) zoneKeys(zone string, dsSet []ResourceRecord) ([]ResourceRecord, uint32, error) {
+	var usableDS []ResourceRecord
+	for _, ds := range dsSet {
+		if isSupportedDS(ds.Data) {
+			usableDS = append(usableDS, ds)
+		}
+	}
+	if len(usableDS) == 0 {
+		return nil, DNSSECMaxCacheSec, nil
+	}
+	resp, err := v.lookup(zone, TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys, sigs := recordsOf(resp.Answers, zone, TypeDNSKEY)
+	for _, key := range keys {
+		for _, ds := range usableDS {
+			// The key set must be signed by a key that matches the DS record
+			if DSMatchesKey(ds.Data, zone, key.Data) && VerifyRRSet(keys, sigs, []ResourceRecord{key}, zone) == nil {
+				return keys, minTTL(resp), nil
+			}
+		}
+	}
+	return nil, 0, fmt.Errorf("DNSKEY records of \"%s\" do not match DS records or lack a valid signature", zone)
+}
+
+/*
+checkDenial validates signatures of the denial-of-existence records of a DS query, and returns true if they prove that
+the child name is an insecure delegation of the zone.
+*/
+func (v *DNSSECValidator) checkDenial(resp *Message, zone string, keys []ResourceRecord, child string) (bool, error) {
+	var numVerified int
+	var insecure bool
+	for _, set := range GroupRRSets(resp.Authorities) {
+		rrType := set.Records[0].Type
+		if rrType != TypeSOA && rrType != TypeNSEC && rrType != TypeNSEC3 {
+			continue
+		}
+		if err := VerifyRRSet(set.Records, set.Sigs, keys, zone); err != nil {
+			return false, err
+		}
+		numVerified++
+		for _, rr := range set.Records {
+			owner := strings.ToLower(rr.Name)
+			if rrType == TypeNSEC && owner == child {
+				nsec, err := parseNSEC(rr)
+				if err != nil {
+					return false, err
+				}
+				insecure = insecure || nsec.types[TypeNS] && !nsec.types[TypeDS] && !nsec.types[TypeSOA]
+			} else if rrType == TypeNSEC3 {
+				nsec3, err := parseNSEC3(rr)
+				if err != nil {
+					return false, err
+				}
+				if nsec3.iterations > MaxNSEC3Iterations {
+					// Following RFC 9276, excessive iterations are not worth the computation
+					insecure = true
+					continue
+				}
+				if nsec3.matches(child) {
+					insecure = insecure || nsec3.types[TypeNS] && !nsec3.types[TypeDS] && !nsec3.types[TypeSOA]
+				} else if nsec3.flags&NSEC3FlagOptOut != 0 {
+					// An opt-out NSEC3 record that covers the child may conceal an unsigned delegation
+					insecure = insecure || nsec3.covers(child)
+				}
+			}
+		}
+	}
+	if numVerified == 0 {
+		return false, fmt.Errorf("absence of DS record for \"%s\" is not signed by \"%s\"", child, zone)
+	}
+	return insecure, nil
+}
+
+// findDelegation determines whether the child name of a secure zone is a secure zone, an insecure delegation, or neither.
+func (v *DNSSECValidator) findDelegation(zone string, keys []ResourceRecord, child string) (delegation, error) {
+	if d, found := v.getCache(child); found {
+		return d, nil
+	}
+	resp, err := v.lookup(child, TypeDS)
+	if err != nil {
+		return delegation{}, err
+	}
+	var d delegation
+	ttl := minTTL(resp)
+	if dsSet, sigs := recordsOf(resp.Answers, child, TypeDS); len(dsSet) > 0 {
+		if err := VerifyRRSet(dsSet, sigs, keys, zone); err != nil {
+			return d, err
+		}
+		childKeys, keysTTL, err := v.zoneKeys(child, dsSet)
+		if err != nil {
+			return d, err
+		}
+		if keysTTL < ttl {
+			ttl = keysTTL
+		}
+		d = delegation{isZone: childKeys != nil, insecure: childKeys == nil, keys: childKeys}
+	} else if cname, sigs := recordsOf(resp.Answers, child, TypeCNAME); len(cname) > 0 {
+		// An alias is never a zone cut
+		if err := VerifyRRSet(cname, sigs, keys, zone); err != nil {
+			return d, err
+		}
+	} else if d.insecure, err = v.checkDenial(resp, zone, keys, child); err != nil {
+		return d, err
+	}
+	v.putCache(child, d, ttl)
+	return d, nil
+}
+
+/*
+ChainOfTrust follows the delegations from the closest trust anchor down to the name, and returns the deepest secure
+zone that encloses the name along with the zone's validated keys. The keys are empty if the name is not beneath a trust
+anchor or it is beneath an insecure delegation. An error is returned if the chain is broken.
+*/
+func (v *DNSSECValidator) ChainOfTrust(name string) (zone string, keys []ResourceRecord, err error) {
+	name = strings.ToLower(name)
+	var anchors []ResourceRecord
+	for _, ds := range v.TrustAnchors {
+		owner := strings.ToLower(ds.Name)
+		if !isSubdomain(name, owner) || len(anchors) > 0 && len(owner) < len(anchors[0].Name) {
+			continue
+		}
+		if len(anchors) > 0 && len(owner) > len(anchors[0].Name) {
+			anchors = nil
+		}
+		anchors = append(anchors, ResourceRecord{Name: owner, Type: TypeDS, Class: ds.Class, TTL: ds.TTL, Data: ds.Data})
+	}
+	if len(anchors) == 0 {
+		return "", nil, nil
+	}
+	zone = anchors[0].Name
+	d, found := v.getCache(zone)
+	if !found || !d.isZone {
+		var ttl uint32
+		if keys, ttl, err = v.zoneKeys(zone, anchors); err != nil {
+			return
+		}
+		d = delegation{isZone: keys != nil, insecure: keys == nil, keys: keys}
+		v.putCache(zone, d, ttl)
+	}
+	if d.insecure {
+		return zone, nil, nil
+	}
+	keys = d.keys
+	// Follow delegations one label at a time
+	labels := splitLabels(name)
+	for i := len(labels) - len(splitLabels(zone)) - 1; i >= 0; i-- {
+		child := strings.Join(labels[i:], ".")
+		d, err := v.findDelegation(zone, keys, child)
+		if err != nil {
+			return zone, nil, err
+		}
+		if d.insecure {
+			return child, nil, nil
+		}
+		if d.isZone {
+			zone, keys = child, d.keys
+		}
+	}
+	return zone, keys, nil
+}
+
+// validateRRSet returns the DNSSEC status of a record set found in a response.
+func (v *DNSSECValidator) validateRRSet(set *RRSet) (string, error) {
+	owner := strings.ToLower(set.Records[0].Name)
+	if len(set.Sigs) == 0 {
+		// An unsigned record set is only acceptable beneath an insecure delegation
+		zone, keys, err := v.ChainOfTrust(owner)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if keys != nil {
+			return DNSSECBogus, fmt.Errorf("%s %s record is not signed by secure zone \"%s\"", owner, RecordTypeName(set.Records[0].Type), zone)
+		}
+		return DNSSECInsecure, nil
+	}
+	lastErr := fmt.Errorf("%s %s record does not have a usable signature", owner, RecordTypeName(set.Records[0].Type))
+	triedSigners := make(map[string]bool)
+	for _, sigRR := range set.Sigs {
+		sig, err := ParseRRSIG(sigRR.Data)
+		if err != nil || triedSigners[sig.SignerName] || !isSubdomain(owner, sig.SignerName) {
+			continue
+		}
+		triedSigners[sig.SignerName] = true
+		zone, keys, err := v.ChainOfTrust(sig.SignerName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if keys == nil {
+			return DNSSECInsecure, nil
+		}
+		if zone != sig.SignerName {
+			lastErr = fmt.Errorf("signer \"%s\" of %s %s record is not a secure zone", sig.SignerName, owner, RecordTypeName(set.Records[0].Type))
+			continue
+		}
+		if lastErr = VerifyRRSet(set.Records, set.Sigs, keys, zone); lastErr == nil {
+			return DNSSECSecure, nil
+		}
+	}
+	return DNSSECBogus, lastErr
+}
+
+/*
+deniedName follows aliases in answer section of the response from the question name, and returns the name of which the
+response denies the existence of records of the question type. Return false if the response answers the question.
+*/
+func deniedName(response *Message) (string, bool) {
+	question := response.Questions[0]
+	name := strings.ToLower(question.Name)
+	// Each step of the alias chain takes an answer record, which bounds the chain.
+	for i := 0; i <= len(response.Answers); i++ {
+		var target string
+		for _, rr := range response.Answers {
+			if strings.ToLower(rr.Name) != name {
+				continue
+			}
+			if rr.Type == question.Type || question.Type == TypeANY {
+				return "", false
+			}
+			if rr.Type == TypeCNAME {
+				var err error
+				if target, _, err = readName(rr.Data, 0); err != nil {
+					return "", false
+				}
+			}
+		}
+		if target == "" {
+			return name, true
+		}
+		name = strings.ToLower(target)
+	}
+	return "", false
+}
+
+/*
+proveDenial returns true if NSEC or NSEC3 records in authority section of the response prove that the name does not
+exist (nxdomain), or that the name does not have records of the type, and a wildcard could not have answered instead.
+Only the records signed by a zone that encloses the name are taken into account, their signatures must have already
+been validated.
+*/
+func proveDenial(response *Message, name string, qtype uint16, nxdomain bool) bool {
+	// Record sets (keyed by owner and type) that are signed by an enclosing zone
+	signed := make(map[string]bool)
+	for _, rr := range response.Authorities {
+		if rr.Type != TypeRRSIG {
+			continue
+		}
+		if sig, err := ParseRRSIG(rr.Data); err == nil && isSubdomain(name, sig.SignerName) {
+			signed[fmt.Sprintf("%s/%d", strings.ToLower(rr.Name), sig.TypeCovered)] = true
+		}
+	}
+	var nsecs []nsecRecord
+	var nsec3s []nsec3Record
+	for _, rr := range response.Authorities {
+		if !signed[fmt.Sprintf("%s/%d", strings.ToLower(rr.Name), rr.Type)] {
+			continue
+		}
+		if rr.Type == TypeNSEC {
+			if nsec, err := parseNSEC(rr); err == nil {
+				nsecs = append(nsecs, nsec)
+			}
+		} else if rr.Type == TypeNSEC3 {
+			if nsec3, err := parseNSEC3(rr); err == nil && nsec3.iterations <= MaxNSEC3Iterations {
+				nsec3s = append(nsec3s, nsec3)
+			}
+		}
+	}
+	if len(nsecs) > 0 {
+		return proveDenialNSEC(nsecs, name, qtype, nxdomain)
+	}
+	return len(nsec3s) > 0 && proveDenialNSEC3(nsec3s, name, qtype, nxdomain)
+}
+
+// proveDenialNSEC proves denial of existence by NSEC records (RFC 4035 section 5.4).
+func proveDenialNSEC(nsecs []nsecRecord, name string, qtype uint16, nxdomain bool) bool {
+	if !nxdomain {
+		for _, nsec := range nsecs {
+			if nsec.owner == name {
+				return !nsec.types[qtype] && !nsec.types[TypeCNAME]
+			}
+		}
+		return false
+	}
+	for _, nsec := range nsecs {
+		if !nsec.covers(name) {
+			continue
+		}
+		// The closest encloser is the deepest ancestor of the name that exists, it must not have a wildcard.
+		closestEncloser := commonAncestor(name, nsec.owner)
+		if ancestor := commonAncestor(name, nsec.next); len(ancestor) > len(closestEncloser) {
+			closestEncloser = ancestor
+		}
+		for _, wildcardNSEC := range nsecs {
+			if wildcardNSEC.covers(wildcardOf(closestEncloser)) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// proveDenialNSEC3 proves denial of existence by NSEC3 records (RFC 5155 section 8), opt-out does not prove anything.
+func proveDenialNSEC3(nsec3s []nsec3Record, name string, qtype uint16, nxdomain bool) bool {
+	if !nxdomain {
+		for _, nsec3 := range nsec3s {
+			if nsec3.matches(name) {
+				return !nsec3.types[qtype] && !nsec3.types[TypeCNAME]
+			}
+		}
+		return false
+	}
+	// Closest encloser proof - an ancestor exists, the next closer name does not, nor does the wildcard.
+	labels := splitLabels(name)
+	for i := 1; i <= len(labels); i++ {
+		closestEncloser := strings.Join(labels[i:], ".")
+		var encloserExists, nextCloserCovered, wildcardCovered bool
+		for _, nsec3 := range nsec3s {
+			encloserExists = encloserExists || nsec3.matches(closestEncloser)
+			nextCloserCovered = nextCloserCovered || nsec3.flags&NSEC3FlagOptOut == 0 && nsec3.covers(strings.Join(labels[i-1:], "."))
+			wildcardCovered = wildcardCovered || nsec3.covers(wildcardOf(closestEncloser))
+		}
+		if encloserExists {
+			return nextCloserCovered && wildcardCovered
+		}
+	}
+	return false
+}
+
+/*
+Validate returns the DNSSEC status of all record sets in answer and authority sections of the response. Unsigned NS
+records of authority section are ignored, for they are not signed by the parent zone of a delegation.
+*/
+func (v *DNSSECValidator) Validate(response *Message) (string, error) {
+	sets := GroupRRSets(response.Answers)
+	for _, set := range GroupRRSets(response.Authorities) {
+		if set.Records[0].Type != TypeNS || len(set.Sigs) > 0 {
+			sets = append(sets, set)
+		}
+	}
+	if len(sets) == 0 {
+		// There is nothing to validate, which is only acceptable outside of secure zones.
+		if len(response.Questions) == 0 {
+			return DNSSECBogus, errors.New("response does not have a question")
+		}
+		zone, keys, err := v.ChainOfTrust(response.Questions[0].Name)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if keys != nil {
+			return DNSSECBogus, fmt.Errorf("response from secure zone \"%s\" does not carry signed records", zone)
+		}
+		return DNSSECInsecure, nil
+	}
+	status := DNSSECSecure
+	for _, set := range sets {
+		setStatus, err := v.validateRRSet(set)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if setStatus == DNSSECInsecure {
+			status = DNSSECInsecure
+		}
+	}
+	// Signed records of a negative response are not secure unless they prove the denial
+	if status == DNSSECSecure && len(response.Questions) > 0 {
+		if name, denied := deniedName(response); denied && !proveDenial(response, name, response.Questions[0].Type, response.Rcode() == RcodeNXDomain) {
+			status = DNSSECInsecure
+		}
+	}
+	return status, nil
+}
+
+// initialiseDNSSEC parses the trust anchors and prepares the validator for forwarded answers.
+func (dnsd *DNSD) initialiseDNSSEC() error {
+	anchorTexts := dnsd.DNSSECTrustAnchors
+	if len(anchorTexts) == 0 {
+		anchorTexts = DefaultTrustAnchors
+	}
+	anchors := make([]ResourceRecord, 0, len(anchorTexts))
+	for _, text := range anchorTexts {
+		records, err := ParseZoneFile(text, "", DefaultZoneTTL)
+		if err != nil {
+			return fmt.Errorf("DNSD.Initialise: failed to parse DNSSEC trust anchor \"%s\" - %v", text, err)
+		}
+		for _, record := range records {
+			if record.Type != "DS" {
+				return fmt.Errorf("DNSD.Initialise: DNSSEC trust anchor \"%s\" is not a DS record", text)
+			}
+			rr, err := record.ToResourceRecord("", DefaultZoneTTL)
+			if err != nil {
+				return fmt.Errorf("DNSD.Initialise: failed to parse DNSSEC trust anchor \"%s\" - %v", text, err)
+			}
+			anchors = append(anchors, rr)
+		}
+	}
+	dnsd.dnssecValidator = NewDNSSECValidator(anchors, dnsd.lookupDNSSEC)
+	return nil
+}
+
+// lookupDNSSEC asks forwarder for records along with their signatures, without letting forwarder validate them.
+func (dnsd *DNSD) lookupDNSSEC(name string, qtype uint16) (*Message, error) {
+	query := &Message{
+		ID:          uint16(rand.Intn(65536)),
+		Flags:       FlagRD | FlagCD,
+		Questions:   []Question{{Name: name, Type: qtype, Class: ClassIN}},
+		Additionals: []ResourceRecord{{Type: TypeOPT, Class: EDNSBufferSize, TTL: EDNSFlagDO}},
+	}
+	queryPacket := query.Pack()
+	respPacket, err := dnsd.ForwardQuery(queryPacket)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ParseMessage(respPacket)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Flags&FlagTC != 0 && dnsd.TCPForwarder == "" {
+		// Key sets are often too large for UDP, ask again over TCP.
+		if respPacket, err = forwardQueryTCP(dnsd.UDPForwarder, queryPacket, IOTimeoutSec*time.Second); err != nil {
+			return nil, err
+		}
+		if resp, err = ParseMessage(respPacket); err != nil {
+			return nil, err
+		}
+	}
+	if resp.ID != query.ID {
+		return nil, errors.New("forwarder response does not match query")
+	}
+	return resp, nil
+}
+
+/*
+prepareForwardQuery returns the query to be sent to forwarder. If DNSSEC validation is enabled and client does not
+disable checking, the query asks forwarder for DNSSEC records, and the parsed client query is returned for the
+validation of forwarder's response.
+*/
+func (dnsd *DNSD) prepareForwardQuery(queryNoLength []byte) ([]byte, *Message) {
+	if dnsd.dnssecValidator == nil {
+		return queryNoLength, nil
+	}
+	clientQuery, err := ParseMessage(queryNoLength)
+	if err != nil || clientQuery.Flags&FlagCD != 0 || len(clientQuery.Questions) == 0 {
+		return queryNoLength, nil
+	}
+	forwardQuery := *clientQuery
+	forwardQuery.Flags |= FlagCD
+	forwardQuery.Additionals = make([]ResourceRecord, 0, len(clientQuery.Additionals)+1)
+	var hasOPT bool
+	for _, rr := range clientQuery.Additionals {
+		if rr.Type == TypeOPT {
+			hasOPT = true
+			rr.TTL |= EDNSFlagDO
+			if rr.Class < EDNSBufferSize {
+				rr.Class = EDNSBufferSize
+			}
+		}
+		forwardQuery.Additionals = append(forwardQuery.Additionals, rr)
+	}
+	if !hasOPT {
+		forwardQuery.Additionals = append(forwardQuery.Additionals, ResourceRecord{Type: TypeOPT, Class: EDNSBufferSize, TTL: EDNSFlagDO})
+	}
+	return forwardQuery.Pack(), clientQuery
+}
+
+/*
+validateResponse validates DNSSEC signatures of forwarder's response to client query. A bogus response is replaced by
+SERVFAIL, a secure response carries the AD bit. DNSSEC records are removed if client did not ask for them, and the
+response is truncated if it does not fit into a UDP packet of client's size.
+*/
+func (dnsd *DNSD) validateResponse(functionName, clientIP string, clientQuery *Message, responseNoLength []byte, isUDP bool) ([]byte, string) {
+	response, err := ParseMessage(responseNoLength)
+	if err != nil {
+		dnsd.Logger.Warningf(functionName, clientIP, err, "failed to parse forwarder response")
+		failure := MakeResponse(clientQuery)
+		failure.Flags |= FlagRA
+		failure.SetRcode(RcodeServFail)
+		return failure.Pack(), DNSSECBogus
+	}
+	// Truncated response will be retried by client over TCP, and failure response does not carry records to validate.
+	if rcode := response.Rcode(); response.Flags&FlagTC != 0 || rcode != RcodeNoError && rcode != RcodeNXDomain {
+		return responseNoLength, ""
+	}
+	status, err := dnsd.dnssecValidator.Validate(response)
+	if status == DNSSECBogus {
+		dnsd.Logger.Warningf(functionName, clientIP, err, "DNSSEC validation failed for \"%s\"", clientQuery.Questions[0].Name)
+		failure := MakeResponse(clientQuery)
+		failure.Flags |= FlagRA
+		failure.SetRcode(RcodeServFail)
+		return failure.Pack(), status
+	}
+	response.Flags &^= FlagAD
+	if status == DNSSECSecure {
+		response.Flags |= FlagAD
+	}
+	// Give client no more than what it asked for
+	clientOPT := getClientOPT(clientQuery)
+	if clientOPT == nil || clientOPT.TTL&EDNSFlagDO == 0 {
+		qtype := clientQuery.Questions[0].Type
+		stripDNSSEC := func(section []ResourceRecord) []ResourceRecord {
+			ret := make([]ResourceRecord, 0, len(section))
+			for _, rr := range section {
+				if (rr.Type == TypeRRSIG || rr.Type == TypeNSEC || rr.Type == TypeNSEC3) && rr.Type != qtype && qtype != TypeANY {
+					continue
+				}
+				ret = append(ret, rr)
+			}
+			return ret
+		}
+		response.Answers = stripDNSSEC(response.Answers)
+		response.Authorities = stripDNSSEC(response.Authorities)
+	}
+	if clientOPT == nil {
+		additionals := make([]ResourceRecord, 0, len(response.Additionals))
+		for _, rr := range response.Additionals {
+			if rr.Type != TypeOPT {
+				additionals = append(additionals, rr)
+			}
+		}
+		response.Additionals = additionals
+	}
+	packet := response.Pack()
+	if isUDP && len(packet) > clientUDPSize(clientQuery) {
+		packet = truncateResponse(response)
+	}
+	return packet, status
+}
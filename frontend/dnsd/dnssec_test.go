@@ -0,0 +1,370 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/*
+dnssecFixtureZones are pre-signed zones that form a chain of trust from the fixture root zone, signatures expire in 2060.
+- "test" (RSA/SHA-256) has a signed name, a wildcard, an expired signature, an insecure and a secure delegation.
+- "secure.test" (ECDSA P-384/SHA-384) is the secure delegation of "test".
+- "optout" (ECDSA P-256/SHA-256) uses an NSEC3 opt-out record to conceal the unsigned delegation "unsigned.optout".
+*/
+var dnssecFixtureZones = map[string]string{
+	"": `test. NS ns.test.
+optout. NS ns.optout.
+. SOA ns.test. admin.test. 1 3600 600 86400 300
+. RRSIG SOA 13 0 3600 20600101000000 20200101000000 55334 . Fi9uqgOjaZ4LnG9RLsvNV7pAv1+PB7lJNu2m7L/WWkZ9HPKqy7l8pKNfa8GSXpWc4FhOMKedkRd9IrqQc97Jug==
+. NS ns.test.
+. RRSIG NS 13 0 3600 20600101000000 20200101000000 55334 . SNJQ9kSF1e4UiHtgw66Q3LAM3K/7Ws8axgtjcQADaJULyIssnwlPJsfN5LAHGifiB7a3gZ+RQmzX2LmMgrjLZg==
+. DNSKEY 257 3 13 1TvWDnU7b3LDwQ2toGM/M88h0/lwFWH7HVHol8APiX7JnyTLWB2oZ++SmF3GvfZxupKIqKkyKYC+Cr6wYJqnIg==
+. RRSIG DNSKEY 13 0 3600 20600101000000 20200101000000 55334 . wrzUbY2NvunOwgBRa348QfIWbHgxeXy5F2RYRDbQZrRvk6cbw00SvH015Ubn99zVdAayGpEnT+BHQ7gI+UXy0Q==
+test. DS 42781 8 2 A73F63DE538FAC7FCAF1E9C8C170530EC279BF7FBD5AF0B4B4AD29F9E76ED771
+test. RRSIG DS 13 1 3600 20600101000000 20200101000000 55334 . xzbhKnJnIbWk+GJ2iNU2erU51KyK48Qh0nHdwTLeFwddyiWFxSgq6ioBm1asqwzUw0pckpzo5pckc5EWNX29Bg==
+optout. DS 23584 13 2 02B138871F1EF2E5899737C025C26A690024226D59C4537BCD52E83F77D27C94
+optout. RRSIG DS 13 1 3600 20600101000000 20200101000000 55334 . 7+v9afL0SS/A9RhVzQwKLPPsn3t/KZZMEJmu9ZgXyM13WXM8pnCNRz7BQEVO0ajIhZYCDqkJ3sK2u4wo+pqqxQ==
+. NSEC optout. NS SOA RRSIG NSEC DNSKEY
+. RRSIG NSEC 13 0 3600 20600101000000 20200101000000 55334 . EMfvX9qbjQFnxYDzYeF4kEGtlhdD5tjAGGZzZWnBl8lF+JDkhNT5WICaNI5ohBzKZVeeQ+vZifyDW0Ps5QPxpg==
+optout. NSEC test. NS DS RRSIG NSEC
+optout. RRSIG NSEC 13 1 3600 20600101000000 20200101000000 55334 . BXxSPxwJCBYU+btVCTmZySAkhLpWkhY7oWhoixh9jl72FV3PSYAg2+8NKetszSvi0pAubOlYH93mP6RH+kpv1g==
+test. NSEC . NS DS RRSIG NSEC
+test. RRSIG NSEC 13 1 3600 20600101000000 20200101000000 55334 . TTrYFFxib5bqBneNVU+XblQp/ckPiMbz3vsa6q78jFmHP+8hGs3STI5X+VUEfGlPX9lJWVmRfH03waWHGX5Gww==
+`,
+	"test": `insecure.test. NS ns.insecure.test.
+secure.test. NS ns.secure.test.
+test. SOA ns.test. admin.test. 1 3600 600 86400 300
+test. RRSIG SOA 8 1 3600 20600101000000 20200101000000 42781 test. RDA7odXQF+yuvqVSb0j/l5H8zEVPZxytxiLDkD8aiwFTIHrTGLZXz2/cqXFpLULs0QwTe9oqRIjqB2Z+UI+8y45gpQ5SzcwaZ6NYWcH5tKoQzNIn5mTestQgd/EDWN57ljO4SCGzSTRTdjouz+NPnqdP+lxepaGC3mwo5PTRjmRuTz6FJyxLKVPP42cQS6cQoEER1Y+LYFzqEMX/MywnvawwPU/3ACznjqEwLNCeuojkhZEChxLQB+v3cNvMMY1/4ZZ04SbtcCYdx0aKDdmF7DdfUTpKx8boUjupuFlb12CFCsbvhcDgwZHugpli+5P2N2NMmim/lm1Cnx1iRTc1Tw==
+test. NS ns.test.
+test. RRSIG NS 8 1 3600 20600101000000 20200101000000 42781 test. eAUp7XH8vuZXbs0UUWaukBG0F2qVvq66uYT5k1bKSlGLeHYJTujZOKh9gcp+/0B2l+9Z9IVhf3pRXiqR+kvy/nrgU/Y0y0Km4tfP/tXnQj6pevYrnwtPQKRheOj3kB3EGdtQRTXEv38X8J3P2ooydJvr6x95La6T1d+wqdaSFyo42onAxHwGr53iOpbahXpV2djAdM4rSVpnKQw0tTTsXM8Vi0GTMJGRmJ+V05kOSC5oIeWeQ2CGm+ACoZJUAAXLO1R10FhwT7Rwqb22VN/QqIkMjRs8Rxtsb5GPr7DwVRvzcUJ1rC3HhkSa76I2g61P6fsF76DpGR03ebZPFsALzQ==
+test. DNSKEY 257 3 8 AwEAAaW0QPxheoe5dCN8E1EpMDanEMGfJFy3r2B/mbR3D7iAo5FhuH3Ct0xVa2Usx/UB+6Kplh+ezqguv7s0CfBy3yW9f3plCQ9ymxAXnITDA5hlZNgikNQXbErBdx1G74FyKUO3nmxBEVbfP/Gurp5tPvTXakIQzchEyBaHwKhUWOptGp37z7akYkyGJRN+MvjD1LBpSW8Of6MXmHx/nusjkr7aC7PQ9cDzftlE/OSLublg50ZN7Xnw0iJ0XYO3K/KnvKcRPNw9Uv/pWC5yKrPog4Ujxj/6u2jDXonzRSZV/HhS5k+6XFWsgne3qhWjyWwMzpF9gQ97YsLIVB0i8n1DvUE=
+test. RRSIG DNSKEY 8 1 3600 20600101000000 20200101000000 42781 test. Kb4ezFj63b1IfxBdiysqwmgVVzheHZu1AuNgQadEgOjgJqBipK5R+0AYRDAWrq2mc4zhrhw8FyOcwBe5lijEzH4yvjPC0RQ3AZAj7dxKRl1F3g0s7drLWQxcJ5G3/8P0Wm/Z7MZlm8c8YR8FjZBcZhbFDicR47LTLz5N+190KVQ6l9ZPdnalIujFeNVXMb673gnbmjr0wAABTr+2dEGwCdP4Cotl4XTRhP5HHNGAMNIwGgZIeW/yfKXJvU1B6gy2pPThI87uhFCK11OoDcTRQhbPVMWWO4pKBBTzzHuh/vQr41j+VKBDmh6Z7UYW2gKWjBHczva4hxJV9mD4V5dgrA==
+www.test. A 192.0.2.1
+www.test. RRSIG A 8 2 3600 20600101000000 20200101000000 42781 test. DvW6GQYr+L+I5K/Vj4QY7LPLAq+WatnmA/IJSZNjTbDm7HrRt+RxIS/BTDZZ0e5AZmYr5j+N6QZwEHtOyK8fHgg7RKyYp2w4SD0lSvkSuE+foKzCpSe70kLIFTIqH9omfq1lTnsT2jf2YuAztFwS3UVOSEZ52QNg9rV1EuQ/paTclTkDjm8+u0ZJ6LkcVM/RdDpvhnefgaZ+Vz6e8RdRR/M5IonCfyjRln4CRf5TPKn5irIRdAgohrFPcpas1Dfk/0VV6sNWv9Uk8HRffpBtF5k6z+nMdgKm5wyiiJE3P1gxI8QA854e6Iy4QhqEANA+TKcdJaBNGdaw7DYhwWWcQQ==
+*.wild.test. A 192.0.2.3
+*.wild.test. RRSIG A 8 2 3600 20600101000000 20200101000000 42781 test. NwLl4V3aeTVYy0KmfC5gU5DFCpqHU/njv71/FP2sP+dETSe4aKuDFWli2k214chdXFAS7xJFw56W3vs6Aj1xOBpobLLYdZPd8xXmi6jfdKli4pLiHj1Cxy8llZKfH7YLJuFJHiBzHLXfJZWZtOdszycXa9Mr6KWVSvbIRxv+Vz31oRYT9RjNQt8jtLheDer5q43mmqVv4EcFyV0do5RVf30+qCIqTXf1KK5HXy0kzC2xx67dw3eFot13/tslT9RwGIiGYVyuvbn2lRR5hmD6k4++HI1eHXj6WWm2/PdW3aHrF1S8Vm80kk7mUXIE+iRZlXzBhakfTuA2Gr/lF2o37A==
+expired.test. A 192.0.2.4
+expired.test. RRSIG A 8 2 3600 20210101000000 20200101000000 42781 test. ffvhMw44BMqi3v0tEte2FXB6hNinql7Du4YFIIkTAcu5UERgGiQN750MLuoM5316LxEVfYS3ZlAPM3P6uk4/B2ORnOjhaRTkbQHTpUgpLTlWw6RMam+Rg/1xvZpeFC2qw5yMnrGAmwDLv8tCjPh6cEpY1xCXO8wgS6V4rIcTdLhHqraBFMeQJV1EKr7Ci1EEeHqOzErli4ZvCt8xzycpbmIQX5+cTfbL2vPspt8cIOWDtxnKRIqz/unvDQ6nX85JyDIeAYAN7SZ7qVoBDnJ5xKVAH91cAki6hPC8Rp7gsT3PR2PZBhc+5ib40FACjV2jCmX6JB5eAltbNuMWQNXtfQ==
+secure.test. DS 61638 14 2 1CCB9AA007D751E5EC7726B0F8DE7A7DFE338C988F81D680F8022D175C139778
+secure.test. RRSIG DS 8 2 3600 20600101000000 20200101000000 42781 test. A6GdbzpL+iB3RKJoYuaeaRvvU/0coDkl2pvrj9YuRsfB1jAzMCsDKAdarSAXsLxWPJz7CH+VJ/3Wd930inFmpSDMCgjraeXnGPz5zucWv0gJRAMvyCue57VLyRtz3RKyn4csUCjdQOusvAAqeaH04UdsI6+8YeJ3NL4psqcWIwAowdcPiRTG0m2SjQswZwNfT1lweylw9QtDCsd/I+fDx3L7d+r8HE3M45rcjF9EEQTZIYE8350kbKBGOXTxY4KuvZ5KjrFjqo/hOLBOSUxTrxg/77oiWInsq0Wla3gbfxEsk+T/+IBDyyWcKV5rEoLXwTIvHzYk1TohRKezCLf2Fw==
+test. NSEC expired.test. NS SOA RRSIG NSEC DNSKEY
+test. RRSIG NSEC 8 1 3600 20600101000000 20200101000000 42781 test. i37LiQCW9qPtN93UmZRFtQsf4p129jcQL1+ec1qpFGJLaLFWpNJwCFxVjI8KhL/Epy2KaLK32SP5y4zb1o+FeNwUEd5xWrfSbQtGMYPmP4DvzqMpzOxDXgClmdBLqhhCotQ2sXxUoope72u0CPbIT01c5V0JJGS2OozPyNwyuU3Q6iFFCoSFoFcDv5SQF3+mE5TQJniU7h0m19itEcw1r6lDP3KuZgx5wxMmcQvxm+98nOAt8VfU5TkGS42+EcoeqlTWBnb5j2Srp3HI3wJ8btGZ9pw6mCp5B4Ba3JKBX2lprsjDiu8Sfk6VdQARVUwQkn4p/wQOW8qF8/a/FbPtnw==
+expired.test. NSEC insecure.test. A RRSIG NSEC
+expired.test. RRSIG NSEC 8 2 3600 20600101000000 20200101000000 42781 test. NJwKRJ1AaTpwbKybqIqB1QX0h+zre9SuoVXiLT5N8FFItDM4IykzXzWnosg8MQhTjWKvD0QvU+mPDguv6sDcz/OFRS+JbJjsu9IeZ7zjE7M7rJjixn67zar9Bk5ZE2/DWA77DdTKGlgAUxtg+7Zt6FauL9UIuuU8pa71GaucwGtbMkxerdEsM3mz/rboKEgIFj9F+DO5qpzXdJcwleuRpHbDtjUcYdFIRGOpChzHwjiXo+e+soXrv9adRxMc4WEE7jyVOvq7GjVaAQHtgIJXhqPl3yhne9AvZx9Ld3u1mrqFGrmZ6aDMY2dAzI+l0Aq1X+BiAUmI1n6uPR2If30ZAg==
+insecure.test. NSEC secure.test. NS RRSIG NSEC
+insecure.test. RRSIG NSEC 8 2 3600 20600101000000 20200101000000 42781 test. NERv8E6RzcX0hXPnHe6fZ6ifb8WVKEU5ag5cwGVGxyT5xRX+fwzem1eiliST+keuyKFt0lW8Bq8pkUPpiVXP8/0QHRohME/ccJTIWZztY+RF4lCZTzYZfgshR6Mxj8NUliRlzi1gFnxL9GBbZwFGw2M+QcCy9+9S6bMWDEr4y5eoFtdWwL6xcRNJ8QNR2ZlrPiwIv/ST5Un03JlCpNdN8ST8DYB/67CDM8UC/YKAHG2fQu3C5ZALHE44lS4UwE/2e8kwwi+p6TCSV9ocOtxgpjxs3VZa1mYLR60VwF8xbe+TMSI8ZG7T2FR9SfiwQ2wNsKNNog5vhAKHluxzSFdzvw==
+secure.test. NSEC *.wild.test. NS DS RRSIG NSEC
+secure.test. RRSIG NSEC 8 2 3600 20600101000000 20200101000000 42781 test. ENzzSmFqjJWtyIRQoDu7457lfL9ZsS64tJyEc1GZDVspVjYJK/bWPw1vx1hpk2+W6DOVuYS0u094kk+GuXQh2bR9hAiNqb8v8VVR2DVMvdcjeQrCAtchfbQG4chLM3+OcZo1EPM46lU94+CMC1xDlv69BNpRgd7X3A8/E8W2r1DERvJl6EkFvp7x6AIol4moXiqBJr4IM3nJMfOWL5+SrUHqeZqwxqZgruEiOuoEDQ+EJPeVbUsbynM8UHwz1fft+lJLoR2yTC1D/JPt3aUKTPGdB7pla0C0ztd9ke5YffU6CVQww79qRGedgFfh2EdoP4nD5zSUufqkVDQAtYq2WQ==
+*.wild.test. NSEC www.test. A RRSIG NSEC
+*.wild.test. RRSIG NSEC 8 2 3600 20600101000000 20200101000000 42781 test. MF/xPfrggNmBMFuPF5zTloasWB6O2MTM78efk5v79pT+rzrm3qCpG0b5BAOFY4JNJdh5rOTSB/7sgZBJcwpkF3V5QfcQO8fMfi8HssVbw8r1pTgOucLbz4gU9DjEexxwh5DqdJ6+rlQ1C9obZBYRSbZGDUOXw5fEjGVIrsE8KyIfaYgdYOF7Y3DxOiepyPSTIHLZ31MBZ5cPce2Md+m3EFm8dp57bXXPxpSq3iHkEc/Sr3OCcCrBTFWDur3HeUuMm9SK+6kNXztugx3Xz9RAEOAH9vj+dc4OWtN9PsByAVzr80KBrA/ozKrDAResu0A4ADYxz0vVSPQIlCQBUxluCg==
+www.test. NSEC test. A RRSIG NSEC
+www.test. RRSIG NSEC 8 2 3600 20600101000000 20200101000000 42781 test. hcuYW7Y5L0rK2hF+xn+MX3jWMJB3HqjJIJHI+OYuZAm+qFvnB9FqpZ/EOwqKz0YmBZJmlYq+HTo//lO0sXC6rLfIQkjqjrqFxCLllUXwqZTRgv+bDbKThXGz6hDrbBxSREN3ITLXQoWyU4SOJfcCIfj90q+bgMPhFDwDWedCN6j4o52zWjMk/W4ZT5iZkKuoFeAZkJXekxSla3d+Ft53Nnl2ZfMeJnqdp6PMft2RgO4PsrnME86uxTel/vqh9O+npegoepPvjJQVlIizWQsZuWRdLLxJ1seT8VYMQ+AA63CkwRQWVPxg0NGRgk8oPnDwbwlggHnJ9e5SNbw/4ylzdg==
+`,
+	"secure.test": `secure.test. SOA ns.secure.test. admin.test. 1 3600 600 86400 300
+secure.test. RRSIG SOA 14 2 3600 20600101000000 20200101000000 61638 secure.test. na15P6r86HW8ImDwDKTU99yCffxCzbjm4vL3biSZUhnKo6iYjHg63q+jCD2Cf0f9NsquBAZHGumLM6zsDZSKc40KjblgSVSYktOs9kzP+0AFCMz+ZAM/YoaXPSkWp94M
+secure.test. NS ns.secure.test.
+secure.test. RRSIG NS 14 2 3600 20600101000000 20200101000000 61638 secure.test. +cvftaQsBT68uDA//w2XNbIfeAUFgB05PSedwIDfgwI46oB2Vsy351/yu02dqxhW0j/WVdmddOccFx+a4JqNs0KIOEUyJlZ5wYgVJBGklrLec3jLpLWDHG+H8lpafCZE
+secure.test. DNSKEY 257 3 14 80feeNSwWIiHXoYVxxby4IJijBJzeiJSH52ibi7wlIwWCuqnMLqWLyujp2wWht+Kqm3RYb/3bIYLZOpr5H5w8XR+LMdRxLO7jTAwYq9d7qM9EBzDk8lgjjbzX8NWqDpZ
+secure.test. RRSIG DNSKEY 14 2 3600 20600101000000 20200101000000 61638 secure.test. /RV8fOWsCc5nbht8qbjuyvRBcwKbKwO0NMNOyO5QlRK/AO02DepnXAloNWhhlSIPZha7CFoiH4Php5hXN3422hjPs3wI0jFBIoPD4jAND1PlvkRafRs6G5NylObU55pA
+www.secure.test. AAAA 2001:db8::1
+www.secure.test. RRSIG AAAA 14 3 3600 20600101000000 20200101000000 61638 secure.test. Ie96ilOFDg/4NNBqticPZP2NFr3dRv7ofojKRmOeRiIe0xEqmh/bqp3UmhWliaqvf7W/65iqAdaNyi5Gd5CJyMxwVpih72lwXE2KdZkN6Ugz/Xd/F797M0xmSL5CfKJA
+secure.test. NSEC www.secure.test. NS SOA RRSIG NSEC DNSKEY
+secure.test. RRSIG NSEC 14 2 3600 20600101000000 20200101000000 61638 secure.test. wY1RnlEih0UYB1yYwYbXgDzMsB7kxhY7OMlMBtmLF7alXBIVuVxxnKSjkYdi8dhAY6mqv4CtMiHvyfK1e+0gTaziveEYQE61wCyfZfe+M40VVHe3Sv57DRK0LHzo328X
+www.secure.test. NSEC secure.test. AAAA RRSIG NSEC
+www.secure.test. RRSIG NSEC 14 3 3600 20600101000000 20200101000000 61638 secure.test. V1ib2MEnRramocDHe2QQ9BKx61WJoob4p8IEsQZDESMZA9H5T22iA0In6yc55u7mOPXEMnv8ZPBoNY3pq1N2ENcop81H1yIUXKHMFYrLTyANjzGz1+nfVOVix3crv9gs
+`,
+	"optout": `unsigned.optout. NS ns.unsigned.optout.
+optout. SOA ns.optout. admin.optout. 1 3600 600 86400 300
+optout. RRSIG SOA 13 1 3600 20600101000000 20200101000000 23584 optout. F/2UThx9o5qAWC4PuhY1J0BRel2VYWvihYGMhBnHd+M3rWAldRLDpCPRWTzdvEJwDjuY0Z1zdHALJ0HDoBIkqA==
+optout. NS ns.optout.
+optout. RRSIG NS 13 1 3600 20600101000000 20200101000000 23584 optout. 7N7HkGQ+Or+f3BnDUv65HU3DZS5MiZgdCohdRHDL72kIFXMkYSD6x1mPoUz0YhXdzhQNq0iQVc/2I5wkowO6Lg==
+optout. DNSKEY 257 3 13 0MVwnCNrQnCTeDv0hhQswBsJ4uqxycOeYZH+m9a+mDbR4zukyaLXj2/bYYsUnCufvWkZUTJD6RFH7hyCdctfaw==
+optout. RRSIG DNSKEY 13 1 3600 20600101000000 20200101000000 23584 optout. WjWu+hqMTi26ZyfKYbhqcG2pWeg7NIBNWbyGAEtk7Jr20saABr2lTP7gkJEEGLSt8t6+VHHQRP2r8wTVUJuzeQ==
+ctntmtn81bo6dlev4sdor61c00f6vhs7.optout. NSEC3 1 1 0 - CTNTMTN81BO6DLEV4SDOR61C00F6VHS7 NS SOA RRSIG DNSKEY TYPE51
+ctntmtn81bo6dlev4sdor61c00f6vhs7.optout. RRSIG NSEC3 13 2 3600 20600101000000 20200101000000 23584 optout. eH7knihPtURbtVimWrk/NiImW715ajD0KZgrTXqSRn6bhZPsICMa1/OhwCjpxM3RMFQhLPTuXcQtKCDkrCeApw==
+`,
+}
+
+// dnssecFixtureAnchor is the DS record of the key of fixture root zone.
+const dnssecFixtureAnchor = ". IN DS 55334 13 2 CC7A83B086B57DB2F188BF39E2832DB0E9293359A7222DC3E7134522B0AA0604"
+
+// getDNSSECFixtureRecords parses the fixture zones.
+func getDNSSECFixtureRecords(t *testing.T) map[string][]ResourceRecord {
+	ret := make(map[string][]ResourceRecord)
+	for origin, content := range dnssecFixtureZones {
+		records, err := ParseZoneFile(content, origin, DefaultZoneTTL)
+		if err != nil {
+			t.Fatal(origin, err)
+		}
+		for _, record := range records {
+			rr, err := record.ToResourceRecord(origin, DefaultZoneTTL)
+			if err != nil {
+				t.Fatal(origin, err)
+			}
+			ret[origin] = append(ret[origin], rr)
+		}
+	}
+	return ret
+}
+
+// getDNSSECFixtureLookup returns a lookup function that answers from fixture zones like a non-validating resolver.
+func getDNSSECFixtureLookup(zones map[string][]ResourceRecord) func(string, uint16) (*Message, error) {
+	return func(name string, qtype uint16) (*Message, error) {
+		name = strings.ToLower(name)
+		// The closest enclosing zone answers, except that DS records come from the parent zone.
+		zone := ""
+		for origin := range zones {
+			if isSubdomain(name, origin) && len(origin) > len(zone) && !(qtype == TypeDS && name == origin) {
+				zone = origin
+			}
+		}
+		resp := &Message{Flags: FlagQR | FlagRD | FlagRA, Questions: []Question{{Name: name, Type: qtype, Class: ClassIN}}}
+		records, sigs := recordsOf(zones[zone], name, qtype)
+		if resp.Answers = append(records, sigs...); len(resp.Answers) > 0 {
+			return resp, nil
+		}
+		// Denial of existence
+		var nameExists bool
+		for _, rr := range zones[zone] {
+			recordType := rr.Type
+			if rr.Type == TypeRRSIG {
+				recordType = binary.BigEndian.Uint16(rr.Data[0:2])
+			}
+			if recordType == TypeSOA || recordType == TypeNSEC || recordType == TypeNSEC3 {
+				resp.Authorities = append(resp.Authorities, rr)
+			}
+			nameExists = nameExists || rr.Name == name
+		}
+		if !nameExists {
+			resp.SetRcode(RcodeNXDomain)
+		}
+		return resp, nil
+	}
+}
+
+func TestTypeBitmap(t *testing.T) {
+	bitmap, err := packTypeBitmap([]string{"A", "NS", "RRSIG", "NSEC", "TYPE1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, err := unpackTypeBitmap(bitmap)
+	if err != nil || !reflect.DeepEqual(types, map[uint16]bool{TypeA: true, TypeNS: true, TypeRRSIG: true, TypeNSEC: true, 1234: true}) {
+		t.Fatal(types, err)
+	}
+	if _, err := packTypeBitmap([]string{"BOGUS"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := unpackTypeBitmap([]byte{0, 33}); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestDNSSECValidator_Validate(t *testing.T) {
+	lookup := getDNSSECFixtureLookup(getDNSSECFixtureRecords(t))
+	anchorRecords, err := ParseZoneFile(dnssecFixtureAnchor, "", DefaultZoneTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchor, err := anchorRecords[0].ToResourceRecord("", DefaultZoneTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := NewDNSSECValidator([]ResourceRecord{anchor}, lookup)
+	unsignedResponse := func(name string, data []byte) *Message {
+		return &Message{
+			Flags:     FlagQR | FlagRD | FlagRA,
+			Questions: []Question{{Name: name, Type: TypeA, Class: ClassIN}},
+			Answers:   []ResourceRecord{{Name: name, Type: TypeA, Class: ClassIN, TTL: 60, Data: data}},
+		}
+	}
+	tests := []struct {
+		name     string
+		qtype    uint16
+		modify   func(*Message) *Message
+		expected string
+	}{
+		{"www.test", TypeA, nil, DNSSECSecure},
+		// Resolver may randomise letter case of names
+		{"www.test", TypeA, func(resp *Message) *Message {
+			for i := range resp.Answers {
+				resp.Answers[i].Name = "WWW.Test"
+			}
+			return resp
+		}, DNSSECSecure},
+		// Tampered data
+		{"www.test", TypeA, func(resp *Message) *Message {
+			resp.Answers[0].Data = []byte{192, 0, 2, 99}
+			return resp
+		}, DNSSECBogus},
+		// Signatures are stripped
+		{"www.test", TypeA, func(resp *Message) *Message {
+			resp.Answers = resp.Answers[:1]
+			return resp
+		}, DNSSECBogus},
+		{"expired.test", TypeA, nil, DNSSECBogus},
+		// Expanded from wildcard
+		{"*.wild.test", TypeA, func(resp *Message) *Message {
+			resp.Questions[0].Name = "a.b.wild.test"
+			for i := range resp.Answers {
+				resp.Answers[i].Name = "a.b.wild.test"
+			}
+			return resp
+		}, DNSSECSecure},
+		// Securely delegated zone
+		{"www.secure.test", TypeAAAA, nil, DNSSECSecure},
+		{"secure.test", TypeDNSKEY, nil, DNSSECSecure},
+		{"www2.secure.test", TypeA, func(*Message) *Message {
+			return unsignedResponse("www2.secure.test", []byte{192, 0, 2, 6})
+		}, DNSSECBogus},
+		// Non-existent name
+		{"nonexistent.test", TypeA, nil, DNSSECSecure},
+		{"nonexistent.test", TypeA, func(resp *Message) *Message {
+			resp.Authorities = nil
+			return resp
+		}, DNSSECBogus},
+		// Signed records that do not prove the denial
+		{"nonexistent.test", TypeA, func(resp *Message) *Message {
+			authorities := make([]ResourceRecord, 0, len(resp.Authorities))
+			for _, rr := range resp.Authorities {
+				if rr.Name != "insecure.test" {
+					authorities = append(authorities, rr)
+				}
+			}
+			resp.Authorities = authorities
+			return resp
+		}, DNSSECInsecure},
+		{"www.test", TypeAAAA, nil, DNSSECSecure},
+		{"www.test", TypeAAAA, func(resp *Message) *Message {
+			resp.Questions[0].Type = TypeA
+			return resp
+		}, DNSSECInsecure},
+		// Denial proven by NSEC3, except that opt-out does not prove non-existence
+		{"optout", TypeA, nil, DNSSECSecure},
+		{"nonexistent.optout", TypeA, nil, DNSSECInsecure},
+		// Insecure delegation proven by NSEC
+		{"www.insecure.test", TypeA, func(*Message) *Message {
+			return unsignedResponse("www.insecure.test", []byte{192, 0, 2, 5})
+		}, DNSSECInsecure},
+		// Insecure delegation concealed by NSEC3 opt-out
+		{"www.unsigned.optout", TypeA, func(*Message) *Message {
+			return unsignedResponse("www.unsigned.optout", []byte{192, 0, 2, 7})
+		}, DNSSECInsecure},
+	}
+	for _, test := range tests {
+		resp, err := lookup(test.name, test.qtype)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.modify != nil {
+			resp = test.modify(resp)
+		}
+		if status, err := validator.Validate(resp); status != test.expected {
+			t.Fatal(test.name, RecordTypeName(test.qtype), status, err)
+		}
+	}
+	// A wrong trust anchor breaks the chain of trust
+	anchor.Data = append([]byte{}, anchor.Data...)
+	anchor.Data[len(anchor.Data)-1]++
+	validator = NewDNSSECValidator([]ResourceRecord{anchor}, lookup)
+	resp, _ := lookup("www.test", TypeA)
+	if status, err := validator.Validate(resp); status != DNSSECBogus || err == nil {
+		t.Fatal(status, err)
+	}
+}
+
+func TestProveDenialNSEC3(t *testing.T) {
+	// A lone record wraps around to cover every name but the apex itself
+	apexHash := NSEC3Hash("example", []byte{1}, 2)
+	apex := nsec3Record{iterations: 2, salt: []byte{1}, ownerHash: apexHash, nextHash: apexHash, types: map[uint16]bool{TypeSOA: true}}
+	if !proveDenialNSEC3([]nsec3Record{apex}, "a.b.example", TypeA, true) || !proveDenialNSEC3([]nsec3Record{apex}, "example", TypeA, false) {
+		t.Fatal("did not prove denial")
+	}
+	if proveDenialNSEC3([]nsec3Record{apex}, "example", TypeSOA, false) || proveDenialNSEC3([]nsec3Record{apex}, "a.other", TypeA, true) {
+		t.Fatal("should not have proven denial")
+	}
+	apex.flags = NSEC3FlagOptOut
+	if proveDenialNSEC3([]nsec3Record{apex}, "a.b.example", TypeA, true) {
+		t.Fatal("opt-out should not have proven denial")
+	}
+}
+
+func TestDNSD_validateResponse(t *testing.T) {
+	daemon := DNSD{
+		Address:              "127.0.0.1",
+		UDPPort:              61256,
+		UDPForwarder:         "8.8.8.8:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		DNSSECValidation:     true,
+		DNSSECTrustAnchors:   []string{"test. IN A 192.0.2.1"},
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "not a DS record") {
+		t.Fatal(err)
+	}
+	daemon.DNSSECTrustAnchors = nil
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if len(daemon.dnssecValidator.TrustAnchors) != len(DefaultTrustAnchors) || daemon.dnssecValidator.TrustAnchors[0].Name != "" {
+		t.Fatal(daemon.dnssecValidator.TrustAnchors)
+	}
+	daemon.DNSSECTrustAnchors = []string{dnssecFixtureAnchor}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	lookup := getDNSSECFixtureLookup(getDNSSECFixtureRecords(t))
+	daemon.dnssecValidator.Lookup = lookup
+
+	// Forwarder is asked for DNSSEC records without validating them
+	clientQuery := &Message{ID: 1234, Flags: FlagRD, Questions: []Question{{Name: "www.test", Type: TypeA, Class: ClassIN}}}
+	forwardPacket, parsedQuery := daemon.prepareForwardQuery(clientQuery.Pack())
+	forwardQuery, err := ParseMessage(forwardPacket)
+	if err != nil || parsedQuery == nil || forwardQuery.ID != 1234 || forwardQuery.Flags&FlagCD == 0 ||
+		len(forwardQuery.Additionals) != 1 || forwardQuery.Additionals[0].TTL&EDNSFlagDO == 0 {
+		t.Fatalf("%+v %v", forwardQuery, err)
+	}
+	// Client that disables checking does not get its answers validated
+	if _, parsed := daemon.prepareForwardQuery((&Message{ID: 1, Flags: FlagRD | FlagCD, Questions: clientQuery.Questions}).Pack()); parsed != nil {
+		t.Fatal("should not have validated")
+	}
+
+	// Secure answer carries AD bit, signatures are removed for client that did not ask for them.
+	resp, _ := lookup("www.test", TypeA)
+	resp.ID = 1234
+	resp.Additionals = forwardQuery.Additionals
+	validated, status := daemon.validateResponse("test", "127.0.0.1", parsedQuery, resp.Pack(), true)
+	validatedResp, err := ParseMessage(validated)
+	if err != nil || status != DNSSECSecure || validatedResp.Flags&FlagAD == 0 || len(validatedResp.Answers) != 1 ||
+		!net.IP(validatedResp.Answers[0].Data).Equal(net.IPv4(192, 0, 2, 1)) || len(validatedResp.Additionals) != 0 {
+		t.Fatalf("%+v %v %s", validatedResp, err, status)
+	}
+	// Client that asks for DNSSEC records gets the signatures
+	doQuery := &Message{ID: 1234, Flags: FlagRD, Questions: clientQuery.Questions, Additionals: forwardQuery.Additionals}
+	_, parsedQuery = daemon.prepareForwardQuery(doQuery.Pack())
+	validated, status = daemon.validateResponse("test", "127.0.0.1", parsedQuery, resp.Pack(), true)
+	if validatedResp, err = ParseMessage(validated); err != nil || status != DNSSECSecure || len(validatedResp.Answers) != 2 || len(validatedResp.Additionals) != 1 {
+		t.Fatalf("%+v %v %s", validatedResp, err, status)
+	}
+	// Bogus answer is replaced by SERVFAIL
+	resp.Answers[0].Data = []byte{192, 0, 2, 99}
+	validated, status = daemon.validateResponse("test", "127.0.0.1", parsedQuery, resp.Pack(), true)
+	if validatedResp, err = ParseMessage(validated); err != nil || status != DNSSECBogus || validatedResp.ID != 1234 ||
+		validatedResp.Rcode() != RcodeServFail || len(validatedResp.Answers) != 0 {
+		t.Fatalf("%+v %v %s", validatedResp, err, status)
+	}
+	// Insecure answer does not carry AD bit even if forwarder sets it
+	insecureResp := &Message{
+		ID:        1234,
+		Flags:     FlagQR | FlagRD | FlagRA | FlagAD,
+		Questions: []Question{{Name: "www.insecure.test", Type: TypeA, Class: ClassIN}},
+		Answers:   []ResourceRecord{{Name: "www.insecure.test", Type: TypeA, Class: ClassIN, TTL: 60, Data: []byte{192, 0, 2, 5}}},
+	}
+	_, parsedQuery = daemon.prepareForwardQuery((&Message{ID: 1234, Flags: FlagRD, Questions: insecureResp.Questions}).Pack())
+	validated, status = daemon.validateResponse("test", "127.0.0.1", parsedQuery, insecureResp.Pack(), true)
+	if validatedResp, err = ParseMessage(validated); err != nil || status != DNSSECInsecure || validatedResp.Flags&FlagAD != 0 || len(validatedResp.Answers) != 1 {
+		t.Fatalf("%+v %v %s", validatedResp, err, status)
+	}
+}
@@ -0,0 +1,103 @@
+package dnsd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const ForwardRuleTimeoutSec = 5 // ForwardRuleTimeoutSec is how long to wait for each forwarder of a rule before trying the next one.
+
+/*
+ForwardRule forwards queries of names under the domain suffix to dedicated forwarders, e.g. names of a corporate network
+to the VPN's resolver. When several rules match a name, the rule of the longest suffix is used.
+Answers from these forwarders are not subject to DNSSEC validation, as private names usually do not exist in public DNS.
+*/
+type ForwardRule struct {
+	Suffix     string   `json:"Suffix"`     // Suffix is the domain name, e.g. "corp.internal", the rule applies to the name itself and all of its sub-domains.
+	Forwarders []string `json:"Forwarders"` // Forwarders are addresses (IP:Port) to try in turn until one of them answers.
+}
+
+// Initialise checks the rule configuration and normalises the suffix.
+func (rule *ForwardRule) Initialise() error {
+	rule.Suffix = strings.Trim(strings.ToLower(strings.TrimSpace(rule.Suffix)), ".")
+	if rule.Suffix == "" {
+		return errors.New("forward rule suffix must not be empty")
+	}
+	if len(rule.Forwarders) == 0 {
+		return fmt.Errorf("forward rule \"%s\" must have at least one forwarder", rule.Suffix)
+	}
+	for _, forwarder := range rule.Forwarders {
+		if _, _, err := net.SplitHostPort(forwarder); err != nil {
+			return fmt.Errorf("forward rule \"%s\" has a bad forwarder address \"%s\"", rule.Suffix, forwarder)
+		}
+	}
+	return nil
+}
+
+// Matches returns true only if the name is the rule's suffix or its sub-domain.
+func (rule *ForwardRule) Matches(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	return name == rule.Suffix || strings.HasSuffix(name, "."+rule.Suffix)
+}
+
+/*
+Forward sends a query packet (without length prefix) to the rule's forwarders in turn until one of them answers. It
+returns the response (without length prefix) and the address of forwarder that answered.
+*/
+func (rule *ForwardRule) Forward(queryNoLength []byte, viaTCP bool) (response []byte, forwarder string, err error) {
+	for _, forwarder = range rule.Forwarders {
+		if viaTCP {
+			response, err = forwardQueryTCP(forwarder, queryNoLength, ForwardRuleTimeoutSec*time.Second)
+		} else {
+			response, err = forwardQueryUDP(forwarder, queryNoLength, ForwardRuleTimeoutSec*time.Second)
+		}
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// matchForwardRule returns the forward rule of the longest suffix that matches the name, or nil if none matches.
+func (dnsd *DNSD) matchForwardRule(name string) (matched *ForwardRule) {
+	for i := range dnsd.ForwardRules {
+		rule := &dnsd.ForwardRules[i]
+		if rule.Matches(name) && (matched == nil || len(rule.Suffix) > len(matched.Suffix)) {
+			matched = rule
+		}
+	}
+	return
+}
+
+// forwardRuleOf returns the forward rule that applies to the name queried by the packet, or nil if none applies.
+func (dnsd *DNSD) forwardRuleOf(queryNoLength []byte) *ForwardRule {
+	if len(dnsd.ForwardRules) == 0 {
+		return nil
+	}
+	query, err := ParseMessage(queryNoLength)
+	if err != nil || len(query.Questions) == 0 {
+		return nil
+	}
+	return dnsd.matchForwardRule(query.Questions[0].Name)
+}
+
+// HandleUDPRuleQuery forwards the query according to forward rule and sends the response to my DNS client.
+func (dnsd *DNSD) HandleUDPRuleQuery(rule *ForwardRule, query *UDPQuery) {
+	beginTime := time.Now()
+	defer func() {
+		UDPDurationStats.Trigger(float64(time.Since(beginTime).Nanoseconds()) / 1000000)
+	}()
+	clientIP := query.ClientAddr.IP.String()
+	response, forwarder, err := rule.Forward(query.QueryPacket, false)
+	if err != nil {
+		dnsd.Logger.Warningf("HandleUDPRuleQuery", clientIP, err, "all forwarders of rule \"%s\" failed", rule.Suffix)
+		dnsd.logQuery(clientIP, query.QueryPacket, QueryResultFailed, forwarder, beginTime)
+		return
+	}
+	response = dnsd.checkRebinding("HandleUDPRuleQuery", clientIP, response)
+	dnsd.logQuery(clientIP, query.QueryPacket, QueryResultForwarded, forwarder, beginTime)
+	dnsd.answerUDP("HandleUDPRuleQuery", query.MyServer, query.ClientAddr, query.QueryPacket, response)
+}
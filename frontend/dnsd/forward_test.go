@@ -0,0 +1,206 @@
+package dnsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeForwarder answers all UDP and TCP queries with the IP address, and returns the address it listens on.
+func startFakeForwarder(t *testing.T, ip net.IP) (addr string, stop func()) {
+	answer := func(queryNoLength []byte) []byte {
+		query, err := ParseMessage(queryNoLength)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		response := MakeResponse(query)
+		response.Answers = []ResourceRecord{{Name: query.Questions[0].Name, Type: TypeA, Class: ClassIN, TTL: 60, Data: ip.To4()}}
+		return response.Pack()
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = tcpListener.Addr().String()
+	udpServer, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			if query, err := ReadTCPPacket(conn); err == nil {
+				WriteTCPPacket(conn, answer(query))
+			}
+			conn.Close()
+		}
+	}()
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, clientAddr, err := udpServer.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpServer.WriteTo(answer(buf[:n]), clientAddr)
+		}
+	}()
+	return addr, func() {
+		tcpListener.Close()
+		udpServer.Close()
+	}
+}
+
+func TestDNSD_ForwardRules(t *testing.T) {
+	corpForwarder, stopCorp := startFakeForwarder(t, net.IPv4(10, 0, 0, 1))
+	defer stopCorp()
+	labForwarder, stopLab := startFakeForwarder(t, net.IPv4(10, 0, 0, 2))
+	defer stopLab()
+	// Nothing listens on this address
+	deadListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadForwarder := deadListener.Addr().String()
+	deadListener.Close()
+
+	daemon := DNSD{
+		Address:              "127.0.0.1",
+		UDPPort:              61258,
+		UDPForwarder:         "8.8.8.8:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		ForwardRules:         []ForwardRule{{Suffix: "corp.internal", Forwarders: []string{"corp"}}},
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "bad forwarder address") {
+		t.Fatal(err)
+	}
+	daemon.ForwardRules = []ForwardRule{{Suffix: "corp.internal"}}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "at least one forwarder") {
+		t.Fatal(err)
+	}
+	daemon.ForwardRules = []ForwardRule{
+		{Suffix: "Corp.Internal.", Forwarders: []string{deadForwarder, corpForwarder}},
+		{Suffix: "lab.corp.internal", Forwarders: []string{labForwarder}},
+		{Suffix: "corp.internal", Forwarders: []string{labForwarder}},
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Fatal(err)
+	}
+	daemon.ForwardRules = daemon.ForwardRules[:2]
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Longest suffix wins
+	for name, expected := range map[string]string{
+		"corp.internal":           "corp.internal",
+		"WWW.corp.internal":       "corp.internal",
+		"lab.corp.internal":       "lab.corp.internal",
+		"a.b.lab.corp.internal":   "lab.corp.internal",
+		"notcorp.internal":        "",
+		"corp.internal.example":   "",
+		"labcorp.internal.com":    "",
+		"www.lab.corp.internal.":  "lab.corp.internal",
+		"www.xlab.corp.internal.": "corp.internal",
+	} {
+		rule := daemon.matchForwardRule(name)
+		if (rule == nil && expected != "") || (rule != nil && rule.Suffix != expected) {
+			t.Fatal(name, rule)
+		}
+	}
+
+	// TCP path tries forwarders in turn
+	query := &Message{ID: 1234, Flags: FlagRD, Questions: []Question{{Name: "www.corp.internal", Type: TypeAAAA, Class: ClassIN}}}
+	packet, err := daemon.ProcessQuery("test", "127.0.0.1", true, query.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := ParseMessage(packet)
+	if err != nil || response.ID != 1234 || len(response.Answers) != 1 || !net.IP(response.Answers[0].Data).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("%+v %v", response, err)
+	}
+	if latest := LatestQueries.GetLatest(1)[0]; latest.Rule != "corp.internal" || latest.Upstream != corpForwarder || latest.Result != QueryResultForwarded {
+		t.Fatalf("%+v", latest)
+	}
+	// Untrusted clients still may not use the forwarders
+	if packet, err := daemon.ProcessQuery("test", "192.0.2.100", false, query.Pack()); packet != nil || err != nil {
+		t.Fatal(packet, err)
+	}
+
+	// UDP path
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	query.Questions[0].Name = "www.lab.corp.internal"
+	daemon.HandleUDPRuleQuery(daemon.matchForwardRule("www.lab.corp.internal"), &UDPQuery{
+		MyServer:    server,
+		ClientAddr:  client.LocalAddr().(*net.UDPAddr),
+		QueryPacket: query.Pack(),
+	})
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, MaxPacketSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, err = ParseMessage(buf[:n]); err != nil || len(response.Answers) != 1 || !net.IP(response.Answers[0].Data).Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Fatalf("%+v %v", response, err)
+	}
+	if latest := LatestQueries.GetLatest(1)[0]; latest.Rule != "lab.corp.internal" || latest.Upstream != labForwarder {
+		t.Fatalf("%+v", latest)
+	}
+
+	// Answers of rule forwarders are subject to rebinding protection, unless the domain is on the allow list
+	daemon.RebindingProtection = RebindingRefuse
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if packet, err := daemon.ProcessQuery("test", "127.0.0.1", true, query.Pack()); err != nil {
+		t.Fatal(err)
+	} else if response, err := ParseMessage(packet); err != nil || response.Rcode() != RcodeRefused {
+		t.Fatalf("%+v %v", response, err)
+	}
+	daemon.HandleUDPRuleQuery(daemon.matchForwardRule("www.lab.corp.internal"), &UDPQuery{
+		MyServer:    server,
+		ClientAddr:  client.LocalAddr().(*net.UDPAddr),
+		QueryPacket: query.Pack(),
+	})
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err = client.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if response, err = ParseMessage(buf[:n]); err != nil || response.Rcode() != RcodeRefused {
+		t.Fatalf("%+v %v", response, err)
+	}
+	daemon.RebindingAllowList = []string{"corp.internal"}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if packet, err := daemon.ProcessQuery("test", "127.0.0.1", true, query.Pack()); err != nil {
+		t.Fatal(err)
+	} else if response, err := ParseMessage(packet); err != nil || len(response.Answers) != 1 {
+		t.Fatalf("%+v %v", response, err)
+	}
+
+	// All forwarders of a rule fail
+	daemon.ForwardRules[1].Forwarders = []string{deadForwarder}
+	if _, err := daemon.ProcessQuery("test", "127.0.0.1", true, query.Pack()); err == nil {
+		t.Fatal("did not error")
+	}
+	if latest := LatestQueries.GetLatest(1)[0]; latest.Result != QueryResultFailed || latest.Rule != "lab.corp.internal" {
+		t.Fatalf("%+v", latest)
+	}
+}
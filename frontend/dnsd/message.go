@@ -0,0 +1,326 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DNS resource record types understood by the daemon.
+const (
+	TypeA      = 1
+	TypeNS     = 2
+	TypeCNAME  = 5
+	TypeSOA    = 6
+	TypePTR    = 12
+	TypeMX     = 15
+	TypeTXT    = 16
+	TypeAAAA   = 28
+	TypeSRV    = 33
+	TypeOPT    = 41
+	TypeDS     = 43
+	TypeRRSIG  = 46
+	TypeNSEC   = 47
+	TypeDNSKEY = 48
+	TypeNSEC3  = 50
+	TypeANY    = 255
+	ClassIN    = 1
+)
+
+// DNS response codes.
+const (
+	RcodeNoError  = 0
+	RcodeFormErr  = 1
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+	RcodeNotImp   = 4
+	RcodeRefused  = 5
+)
+
+// DNS header flag bits.
+const (
+	FlagQR = 1 << 15 // FlagQR indicates a response
+	FlagAA = 1 << 10 // FlagAA indicates an authoritative answer
+	FlagTC = 1 << 9  // FlagTC indicates a truncated response
+	FlagRD = 1 << 8  // FlagRD indicates that recursion is desired by client
+	FlagRA = 1 << 7  // FlagRA indicates that recursion is available from server
+	FlagAD = 1 << 5  // FlagAD indicates that answer is authenticated by DNSSEC
+	FlagCD = 1 << 4  // FlagCD indicates that client does not want server to check DNSSEC
+)
+
+const MaxNameCompressionJumps = 32 // MaxNameCompressionJumps prevents malicious name compression pointer loops.
+
+var ErrMalformedMessage = errors.New("malformed DNS message")
+
+// RecordTypeNames maps DNS record type name to type number.
+var RecordTypeNames = map[string]uint16{
+	"A":      TypeA,
+	"NS":     TypeNS,
+	"CNAME":  TypeCNAME,
+	"SOA":    TypeSOA,
+	"PTR":    TypePTR,
+	"MX":     TypeMX,
+	"TXT":    TypeTXT,
+	"AAAA":   TypeAAAA,
+	"SRV":    TypeSRV,
+	"DS":     TypeDS,
+	"RRSIG":  TypeRRSIG,
+	"NSEC":   TypeNSEC,
+	"DNSKEY": TypeDNSKEY,
+	"NSEC3":  TypeNSEC3,
+	"ANY":    TypeANY,
+}
+
+// Question is an entry of question section in a DNS message.
+type Question struct {
+	Name  string // Name is the domain name without trailing full-stop, e.g. "github.com".
+	Type  uint16
+	Class uint16
+}
+
+/*
+ResourceRecord is an entry of answer, authority, or additional section in a DNS message.
+Domain names embedded in the data of well-known record types are always stored without compression.
+*/
+type ResourceRecord struct {
+	Name  string // Name is the owner name without trailing full-stop, e.g. "github.com".
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// Message is a DNS query or response.
+type Message struct {
+	ID          uint16
+	Flags       uint16
+	Questions   []Question
+	Answers     []ResourceRecord
+	Authorities []ResourceRecord
+	Additionals []ResourceRecord
+}
+
+// Rcode returns the response code carried by message flags.
+func (msg *Message) Rcode() int {
+	return int(msg.Flags & 0xf)
+}
+
+// SetRcode places the response code into message flags.
+func (msg *Message) SetRcode(rcode int) {
+	msg.Flags = msg.Flags&^0xf | uint16(rcode&0xf)
+}
+
+// ParseMessage decodes a DNS message (without TCP length prefix).
+func ParseMessage(packet []byte) (*Message, error) {
+	if len(packet) < 12 {
+		return nil, ErrMalformedMessage
+	}
+	msg := &Message{
+		ID:    binary.BigEndian.Uint16(packet[0:2]),
+		Flags: binary.BigEndian.Uint16(packet[2:4]),
+	}
+	numQuestions := int(binary.BigEndian.Uint16(packet[4:6]))
+	numAnswers := int(binary.BigEndian.Uint16(packet[6:8]))
+	numAuthorities := int(binary.BigEndian.Uint16(packet[8:10]))
+	numAdditionals := int(binary.BigEndian.Uint16(packet[10:12]))
+	offset := 12
+	for i := 0; i < numQuestions; i++ {
+		name, newOffset, err := readName(packet, offset)
+		if err != nil {
+			return nil, err
+		}
+		if newOffset+4 > len(packet) {
+			return nil, ErrMalformedMessage
+		}
+		msg.Questions = append(msg.Questions, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(packet[newOffset : newOffset+2]),
+			Class: binary.BigEndian.Uint16(packet[newOffset+2 : newOffset+4]),
+		})
+		offset = newOffset + 4
+	}
+	var err error
+	for _, section := range []struct {
+		count int
+		rrs   *[]ResourceRecord
+	}{{numAnswers, &msg.Answers}, {numAuthorities, &msg.Authorities}, {numAdditionals, &msg.Additionals}} {
+		for i := 0; i < section.count; i++ {
+			var rr ResourceRecord
+			if rr, offset, err = readResourceRecord(packet, offset); err != nil {
+				return nil, err
+			}
+			*section.rrs = append(*section.rrs, rr)
+		}
+	}
+	return msg, nil
+}
+
+// readResourceRecord decodes a resource record that begins at the offset, and returns offset of the next record.
+func readResourceRecord(packet []byte, offset int) (rr ResourceRecord, newOffset int, err error) {
+	rr.Name, offset, err = readName(packet, offset)
+	if err != nil {
+		return
+	}
+	if offset+10 > len(packet) {
+		err = ErrMalformedMessage
+		return
+	}
+	rr.Type = binary.BigEndian.Uint16(packet[offset : offset+2])
+	rr.Class = binary.BigEndian.Uint16(packet[offset+2 : offset+4])
+	rr.TTL = binary.BigEndian.Uint32(packet[offset+4 : offset+8])
+	dataLen := int(binary.BigEndian.Uint16(packet[offset+8 : offset+10]))
+	offset += 10
+	if offset+dataLen > len(packet) {
+		err = ErrMalformedMessage
+		return
+	}
+	newOffset = offset + dataLen
+	// Decompress domain names in data of well-known types, so that the data remains valid outside of this packet.
+	var numNamesPrefix, numNames int
+	switch rr.Type {
+	case TypeNS, TypeCNAME, TypePTR:
+		numNames = 1
+	case TypeMX:
+		numNamesPrefix, numNames = 2, 1
+	case TypeSOA:
+		numNames = 2
+	}
+	if numNames == 0 {
+		rr.Data = make([]byte, dataLen)
+		copy(rr.Data, packet[offset:newOffset])
+		return
+	}
+	if numNamesPrefix > dataLen {
+		err = ErrMalformedMessage
+		return
+	}
+	data := append([]byte{}, packet[offset:offset+numNamesPrefix]...)
+	nameOffset := offset + numNamesPrefix
+	for i := 0; i < numNames; i++ {
+		var name string
+		if name, nameOffset, err = readName(packet, nameOffset); err != nil {
+			return
+		}
+		data = append(data, PackName(name)...)
+	}
+	if nameOffset > newOffset {
+		err = ErrMalformedMessage
+		return
+	}
+	rr.Data = append(data, packet[nameOffset:newOffset]...)
+	return
+}
+
+/*
+readName decodes a possibly compressed domain name that begins at the offset, and returns the name without trailing
+full-stop as well as the offset right after the name.
+*/
+func readName(packet []byte, offset int) (string, int, error) {
+	labels := make([]string, 0, 8)
+	newOffset := -1
+	for jumps := 0; ; {
+		if offset >= len(packet) {
+			return "", 0, ErrMalformedMessage
+		}
+		labelLen := int(packet[offset])
+		if labelLen == 0 {
+			offset++
+			break
+		}
+		if labelLen&0xc0 == 0xc0 {
+			// Compression pointer
+			if offset+2 > len(packet) || jumps >= MaxNameCompressionJumps {
+				return "", 0, ErrMalformedMessage
+			}
+			if newOffset == -1 {
+				newOffset = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(packet[offset:offset+2]) & 0x3fff)
+			jumps++
+			continue
+		}
+		if labelLen&0xc0 != 0 || offset+1+labelLen > len(packet) {
+			return "", 0, ErrMalformedMessage
+		}
+		labels = append(labels, string(packet[offset+1:offset+1+labelLen]))
+		offset += 1 + labelLen
+	}
+	if newOffset == -1 {
+		newOffset = offset
+	}
+	name := strings.Join(labels, ".")
+	if len(name) > 253 {
+		return "", 0, ErrMalformedMessage
+	}
+	return name, newOffset, nil
+}
+
+// PackName encodes a domain name (trailing full-stop is optional) into wire format without compression.
+func PackName(name string) []byte {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return []byte{0}
+	}
+	ret := make([]byte, 0, len(name)+2)
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		ret = append(ret, byte(len(label)))
+		ret = append(ret, label...)
+	}
+	return append(ret, 0)
+}
+
+// Pack encodes the DNS message into wire format without TCP length prefix.
+func (msg *Message) Pack() []byte {
+	packet := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(packet[0:2], msg.ID)
+	binary.BigEndian.PutUint16(packet[2:4], msg.Flags)
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(msg.Questions)))
+	binary.BigEndian.PutUint16(packet[6:8], uint16(len(msg.Answers)))
+	binary.BigEndian.PutUint16(packet[8:10], uint16(len(msg.Authorities)))
+	binary.BigEndian.PutUint16(packet[10:12], uint16(len(msg.Additionals)))
+	for _, question := range msg.Questions {
+		packet = append(packet, PackName(question.Name)...)
+		packet = append(packet, byte(question.Type>>8), byte(question.Type), byte(question.Class>>8), byte(question.Class))
+	}
+	for _, section := range [][]ResourceRecord{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, rr := range section {
+			packet = append(packet, rr.Pack()...)
+		}
+	}
+	return packet
+}
+
+// Pack encodes the resource record into wire format.
+func (rr ResourceRecord) Pack() []byte {
+	packet := PackName(rr.Name)
+	packet = append(packet, byte(rr.Type>>8), byte(rr.Type), byte(rr.Class>>8), byte(rr.Class))
+	packet = append(packet, byte(rr.TTL>>24), byte(rr.TTL>>16), byte(rr.TTL>>8), byte(rr.TTL))
+	packet = append(packet, byte(len(rr.Data)>>8), byte(len(rr.Data)))
+	return append(packet, rr.Data...)
+}
+
+/*
+MakeResponse creates a response message to the query, the response carries the query's ID, question, opcode, and
+recursion-desired flag.
+*/
+func MakeResponse(query *Message) *Message {
+	return &Message{
+		ID:        query.ID,
+		Flags:     FlagQR | query.Flags&(0x7800|FlagRD|FlagCD),
+		Questions: query.Questions,
+	}
+}
+
+// RecordTypeName returns the name of a record type, or "TYPEnnn" if the type is not well known.
+func RecordTypeName(recordType uint16) string {
+	for name, number := range RecordTypeNames {
+		if number == recordType {
+			return name
+		}
+	}
+	return fmt.Sprintf("TYPE%d", recordType)
+}
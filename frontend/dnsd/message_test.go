@@ -0,0 +1,83 @@
+package dnsd
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	if _, err := ParseMessage(nil); err != ErrMalformedMessage {
+		t.Fatal(err)
+	}
+	// The sample query asks for A record of github.com and carries an EDNS OPT record
+	msg, err := ParseMessage(githubComUDPQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 0xe575 || len(msg.Questions) != 1 || msg.Questions[0] != (Question{Name: "github.com", Type: TypeA, Class: ClassIN}) {
+		t.Fatalf("%+v", msg)
+	}
+	if len(msg.Answers) != 0 || len(msg.Authorities) != 0 || len(msg.Additionals) != 1 || msg.Additionals[0].Type != TypeOPT {
+		t.Fatalf("%+v", msg)
+	}
+	// Packing the parsed message must produce the identical query
+	if packed := msg.Pack(); !bytes.Equal(packed, githubComUDPQuery) {
+		t.Fatal(packed)
+	}
+	// Names in answers and in record data may be compressed
+	response := []byte{
+		0, 1, 0x81, 0x80, 0, 1, 0, 2, 0, 0, 0, 0,
+		6, 'g', 'i', 't', 'h', 'u', 'b', 3, 'c', 'o', 'm', 0, 0, 15, 0, 1, // question github.com MX IN
+		0xc0, 12, 0, 5, 0, 1, 0, 0, 0, 60, 0, 6, 3, 'w', 'w', 'w', 0xc0, 12, // CNAME www.github.com
+		0xc0, 12, 0, 15, 0, 1, 0, 0, 0, 60, 0, 4, 0, 10, 0xc0, 40, // MX 10 www.github.com
+	}
+	msg, err = ParseMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 2 || msg.Answers[0].Name != "github.com" || msg.Answers[0].TTL != 60 {
+		t.Fatalf("%+v", msg)
+	}
+	if !bytes.Equal(msg.Answers[0].Data, PackName("www.github.com")) {
+		t.Fatal(msg.Answers[0].Data)
+	}
+	if !bytes.Equal(msg.Answers[1].Data, append([]byte{0, 10}, PackName("www.github.com")...)) {
+		t.Fatal(msg.Answers[1].Data)
+	}
+	// Decompressed message must survive another round of packing and parsing
+	reparsed, err := ParseMessage(msg.Pack())
+	if err != nil || !reflect.DeepEqual(msg, reparsed) {
+		t.Fatal(err, reparsed)
+	}
+	// Compression pointer must not loop forever
+	loop := []byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 12, 0, 1, 0, 1}
+	if _, err := ParseMessage(loop); err != ErrMalformedMessage {
+		t.Fatal(err)
+	}
+	// Truncated record
+	if _, err := ParseMessage(response[:len(response)-3]); err != ErrMalformedMessage {
+		t.Fatal(err)
+	}
+}
+
+func TestMakeResponse(t *testing.T) {
+	query, err := ParseMessage(githubComUDPQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := MakeResponse(query)
+	response.SetRcode(RcodeNXDomain)
+	if response.ID != query.ID || response.Flags&FlagQR == 0 || response.Flags&FlagAA != 0 || response.Rcode() != RcodeNXDomain {
+		t.Fatalf("%+v", response)
+	}
+	if !reflect.DeepEqual(response.Questions, query.Questions) {
+		t.Fatalf("%+v", response)
+	}
+	if name := RecordTypeName(TypeAAAA); name != "AAAA" {
+		t.Fatal(name)
+	}
+	if name := RecordTypeName(65534); name != "TYPE65534" {
+		t.Fatal(name)
+	}
+}
@@ -0,0 +1,234 @@
+package dnsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/feature"
+	"github.com/HouzuoGuo/laitos/global"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	QueryLogRetention   = 10000            // QueryLogRetention is the number of latest queries kept in memory for statistics.
+	QueryLogMaxFileSize = 16 * 1024 * 1024 // QueryLogMaxFileSize is the size at which on-disk query log is rotated.
+	QueryLogNumBackups  = 3                // QueryLogNumBackups is the number of rotated query log files to keep.
+	QueryStatsTopN      = 10               // QueryStatsTopN is the number of entries in each of the top-N statistics.
+)
+
+// Outcome of a DNS query.
+const (
+	QueryResultForwarded = "forwarded" // QueryResultForwarded means that forwarder answered the query.
+	QueryResultBlocked   = "blocked"   // QueryResultBlocked means that the name is black listed and answered with a black hole.
+	QueryResultZone      = "zone"      // QueryResultZone means that the query is answered from authoritative zones or local records.
+	QueryResultRefused   = "refused"   // QueryResultRefused means that the client is not allowed to query.
+	QueryResultFailed    = "failed"    // QueryResultFailed means that the query could not be answered due to IO error.
+	QueryResultBogus     = "bogus"     // QueryResultBogus means that forwarder's answer failed DNSSEC validation.
+	QueryResultCommand   = "command"   // QueryResultCommand means that the query carried a feature command.
+)
+
+// QueryCounts counts the DNS queries handled by all DNS daemons since startup, keyed by one of the QueryResult* values.
+var QueryCounts = env.NewCounters()
+
+// LatestQueries keeps the latest DNS queries handled by all DNS daemons.
+var LatestQueries = NewQueryLog(QueryLogRetention)
+
+func init() {
+	// Feature package cannot import DNS daemon without causing cyclic import, hence the daemon hands the function over.
+	feature.GetDNSQueryStats = func() string {
+		return LatestQueries.GetStats(QueryStatsTopN).String()
+	}
+}
+
+// QueryLogEntry describes a DNS query and how it was answered.
+type QueryLogEntry struct {
+	Time      time.Time `json:"Time"`      // Time is the moment the query arrived.
+	ClientIP  string    `json:"ClientIP"`  // ClientIP is the IP address of DNS client.
+	Name      string    `json:"Name"`      // Name is the queried domain name.
+	Type      string    `json:"Type"`      // Type is the queried record type, e.g. "A".
+	Result    string    `json:"Result"`    // Result is one of the QueryResult* values.
+	Upstream  string    `json:"Upstream"`  // Upstream is the forwarder address for forwarded queries.
+	Rule      string    `json:"Rule"`      // Rule is the suffix of forward rule that routed the query to upstream.
+	LatencyMS int64     `json:"LatencyMS"` // LatencyMS is the number of milliseconds spent on answering the query.
+}
+
+// NameCount is a name (domain name or client IP) and the number of times it occurred.
+type NameCount struct {
+	Name  string `json:"Name"`
+	Count int    `json:"Count"`
+}
+
+// QueryStats are aggregated from the latest queries kept in query log.
+type QueryStats struct {
+	NumQueries int         `json:"NumQueries"` // NumQueries is the number of queries aggregated into the statistics.
+	NumBlocked int         `json:"NumBlocked"` // NumBlocked is the number of queries made toward black listed names.
+	TopQueried []NameCount `json:"TopQueried"` // TopQueried are the most queried names.
+	TopBlocked []NameCount `json:"TopBlocked"` // TopBlocked are the most queried black listed names.
+	TopClients []NameCount `json:"TopClients"` // TopClients are the clients that made the most queries.
+	Anomalies  []NameCount `json:"Anomalies"`  // Anomalies are the counters of unusual queries and responses (e.g. ANY queries and rate-limited responses) since start-up.
+}
+
+// String returns the statistics in human-readable text.
+func (stats QueryStats) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Queries/blocked: %d/%d\n", stats.NumQueries, stats.NumBlocked)
+	for _, section := range []struct {
+		title   string
+		entries []NameCount
+	}{{"Top queried", stats.TopQueried}, {"Top blocked", stats.TopBlocked}, {"Top clients", stats.TopClients}, {"Anomalies", stats.Anomalies}} {
+		buf.WriteString(section.title + ":")
+		for _, entry := range section.entries {
+			fmt.Fprintf(&buf, " %s(%d)", entry.Name, entry.Count)
+		}
+		buf.WriteRune('\n')
+	}
+	return buf.String()
+}
+
+/*
+QueryLog keeps a bounded number of the latest DNS queries in memory for statistics, and optionally writes all queries
+into a file in JSON, one query per line. The file is rotated when it grows too large.
+*/
+type QueryLog struct {
+	mutex     *sync.Mutex
+	entries   []QueryLogEntry
+	counter   int
+	file      *global.RotatingFile
+	anomalies map[string]int
+}
+
+// NewQueryLog returns an initialised query log that keeps the specified number of latest queries in memory.
+func NewQueryLog(retention int) *QueryLog {
+	return &QueryLog{
+		mutex:     new(sync.Mutex),
+		entries:   make([]QueryLogEntry, retention),
+		anomalies: make(map[string]int),
+	}
+}
+
+// SetFilePath opens the file for appending query log entries. An empty path stops writing entries to file.
+func (ql *QueryLog) SetFilePath(filePath string) error {
+	ql.mutex.Lock()
+	defer ql.mutex.Unlock()
+	if ql.file != nil {
+		ql.file.Close()
+		ql.file = nil
+	}
+	if filePath == "" {
+		return nil
+	}
+	file, err := global.OpenRotatingFile(filePath, QueryLogMaxFileSize, 0, QueryLogNumBackups)
+	if err != nil {
+		return err
+	}
+	ql.file = file
+	return nil
+}
+
+// Add places a query into the log.
+func (ql *QueryLog) Add(entry QueryLogEntry) {
+	ql.mutex.Lock()
+	defer ql.mutex.Unlock()
+	ql.entries[ql.counter%len(ql.entries)] = entry
+	ql.counter++
+	if ql.file == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	// Query log is merely a diagnosis aid, do not let it disrupt DNS service.
+	ql.file.Write(append(line, '\n'))
+}
+
+// CountAnomaly increases the counter of an anomaly (one of the Anomaly* values) by one.
+func (ql *QueryLog) CountAnomaly(anomaly string) {
+	ql.mutex.Lock()
+	ql.anomalies[anomaly]++
+	ql.mutex.Unlock()
+}
+
+// GetLatest returns up to the specified number of latest queries, the latest query comes first.
+func (ql *QueryLog) GetLatest(limit int) []QueryLogEntry {
+	ql.mutex.Lock()
+	defer ql.mutex.Unlock()
+	ret := make([]QueryLogEntry, 0, limit)
+	for i := ql.counter - 1; i >= 0 && i >= ql.counter-len(ql.entries) && len(ret) < limit; i-- {
+		ret = append(ret, ql.entries[i%len(ql.entries)])
+	}
+	return ret
+}
+
+// GetStats aggregates statistics from the latest queries kept in memory.
+func (ql *QueryLog) GetStats(topN int) (stats QueryStats) {
+	queried := make(map[string]int)
+	blocked := make(map[string]int)
+	clients := make(map[string]int)
+	for _, entry := range ql.GetLatest(len(ql.entries)) {
+		stats.NumQueries++
+		queried[entry.Name]++
+		clients[entry.ClientIP]++
+		if entry.Result == QueryResultBlocked {
+			stats.NumBlocked++
+			blocked[entry.Name]++
+		}
+	}
+	stats.TopQueried = topNameCounts(queried, topN)
+	stats.TopBlocked = topNameCounts(blocked, topN)
+	stats.TopClients = topNameCounts(clients, topN)
+	ql.mutex.Lock()
+	stats.Anomalies = topNameCounts(ql.anomalies, len(ql.anomalies))
+	ql.mutex.Unlock()
+	return
+}
+
+// topNameCounts returns up to N names that have the greatest counts, the greatest count comes first.
+func topNameCounts(counts map[string]int, topN int) []NameCount {
+	ret := make([]NameCount, 0, len(counts))
+	for name, count := range counts {
+		ret = append(ret, NameCount{Name: name, Count: count})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count == ret[j].Count {
+			return ret[i].Name < ret[j].Name
+		}
+		return ret[i].Count > ret[j].Count
+	})
+	if len(ret) > topN {
+		ret = ret[:topN]
+	}
+	return ret
+}
+
+// logQuery places the query into query log of all DNS daemons.
+func (dnsd *DNSD) logQuery(clientIP string, queryNoLength []byte, result, upstream string, beginTime time.Time) {
+	entry := QueryLogEntry{
+		Time:      beginTime,
+		ClientIP:  clientIP,
+		Result:    result,
+		Upstream:  upstream,
+		LatencyMS: time.Since(beginTime).Nanoseconds() / 1000000,
+	}
+	if query, err := ParseMessage(queryNoLength); err == nil && len(query.Questions) > 0 {
+		entry.Name = query.Questions[0].Name
+		if upstream != "" {
+			if rule := dnsd.matchForwardRule(entry.Name); rule != nil {
+				entry.Rule = rule.Suffix
+			}
+		}
+		if result == QueryResultCommand {
+			// The name carries PIN, which must not be logged.
+			entry.Name = dnsd.CommandSubdomain
+		}
+		entry.Type = RecordTypeName(query.Questions[0].Type)
+		if query.Questions[0].Type == TypeANY {
+			LatestQueries.CountAnomaly(AnomalyANYQuery)
+		}
+	}
+	LatestQueries.Add(entry)
+	QueryCounts.Add(1, result)
+}
@@ -0,0 +1,89 @@
+package dnsd
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLog_GetStats(t *testing.T) {
+	ql := NewQueryLog(4)
+	if stats := ql.GetStats(2); stats.NumQueries != 0 || len(stats.TopQueried) != 0 || len(ql.GetLatest(10)) != 0 {
+		t.Fatalf("%+v", stats)
+	}
+	// The oldest entry falls out of retention
+	ql.Add(QueryLogEntry{ClientIP: "1.1.1.1", Name: "old.example.com", Result: QueryResultBlocked})
+	ql.Add(QueryLogEntry{ClientIP: "1.1.1.1", Name: "ads.example.com", Result: QueryResultBlocked})
+	ql.Add(QueryLogEntry{ClientIP: "2.2.2.2", Name: "ads.example.com", Result: QueryResultBlocked})
+	ql.Add(QueryLogEntry{ClientIP: "2.2.2.2", Name: "github.com", Result: QueryResultForwarded})
+	ql.Add(QueryLogEntry{ClientIP: "2.2.2.2", Name: "github.com", Result: QueryResultForwarded})
+	ql.CountAnomaly(AnomalyANYQuery)
+	ql.CountAnomaly(AnomalyANYQuery)
+	ql.CountAnomaly(AnomalyTruncated)
+	if latest := ql.GetLatest(2); len(latest) != 2 || latest[0].Name != "github.com" || latest[1].Name != "github.com" {
+		t.Fatal(latest)
+	}
+	stats := ql.GetStats(1)
+	expected := QueryStats{
+		NumQueries: 4,
+		NumBlocked: 2,
+		TopQueried: []NameCount{{Name: "ads.example.com", Count: 2}},
+		TopBlocked: []NameCount{{Name: "ads.example.com", Count: 2}},
+		TopClients: []NameCount{{Name: "2.2.2.2", Count: 3}},
+		Anomalies:  []NameCount{{Name: AnomalyANYQuery, Count: 2}, {Name: AnomalyTruncated, Count: 1}},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("%+v", stats)
+	}
+	if text := stats.String(); !strings.Contains(text, "Queries/blocked: 4/2") || !strings.Contains(text, "Top clients: 2.2.2.2(3)") ||
+		!strings.Contains(text, "Anomalies: any(2) truncated(1)") {
+		t.Fatal(text)
+	}
+}
+
+func TestQueryLog_SetFilePath(t *testing.T) {
+	logFile := "/tmp/test-laitos-dnsd-querylog.txt"
+	defer func() {
+		for _, suffix := range []string{"", ".1", ".2", ".3"} {
+			os.Remove(logFile + suffix)
+		}
+	}()
+	os.Remove(logFile)
+	ql := NewQueryLog(10)
+	if err := ql.SetFilePath(logFile); err != nil {
+		t.Fatal(err)
+	}
+	ql.Add(QueryLogEntry{Time: time.Now(), ClientIP: "1.1.1.1", Name: "github.com", Type: "A", Result: QueryResultForwarded})
+	// Shrink the maximum size so that the next entry rotates the file
+	ql.file.SetRotation(1, 0, QueryLogNumBackups)
+	ql.Add(QueryLogEntry{Time: time.Now(), ClientIP: "1.1.1.1", Name: "ads.example.com", Type: "A", Result: QueryResultBlocked})
+	if err := ql.SetFilePath(""); err != nil {
+		t.Fatal(err)
+	}
+	for suffix, name := range map[string]string{"": "ads.example.com", ".1": "github.com"} {
+		file, err := os.Open(logFile + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(file)
+		var entry QueryLogEntry
+		if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Name != name || scanner.Scan() {
+			t.Fatal(suffix, entry)
+		}
+		file.Close()
+	}
+}
+
+func TestDNSD_logQuery(t *testing.T) {
+	daemon := DNSD{}
+	LatestQueries.Add(QueryLogEntry{})
+	daemon.logQuery("127.0.0.1", githubComUDPQuery, QueryResultForwarded, "8.8.8.8:53", time.Now())
+	latest := LatestQueries.GetLatest(1)
+	if len(latest) != 1 || latest[0].Name != "github.com" || latest[0].Type != "A" || latest[0].ClientIP != "127.0.0.1" || latest[0].Upstream != "8.8.8.8:53" {
+		t.Fatal(latest)
+	}
+}
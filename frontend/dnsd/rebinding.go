@@ -0,0 +1,112 @@
+package dnsd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Modes of DNS rebinding protection.
+const (
+	RebindingStrip  = "strip"  // RebindingStrip removes answers that point to private addresses.
+	RebindingRefuse = "refuse" // RebindingRefuse refuses the entire response if any answer points to a private address.
+)
+
+// PrivateNetworks are the loopback, private, and link-local address ranges that public names should never point to.
+var PrivateNetworks = mustParseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10",
+)
+
+// mustParseCIDRs parses network addresses in CIDR notation, it panics if any of them is malformed.
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	ret := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, network)
+	}
+	return ret
+}
+
+// IsPrivateIP returns true only if the IP address is a loopback, private, or link-local address.
+func IsPrivateIP(ip net.IP) bool {
+	// IPv4-mapped IPv6 addresses are checked as IPv4 addresses
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	for _, network := range PrivateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// initialiseRebinding checks rebinding protection mode and prepares the allow list of local domains.
+func (dnsd *DNSD) initialiseRebinding() error {
+	dnsd.RebindingProtection = strings.ToLower(strings.TrimSpace(dnsd.RebindingProtection))
+	if dnsd.RebindingProtection != "" && dnsd.RebindingProtection != RebindingStrip && dnsd.RebindingProtection != RebindingRefuse {
+		return fmt.Errorf("DNSD.Initialise: RebindingProtection must be empty, \"%s\", or \"%s\"", RebindingStrip, RebindingRefuse)
+	}
+	dnsd.rebindingAllowHash = make(map[string]struct{})
+	for _, name := range dnsd.RebindingAllowList {
+		dnsd.rebindingAllowHash[strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")] = struct{}{}
+	}
+	return nil
+}
+
+// isRebindingAllowed returns true only if the name or any of its parent domains is on the rebinding allow list.
+func (dnsd *DNSD) isRebindingAllowed(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for {
+		if _, allowed := dnsd.rebindingAllowHash[name]; allowed {
+			return true
+		}
+		index := strings.IndexRune(name, '.')
+		if index < 0 {
+			return false
+		}
+		name = name[index+1:]
+	}
+}
+
+/*
+checkRebinding protects clients against DNS rebinding attack by inspecting forwarder's response (without length prefix)
+for A and AAAA answers that point to private addresses. Depending on the protection mode, such answers are either
+removed from the response, or the entire response is replaced by REFUSED. Names on the allow list are not inspected.
+*/
+func (dnsd *DNSD) checkRebinding(functionName, clientIP string, responseNoLength []byte) []byte {
+	if dnsd.RebindingProtection == "" {
+		return responseNoLength
+	}
+	response, err := ParseMessage(responseNoLength)
+	if err != nil || len(response.Questions) == 0 || dnsd.isRebindingAllowed(response.Questions[0].Name) {
+		return responseNoLength
+	}
+	answers := make([]ResourceRecord, 0, len(response.Answers))
+	for _, rr := range response.Answers {
+		if (rr.Type == TypeA || rr.Type == TypeAAAA) && IsPrivateIP(net.IP(rr.Data)) {
+			if dnsd.RebindingProtection == RebindingRefuse {
+				dnsd.Logger.Warningf(functionName, clientIP, nil, "refused response of \"%s\" that points to private address %s (possible DNS rebinding)",
+					response.Questions[0].Name, net.IP(rr.Data).String())
+				refusal := MakeResponse(response)
+				refusal.Flags |= FlagRA
+				refusal.SetRcode(RcodeRefused)
+				return refusal.Pack()
+			}
+			dnsd.Logger.Warningf(functionName, clientIP, nil, "removed answer of \"%s\" that points to private address %s (possible DNS rebinding)",
+				response.Questions[0].Name, net.IP(rr.Data).String())
+			continue
+		}
+		answers = append(answers, rr)
+	}
+	if len(answers) == len(response.Answers) {
+		return responseNoLength
+	}
+	response.Answers = answers
+	response.Flags &^= FlagAD
+	return response.Pack()
+}
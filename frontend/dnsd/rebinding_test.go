@@ -0,0 +1,118 @@
+package dnsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	for ip, expected := range map[string]bool{
+		"0.0.0.0":          true,
+		"10.1.2.3":         true,
+		"100.64.0.1":       true,
+		"127.0.0.1":        true,
+		"169.254.169.254":  true,
+		"172.16.0.1":       true,
+		"172.31.255.255":   true,
+		"192.168.1.1":      true,
+		"::1":              true,
+		"::":               true,
+		"fd00::1":          true,
+		"fe80::1":          true,
+		"::ffff:127.0.0.1": true,
+		"8.8.8.8":          false,
+		"172.32.0.1":       false,
+		"192.169.0.1":      false,
+		"2001:db8::1":      false,
+		"::ffff:8.8.8.8":   false,
+	} {
+		if IsPrivateIP(net.ParseIP(ip)) != expected {
+			t.Fatal(ip)
+		}
+	}
+}
+
+func TestDNSD_checkRebinding(t *testing.T) {
+	daemon := DNSD{
+		Address:              "127.0.0.1",
+		UDPPort:              61259,
+		UDPForwarder:         "8.8.8.8:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		RebindingProtection:  "bogus",
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "RebindingProtection") {
+		t.Fatal(err)
+	}
+	// Protection is turned off by default
+	daemon.RebindingProtection = ""
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	response := &Message{
+		ID:        1234,
+		Flags:     FlagQR | FlagRD | FlagRA | FlagAD,
+		Questions: []Question{{Name: "evil.example.com", Type: TypeA, Class: ClassIN}},
+		Answers: []ResourceRecord{
+			{Name: "evil.example.com", Type: TypeCNAME, Class: ClassIN, TTL: 60, Data: PackName("target.example.com")},
+			{Name: "target.example.com", Type: TypeA, Class: ClassIN, TTL: 60, Data: []byte{192, 168, 1, 1}},
+			{Name: "target.example.com", Type: TypeA, Class: ClassIN, TTL: 60, Data: []byte{192, 0, 2, 1}},
+		},
+	}
+	packet := response.Pack()
+	if filtered := daemon.checkRebinding("test", "127.0.0.1", packet); string(filtered) != string(packet) {
+		t.Fatal("should not have filtered")
+	}
+
+	// Strip private addresses
+	daemon.RebindingProtection = " Strip "
+	daemon.RebindingAllowList = []string{"Home.Lan."}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	filtered, err := ParseMessage(daemon.checkRebinding("test", "127.0.0.1", packet))
+	if err != nil || filtered.ID != 1234 || filtered.Flags&FlagAD != 0 || len(filtered.Answers) != 2 ||
+		filtered.Answers[0].Type != TypeCNAME || !net.IP(filtered.Answers[1].Data).Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("%+v %v", filtered, err)
+	}
+	// Public addresses are untouched
+	public := &Message{ID: 1234, Flags: FlagQR, Questions: response.Questions, Answers: response.Answers[2:]}
+	if filtered := daemon.checkRebinding("test", "127.0.0.1", public.Pack()); string(filtered) != string(public.Pack()) {
+		t.Fatal("should not have filtered")
+	}
+	// Local domains are allowed to have private addresses
+	local := &Message{
+		ID:        1234,
+		Flags:     FlagQR,
+		Questions: []Question{{Name: "NAS.home.lan", Type: TypeAAAA, Class: ClassIN}},
+		Answers:   []ResourceRecord{{Name: "NAS.home.lan", Type: TypeAAAA, Class: ClassIN, TTL: 60, Data: net.ParseIP("fd00::1")}},
+	}
+	if filtered := daemon.checkRebinding("test", "127.0.0.1", local.Pack()); string(filtered) != string(local.Pack()) {
+		t.Fatal("should not have filtered")
+	}
+	local.Questions[0].Name = "nas.notthehome.lan"
+	if filtered, err := ParseMessage(daemon.checkRebinding("test", "127.0.0.1", local.Pack())); err != nil || len(filtered.Answers) != 0 {
+		t.Fatalf("%+v %v", filtered, err)
+	}
+
+	// Refuse the whole response
+	daemon.RebindingProtection = RebindingRefuse
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if filtered, err := ParseMessage(daemon.checkRebinding("test", "127.0.0.1", packet)); err != nil || filtered.ID != 1234 ||
+		filtered.Rcode() != RcodeRefused || len(filtered.Answers) != 0 {
+		t.Fatalf("%+v %v", filtered, err)
+	}
+
+	// Forwarded answers are inspected
+	forwarder, stop := startFakeForwarder(t, net.IPv4(127, 0, 0, 1))
+	defer stop()
+	daemon.TCPForwarder = forwarder
+	query := &Message{ID: 1234, Flags: FlagRD, Questions: []Question{{Name: "evil.example.com", Type: TypeA, Class: ClassIN}}}
+	packet, err = daemon.ProcessQuery("test", "127.0.0.1", true, query.Pack())
+	if filtered, err := ParseMessage(packet); err != nil || filtered.Rcode() != RcodeRefused {
+		t.Fatalf("%+v %v", filtered, err)
+	}
+}
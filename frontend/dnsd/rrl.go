@@ -0,0 +1,163 @@
+package dnsd
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/laitos/global"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	RRLSlipRatio     = 2  // RRLSlipRatio is the ratio of rate-limited responses of which one is sent as a truncated response instead of being dropped.
+	IPv4NetblockBits = 24 // IPv4NetblockBits is the prefix length of IPv4 netblocks that share a response rate limit.
+	IPv6NetblockBits = 56 // IPv6NetblockBits is the prefix length of IPv6 netblocks that share a response rate limit.
+)
+
+// Names of anomaly counters in query statistics.
+const (
+	AnomalyANYQuery    = "any"          // AnomalyANYQuery counts queries of type ANY.
+	AnomalyTruncated   = "truncated"    // AnomalyTruncated counts UDP responses truncated to fit client's buffer size.
+	AnomalyRateLimited = "rate-limited" // AnomalyRateLimited counts UDP responses dropped by response rate limit.
+	AnomalySlipped     = "slipped"      // AnomalySlipped counts UDP responses replaced by truncated response due to response rate limit.
+)
+
+// Netblock returns the network address (in CIDR notation) of the netblock the IP address belongs to.
+func Netblock(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return fmt.Sprintf("%s/%d", ipv4.Mask(net.CIDRMask(IPv4NetblockBits, 32)), IPv4NetblockBits)
+	}
+	return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(IPv6NetblockBits, 128)), IPv6NetblockBits)
+}
+
+/*
+ResponseRateLimit allows a netblock to receive no more than certain number of response bytes per unit of time. It
+prevents the daemon from being used to reflect and amplify traffic toward a victim whose address is spoofed by
+attacker. Among the responses that exceed the limit, one in every RRLSlipRatio "slips" through as a small truncated
+response, so that legitimate clients may retry over TCP.
+*/
+type ResponseRateLimit struct {
+	UnitSecs      int64
+	MaxBytes      int
+	Logger        global.Logger
+	lastTimestamp int64
+	bytes         map[string]int
+	exceeded      map[string]int
+	mutex         *sync.Mutex
+}
+
+// Initialise response rate limiter internal states.
+func (limit *ResponseRateLimit) Initialise() {
+	limit.bytes = make(map[string]int)
+	limit.exceeded = make(map[string]int)
+	limit.mutex = new(sync.Mutex)
+	if limit.UnitSecs < 1 || limit.MaxBytes < 1 {
+		limit.Logger.Panicf("Initialise", "ResponseRateLimit", nil, "UnitSecs and MaxBytes must be greater than 0")
+		return
+	}
+}
+
+// SetMaxBytes changes the max limit, usually to apply a freshly loaded configuration. Counters carry on as they are.
+func (limit *ResponseRateLimit) SetMaxBytes(maxBytes int) {
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+	limit.MaxBytes = maxBytes
+}
+
+/*
+Add counts the response size toward the netblock's limit. If the netblock has not exceeded the limit, the function
+returns true and the response may be sent. Otherwise, the function returns false, and slip tells whether a truncated
+response should be sent in place of the response.
+*/
+func (limit *ResponseRateLimit) Add(netblock string, size int) (allow, slip bool) {
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+	// Reset all counters if unit of time has past
+	if now := time.Now().Unix(); now-limit.lastTimestamp >= limit.UnitSecs {
+		limit.bytes = make(map[string]int)
+		limit.exceeded = make(map[string]int)
+		limit.lastTimestamp = now
+	}
+	if limit.bytes[netblock]+size <= limit.MaxBytes {
+		limit.bytes[netblock] += size
+		return true, false
+	}
+	if limit.exceeded[netblock] == 0 {
+		limit.Logger.Warningf("Add", "ResponseRateLimit", nil, "%s exceeded limit of %d response bytes per %d seconds", netblock, limit.MaxBytes, limit.UnitSecs)
+	}
+	limit.exceeded[netblock]++
+	return false, limit.exceeded[netblock]%RRLSlipRatio == 0
+}
+
+// getClientOPT returns the EDNS OPT record of client query, or nil if client does not use EDNS.
+func getClientOPT(query *Message) *ResourceRecord {
+	for i, rr := range query.Additionals {
+		if rr.Type == TypeOPT {
+			return &query.Additionals[i]
+		}
+	}
+	return nil
+}
+
+// clientUDPSize returns the maximum size of UDP response advertised by client, which is at least 512 bytes.
+func clientUDPSize(query *Message) int {
+	if opt := getClientOPT(query); opt != nil && int(opt.Class) > MaxUDPResponseSize {
+		return int(opt.Class)
+	}
+	return MaxUDPResponseSize
+}
+
+// truncateResponse removes all records except OPT from the response and sets TC flag, so that client will retry over TCP.
+func truncateResponse(response *Message) []byte {
+	LatestQueries.CountAnomaly(AnomalyTruncated)
+	response.Flags |= FlagTC
+	response.Answers, response.Authorities = nil, nil
+	additionals := make([]ResourceRecord, 0, 1)
+	for _, rr := range response.Additionals {
+		if rr.Type == TypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+	response.Additionals = additionals
+	return response.Pack()
+}
+
+/*
+answerUDP sends the response (without length prefix) to UDP client. The response is truncated if it exceeds the buffer
+size advertised by client, and it is subject to response rate limit of the client's netblock.
+*/
+func (dnsd *DNSD) answerUDP(functionName string, server *net.UDPConn, clientAddr *net.UDPAddr, queryNoLength, responseNoLength []byte) {
+	clientIP := clientAddr.IP.String()
+	if len(responseNoLength) > MaxUDPResponseSize {
+		query, err := ParseMessage(queryNoLength)
+		if err != nil {
+			return
+		}
+		if len(responseNoLength) > clientUDPSize(query) {
+			response, err := ParseMessage(responseNoLength)
+			if err != nil {
+				dnsd.Logger.Warningf(functionName, clientIP, err, "failed to parse oversized response")
+				return
+			}
+			responseNoLength = truncateResponse(response)
+		}
+	}
+	if allow, slip := dnsd.ResponseRateLimit.Add(Netblock(clientAddr.IP), len(responseNoLength)); !allow {
+		if !slip {
+			LatestQueries.CountAnomaly(AnomalyRateLimited)
+			return
+		}
+		LatestQueries.CountAnomaly(AnomalySlipped)
+		query, err := ParseMessage(queryNoLength)
+		if err != nil {
+			return
+		}
+		slipResponse := MakeResponse(query)
+		slipResponse.Flags |= FlagRA | FlagTC
+		responseNoLength = slipResponse.Pack()
+	}
+	server.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+	if _, err := server.WriteTo(responseNoLength, clientAddr); err != nil {
+		dnsd.Logger.Warningf(functionName, clientIP, err, "failed to answer to client")
+	}
+}
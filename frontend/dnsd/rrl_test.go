@@ -0,0 +1,121 @@
+package dnsd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetblock(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"192.0.2.123":            "192.0.2.0/24",
+		"::ffff:192.0.2.123":     "192.0.2.0/24",
+		"2001:db8:1:2:3:4:5:6":   "2001:db8:1::/56",
+		"2001:db8:1:2ff::1":      "2001:db8:1:200::/56",
+		"2001:db8:ffff:ffff::99": "2001:db8:ffff:ff00::/56",
+	} {
+		if netblock := Netblock(net.ParseIP(ip)); netblock != expected {
+			t.Fatal(ip, netblock)
+		}
+	}
+}
+
+func TestResponseRateLimit(t *testing.T) {
+	limit := &ResponseRateLimit{UnitSecs: 1, MaxBytes: 1000}
+	limit.Initialise()
+	for i := 0; i < 10; i++ {
+		if allow, slip := limit.Add("192.0.2.0/24", 100); !allow || slip {
+			t.Fatal(i)
+		}
+	}
+	// Other netblocks are not affected
+	if allow, _ := limit.Add("198.51.100.0/24", 1000); !allow {
+		t.Fatal("should have allowed")
+	}
+	// Every other rate-limited response slips through
+	for i := 0; i < 10; i++ {
+		if allow, slip := limit.Add("192.0.2.0/24", 100); allow || slip != (i%2 == 1) {
+			t.Fatal(i, allow, slip)
+		}
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if allow, _ := limit.Add("192.0.2.0/24", 1000); !allow {
+		t.Fatal("should have allowed")
+	}
+}
+
+func TestDNSD_answerUDP(t *testing.T) {
+	daemon := DNSD{
+		Address:                  "127.0.0.1",
+		UDPPort:                  61260,
+		UDPForwarder:             "8.8.8.8:53",
+		PerIPLimit:               10,
+		PerNetblockResponseBytes: 1500,
+		AllowQueryIPPrefixes:     []string{"127"},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, MaxPacketSize)
+	read := func() *Message {
+		client.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			return nil
+		}
+		response, err := ParseMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	query := &Message{ID: 1234, Flags: FlagRD, Questions: []Question{{Name: "big.example.com", Type: TypeTXT, Class: ClassIN}}}
+	response := MakeResponse(query)
+	for i := 0; i < 5; i++ {
+		response.Answers = append(response.Answers, ResourceRecord{Name: "big.example.com", Type: TypeTXT, Class: ClassIN, TTL: 60, Data: make([]byte, 200)})
+	}
+	// Client without EDNS gets a truncated response
+	daemon.answerUDP("test", server, clientAddr, query.Pack(), response.Pack())
+	if truncated := read(); truncated == nil || truncated.ID != 1234 || truncated.Flags&FlagTC == 0 || len(truncated.Answers) != 0 {
+		t.Fatalf("%+v", truncated)
+	}
+	// Client with large enough buffer gets the full response
+	query.Additionals = []ResourceRecord{{Type: TypeOPT, Class: 1232}}
+	daemon.answerUDP("test", server, clientAddr, query.Pack(), response.Pack())
+	if full := read(); full == nil || full.Flags&FlagTC != 0 || len(full.Answers) != 5 {
+		t.Fatalf("%+v", full)
+	}
+	// The netblock has now received more than 1000 bytes, further large responses are dropped or slipped.
+	daemon.answerUDP("test", server, clientAddr, query.Pack(), response.Pack())
+	if dropped := read(); dropped != nil {
+		t.Fatalf("%+v", dropped)
+	}
+	daemon.answerUDP("test", server, clientAddr, query.Pack(), response.Pack())
+	if slipped := read(); slipped == nil || slipped.ID != 1234 || slipped.Flags&FlagTC == 0 || len(slipped.Answers) != 0 {
+		t.Fatalf("%+v", slipped)
+	}
+	stats := LatestQueries.GetStats(10)
+	for _, anomaly := range []string{AnomalyTruncated, AnomalyRateLimited, AnomalySlipped} {
+		found := false
+		for _, counter := range stats.Anomalies {
+			if counter.Name == anomaly && counter.Count > 0 {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatal(anomaly, stats.Anomalies)
+		}
+	}
+}
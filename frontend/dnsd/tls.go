@@ -0,0 +1,165 @@
+package dnsd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/global"
+	"github.com/HouzuoGuo/laitos/testingstub"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MaxTLSQueriesPerConn = 100 // MaxTLSQueriesPerConn is the maximum number of queries a DNS-over-TLS client may send over one connection.
+
+var TLSDurationStats = env.NewStats() // TLSDurationStats stores statistics of duration of all DNS-over-TLS connections.
+
+/*
+HandleTLSConnection answers DNS-over-TLS queries that arrive on the connection. Client is authorised by a certificate
+signed by client CA. Unlike plain DNS-over-TCP, the client may send more than one query over the same connection.
+*/
+func (dnsd *DNSD) HandleTLSConnection(clientConn net.Conn) {
+	// Put conversation duration (including IO time) into statistics
+	beginTimeNano := time.Now().UnixNano()
+	defer func() {
+		TLSDurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
+	}()
+	defer clientConn.Close()
+	clientIP := clientConn.RemoteAddr().(*net.TCPAddr).IP.String()
+	if !dnsd.RateLimit.Add(clientIP, true) {
+		return
+	}
+	tlsConn := clientConn.(*tls.Conn)
+	tlsConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		dnsd.Logger.Warningf("HandleTLSConnection", clientIP, err, "failed to complete TLS handshake")
+		return
+	}
+	connState := tlsConn.ConnectionState()
+	if !dnsd.CheckSecureClient("", &connState) {
+		dnsd.Logger.Warningf("HandleTLSConnection", clientIP, nil, "client did not present a valid certificate")
+		return
+	}
+	for i := 0; i < MaxTLSQueriesPerConn; i++ {
+		if global.EmergencyLockDown {
+			return
+		}
+		tlsConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+		queryBuf, err := ReadTCPPacket(tlsConn)
+		if err != nil {
+			if err != io.EOF {
+				dnsd.Logger.Warningf("HandleTLSConnection", clientIP, err, "failed to read query from client")
+			}
+			return
+		}
+		// Every query counts toward rate limit
+		if i > 0 && !dnsd.RateLimit.Add(clientIP, true) {
+			return
+		}
+		responseBuf, err := dnsd.ProcessQuery("HandleTLSConnection", clientIP, true, queryBuf)
+		if err != nil {
+			dnsd.Logger.Warningf("HandleTLSConnection", clientIP, err, "failed to forward query")
+			return
+		}
+		if err := WriteTCPPacket(tlsConn, responseBuf); err != nil {
+			dnsd.Logger.Warningf("HandleTLSConnection", clientIP, err, "failed to answer to client")
+			return
+		}
+	}
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start DNS daemon to listen on DNS-over-TLS port only, until daemon is told to stop.
+*/
+func (dnsd *DNSD) StartAndBlockTLS() error {
+	listenAddr := fmt.Sprintf("%s:%d", dnsd.Address, dnsd.TLSPort)
+	listener, err := tls.Listen("tcp", listenAddr, dnsd.TLSConfig)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	dnsd.TLSListener = listener
+	// Process incoming DNS-over-TLS connections
+	dnsd.Logger.Printf("StartAndBlockTLS", listenAddr, nil, "going to listen for queries")
+	for {
+		if global.EmergencyLockDown {
+			return global.ErrEmergencyLockDown
+		}
+		clientConn, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return nil
+			}
+			return fmt.Errorf("DNSD.StartAndBlockTLS: failed to accept new connection - %v", err)
+		}
+		go dnsd.HandleTLSConnection(clientConn)
+	}
+}
+
+/*
+Run unit tests on DNS-over-TLS daemon. See TestDNSD_StartAndBlockTLS for daemon setup.
+The client certificate must be signed by daemon's client CA, and github.com must not be resolvable by its forwarder.
+*/
+func TestTLSQueries(dnsd *DNSD, clientCert tls.Certificate, t testingstub.T) {
+	// Prevent daemon from listening to UDP and TCP queries in this TLS test case
+	udpListenPort, tcpListenPort := dnsd.UDPPort, dnsd.TCPPort
+	dnsd.UDPPort = 0
+	dnsd.TCPPort = 0
+	defer func() {
+		dnsd.UDPPort = udpListenPort
+		dnsd.TCPPort = tcpListenPort
+	}()
+	var stoppedNormally bool
+	go func() {
+		if err := dnsd.StartAndBlock(); err != nil {
+			t.Fatal(err)
+		}
+		stoppedNormally = true
+	}()
+	// Server should start within two seconds
+	time.Sleep(2 * time.Second)
+	serverAddr := "127.0.0.1:" + strconv.Itoa(dnsd.TLSPort)
+	// Client without a certificate is disconnected without an answer
+	clientConn, err := tls.Dial("tcp", serverAddr, &tls.Config{InsecureSkipVerify: true, ServerName: "dns.example.com"})
+	if err == nil {
+		clientConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+		WriteTCPPacket(clientConn, githubComUDPQuery)
+		if resp, err := ReadTCPPacket(clientConn); err == nil {
+			t.Fatal("should not have answered", resp)
+		}
+		clientConn.Close()
+	}
+	// Black list github and see if query gets a black hole response, two queries are sent over the same connection.
+	dnsd.BlackListMutex.Lock()
+	dnsd.BlackList["github.com"] = struct{}{}
+	dnsd.BlackListMutex.Unlock()
+	clientConn, err = tls.Dial("tcp", serverAddr, &tls.Config{InsecureSkipVerify: true, ServerName: "dns.example.com", Certificates: []tls.Certificate{clientCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+	for i := 0; i < 2; i++ {
+		if err := WriteTCPPacket(clientConn, githubComUDPQuery); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ReadTCPPacket(clientConn)
+		if err != nil || bytes.Index(resp, BlackHoleAnswer) == -1 {
+			t.Fatal(err, resp)
+		}
+	}
+	clientConn.Close()
+	// Daemon must stop in a second
+	dnsd.Stop()
+	time.Sleep(1 * time.Second)
+	if !stoppedNormally {
+		t.Fatal("did not stop")
+	}
+	// Repeatedly stopping the daemon should have no negative consequence
+	dnsd.Stop()
+	dnsd.Stop()
+}
@@ -21,28 +21,36 @@ func (dnsd *DNSD) HandleUDPQueries(myQueue chan *UDPQuery, forwarderConn net.Con
 	for {
 		query := <-myQueue
 		// Put query duration (including IO time) into statistics
-		beginTimeNano := time.Now().UnixNano()
+		beginTime := time.Now()
+		beginTimeNano := beginTime.UnixNano()
+		clientIP := query.ClientAddr.IP.String()
+		forwardQuery, clientQuery := dnsd.prepareForwardQuery(query.QueryPacket)
 		// Set deadline for IO with forwarder
 		forwarderConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
-		if _, err := forwarderConn.Write(query.QueryPacket); err != nil {
+		if _, err := forwarderConn.Write(forwardQuery); err != nil {
 			dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to write to forwarder")
-			UDPDurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+			dnsd.logQuery(clientIP, query.QueryPacket, QueryResultFailed, forwarderConn.RemoteAddr().String(), beginTime)
+			UDPDurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 			continue
 		}
 		packetLength, err := forwarderConn.Read(packetBuf)
 		if err != nil {
 			dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to read from forwarder")
-			UDPDurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+			dnsd.logQuery(clientIP, query.QueryPacket, QueryResultFailed, forwarderConn.RemoteAddr().String(), beginTime)
+			UDPDurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 			continue
 		}
-		// Set deadline for responding to my DNS client
-		query.MyServer.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
-		if _, err := query.MyServer.WriteTo(packetBuf[:packetLength], query.ClientAddr); err != nil {
-			dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to answer to client")
-			UDPDurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
-			continue
+		response, result := packetBuf[:packetLength], QueryResultForwarded
+		if clientQuery != nil {
+			var status string
+			if response, status = dnsd.validateResponse("HandleUDPQueries", clientIP, clientQuery, response, true); status == DNSSECBogus {
+				result = QueryResultBogus
+			}
 		}
-		UDPDurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+		response = dnsd.checkRebinding("HandleUDPQueries", clientIP, response)
+		dnsd.logQuery(clientIP, query.QueryPacket, result, forwarderConn.RemoteAddr().String(), beginTime)
+		dnsd.answerUDP("HandleUDPQueries", query.MyServer, query.ClientAddr, query.QueryPacket, response)
+		UDPDurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 	}
 }
 
@@ -51,14 +59,12 @@ func (dnsd *DNSD) HandleBlackHoleAnswer(myQueue chan *UDPQuery) {
 	for {
 		query := <-myQueue
 		// Put query duration (including IO time) into statistics
-		beginTimeNano := time.Now().UnixNano()
-		// Set deadline for responding to my DNS client
+		beginTime := time.Now()
+		beginTimeNano := beginTime.UnixNano()
 		blackHoleAnswer := RespondWith0(query.QueryPacket)
-		query.MyServer.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
-		if _, err := query.MyServer.WriteTo(blackHoleAnswer, query.ClientAddr); err != nil {
-			dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "IO failure")
-		}
-		UDPDurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+		dnsd.logQuery(query.ClientAddr.IP.String(), query.QueryPacket, QueryResultBlocked, "", beginTime)
+		dnsd.answerUDP("HandleBlackHoleAnswer", query.MyServer, query.ClientAddr, query.QueryPacket, blackHoleAnswer)
+		UDPDurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 	}
 }
 
@@ -67,6 +73,17 @@ You may call this function only after having called Initialise()!
 Start DNS daemon to listen on UDP port only, until daemon is told to stop.
 */
 func (dnsd *DNSD) StartAndBlockUDP() error {
+	// Connect to forwarder, the connections are kept for subsequent starts of the daemon.
+	for i := range dnsd.UDPForwarderConns {
+		if dnsd.UDPForwarderConns[i] != nil {
+			continue
+		}
+		forwarderConn, err := net.DialTimeout("udp", dnsd.UDPForwarder, IOTimeoutSec*time.Second)
+		if err != nil {
+			return fmt.Errorf("DNSD.StartAndBlockUDP: failed to connect to forwarder - %v", err)
+		}
+		dnsd.UDPForwarderConns[i] = forwarderConn
+	}
 	listenAddr := fmt.Sprintf("%s:%d", dnsd.Address, dnsd.UDPPort)
 	udpAddr, err := net.ResolveUDPAddr("udp", listenAddr)
 	if err != nil {
@@ -99,22 +116,49 @@ func (dnsd *DNSD) StartAndBlockUDP() error {
 			}
 			return fmt.Errorf("DNSD.StartAndBlockUDP: failed to accept new connection - %v", err)
 		}
-		// Check address against rate limit and allowed IP prefixes
+		// Check address against rate limit
 		clientIP := clientAddr.IP.String()
 		if !dnsd.RateLimit.Add(clientIP, true) {
 			continue
 		}
-		if !dnsd.checkAllowClientIP(clientIP) {
+		forwardPacket := make([]byte, packetLength)
+		copy(forwardPacket, packetBuf[:packetLength])
+		// Anyone may query authoritative zones, but only clients among allowed IP prefixes may query other names.
+		isTrusted := dnsd.checkAllowClientIP(clientIP)
+		beginTime := time.Now()
+		if query := dnsd.commandQuery(forwardPacket); query != nil {
+			// Command execution takes a while, do not let it hold up other queries.
+			go func(clientAddr *net.UDPAddr, forwardPacket []byte) {
+				response := dnsd.AnswerCommand("UDPLoop", clientIP, query)
+				dnsd.logQuery(clientIP, forwardPacket, QueryResultCommand, "", beginTime)
+				dnsd.answerUDP("UDPLoop", udpServer, clientAddr, forwardPacket, response)
+			}(clientAddr, forwardPacket)
+			continue
+		}
+		if response := dnsd.AnswerFromZones("UDPLoop", clientIP, isTrusted, forwardPacket); response != nil {
+			dnsd.logQuery(clientIP, forwardPacket, QueryResultZone, "", beginTime)
+			dnsd.answerUDP("UDPLoop", udpServer, clientAddr, forwardPacket, response)
+			continue
+		}
+		if !isTrusted {
 			dnsd.Logger.Warningf("UDPLoop", clientIP, nil, "client IP is not allowed to query")
+			dnsd.logQuery(clientIP, forwardPacket, QueryResultRefused, "", beginTime)
 			continue
 		}
 
 		// Prepare parameters for forwarding the query
 		randForwarder := rand.Intn(len(dnsd.UDPForwarderQueues))
-		forwardPacket := make([]byte, packetLength)
-		copy(forwardPacket, packetBuf[:packetLength])
 		domainName := ExtractDomainName(forwardPacket)
-		if len(domainName) == 0 {
+		isBlackListed := len(domainName) > 0 && dnsd.NamesAreBlackListed(domainName)
+		if rule := dnsd.forwardRuleOf(forwardPacket); rule != nil && !isBlackListed {
+			// The name belongs to a dedicated forwarder
+			dnsd.Logger.Printf("UDPLoop", clientIP, nil, "handle query via forward rule \"%s\"", rule.Suffix)
+			go dnsd.HandleUDPRuleQuery(rule, &UDPQuery{
+				ClientAddr:  clientAddr,
+				MyServer:    udpServer,
+				QueryPacket: forwardPacket,
+			})
+		} else if len(domainName) == 0 {
 			// If I cannot figure out what domain is from the query, simply forward it without much concern.
 			dnsd.Logger.Printf(fmt.Sprintf("UDP-%d", randForwarder), clientIP, nil,
 				"handle non-name query (backlog %d)", len(dnsd.UDPForwarderQueues[randForwarder]))
@@ -123,7 +167,7 @@ func (dnsd *DNSD) StartAndBlockUDP() error {
 				MyServer:    udpServer,
 				QueryPacket: forwardPacket,
 			}
-		} else if dnsd.NamesAreBlackListed(domainName) {
+		} else if isBlackListed {
 			// Requested domain name is black-listed
 			randBlackListResponder := rand.Intn(len(dnsd.UDPBlackHoleQueues))
 			dnsd.Logger.Printf(fmt.Sprintf("UDP-%d", randBlackListResponder), clientIP, nil,
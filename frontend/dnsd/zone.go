@@ -0,0 +1,799 @@
+package dnsd
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultZoneTTL   = 3600 // DefaultZoneTTL is the TTL of zone records that do not specify their own TTL.
+	MaxCNAMEChainLen = 8    // MaxCNAMEChainLen is the maximum number of CNAME records followed within a zone for one query.
+)
+
+// ZoneRecord is a resource record of an authoritative zone or local record, written in the style of a zone file.
+type ZoneRecord struct {
+	Name  string `json:"Name"`  // Owner name relative to zone origin, "@" for the origin itself, "*" for wildcard; a name that ends with full-stop is absolute.
+	Type  string `json:"Type"`  // A, AAAA, CNAME, MX, TXT, NS, SOA, SRV, or pre-signed DNSSEC records DS, DNSKEY, RRSIG, NSEC, and NSEC3
+	TTL   int    `json:"TTL"`   // (Optional) TTL in seconds, defaults to zone's default TTL.
+	Value string `json:"Value"` // Record data in zone file presentation format, e.g. "10 mail.example.com." for MX.
+}
+
+/*
+Zone is a collection of resource records that the DNS daemon answers for. An authoritative zone answers to anyone
+on the Internet, so that laitos may act as name server of its own domain names (e.g. the same domains that SMTPD
+receives mails for). Each authoritative zone must have exactly one SOA record at its origin.
+*/
+type Zone struct {
+	Origin       string       `json:"Origin"`       // Domain name of the zone, e.g. "example.com".
+	DefaultTTL   int          `json:"DefaultTTL"`   // (Optional) TTL of records that do not specify their own TTL
+	Records      []ZoneRecord `json:"Records"`      // Resource records of the zone
+	ZoneFilePath string       `json:"ZoneFilePath"` // (Optional) read more records from this zone file, which may use $ORIGIN, $TTL, and the record types supported by ZoneRecord.
+
+	origin  string                                 // origin is the lower case zone origin without trailing full-stop
+	records map[string]map[uint16][]ResourceRecord // records are indexed by lower case owner name and then record type
+	names   map[string]struct{}                    // names are all owner names and the empty non-terminal names above them
+	soa     *ResourceRecord                        // soa is the SOA record at zone origin
+}
+
+// Initialise parses zone records and zone file, then checks the zone for consistency.
+func (zone *Zone) Initialise(mustHaveSOA bool) error {
+	zone.origin = strings.ToLower(strings.TrimSuffix(zone.Origin, "."))
+	if zone.DefaultTTL < 1 {
+		zone.DefaultTTL = DefaultZoneTTL
+	}
+	zone.records = make(map[string]map[uint16][]ResourceRecord)
+	zone.names = make(map[string]struct{})
+	zone.soa = nil
+	records := zone.Records
+	if zone.ZoneFilePath != "" {
+		content, err := ioutil.ReadFile(zone.ZoneFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to read zone file of \"%s\" - %v", zone.Origin, err)
+		}
+		fileRecords, err := ParseZoneFile(string(content), zone.origin, zone.DefaultTTL)
+		if err != nil {
+			return fmt.Errorf("failed to parse zone file of \"%s\" - %v", zone.Origin, err)
+		}
+		records = append(append([]ZoneRecord{}, records...), fileRecords...)
+	}
+	for _, record := range records {
+		rr, err := record.ToResourceRecord(zone.origin, zone.DefaultTTL)
+		if err != nil {
+			return fmt.Errorf("bad record %s %s \"%s\" in zone \"%s\" - %v", record.Name, record.Type, record.Value, zone.Origin, err)
+		}
+		if zone.origin != "" && rr.Name != zone.origin && !strings.HasSuffix(rr.Name, "."+zone.origin) {
+			return fmt.Errorf("record %s does not belong to zone \"%s\"", rr.Name, zone.Origin)
+		}
+		if rr.Type == TypeSOA {
+			if rr.Name != zone.origin || zone.soa != nil {
+				return fmt.Errorf("zone \"%s\" must have exactly one SOA record at its origin", zone.Origin)
+			}
+			soa := rr
+			zone.soa = &soa
+		}
+		zone.addRecord(rr)
+	}
+	if mustHaveSOA && zone.soa == nil {
+		return fmt.Errorf("zone \"%s\" must have exactly one SOA record at its origin", zone.Origin)
+	}
+	for name, types := range zone.records {
+		if _, hasCNAME := types[TypeCNAME]; hasCNAME && len(types) > 1 {
+			return fmt.Errorf("CNAME record of %s must not coexist with other records", name)
+		}
+	}
+	return nil
+}
+
+// addRecord places a resource record into the zone's indexes.
+func (zone *Zone) addRecord(rr ResourceRecord) {
+	types, exists := zone.records[rr.Name]
+	if !exists {
+		types = make(map[uint16][]ResourceRecord)
+		zone.records[rr.Name] = types
+	}
+	types[rr.Type] = append(types[rr.Type], rr)
+	// Remember the name and the empty non-terminals between the name and zone origin
+	for name := rr.Name; ; {
+		zone.names[name] = struct{}{}
+		dot := strings.IndexRune(name, '.')
+		if name == zone.origin || dot == -1 {
+			break
+		}
+		name = name[dot+1:]
+	}
+}
+
+// Contains returns true only if the name (without trailing full-stop) is the zone origin or underneath it.
+func (zone *Zone) Contains(name string) bool {
+	if zone.origin == "" {
+		// Local records are not confined to a zone
+		return true
+	}
+	name = strings.ToLower(name)
+	return name == zone.origin || strings.HasSuffix(name, "."+zone.origin)
+}
+
+// negativeAuthority returns the zone's SOA record with TTL adjusted for caching of negative answers.
+func (zone *Zone) negativeAuthority() []ResourceRecord {
+	if zone.soa == nil {
+		return nil
+	}
+	soa := *zone.soa
+	if len(soa.Data) >= 4 {
+		if minimum := binary.BigEndian.Uint32(soa.Data[len(soa.Data)-4:]); minimum < soa.TTL {
+			soa.TTL = minimum
+		}
+	}
+	return []ResourceRecord{soa}
+}
+
+// lookupName returns records owned by the name, including the records synthesised from a wildcard.
+func (zone *Zone) lookupName(name string) (types map[uint16][]ResourceRecord, nameExists bool) {
+	lowerName := strings.ToLower(name)
+	if types, exists := zone.records[lowerName]; exists {
+		return types, true
+	}
+	if _, exists := zone.names[lowerName]; exists {
+		// An empty non-terminal exists but does not own records
+		return nil, true
+	}
+	// Find the closest encloser and see if there is a wildcard right beneath it
+	for encloser := lowerName; encloser != zone.origin; {
+		dot := strings.IndexRune(encloser, '.')
+		if dot == -1 {
+			break
+		}
+		encloser = encloser[dot+1:]
+		if _, exists := zone.names[encloser]; !exists {
+			continue
+		}
+		wildcardTypes, exists := zone.records["*."+encloser]
+		if !exists {
+			break
+		}
+		// Synthesise records owned by the queried name
+		types = make(map[uint16][]ResourceRecord)
+		for recordType, rrs := range wildcardTypes {
+			for _, rr := range rrs {
+				rr.Name = name
+				types[recordType] = append(types[recordType], rr)
+			}
+		}
+		return types, true
+	}
+	return nil, false
+}
+
+// findDelegation returns NS records of a delegation point at or above the name but below zone origin.
+func (zone *Zone) findDelegation(name string) []ResourceRecord {
+	for current := strings.ToLower(name); current != zone.origin; {
+		if nsRecords := zone.records[current][TypeNS]; len(nsRecords) > 0 {
+			return nsRecords
+		}
+		dot := strings.IndexRune(current, '.')
+		if dot == -1 {
+			break
+		}
+		current = current[dot+1:]
+	}
+	return nil
+}
+
+// glueRecords returns A and AAAA records within the zone that belong to the target names of NS, MX, and SRV records.
+func (zone *Zone) glueRecords(rrs []ResourceRecord) (ret []ResourceRecord) {
+	for _, rr := range rrs {
+		var target string
+		switch rr.Type {
+		case TypeNS:
+			target, _, _ = readName(rr.Data, 0)
+		case TypeMX:
+			if len(rr.Data) > 2 {
+				target, _, _ = readName(rr.Data, 2)
+			}
+		case TypeSRV:
+			if len(rr.Data) > 6 {
+				target, _, _ = readName(rr.Data, 6)
+			}
+		}
+		if target == "" || !zone.Contains(target) {
+			continue
+		}
+		types := zone.records[strings.ToLower(target)]
+		ret = append(ret, types[TypeA]...)
+		ret = append(ret, types[TypeAAAA]...)
+	}
+	return
+}
+
+/*
+Answer fills the response with records that answer the question. Returns false if the zone does not know the answer
+to a question, this is only possible for local records, for an authoritative zone always knows the answer.
+*/
+func (zone *Zone) Answer(question Question, response *Message) bool {
+	if zone.soa != nil {
+		if nsRecords := zone.findDelegation(question.Name); nsRecords != nil {
+			// The name belongs to a sub-zone, refer the client to the sub-zone's name servers.
+			response.Authorities = append(response.Authorities, nsRecords...)
+			response.Additionals = append(response.Additionals, zone.glueRecords(nsRecords)...)
+			return true
+		}
+	}
+	if zone.soa != nil {
+		response.Flags |= FlagAA
+	}
+	name := question.Name
+	for i := 0; i < MaxCNAMEChainLen; i++ {
+		types, nameExists := zone.lookupName(name)
+		if !nameExists {
+			if i > 0 || zone.soa != nil {
+				// Name error concerns the last name in CNAME chain (RFC 6604)
+				response.SetRcode(RcodeNXDomain)
+				response.Authorities = append(response.Authorities, zone.negativeAuthority()...)
+				return true
+			}
+			return false
+		}
+		var answers []ResourceRecord
+		if question.Type == TypeANY {
+			for _, rrs := range types {
+				answers = append(answers, rrs...)
+			}
+		} else {
+			answers = types[question.Type]
+		}
+		if len(answers) > 0 {
+			response.Answers = append(response.Answers, answers...)
+			response.Additionals = append(response.Additionals, zone.glueRecords(answers)...)
+			return true
+		}
+		cname := types[TypeCNAME]
+		if len(cname) == 0 {
+			// The name exists but does not own records of the type
+			if i == 0 && zone.soa == nil {
+				return false
+			}
+			response.Authorities = append(response.Authorities, zone.negativeAuthority()...)
+			return true
+		}
+		response.Answers = append(response.Answers, cname[0])
+		target, _, err := readName(cname[0].Data, 0)
+		if err != nil || !zone.Contains(target) {
+			// Client will follow CNAME target outside of the zone by itself
+			return true
+		}
+		name = target
+	}
+	return true
+}
+
+/*
+AnswerFromZones answers the query if it asks for a name in authoritative zones, or for a local record. Authoritative
+zones answer to anyone, whereas local records only answer to trusted clients. Returns nil if the query should be
+handled by forwarder instead.
+*/
+func (dnsd *DNSD) AnswerFromZones(functionName, clientIP string, isTrusted bool, queryNoLength []byte) []byte {
+	if len(dnsd.AuthoritativeZones) == 0 && len(dnsd.LocalRecords) == 0 {
+		return nil
+	}
+	query, err := ParseMessage(queryNoLength)
+	if err != nil || query.Flags&FlagQR != 0 || query.Flags&0x7800 != 0 || len(query.Questions) != 1 {
+		// Leave unusual queries to forwarder
+		return nil
+	}
+	question := query.Questions[0]
+	if question.Class != ClassIN && question.Class != TypeANY {
+		return nil
+	}
+	response := MakeResponse(query)
+	if isTrusted {
+		response.Flags |= FlagRA
+	}
+	// Find the most specific zone that contains the name
+	var matchedZone *Zone
+	for i := range dnsd.AuthoritativeZones {
+		zone := &dnsd.AuthoritativeZones[i]
+		if zone.Contains(question.Name) && (matchedZone == nil || len(zone.origin) > len(matchedZone.origin)) {
+			matchedZone = zone
+		}
+	}
+	if matchedZone != nil && ACMEChallenges.answer(question, response) {
+		dnsd.Logger.Printf(functionName, clientIP, nil, "answer ACME challenge of \"%s\"", question.Name)
+		return response.Pack()
+	}
+	if matchedZone == nil && isTrusted && dnsd.localZone != nil {
+		matchedZone = dnsd.localZone
+	}
+	if matchedZone == nil || !matchedZone.Answer(question, response) {
+		return nil
+	}
+	dnsd.Logger.Printf(functionName, clientIP, nil, "answer %s query of \"%s\" from zone data", RecordTypeName(question.Type), question.Name)
+	return response.Pack()
+}
+
+// absoluteName turns a presentation format domain name into an absolute lower case name without trailing full-stop.
+func absoluteName(name, origin string) string {
+	if name == "@" {
+		return origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return strings.ToLower(strings.TrimSuffix(name, "."))
+	}
+	if origin == "" {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name + "." + origin)
+}
+
+// ToResourceRecord converts the zone record into a resource record that belongs to the zone origin.
+func (record ZoneRecord) ToResourceRecord(origin string, defaultTTL int) (ResourceRecord, error) {
+	rr := ResourceRecord{Name: absoluteName(record.Name, origin), Class: ClassIN, TTL: uint32(defaultTTL)}
+	if record.TTL > 0 {
+		rr.TTL = uint32(record.TTL)
+	}
+	recordType, found := RecordTypeNames[strings.ToUpper(record.Type)]
+	if !found || recordType == TypeANY {
+		return rr, fmt.Errorf("unsupported record type \"%s\"", record.Type)
+	}
+	rr.Type = recordType
+	data, err := PackRecordData(recordType, record.Value, origin)
+	if err != nil {
+		return rr, err
+	}
+	rr.Data = data
+	return rr, nil
+}
+
+// PackRecordData encodes record data written in zone file presentation format into wire format.
+func PackRecordData(recordType uint16, value, origin string) ([]byte, error) {
+	fields := strings.Fields(value)
+	numbers := func(count, bits int) ([]byte, error) {
+		if len(fields) < count {
+			return nil, errors.New("too few fields")
+		}
+		ret := make([]byte, 0, count*bits/8)
+		for _, field := range fields[:count] {
+			number, err := strconv.ParseUint(field, 10, bits)
+			if err != nil {
+				return nil, err
+			}
+			if bits == 8 {
+				ret = append(ret, byte(number))
+			} else if bits == 16 {
+				ret = append(ret, byte(number>>8), byte(number))
+			} else {
+				ret = append(ret, byte(number>>24), byte(number>>16), byte(number>>8), byte(number))
+			}
+		}
+		fields = fields[count:]
+		return ret, nil
+	}
+	switch recordType {
+	case TypeA:
+		ip := net.ParseIP(strings.TrimSpace(value))
+		if ip == nil || ip.To4() == nil {
+			return nil, errors.New("not an IPv4 address")
+		}
+		return []byte(ip.To4()), nil
+	case TypeAAAA:
+		ip := net.ParseIP(strings.TrimSpace(value))
+		if ip == nil || !strings.Contains(value, ":") {
+			return nil, errors.New("not an IPv6 address")
+		}
+		return []byte(ip.To16()), nil
+	case TypeNS, TypeCNAME, TypePTR:
+		if len(fields) != 1 {
+			return nil, errors.New("expecting exactly one domain name")
+		}
+		return PackName(absoluteName(fields[0], origin)), nil
+	case TypeMX:
+		data, err := numbers(1, 16)
+		if err != nil || len(fields) != 1 {
+			return nil, errors.New("expecting preference and domain name")
+		}
+		return append(data, PackName(absoluteName(fields[0], origin))...), nil
+	case TypeSRV:
+		data, err := numbers(3, 16)
+		if err != nil || len(fields) != 1 {
+			return nil, errors.New("expecting priority, weight, port, and target")
+		}
+		return append(data, PackName(absoluteName(fields[0], origin))...), nil
+	case TypeSOA:
+		if len(fields) != 7 {
+			return nil, errors.New("expecting mname, rname, serial, refresh, retry, expire, and minimum")
+		}
+		data := append(PackName(absoluteName(fields[0], origin)), PackName(absoluteName(fields[1], origin))...)
+		fields = fields[2:]
+		timers, err := numbers(5, 32)
+		if err != nil {
+			return nil, err
+		}
+		return append(data, timers...), nil
+	case TypeTXT:
+		texts, err := splitZoneFields(value)
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		for _, text := range texts {
+			// Each character string is at most 255 bytes long
+			for len(text) > 255 {
+				data = append(data, 255)
+				data = append(data, text[:255]...)
+				text = text[255:]
+			}
+			data = append(data, byte(len(text)))
+			data = append(data, text...)
+		}
+		if len(data) == 0 {
+			data = []byte{0}
+		}
+		return data, nil
+	case TypeDS:
+		// Key tag, algorithm, digest type, and the digest in hex that may contain spaces
+		data, err := numbers(1, 16)
+		if err != nil || len(fields) < 3 {
+			return nil, errors.New("expecting key tag, algorithm, digest type, and digest")
+		}
+		octets, err := numbers(2, 8)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := hex.DecodeString(strings.Join(fields, ""))
+		if err != nil {
+			return nil, err
+		}
+		return append(append(data, octets...), digest...), nil
+	case TypeDNSKEY:
+		// Flags, protocol, algorithm, and the public key in base64 that may contain spaces
+		data, err := numbers(1, 16)
+		if err != nil || len(fields) < 3 {
+			return nil, errors.New("expecting flags, protocol, algorithm, and public key")
+		}
+		octets, err := numbers(2, 8)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.Join(fields, ""))
+		if err != nil {
+			return nil, err
+		}
+		return append(append(data, octets...), key...), nil
+	case TypeRRSIG:
+		if len(fields) < 9 {
+			return nil, errors.New("expecting type covered, algorithm, labels, original TTL, expiration, inception, key tag, signer, and signature")
+		}
+		typeCovered, err := parseRecordType(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		data := []byte{byte(typeCovered >> 8), byte(typeCovered)}
+		fields = fields[1:]
+		octets, err := numbers(2, 8)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, octets...)
+		originalTTL, err := numbers(1, 32)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, originalTTL...)
+		// Expiration and inception are written as YYYYMMDDHHmmSS or seconds since Unix epoch
+		for _, field := range fields[:2] {
+			timestamp, err := parseSignatureTime(field)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, byte(timestamp>>24), byte(timestamp>>16), byte(timestamp>>8), byte(timestamp))
+		}
+		fields = fields[2:]
+		keyTag, err := numbers(1, 16)
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, keyTag...), PackName(absoluteName(fields[0], origin))...)
+		signature, err := base64.StdEncoding.DecodeString(strings.Join(fields[1:], ""))
+		if err != nil {
+			return nil, err
+		}
+		return append(data, signature...), nil
+	case TypeNSEC:
+		if len(fields) < 1 {
+			return nil, errors.New("expecting next domain name and types")
+		}
+		bitmap, err := packTypeBitmap(fields[1:])
+		if err != nil {
+			return nil, err
+		}
+		return append(PackName(absoluteName(fields[0], origin)), bitmap...), nil
+	case TypeNSEC3:
+		// Hash algorithm, flags, iterations, salt in hex ("-" for empty), next hashed owner in base32hex, and types
+		if len(fields) < 5 {
+			return nil, errors.New("expecting hash algorithm, flags, iterations, salt, next hashed owner, and types")
+		}
+		data, err := numbers(2, 8)
+		if err != nil {
+			return nil, err
+		}
+		iterations, err := numbers(1, 16)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, iterations...)
+		var salt []byte
+		if fields[0] != "-" {
+			if salt, err = hex.DecodeString(fields[0]); err != nil {
+				return nil, err
+			}
+		}
+		nextHash, err := NSEC3Encoding.DecodeString(strings.ToUpper(fields[1]))
+		if err != nil {
+			return nil, err
+		}
+		bitmap, err := packTypeBitmap(fields[2:])
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, byte(len(salt))), salt...)
+		data = append(append(data, byte(len(nextHash))), nextHash...)
+		return append(data, bitmap...), nil
+	}
+	return nil, fmt.Errorf("unsupported record type %d", recordType)
+}
+
+// parseRecordType returns the type number of a record type name, which may be written as "TYPEnnn".
+func parseRecordType(name string) (uint16, error) {
+	name = strings.ToUpper(name)
+	if recordType, found := RecordTypeNames[name]; found {
+		return recordType, nil
+	}
+	if strings.HasPrefix(name, "TYPE") {
+		if recordType, err := strconv.ParseUint(name[4:], 10, 16); err == nil {
+			return uint16(recordType), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record type \"%s\"", name)
+}
+
+// parseSignatureTime reads RRSIG expiration or inception time written as YYYYMMDDHHmmSS or seconds since Unix epoch.
+func parseSignatureTime(value string) (uint32, error) {
+	if len(value) == 14 {
+		timestamp, err := time.Parse("20060102150405", value)
+		if err != nil {
+			return 0, err
+		}
+		return uint32(timestamp.Unix()), nil
+	}
+	timestamp, err := strconv.ParseUint(value, 10, 32)
+	return uint32(timestamp), err
+}
+
+// packTypeBitmap encodes record type names into the type bitmap of NSEC and NSEC3 records.
+func packTypeBitmap(typeNames []string) ([]byte, error) {
+	var windows [256][32]byte
+	var windowLens [256]int
+	for _, name := range typeNames {
+		recordType, err := parseRecordType(name)
+		if err != nil {
+			return nil, err
+		}
+		window, bit := recordType>>8, recordType&0xff
+		windows[window][bit/8] |= 0x80 >> (bit % 8)
+		if int(bit/8)+1 > windowLens[window] {
+			windowLens[window] = int(bit/8) + 1
+		}
+	}
+	var data []byte
+	for window, length := range windowLens {
+		if length > 0 {
+			data = append(data, byte(window), byte(length))
+			data = append(data, windows[window][:length]...)
+		}
+	}
+	return data, nil
+}
+
+// unpackTypeBitmap decodes the type bitmap of NSEC and NSEC3 records into a set of record types.
+func unpackTypeBitmap(data []byte) (map[uint16]bool, error) {
+	types := make(map[uint16]bool)
+	for len(data) > 0 {
+		if len(data) < 2 || data[1] == 0 || data[1] > 32 || len(data) < 2+int(data[1]) {
+			return nil, ErrMalformedMessage
+		}
+		window, length := uint16(data[0]), int(data[1])
+		for i, octet := range data[2 : 2+length] {
+			for bit := uint16(0); bit < 8; bit++ {
+				if octet&(0x80>>bit) != 0 {
+					types[window<<8|uint16(i)*8+bit] = true
+				}
+			}
+		}
+		data = data[2+length:]
+	}
+	return types, nil
+}
+
+// splitZoneFields splits a line of zone file into fields, a double-quoted string (\" and \\ are escaped) is a field.
+func splitZoneFields(line string) ([]string, error) {
+	fields := make([]string, 0, 8)
+	var field []byte
+	var inQuote, inField, escape bool
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case escape:
+			field = append(field, c)
+			escape = false
+		case c == '\\':
+			escape = true
+			inField = true
+		case c == '"':
+			if inQuote {
+				fields = append(fields, string(field))
+				field, inField = nil, false
+			}
+			inQuote = !inQuote
+		case inQuote:
+			field = append(field, c)
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, string(field))
+				field, inField = nil, false
+			}
+		default:
+			field = append(field, c)
+			inField = true
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, string(field))
+	}
+	return fields, nil
+}
+
+/*
+ParseZoneFile reads records from a subset of RFC 1035 zone file format: $ORIGIN and $TTL directives, comments,
+parentheses spanning multiple lines, omitted owner names, and the record types supported by ZoneRecord in class IN.
+Owner names and domain names in data of the returned records are absolute.
+*/
+func ParseZoneFile(content, origin string, defaultTTL int) ([]ZoneRecord, error) {
+	// Remove comments and join lines enclosed in parentheses
+	lines := make([]string, 0, 64)
+	var current []byte
+	var inQuote, inParen bool
+	for _, line := range strings.Split(content, "\n") {
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			if c == '"' && (i == 0 || line[i-1] != '\\') {
+				inQuote = !inQuote
+			} else if !inQuote && c == ';' {
+				break
+			} else if !inQuote && (c == '(' || c == ')') {
+				inParen = c == '('
+				current = append(current, ' ')
+				continue
+			}
+			current = append(current, c)
+		}
+		if !inParen {
+			lines = append(lines, strings.TrimRight(string(current), " \t\r"))
+			current = nil
+		} else {
+			current = append(current, ' ')
+		}
+	}
+	if inParen {
+		return nil, errors.New("unterminated parentheses")
+	}
+	ret := make([]ZoneRecord, 0, len(lines))
+	lastOwner := ""
+	var hasOwner bool
+	for lineNum, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields, err := splitZoneFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum+1, err)
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: bad $ORIGIN", lineNum+1)
+			}
+			origin = absoluteName(fields[1], origin)
+			continue
+		case "$TTL":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: bad $TTL", lineNum+1)
+			}
+			if defaultTTL, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, fmt.Errorf("line %d: bad $TTL - %v", lineNum+1, err)
+			}
+			continue
+		}
+		// Owner name is omitted if the line begins with a space
+		owner := lastOwner
+		if line[0] != ' ' && line[0] != '\t' {
+			owner = absoluteName(fields[0], origin)
+			fields = fields[1:]
+			hasOwner = true
+		}
+		// The root domain is an empty name, e.g. the owner of root trust anchor.
+		if !hasOwner && origin == "" {
+			return nil, fmt.Errorf("line %d: missing owner name", lineNum+1)
+		}
+		lastOwner = owner
+		record := ZoneRecord{Name: owner + ".", TTL: defaultTTL}
+		// TTL and class may appear in either order before record type
+		for len(fields) > 0 {
+			if ttl, err := strconv.Atoi(fields[0]); err == nil {
+				record.TTL = ttl
+			} else if strings.ToUpper(fields[0]) == "IN" {
+			} else {
+				break
+			}
+			fields = fields[1:]
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: missing record type or data", lineNum+1)
+		}
+		record.Type = strings.ToUpper(fields[0])
+		if _, err := PackRecordData(RecordTypeNames[record.Type], strings.Join(quoteFields(record.Type, fields[1:]), " "), origin); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum+1, err)
+		}
+		// Make domain names in record data absolute so that the record no longer depends on origin
+		record.Value = strings.Join(quoteFields(record.Type, absoluteDataNames(record.Type, fields[1:], origin)), " ")
+		ret = append(ret, record)
+	}
+	return ret, nil
+}
+
+// quoteFields quotes the character strings of TXT record data so that they survive another round of parsing.
+func quoteFields(recordType string, fields []string) []string {
+	if recordType != "TXT" {
+		return fields
+	}
+	ret := make([]string, len(fields))
+	for i, field := range fields {
+		ret[i] = `"` + strings.Replace(strings.Replace(field, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+	}
+	return ret
+}
+
+// absoluteDataNames turns domain names in the record data fields into absolute names that end with full-stop.
+func absoluteDataNames(recordType string, fields []string, origin string) []string {
+	var nameIndexes []int
+	switch recordType {
+	case "NS", "CNAME", "PTR":
+		nameIndexes = []int{0}
+	case "MX":
+		nameIndexes = []int{1}
+	case "SRV":
+		nameIndexes = []int{3}
+	case "SOA":
+		nameIndexes = []int{0, 1}
+	case "NSEC":
+		nameIndexes = []int{0}
+	case "RRSIG":
+		nameIndexes = []int{7}
+	}
+	ret := append([]string{}, fields...)
+	for _, index := range nameIndexes {
+		if index < len(ret) {
+			ret[index] = absoluteName(ret[index], origin) + "."
+		}
+	}
+	return ret
+}
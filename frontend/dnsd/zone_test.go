@@ -0,0 +1,271 @@
+package dnsd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testZoneFile = `
+$ORIGIN example.org.
+$TTL 600
+@	IN	SOA	ns1 hostmaster (
+		2017010101 ; serial
+		7200 3600 1209600
+		60 )
+	IN	NS	ns1.example.com.
+ns1	300	IN	A	192.0.2.10
+txt		TXT	"hello ; world" "second \"string\""
+`
+
+// askZones sends a query to the zone data of DNS daemon and returns the parsed response.
+func askZones(t *testing.T, daemon *DNSD, isTrusted bool, name string, recordType uint16) *Message {
+	query := &Message{ID: 1234, Flags: FlagRD, Questions: []Question{{Name: name, Type: recordType, Class: ClassIN}}}
+	packet := daemon.AnswerFromZones("test", "127.0.0.1", isTrusted, query.Pack())
+	if packet == nil {
+		return nil
+	}
+	response, err := ParseMessage(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.ID != query.ID || response.Flags&FlagRD == 0 || response.Flags&FlagQR == 0 {
+		t.Fatalf("%+v", response)
+	}
+	return response
+}
+
+func TestParseZoneFile(t *testing.T) {
+	records, err := ParseZoneFile(testZoneFile, "", 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ZoneRecord{
+		{Name: "example.org.", Type: "SOA", TTL: 600, Value: "ns1.example.org. hostmaster.example.org. 2017010101 7200 3600 1209600 60"},
+		{Name: "example.org.", Type: "NS", TTL: 600, Value: "ns1.example.com."},
+		{Name: "ns1.example.org.", Type: "A", TTL: 300, Value: "192.0.2.10"},
+		{Name: "txt.example.org.", Type: "TXT", TTL: 600, Value: `"hello ; world" "second \"string\""`},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("%+v", records)
+	}
+	for i, record := range records {
+		if record != expected[i] {
+			t.Fatalf("%+v\n%+v", record, expected[i])
+		}
+	}
+	if _, err := ParseZoneFile("@ SOA ( a b", "example.org", 3600); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := ParseZoneFile("www A 1.2.3", "example.org", 3600); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatal(err)
+	}
+	if _, err := ParseZoneFile("www A", "example.org", 3600); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestPackRecordData(t *testing.T) {
+	if data, err := PackRecordData(TypeA, "192.0.2.1", ""); err != nil || !bytes.Equal(data, []byte{192, 0, 2, 1}) {
+		t.Fatal(data, err)
+	}
+	if _, err := PackRecordData(TypeA, "2001:db8::1", ""); err == nil {
+		t.Fatal("did not error")
+	}
+	if data, err := PackRecordData(TypeAAAA, "2001:db8::1", ""); err != nil || len(data) != 16 {
+		t.Fatal(data, err)
+	}
+	if data, err := PackRecordData(TypeMX, "10 mail", "example.com"); err != nil || !bytes.Equal(data, append([]byte{0, 10}, PackName("mail.example.com")...)) {
+		t.Fatal(data, err)
+	}
+	if data, err := PackRecordData(TypeSRV, "1 2 5060 sip.example.com.", "example.com"); err != nil || !bytes.Equal(data, append([]byte{0, 1, 0, 2, 0x13, 0xc4}, PackName("sip.example.com")...)) {
+		t.Fatal(data, err)
+	}
+	if _, err := PackRecordData(TypeSRV, "1 2 sip.example.com.", "example.com"); err == nil {
+		t.Fatal("did not error")
+	}
+	if data, err := PackRecordData(TypeTXT, `"a b" c`, ""); err != nil || !bytes.Equal(data, []byte{3, 'a', ' ', 'b', 1, 'c'}) {
+		t.Fatal(data, err)
+	}
+	if data, err := PackRecordData(TypeTXT, strings.Repeat("a", 300), ""); err != nil || len(data) != 302 || data[0] != 255 || data[256] != 45 {
+		t.Fatal(data, err)
+	}
+	if _, err := PackRecordData(TypeSOA, "ns1 hostmaster 1 2 3 4", "example.com"); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestZone_Initialise(t *testing.T) {
+	zone := Zone{Origin: "example.com", Records: []ZoneRecord{{Name: "@", Type: "A", Value: "192.0.2.1"}}}
+	if err := zone.Initialise(true); err == nil || !strings.Contains(err.Error(), "SOA") {
+		t.Fatal(err)
+	}
+	if err := zone.Initialise(false); err != nil {
+		t.Fatal(err)
+	}
+	zone.Records = append(zone.Records, ZoneRecord{Name: "www.example.net.", Type: "A", Value: "192.0.2.1"})
+	if err := zone.Initialise(false); err == nil || !strings.Contains(err.Error(), "does not belong") {
+		t.Fatal(err)
+	}
+	zone.Records = []ZoneRecord{{Name: "www", Type: "A", Value: "192.0.2.1"}, {Name: "www", Type: "CNAME", Value: "@"}}
+	if err := zone.Initialise(false); err == nil || !strings.Contains(err.Error(), "coexist") {
+		t.Fatal(err)
+	}
+	zone.Records = []ZoneRecord{{Name: "www", Type: "HINFO", Value: "a b"}}
+	if err := zone.Initialise(false); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Fatal(err)
+	}
+}
+
+func TestDNSD_AnswerFromZones(t *testing.T) {
+	zoneFile := "/tmp/test-laitos-dnsd-zone.txt"
+	if err := ioutil.WriteFile(zoneFile, []byte(testZoneFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(zoneFile)
+	daemon := DNSD{
+		Address:              "127.0.0.1",
+		UDPPort:              61254,
+		UDPForwarder:         "8.8.8.8:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		AuthoritativeZones: []Zone{
+			{
+				Origin: "example.com",
+				Records: []ZoneRecord{
+					{Name: "@", Type: "SOA", Value: "ns1 hostmaster 2017010101 7200 3600 1209600 300"},
+					{Name: "@", Type: "NS", Value: "ns1"},
+					{Name: "@", Type: "A", Value: "192.0.2.1"},
+					{Name: "@", Type: "MX", Value: "10 mail"},
+					{Name: "@", Type: "TXT", Value: `"v=spf1 mx -all"`},
+					{Name: "ns1", Type: "A", Value: "192.0.2.1"},
+					{Name: "mail", Type: "A", TTL: 60, Value: "192.0.2.2"},
+					{Name: "mail", Type: "AAAA", Value: "2001:db8::2"},
+					{Name: "www", Type: "CNAME", Value: "@"},
+					{Name: "*.dyn", Type: "A", Value: "192.0.2.4"},
+					{Name: "_sip._tcp", Type: "SRV", Value: "10 5 5060 mail"},
+					{Name: "sub", Type: "NS", Value: "ns.sub"},
+					{Name: "ns.sub", Type: "A", Value: "192.0.2.5"},
+				},
+			},
+			{Origin: "example.org", ZoneFilePath: zoneFile},
+		},
+		LocalRecords: []ZoneRecord{{Name: "nas.home", Type: "A", Value: "192.168.1.10"}},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Positive answer
+	resp := askZones(t, &daemon, false, "Example.COM", TypeA)
+	if resp.Flags&FlagAA == 0 || resp.Flags&FlagRA != 0 || resp.Rcode() != RcodeNoError || len(resp.Answers) != 1 ||
+		!bytes.Equal(resp.Answers[0].Data, []byte{192, 0, 2, 1}) || resp.Answers[0].TTL != DefaultZoneTTL {
+		t.Fatalf("%+v", resp)
+	}
+	// CNAME within the zone is followed
+	resp = askZones(t, &daemon, true, "www.example.com", TypeA)
+	if resp.Flags&FlagRA == 0 || len(resp.Answers) != 2 || resp.Answers[0].Type != TypeCNAME || resp.Answers[1].Type != TypeA {
+		t.Fatalf("%+v", resp)
+	}
+	// MX comes with addresses of mail server
+	resp = askZones(t, &daemon, false, "example.com", TypeMX)
+	if len(resp.Answers) != 1 || len(resp.Additionals) != 2 || resp.Additionals[0].TTL != 60 || resp.Additionals[1].Type != TypeAAAA {
+		t.Fatalf("%+v", resp)
+	}
+	resp = askZones(t, &daemon, false, "_sip._tcp.example.com", TypeSRV)
+	if len(resp.Answers) != 1 || len(resp.Additionals) != 2 {
+		t.Fatalf("%+v", resp)
+	}
+	resp = askZones(t, &daemon, false, "example.com", TypeANY)
+	if len(resp.Answers) != 5 {
+		t.Fatalf("%+v", resp)
+	}
+	// Non-existent name
+	resp = askZones(t, &daemon, false, "doesnotexist.example.com", TypeA)
+	if resp.Flags&FlagAA == 0 || resp.Rcode() != RcodeNXDomain || len(resp.Answers) != 0 || len(resp.Authorities) != 1 ||
+		resp.Authorities[0].Type != TypeSOA || resp.Authorities[0].TTL != 300 {
+		t.Fatalf("%+v", resp)
+	}
+	// Name exists without the record type
+	resp = askZones(t, &daemon, false, "mail.example.com", TypeTXT)
+	if resp.Rcode() != RcodeNoError || len(resp.Answers) != 0 || len(resp.Authorities) != 1 || resp.Authorities[0].Type != TypeSOA {
+		t.Fatalf("%+v", resp)
+	}
+	// Wildcard record is synthesised for the queried name, the empty non-terminal above it exists without records.
+	resp = askZones(t, &daemon, false, "a.b.dyn.example.com", TypeA)
+	if resp.Rcode() != RcodeNoError || len(resp.Answers) != 1 || resp.Answers[0].Name != "a.b.dyn.example.com" {
+		t.Fatalf("%+v", resp)
+	}
+	resp = askZones(t, &daemon, false, "dyn.example.com", TypeA)
+	if resp.Rcode() != RcodeNoError || len(resp.Answers) != 0 || len(resp.Authorities) != 1 {
+		t.Fatalf("%+v", resp)
+	}
+	// Delegated sub-zone is referred to its name servers
+	resp = askZones(t, &daemon, false, "www.sub.example.com", TypeA)
+	if resp.Flags&FlagAA != 0 || resp.Rcode() != RcodeNoError || len(resp.Answers) != 0 ||
+		len(resp.Authorities) != 1 || resp.Authorities[0].Type != TypeNS || len(resp.Additionals) != 1 {
+		t.Fatalf("%+v", resp)
+	}
+	// Zone file
+	resp = askZones(t, &daemon, false, "txt.example.org", TypeTXT)
+	if len(resp.Answers) != 1 || !bytes.Equal(resp.Answers[0].Data, []byte("\x0dhello ; world\x0fsecond \"string\"")) {
+		t.Fatalf("%+v", resp)
+	}
+	resp = askZones(t, &daemon, false, "nothing.example.org", TypeA)
+	if resp.Rcode() != RcodeNXDomain || resp.Authorities[0].TTL != 60 {
+		t.Fatalf("%+v", resp)
+	}
+	// Local records only answer to trusted clients
+	if resp = askZones(t, &daemon, false, "nas.home", TypeA); resp != nil {
+		t.Fatalf("%+v", resp)
+	}
+	resp = askZones(t, &daemon, true, "NAS.home", TypeA)
+	if resp.Flags&FlagAA != 0 || len(resp.Answers) != 1 || !bytes.Equal(resp.Answers[0].Data, []byte{192, 168, 1, 10}) {
+		t.Fatalf("%+v", resp)
+	}
+	// Other queries go to forwarder
+	if resp = askZones(t, &daemon, true, "nas.home", TypeAAAA); resp != nil {
+		t.Fatalf("%+v", resp)
+	}
+	if resp = askZones(t, &daemon, true, "github.com", TypeA); resp != nil {
+		t.Fatalf("%+v", resp)
+	}
+	// Untrusted client must not get answer for names outside of authoritative zones
+	if response, err := daemon.ProcessQuery("test", "192.0.2.100", false, githubComUDPQuery); response != nil || err != nil {
+		t.Fatal(response, err)
+	}
+	// Authoritative answer over UDP
+	go func() {
+		if err := daemon.StartAndBlockUDP(); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+	clientConn, err := net.Dial("udp", "127.0.0.1:61254")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	query := &Message{ID: 4321, Questions: []Question{{Name: "mail.example.com", Type: TypeAAAA, Class: ClassIN}}}
+	if _, err := clientConn.Write(query.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	packetBuf := make([]byte, MaxPacketSize)
+	packetLen, err := clientConn.Read(packetBuf)
+	clientConn.Close()
+	daemon.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = ParseMessage(packetBuf[:packetLen]); err != nil || resp.ID != 4321 || len(resp.Answers) != 1 || resp.Answers[0].Type != TypeAAAA {
+		t.Fatal(err, resp)
+	}
+	// Zones must not be defined twice
+	daemon.AuthoritativeZones = append(daemon.AuthoritativeZones, Zone{Origin: "example.org.", ZoneFilePath: zoneFile})
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,241 @@
+package httpd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
+	"github.com/HouzuoGuo/laitos/global"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AccessLogFormatCommon   = "common"   // AccessLogFormatCommon is the Common Log Format of NCSA/Apache.
+	AccessLogFormatCombined = "combined" // AccessLogFormatCombined is the Common Log Format followed by referrer and user agent.
+	AccessLogFormatJSON     = "json"     // AccessLogFormatJSON writes each request as a JSON object in a line of its own.
+
+	AccessLogDefaultMaxFileSizeMB = 64 // AccessLogDefaultMaxFileSizeMB is the default size at which access log file is rotated.
+	AccessLogDefaultNumBackups    = 5  // AccessLogDefaultNumBackups is the default number of rotated access log files to keep.
+)
+
+// AccessLogEntry describes an HTTP request and its response.
+type AccessLogEntry struct {
+	Time       time.Time `json:"Time"`       // Time is the moment the request arrived.
+	ClientIP   string    `json:"ClientIP"`   // ClientIP is the IP address of HTTP client.
+	Host       string    `json:"Host"`       // Host is the host name that client asked for.
+	Method     string    `json:"Method"`     // Method is the HTTP request method.
+	URI        string    `json:"URI"`        // URI is the requested path and query.
+	Protocol   string    `json:"Protocol"`   // Protocol is the HTTP protocol version, e.g. "HTTP/1.1".
+	Status     int       `json:"Status"`     // Status is the response status code.
+	Bytes      int64     `json:"Bytes"`      // Bytes is the size of response body.
+	DurationMS int64     `json:"DurationMS"` // DurationMS is the number of milliseconds spent on the request.
+	Referer    string    `json:"Referer"`    // Referer is the referrer page that linked to the request.
+	UserAgent  string    `json:"UserAgent"`  // UserAgent identifies client software.
+	Handler    string    `json:"Handler"`    // Handler is the route pattern that served the request, empty if none matched.
+}
+
+// clfValue returns the value for a field of Common Log Format, or "-" if it is empty.
+func clfValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// clfQuote returns the value quoted for Common Log Format, with quotes and control characters escaped.
+func clfQuote(value string) string {
+	return strconv.Quote(clfValue(value))
+}
+
+// CommonFormat returns the entry in Common Log Format, without line break.
+func (entry AccessLogEntry) CommonFormat() string {
+	// Empty response body is represented by a dash
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = strconv.FormatInt(entry.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s",
+		clfValue(entry.ClientIP), entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		clfQuote(entry.Method+" "+entry.URI+" "+entry.Protocol), entry.Status, bytes)
+}
+
+/*
+CombinedFormat returns the entry in Combined Log Format, without line break. The format is understood by log analysers
+such as GoAccess and fail2ban, hence it does not carry duration and handler, which are available in JSON format.
+*/
+func (entry AccessLogEntry) CombinedFormat() string {
+	return fmt.Sprintf("%s %s %s", entry.CommonFormat(), clfQuote(entry.Referer), clfQuote(entry.UserAgent))
+}
+
+/*
+AccessLog writes HTTP requests into a file in a standard format, one request per line. The file is rotated when it grows
+too large or gets too old. All HTTP daemons that log to the same file share the file and its rotation.
+*/
+type AccessLog struct {
+	FilePath            string `json:"FilePath"`            // (Optional) write access log into this file, access log is disabled if the path is empty.
+	Format              string `json:"Format"`              // (Optional) "common", "combined", or "json", by default "combined".
+	MaxFileSizeMB       int    `json:"MaxFileSizeMB"`       // (Optional) rotate the file when it grows beyond this size, by default 64MB.
+	RotateIntervalHours int    `json:"RotateIntervalHours"` // (Optional) also rotate the file after this many hours, by default the file is only rotated by size.
+	NumBackups          int    `json:"NumBackups"`          // (Optional) keep this many rotated files, by default 5.
+
+	file *global.RotatingFile
+}
+
+// accessLogFiles are the open access log files keyed by file path, they are shared by all HTTP daemons that log to the same path.
+var accessLogFiles = struct {
+	mutex *sync.Mutex
+	files map[string]*global.RotatingFile
+}{mutex: new(sync.Mutex), files: make(map[string]*global.RotatingFile)}
+
+// Check validates configuration and fills in the defaults, without opening the access log file.
+func (accessLog *AccessLog) Check() error {
+	if accessLog.FilePath == "" {
+		return nil
+	}
+	switch accessLog.Format {
+	case "":
+		accessLog.Format = AccessLogFormatCombined
+	case AccessLogFormatCommon, AccessLogFormatCombined, AccessLogFormatJSON:
+	default:
+		return fmt.Errorf("AccessLog.Check: unknown format \"%s\"", accessLog.Format)
+	}
+	if accessLog.MaxFileSizeMB < 1 {
+		accessLog.MaxFileSizeMB = AccessLogDefaultMaxFileSizeMB
+	}
+	if accessLog.RotateIntervalHours < 0 {
+		accessLog.RotateIntervalHours = 0
+	}
+	if accessLog.NumBackups < 1 {
+		accessLog.NumBackups = AccessLogDefaultNumBackups
+	}
+	return nil
+}
+
+// Initialise checks configuration and opens the access log file for appending.
+func (accessLog *AccessLog) Initialise() error {
+	accessLog.file = nil
+	if err := accessLog.Check(); err != nil || accessLog.FilePath == "" {
+		return err
+	}
+	accessLogFiles.mutex.Lock()
+	defer accessLogFiles.mutex.Unlock()
+	maxFileSize := int64(accessLog.MaxFileSizeMB) * 1024 * 1024
+	maxAge := time.Duration(accessLog.RotateIntervalHours) * time.Hour
+	file, exists := accessLogFiles.files[accessLog.FilePath]
+	if exists {
+		// The latest configuration decides how the shared file is rotated
+		file.SetRotation(maxFileSize, maxAge, accessLog.NumBackups)
+	} else {
+		var err error
+		if file, err = global.OpenRotatingFile(accessLog.FilePath, maxFileSize, maxAge, accessLog.NumBackups); err != nil {
+			return fmt.Errorf("AccessLog.Initialise: failed to open access log file - %v", err)
+		}
+		accessLogFiles.files[accessLog.FilePath] = file
+	}
+	accessLog.file = file
+	return nil
+}
+
+// IsEnabled returns true only if access log has been initialised with a file path.
+func (accessLog *AccessLog) IsEnabled() bool {
+	return accessLog.file != nil
+}
+
+// Add writes a request into access log file.
+func (accessLog *AccessLog) Add(entry AccessLogEntry) {
+	if accessLog.file == nil {
+		return
+	}
+	var line []byte
+	switch accessLog.Format {
+	case AccessLogFormatCommon:
+		line = []byte(entry.CommonFormat())
+	case AccessLogFormatJSON:
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			return
+		}
+	default:
+		line = []byte(entry.CombinedFormat())
+	}
+	// Access log is merely a diagnosis aid, do not let it disrupt HTTP service.
+	accessLog.file.Write(append(line, '\n'))
+}
+
+// accessLogResponseWriter remembers the status code and body size of a response for access log.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends buffered response to client, such as streamed command output.
+func (w *accessLogResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the connection for a protocol switch, such as WebSocket.
+func (w *accessLogResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("accessLogResponseWriter.Hijack: connection cannot be taken over")
+	}
+	conn, bufRW, err := hijacker.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, bufRW, err
+}
+
+// serveAndLog serves the request via the router, and then writes the request into access log.
+func serveAndLog(accessLog *AccessLog, mux *http.ServeMux, w http.ResponseWriter, r *http.Request) {
+	beginTime := time.Now()
+	recorder := &accessLogResponseWriter{ResponseWriter: w}
+	_, pattern := mux.Handler(r)
+	uri := r.RequestURI
+	mux.ServeHTTP(recorder, r)
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	accessLog.Add(AccessLogEntry{
+		Time:       beginTime,
+		ClientIP:   api.GetRealClientIP(r),
+		Host:       strings.ToLower(r.Host),
+		Method:     r.Method,
+		URI:        uri,
+		Protocol:   r.Proto,
+		Status:     recorder.status,
+		Bytes:      recorder.bytes,
+		DurationMS: time.Since(beginTime).Nanoseconds() / 1000000,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Handler:    pattern,
+	})
+}
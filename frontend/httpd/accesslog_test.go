@@ -0,0 +1,118 @@
+package httpd
+
+import (
+	"encoding/json"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogEntry_Format(t *testing.T) {
+	entry := AccessLogEntry{
+		Time:      time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		ClientIP:  "127.0.0.1",
+		Method:    http.MethodGet,
+		URI:       "/apache_pb.gif",
+		Protocol:  "HTTP/1.0",
+		Status:    http.StatusOK,
+		Bytes:     2326,
+		Referer:   "http://www.example.com/start.html",
+		UserAgent: `Mozilla/4.08 "quoted"`,
+	}
+	if line := entry.CommonFormat(); line != `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326` {
+		t.Fatal(line)
+	}
+	if line := entry.CombinedFormat(); line != `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"quoted\""` {
+		t.Fatal(line)
+	}
+	entry.Bytes = 0
+	entry.Referer = ""
+	if line := entry.CombinedFormat(); !strings.HasSuffix(line, `200 - "-" "Mozilla/4.08 \"quoted\""`) {
+		t.Fatal(line)
+	}
+}
+
+func TestHTTPD_AccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestHTTPD_AccessLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "access.log")
+	daemon := HTTPD{
+		Address:       "127.0.0.1",
+		Port:          12345,
+		BaseRateLimit: 10,
+		Processor:     common.GetTestCommandProcessor(),
+		SpecialHandlers: map[string]api.HandlerFactory{
+			"/dns_stats": &api.HandleDNSQueryStats{},
+		},
+		AccessLog: AccessLog{FilePath: logPath, Format: "bad"},
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "format") {
+		t.Fatal(err)
+	}
+	daemon.AccessLog.Format = AccessLogFormatJSON
+	daemon.AccessLog.MaxFileSizeMB = 1
+	daemon.AccessLog.NumBackups = 2
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("User-Agent", "test-agent")
+		req.Header.Set("Referer", "http://example.com")
+		// Skip the warning about not using HTTPS
+		req.SetBasicAuth("user", "pass")
+		daemon.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	get("/dns_stats?a=b")
+	get("/does_not_exist")
+	content, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatal(lines)
+	}
+	var entry AccessLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != http.StatusOK || entry.Bytes == 0 || entry.URI != "/dns_stats?a=b" || entry.Handler != "/dns_stats" ||
+		entry.UserAgent != "test-agent" || entry.Referer != "http://example.com" || entry.ClientIP != "192.0.2.1" || entry.Method != http.MethodGet {
+		t.Fatalf("%+v", entry)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != http.StatusNotFound || entry.Handler != "" {
+		t.Fatalf("%+v", entry)
+	}
+	// Rotate the file when it grows too large, and keep only the configured number of backups.
+	daemon.AccessLog.file.SetRotation(1, 0, daemon.AccessLog.NumBackups)
+	for i := 0; i < 4; i++ {
+		get("/dns_stats")
+	}
+	for _, name := range []string{"access.log", "access.log.1", "access.log.2"} {
+		if content, err := ioutil.ReadFile(path.Join(dir, name)); err != nil || strings.Count(string(content), "\n") != 1 {
+			t.Fatal(name, err, string(content))
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, "access.log.3")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Connection cannot be taken over if the underlying response writer does not allow it
+	recorder := &accessLogResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	if _, _, err := recorder.Hijack(); err == nil || recorder.status != 0 {
+		t.Fatal(err, recorder.status)
+	}
+}
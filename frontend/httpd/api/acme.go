@@ -0,0 +1,29 @@
+package api
+
+import (
+	"errors"
+	"github.com/HouzuoGuo/laitos/acme"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"net/http"
+)
+
+// Answer ACME server's HTTP challenges (/.well-known/acme-challenge/) on behalf of the certificate manager.
+type HandleACMEChallenge struct {
+	CertManager *acme.CertManager `json:"-"` // Certificate manager that prepares challenge responses
+}
+
+func (chal *HandleACMEChallenge) MakeHandler(_ global.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	if chal.CertManager == nil {
+		return nil, errors.New("HandleACMEChallenge.MakeHandler: certificate manager is not assigned")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		NoCache(w)
+		chal.CertManager.HandleHTTPChallenge(w, r)
+	}, nil
+}
+
+func (_ *HandleACMEChallenge) GetRateLimitFactor() int {
+	// ACME server validates challenges from several locations at once
+	return 10
+}
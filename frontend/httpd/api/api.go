@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"github.com/HouzuoGuo/laitos/env"
@@ -15,8 +16,10 @@ import (
 	"github.com/HouzuoGuo/laitos/frontend/telegrambot"
 	"github.com/HouzuoGuo/laitos/global"
 	"log"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
 /*
@@ -32,6 +35,15 @@ type HandlerFactory interface {
 	GetRateLimitFactor() int                                                       // Factor of how expensive the handler is to execute, 1 being most expensive.
 }
 
+/*
+A HTTP handler function factory whose handler keeps working in background, such as health check of reverse proxy.
+HTTP daemon stops the background work when it stops, or when reloaded configuration replaces the handler.
+*/
+type StoppableHandlerFactory interface {
+	HandlerFactory
+	StopHandler() // Stop background work of the handler function made by MakeHandler. It may be called more than once.
+}
+
 // Escape sequences in a string to make it safe for being element data.
 func XMLEscape(in string) string {
 	var escapeOutput bytes.Buffer
@@ -46,12 +58,48 @@ func NoCache(w http.ResponseWriter) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 }
 
+// sessionUserKey is the request context key of the user name of a signed-in session.
+type sessionUserKey struct{}
+
+// WithSessionUser returns a copy of the request that carries the user name of its signed-in session.
+func WithSessionUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, user))
+}
+
+// GetSessionUser returns the user name of the request's signed-in session, or an empty string if there is none.
+func GetSessionUser(r *http.Request) string {
+	user, _ := r.Context().Value(sessionUserKey{}).(string)
+	return user
+}
+
+// connKey is the request context key of the client connection that carries the request.
+type connKey struct{}
+
+// WithConn returns a copy of the context that carries the client connection, it is used by HTTP server's ConnContext.
+func WithConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+/*
+SetConnDeadline moves the read and write deadlines of the connection that carries the request, so that a long response
+(e.g. a stream) is cut short by neither HTTP server's write timeout nor its read timeout, which would otherwise cancel
+the request context. Zero deadline means no deadline. It does nothing if the connection is unknown.
+*/
+func SetConnDeadline(r *http.Request, deadline time.Time) error {
+	conn, ok := r.Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return nil
+	}
+	return conn.SetDeadline(deadline)
+}
+
 /*
 If request came in HTTP instead of HTTPS, asks client to confirm the request via a dummy basic authentication request.
+Visitors who have signed in to a session already made the choice, and are not asked again.
 Return true only if caller should continue processing the request.
 */
 func WarnIfNoHTTPS(r *http.Request, w http.ResponseWriter) bool {
-	if r.TLS == nil {
+	if r.TLS == nil && GetSessionUser(r) == "" {
 		if _, _, ok := r.BasicAuth(); !ok {
 			w.Header().Set("WWW-Authenticate", `Basic realm="You are not using HTTPS. Enter any user/password to continue."`)
 			w.WriteHeader(http.StatusUnauthorized)
@@ -69,23 +117,26 @@ type HandleSystemInfo struct {
 }
 
 /*
-GetLatestStats returns statistic information from all front-end daemons, each on their own line.
-Due to inevitable cyclic import, this function is defined twice, once in api.go of api package, the other in
-maintenance.go of maintenance package.
+GetLatestStats returns statistic information from all front-end daemons, each on their own line. Each line shows
+lifetime lowest/average/highest/total(count), lifetime percentiles, and 99th percentile(count) of recent windows.
 */
 func GetLatestStats() string {
 	numDecimals := 2
 	return fmt.Sprintf(`CmdProc: %s
-DNSD TCP/UDP: %s/%s
+DNSD TCP: %s
+DNSD UDP: %s
+DNSD TLS: %s
 HTTPD: %s
 MAILP: %s
-PLAIN TCP/UDP: %s%s
+PLAIN TCP: %s
+PLAIN UDP: %s
 SMTPD: %s
-SOCKD TCP/UDP: %s/%s
+SOCKD TCP: %s
+SOCKD UDP: %s
 TELEGRAM BOT: %s
 `,
 		common.DurationStats.Format(numDecimals),
-		dnsd.TCPDurationStats.Format(numDecimals), dnsd.UDPDurationStats.Format(numDecimals),
+		dnsd.TCPDurationStats.Format(numDecimals), dnsd.UDPDurationStats.Format(numDecimals), dnsd.TLSDurationStats.Format(numDecimals),
 		DurationStats.Format(numDecimals),
 		mailp.DurationStats.Format(numDecimals),
 		plain.TCPDurationStats.Format(numDecimals), plain.UDPDurationStats.Format(numDecimals),
@@ -121,7 +172,7 @@ func (info *HandleSystemInfo) MakeHandler(logger global.Logger, _ *common.Comman
 		// Runtime info
 		fmt.Fprint(w, feature.GetRuntimeInfo())
 		// Statistics
-		fmt.Fprint(w, "\nStatistics low/avg/high/total(count) millisec:\n")
+		fmt.Fprint(w, "\nStatistics low/avg/high/total(count), percentiles, and recent p99(count) millisec:\n")
 		fmt.Fprint(w, GetLatestStats())
 		// Feature checks
 		if len(featureErrs) == 0 {
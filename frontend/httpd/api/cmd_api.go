@@ -0,0 +1,230 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/feature"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CommandAPIVersion         = 1                    // CommandAPIVersion is the version of request and response structures, it increases when they change incompatibly.
+	CommandAPIMaxRequestSize  = 64 * 1024            // CommandAPIMaxRequestSize is the maximum size of request body.
+	CommandAPIMaxClockSkew    = 300                  // CommandAPIMaxClockSkew is the maximum difference (in seconds) between the time of signed request and server time.
+	CommandAPITimestampHeader = "X-Laitos-Timestamp" // CommandAPITimestampHeader carries the unix time (in seconds) at which the request was signed.
+	CommandAPISignatureHeader = "X-Laitos-Signature" // CommandAPISignatureHeader carries hex-encoded HMAC-SHA256 signature of the request.
+	CommandAPIMaxOutputLength = 4096                 // CommandAPIMaxOutputLength is the output length when client overrides position only and there is no LintText bridge.
+)
+
+var ErrCommandAPIUnauthorised = errors.New("missing or invalid bearer token or request signature")
+
+// CommandAPIRequest is the JSON request body of command API.
+type CommandAPIRequest struct {
+	Command    string `json:"Command"`    // Command is the feature command without PIN, e.g. ".s echo hi".
+	TimeoutSec int    `json:"TimeoutSec"` // (Optional) TimeoutSec is the command timeout in seconds, by default 110, capped by the server's MaxTimeoutSec.
+	Position   *int   `json:"Position"`   // (Optional) Position overrides the output position like PLT does.
+	Length     *int   `json:"Length"`     // (Optional) Length overrides the maximum output length like PLT does.
+}
+
+// CommandAPIResponse is the JSON response of command API.
+type CommandAPIResponse struct {
+	APIVersion     int    `json:"APIVersion"`     // APIVersion is the version of command API
+	Trigger        string `json:"Trigger"`        // Trigger is the prefix of the feature that ran the command, or empty if nothing ran.
+	Error          string `json:"Error"`          // Error is the error text of command result, or empty if there is no error.
+	Output         string `json:"Output"`         // Output is the command output excluding error text.
+	CombinedOutput string `json:"CombinedOutput"` // CombinedOutput is the error text and output that went through result bridges.
+}
+
+/*
+Run feature commands via JSON requests and respond with structured results. Client authenticates with any of the bearer
+tokens in Authorization header, or signs the request with the HMAC secret: the signature is hex-encoded HMAC-SHA256 of
+timestamp, request method, URL path, and request body, each followed by a new line. A signature is accepted only once.
+*/
+type HandleCommandAPI struct {
+	BearerTokens  []string `json:"BearerTokens"`  // (Optional) authorise clients that present any of these tokens in "Authorization: Bearer" header
+	HMACSecret    string   `json:"HMACSecret"`    // (Optional) authorise clients that sign requests with this secret
+	MaxTimeoutSec int      `json:"MaxTimeoutSec"` // (Optional) client may not ask for a command timeout longer than this, by default 110 seconds.
+
+	seenSignatures map[string]int64 // seenSignatures are the signatures of accepted requests mapped to the unix time at which they become stale.
+	seenMutex      *sync.Mutex      // seenMutex protects seenSignatures from concurrent access.
+}
+
+// SignCommandAPIRequest returns the signature of a command API request made at the unix timestamp.
+func SignCommandAPIRequest(secret string, timestamp int64, method, path string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n", timestamp, method, path)
+	mac.Write(body)
+	mac.Write([]byte{'\n'})
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isAuthorised returns true only if the request carries a valid bearer token or signature.
+func (cmdAPI *HandleCommandAPI) isAuthorised(r *http.Request, body []byte) bool {
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		for _, validToken := range cmdAPI.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(validToken)) == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	if cmdAPI.HMACSecret == "" {
+		return false
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(CommandAPITimestampHeader), 10, 64)
+	if err != nil || math.Abs(float64(time.Now().Unix()-timestamp)) > CommandAPIMaxClockSkew {
+		return false
+	}
+	signature, err := hex.DecodeString(r.Header.Get(CommandAPISignatureHeader))
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(SignCommandAPIRequest(cmdAPI.HMACSecret, timestamp, r.Method, r.URL.Path, body))
+	if !hmac.Equal(signature, expected) {
+		return false
+	}
+	// Remember the signature until its timestamp becomes stale, so that the request cannot be replayed.
+	now := time.Now().Unix()
+	cmdAPI.seenMutex.Lock()
+	defer cmdAPI.seenMutex.Unlock()
+	for seen, staleAt := range cmdAPI.seenSignatures {
+		if now > staleAt {
+			delete(cmdAPI.seenSignatures, seen)
+		}
+	}
+	if _, seen := cmdAPI.seenSignatures[string(signature)]; seen {
+		return false
+	}
+	cmdAPI.seenSignatures[string(signature)] = timestamp + CommandAPIMaxClockSkew
+	return true
+}
+
+// GetProcessorPIN returns the PIN of command processor's PIN bridge, or empty string if there is none.
+func GetProcessorPIN(cmdProc *common.CommandProcessor) string {
+	return cmdProc.GetPIN()
+}
+
+/*
+MatchProcessorPIN compares the password against the PIN in constant time, and counts a mismatch toward the client's ban.
+Return false if the password is wrong or the client is banned.
+*/
+func MatchProcessorPIN(bans *env.BanManager, pin, clientIP, password string) bool {
+	if pin == "" || bans.IsBanned(clientIP) {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(pin)) != 1 {
+		bans.AddFailure(clientIP)
+		return false
+	}
+	return true
+}
+
+// writeJSON responds with the status code and JSON value.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func (cmdAPI *HandleCommandAPI) MakeHandler(logger global.Logger, cmdProc *common.CommandProcessor) (http.HandlerFunc, error) {
+	if len(cmdAPI.BearerTokens) == 0 && cmdAPI.HMACSecret == "" {
+		return nil, errors.New("HandleCommandAPI.MakeHandler: bearer tokens and HMAC secret are both empty")
+	}
+	for _, token := range cmdAPI.BearerTokens {
+		if len(token) < 7 {
+			return nil, errors.New("HandleCommandAPI.MakeHandler: bearer token must be at least 7 characters long")
+		}
+	}
+	if cmdAPI.HMACSecret != "" && len(cmdAPI.HMACSecret) < 7 {
+		return nil, errors.New("HandleCommandAPI.MakeHandler: HMAC secret must be at least 7 characters long")
+	}
+	if cmdAPI.MaxTimeoutSec < 1 {
+		cmdAPI.MaxTimeoutSec = CommandFormTimeoutSec
+	}
+	cmdAPI.seenSignatures = make(map[string]int64)
+	cmdAPI.seenMutex = new(sync.Mutex)
+	if GetProcessorPIN(cmdProc) == "" {
+		return nil, errors.New("HandleCommandAPI.MakeHandler: command processor must have a PIN")
+	}
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		NoCache(w)
+		clientIP := GetRealClientIP(r)
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, CommandAPIResponse{APIVersion: CommandAPIVersion, Error: "method not allowed"})
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, CommandAPIMaxRequestSize))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, CommandAPIResponse{APIVersion: CommandAPIVersion, Error: "failed to read request"})
+			return
+		}
+		if cmdProc.Bans.IsBanned(clientIP) {
+			writeJSON(w, http.StatusForbidden, CommandAPIResponse{APIVersion: CommandAPIVersion, Error: env.ErrClientBanned.Error()})
+			return
+		}
+		if !cmdAPI.isAuthorised(r, body) {
+			logger.Warningf("HandleCommandAPI", clientIP, nil, "unauthorised request")
+			cmdProc.Bans.AddFailure(clientIP)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="laitos"`)
+			writeJSON(w, http.StatusUnauthorized, CommandAPIResponse{APIVersion: CommandAPIVersion, Error: ErrCommandAPIUnauthorised.Error()})
+			return
+		}
+		var req CommandAPIRequest
+		if err := json.Unmarshal(body, &req); err != nil || strings.TrimSpace(req.Command) == "" {
+			writeJSON(w, http.StatusBadRequest, CommandAPIResponse{APIVersion: CommandAPIVersion, Error: "request must be a JSON object with a Command"})
+			return
+		}
+		if req.TimeoutSec < 1 {
+			req.TimeoutSec = CommandFormTimeoutSec
+		}
+		if req.TimeoutSec > cmdAPI.MaxTimeoutSec {
+			req.TimeoutSec = cmdAPI.MaxTimeoutSec
+		}
+		content := strings.TrimSpace(req.Command)
+		// Output position and length overrides are carried out by PLT prefix
+		if req.Position != nil || req.Length != nil {
+			position, length := 0, CommandAPIMaxOutputLength
+			if lintText := cmdProc.GetLintText(); lintText != nil {
+				length = lintText.MaxLength
+			}
+			if req.Position != nil {
+				position = *req.Position
+			}
+			if req.Length != nil {
+				length = *req.Length
+			}
+			if position < 0 || length < 0 {
+				writeJSON(w, http.StatusBadRequest, CommandAPIResponse{APIVersion: CommandAPIVersion, Error: "Position and Length must not be negative"})
+				return
+			}
+			content = fmt.Sprintf("%s %d %d %d %s", common.PrefixCommandPLT, position, length, req.TimeoutSec, content)
+		}
+		resp := CommandAPIResponse{APIVersion: CommandAPIVersion, Trigger: string(cmdProc.FindTrigger(req.Command))}
+		// The client is already authorised, hence the command API presents the PIN on the client's behalf.
+		result := cmdProc.Process(feature.Command{Content: GetProcessorPIN(cmdProc) + content, TimeoutSec: req.TimeoutSec, ClientID: GetRealClientIP(r)})
+		resp.Error = result.ErrText()
+		resp.Output = result.Output
+		resp.CombinedOutput = result.CombinedOutput
+		writeJSON(w, http.StatusOK, resp)
+	}
+	return fun, nil
+}
+
+func (_ *HandleCommandAPI) GetRateLimitFactor() int {
+	return 2
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/HouzuoGuo/laitos/bridge"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleCommandAPI(t *testing.T) {
+	cmdProc := common.GetTestCommandProcessor()
+	if _, err := (&HandleCommandAPI{}).MakeHandler(global.Logger{}, cmdProc); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := (&HandleCommandAPI{BearerTokens: []string{"short"}}).MakeHandler(global.Logger{}, cmdProc); err == nil {
+		t.Fatal("did not error")
+	}
+	handler := &HandleCommandAPI{BearerTokens: []string{"verysecrettoken"}, HMACSecret: "verysecrethmac"}
+	fun, err := handler.MakeHandler(global.Logger{}, cmdProc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(method, body string, header map[string]string) (int, CommandAPIResponse) {
+		req := httptest.NewRequest(method, "/api/v1/cmd", strings.NewReader(body))
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		fun(rec, req)
+		var resp CommandAPIResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.APIVersion != CommandAPIVersion {
+			t.Fatal(err, rec.Body.String())
+		}
+		return rec.Code, resp
+	}
+	bearer := map[string]string{"Authorization": "Bearer verysecrettoken"}
+
+	if status, _ := call(http.MethodGet, "", bearer); status != http.StatusMethodNotAllowed {
+		t.Fatal(status)
+	}
+	if status, _ := call(http.MethodPost, `{"Command": ".s echo hi"}`, map[string]string{"Authorization": "Bearer wrongtoken"}); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	if status, _ := call(http.MethodPost, `{"Command": ".s echo hi"}`, nil); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	if status, _ := call(http.MethodPost, `not json`, bearer); status != http.StatusBadRequest {
+		t.Fatal(status)
+	}
+	if status, resp := call(http.MethodPost, `{"Command": ".s echo hi"}`, bearer); status != http.StatusOK ||
+		resp.Trigger != ".s" || resp.Error != "" || strings.TrimSpace(resp.Output) != "hi" || resp.CombinedOutput != "hi" {
+		t.Fatal(status, resp)
+	}
+	// Output position and length overrides
+	if status, resp := call(http.MethodPost, `{"Command": ".s echo 0123456789", "Position": 2, "Length": 3}`, bearer); status != http.StatusOK ||
+		resp.CombinedOutput != "234" {
+		t.Fatal(status, resp)
+	}
+	if status, _ := call(http.MethodPost, `{"Command": ".s echo hi", "Position": -1}`, bearer); status != http.StatusBadRequest {
+		t.Fatal(status)
+	}
+	// Command timeout may not exceed the limit
+	handler.MaxTimeoutSec = 1
+	start := time.Now()
+	if status, resp := call(http.MethodPost, `{"Command": ".s sleep 5", "TimeoutSec": 100}`, bearer); status != http.StatusOK || resp.Error == "" ||
+		time.Since(start) > 4*time.Second {
+		t.Fatal(status, resp)
+	}
+	handler.MaxTimeoutSec = CommandFormTimeoutSec
+	// Command errors are reported in the result
+	if status, resp := call(http.MethodPost, `{"Command": ".nonexistent"}`, bearer); status != http.StatusOK ||
+		resp.Trigger != "" || resp.Error != common.ErrBadPrefix.Error() {
+		t.Fatal(status, resp)
+	}
+
+	// HMAC-signed requests
+	body := `{"Command": ".s echo signed"}`
+	now := time.Now().Unix()
+	signed := map[string]string{
+		CommandAPITimestampHeader: strconv.FormatInt(now, 10),
+		CommandAPISignatureHeader: SignCommandAPIRequest("verysecrethmac", now, http.MethodPost, "/api/v1/cmd", []byte(body)),
+	}
+	if status, resp := call(http.MethodPost, body, signed); status != http.StatusOK || strings.TrimSpace(resp.Output) != "signed" {
+		t.Fatal(status, resp)
+	}
+	// The same signature cannot be replayed
+	if status, _ := call(http.MethodPost, body, signed); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	// Tampered body
+	if status, _ := call(http.MethodPost, `{"Command": ".s echo tampered"}`, signed); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	// Stale signature
+	stale := now - CommandAPIMaxClockSkew - 10
+	signed[CommandAPITimestampHeader] = strconv.FormatInt(stale, 10)
+	signed[CommandAPISignatureHeader] = SignCommandAPIRequest("verysecrethmac", stale, http.MethodPost, "/api/v1/cmd", []byte(body))
+	if status, _ := call(http.MethodPost, body, signed); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+
+	// PIN that changes upon reload is picked up by the next request
+	reloaded := common.GetTestCommandProcessor()
+	reloaded.CommandBridges[0].(*bridge.PINAndShortcuts).PIN = "newverysecret"
+	cmdProc.ReplaceWith(reloaded)
+	if status, resp := call(http.MethodPost, `{"Command": ".s echo reloaded"}`, bearer); status != http.StatusOK || strings.TrimSpace(resp.Output) != "reloaded" {
+		t.Fatal(status, resp)
+	}
+
+	// Failed attempts to authorise count toward the client's ban
+	cmdProc.Bans = &env.BanManager{MaxFailures: 2}
+	if err := cmdProc.Bans.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if status, _ := call(http.MethodPost, `{"Command": ".s echo hi"}`, map[string]string{"Authorization": "Bearer wrongtoken"}); status != http.StatusUnauthorized {
+			t.Fatal(status)
+		}
+	}
+	if status, resp := call(http.MethodPost, `{"Command": ".s echo hi"}`, bearer); status != http.StatusForbidden || resp.Error != env.ErrClientBanned.Error() {
+		t.Fatal(status, resp)
+	}
+}
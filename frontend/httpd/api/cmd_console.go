@@ -0,0 +1,217 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/feature"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const HandleCommandConsolePage = `<!doctype html>
+<html>
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
+    <title>Command Console</title>
+</head>
+<body>
+    <pre id="output"></pre>
+    <form action="#" onsubmit="return sendCommand();">
+        <p><input type="password" id="cmd" size="60" autocomplete="off" /><input type="submit" value="Exec"/></p>
+    </form>
+    <script type="text/javascript">
+    var output = document.getElementById('output');
+    var cmd = document.getElementById('cmd');
+    var cmdHistory = [];
+    var historyIndex = 0;
+    var authenticated = false;
+    var ws = null;
+    function print(text) {
+        output.appendChild(document.createTextNode(text + '\n'));
+        window.scrollTo(0, document.body.scrollHeight);
+    }
+    function sendCommand() {
+        var text = cmd.value;
+        if (ws === null || text === '') {
+            return false;
+        }
+        if (authenticated) {
+            cmdHistory.push(text);
+            historyIndex = cmdHistory.length;
+            print('> ' + text);
+        }
+        ws.send(text);
+        cmd.value = '';
+        return false;
+    }
+    cmd.onkeydown = function (evt) {
+        evt = evt || window.event;
+        if (evt.keyCode === 38 && historyIndex > 0) {
+            historyIndex--;
+            cmd.value = cmdHistory[historyIndex];
+            return false;
+        } else if (evt.keyCode === 40 && historyIndex < cmdHistory.length) {
+            historyIndex++;
+            cmd.value = historyIndex < cmdHistory.length ? cmdHistory[historyIndex] : '';
+            return false;
+        }
+        return true;
+    };
+    if (!window.WebSocket) {
+        print('This browser does not support WebSocket, please use the command form instead.');
+    } else {
+        ws = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + location.pathname);
+        ws.onopen = function () {
+            print('Connected, enter password.');
+        };
+        ws.onmessage = function (evt) {
+            var msg = JSON.parse(evt.data);
+            if (msg.Type === 'authenticated') {
+                authenticated = true;
+                try {
+                    cmd.type = 'text';
+                } catch (e) {
+                }
+            }
+            print(msg.Text);
+        };
+        ws.onclose = function () {
+            ws = null;
+            print('Disconnected, reload the page to start a new session.');
+        };
+    }
+    </script>
+</body>
+</html>
+` // Command console page content
+
+const (
+	CommandConsoleIdleTimeoutSec      = 600 // CommandConsoleIdleTimeoutSec is the default number of seconds a session may stay idle before it is closed.
+	CommandConsoleProgressIntervalSec = 3   // CommandConsoleProgressIntervalSec is the interval at which progress of a running command is reported.
+
+	CommandConsoleAuthenticated = "authenticated" // CommandConsoleAuthenticated message confirms the password.
+	CommandConsoleProgress      = "progress"      // CommandConsoleProgress message tells that a command is still running.
+	CommandConsoleResult        = "result"        // CommandConsoleResult message carries the output of a command.
+	CommandConsoleError         = "error"         // CommandConsoleError message tells why the session is about to close.
+)
+
+// CommandConsoleMessage is a message sent by command console to browser.
+type CommandConsoleMessage struct {
+	Type string `json:"Type"` // Type is one of "authenticated", "progress", "result", and "error".
+	Text string `json:"Text"` // Text is displayed to user.
+}
+
+/*
+Run feature commands in an interactive console over WebSocket. User enters password once per session, and then runs
+any number of commands without reloading the page. The page works without any JavaScript framework.
+*/
+type HandleCommandConsole struct {
+	IdleTimeoutSec int `json:"IdleTimeoutSec"` // (Optional) close session after this many seconds without a command, by default 600.
+}
+
+// sendConsoleMessage encodes and sends a console message.
+func sendConsoleMessage(ws *WebSocket, msgType, text string) error {
+	msg, err := json.Marshal(CommandConsoleMessage{Type: msgType, Text: text})
+	if err != nil {
+		return err
+	}
+	return ws.WriteText(string(msg))
+}
+
+func (console *HandleCommandConsole) MakeHandler(logger global.Logger, cmdProc *common.CommandProcessor) (http.HandlerFunc, error) {
+	if GetProcessorPIN(cmdProc) == "" {
+		return nil, errors.New("HandleCommandConsole.MakeHandler: command processor must have a PIN")
+	}
+	if console.IdleTimeoutSec < 1 {
+		console.IdleTimeoutSec = CommandConsoleIdleTimeoutSec
+	}
+	idleTimeout := time.Duration(console.IdleTimeoutSec) * time.Second
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		NoCache(w)
+		if !IsWebSocketUpgrade(r) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if !WarnIfNoHTTPS(r, w) {
+				return
+			}
+			w.Write([]byte(HandleCommandConsolePage))
+			return
+		}
+		clientIP := GetRealClientIP(r)
+		ws, err := UpgradeWebSocket(w, r)
+		if err != nil {
+			logger.Warningf("HandleCommandConsole", clientIP, err, "failed to open WebSocket")
+			return
+		}
+		defer ws.Close()
+		// The first message is the password
+		password, err := ws.ReadText(idleTimeout)
+		if err != nil {
+			return
+		}
+		if cmdProc.Bans.IsBanned(clientIP) {
+			sendConsoleMessage(ws, CommandConsoleError, env.ErrClientBanned.Error())
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(password)), []byte(GetProcessorPIN(cmdProc))) != 1 {
+			cmdProc.Bans.AddFailure(clientIP)
+			logger.Warningf("HandleCommandConsole", clientIP, nil, "incorrect password")
+			sendConsoleMessage(ws, CommandConsoleError, "Incorrect password")
+			return
+		}
+		if sendConsoleMessage(ws, CommandConsoleAuthenticated, "Ready for commands") != nil {
+			return
+		}
+		for {
+			content, err := ws.ReadText(idleTimeout)
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+				sendConsoleMessage(ws, CommandConsoleError, "Session has been idle for too long")
+				return
+			} else if err == io.EOF {
+				return
+			} else if err != nil {
+				logger.Warningf("HandleCommandConsole", clientIP, err, "failed to read command")
+				return
+			}
+			if strings.TrimSpace(content) == "" {
+				continue
+			}
+			// Report progress of long-running command until it completes
+			done := make(chan struct{})
+			progressStopped := new(sync.WaitGroup)
+			progressStopped.Add(1)
+			go func() {
+				defer progressStopped.Done()
+				startTime := time.Now()
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(CommandConsoleProgressIntervalSec * time.Second):
+						sendConsoleMessage(ws, CommandConsoleProgress, fmt.Sprintf("Still running (%ds)...", int(time.Since(startTime).Seconds())))
+					}
+				}
+			}()
+			result := cmdProc.Process(feature.Command{Content: GetProcessorPIN(cmdProc) + content, TimeoutSec: CommandFormTimeoutSec, ClientID: clientIP})
+			close(done)
+			progressStopped.Wait()
+			if sendConsoleMessage(ws, CommandConsoleResult, result.CombinedOutput) != nil {
+				return
+			}
+		}
+	}
+	return fun, nil
+}
+
+func (_ *HandleCommandConsole) GetRateLimitFactor() int {
+	// Each connection is a session of many commands
+	return 2
+}
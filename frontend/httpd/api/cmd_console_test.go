@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testWebSocketClient is a minimal WebSocket client that sends masked text frames.
+type testWebSocketClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestWebSocket(t *testing.T, serverURL string) *testWebSocketClient {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := "GET /console HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	// The accept key of the sample nonce is given by RFC 6455
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal(err, resp)
+	}
+	return &testWebSocketClient{conn: conn, reader: reader}
+}
+
+func (client *testWebSocketClient) send(t *testing.T, text string) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | WebSocketOpText, 0x80 | 126, 0, 0}
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(text)))
+	frame = append(frame, mask...)
+	for i := 0; i < len(text); i++ {
+		frame = append(frame, text[i]^mask[i%4])
+	}
+	if _, err := client.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive reads the next frame and decodes console message from it. Close frame results in io.EOF.
+func (client *testWebSocketClient) receive(t *testing.T) (msg CommandConsoleMessage, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(client.reader, header[:]); err != nil {
+		return
+	}
+	length := int(header[1])
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(client.reader, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err = io.ReadFull(client.reader, payload); err != nil {
+		return
+	}
+	if header[0]&0x0f == WebSocketOpClose {
+		return msg, io.EOF
+	}
+	err = json.Unmarshal(payload, &msg)
+	return
+}
+
+func TestHandleCommandConsole(t *testing.T) {
+	console := &HandleCommandConsole{IdleTimeoutSec: 1}
+	fun, err := console.MakeHandler(global.Logger{}, common.GetTestCommandProcessor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(fun)
+	defer server.Close()
+
+	// Page is served to ordinary visitors
+	resp, err := http.Get(server.URL + "/console")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal(err, resp)
+	}
+	// Incorrect password
+	client := dialTestWebSocket(t, server.URL)
+	client.send(t, "wrong password")
+	if msg, err := client.receive(t); err != nil || msg.Type != CommandConsoleError {
+		t.Fatal(err, msg)
+	}
+	if _, err := client.receive(t); err != io.EOF {
+		t.Fatal(err)
+	}
+	// Authenticate, then run commands
+	client = dialTestWebSocket(t, server.URL)
+	client.send(t, "verysecret")
+	if msg, err := client.receive(t); err != nil || msg.Type != CommandConsoleAuthenticated {
+		t.Fatal(err, msg)
+	}
+	client.send(t, ".s echo hi")
+	if msg, err := client.receive(t); err != nil || msg.Type != CommandConsoleResult || msg.Text != "hi" {
+		t.Fatal(err, msg)
+	}
+	// Long-running command reports progress
+	client.send(t, ".s sleep 4; echo "+strings.Repeat("a", 200))
+	if msg, err := client.receive(t); err != nil || msg.Type != CommandConsoleProgress || !strings.HasPrefix(msg.Text, "Still running") {
+		t.Fatal(err, msg)
+	}
+	if msg, err := client.receive(t); err != nil || msg.Type != CommandConsoleResult || msg.Text != strings.Repeat("a", 35) {
+		t.Fatal(err, msg)
+	}
+	// Idle session times out
+	if msg, err := client.receive(t); err != nil || msg.Type != CommandConsoleError {
+		t.Fatal(err, msg)
+	}
+	if _, err := client.receive(t); err != io.EOF {
+		t.Fatal(err)
+	}
+}
@@ -46,6 +46,7 @@ func (_ *HandleCommandForm) MakeHandler(logger global.Logger, cmdProc *common.Co
 				result := cmdProc.Process(feature.Command{
 					Content:    cmd,
 					TimeoutSec: CommandFormTimeoutSec,
+					ClientID:   GetRealClientIP(r),
 				})
 				w.Write([]byte(fmt.Sprintf(HandleCommandFormPage, html.EscapeString(result.CombinedOutput))))
 			}
@@ -0,0 +1,353 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/feature"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
+	"github.com/HouzuoGuo/laitos/frontend/mailp"
+	"github.com/HouzuoGuo/laitos/frontend/sockd"
+	"github.com/HouzuoGuo/laitos/global"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DashboardDefaultRefreshIntervalSec = 30  // DashboardDefaultRefreshIntervalSec is the default interval at which browser reloads the dashboard.
+	DashboardDefaultNumWarnings        = 50  // DashboardDefaultNumWarnings is the default number of latest warnings shown on dashboard.
+	DashboardMaxNumWarnings            = 500 // DashboardMaxNumWarnings is the maximum number of latest warnings shown on dashboard.
+
+	DashboardActionHealthCheck = "health-check" // DashboardActionHealthCheck runs self test of features and mail processor.
+	DashboardActionBlockList   = "block-list"   // DashboardActionBlockList updates ad-block list of the running DNS daemon in background.
+	DashboardActionLockDown    = "lock-down"    // DashboardActionLockDown triggers emergency lock down.
+)
+
+// dashboardUpdatingBlockList is 1 while a dashboard is updating ad-block list, the update must not run more than once at a time.
+var dashboardUpdatingBlockList int32
+
+// dashboardStyle is the style sheet of dashboard page.
+const dashboardStyle = `body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+pre { background: #f4f4f4; padding: 6px; white-space: pre-wrap; }
+form { display: inline-block; margin-right: 12px; }
+.error { color: #b00; }
+.ok { color: #070; }`
+
+/*
+Show system information, daemon statistics, health check results, DNS and sockd activity, and latest warnings on an HTML
+page that reloads itself without JavaScript. The page also offers buttons for a few safe actions. Visitor signs in via
+HTTP basic authentication, using the password PIN of command processor as password and any user name.
+*/
+type HandleDashboard struct {
+	RefreshIntervalSec int `json:"RefreshIntervalSec"` // (Optional) browser reloads dashboard at this interval, by default 30 seconds.
+
+	FeaturesToCheck *feature.FeatureSet  `json:"-"` // Health check subject - features and their API keys
+	MailpToCheck    *mailp.MailProcessor `json:"-"` // Health check subject - mail processor and its mailer
+
+	bans       *env.BanManager // bans is the brute-force protection of command processor
+	csrfSecret []byte          // csrfSecret derives the token that must accompany actions from visitor's credentials.
+	logger     global.Logger
+
+	mutex          *sync.Mutex
+	lastCheckTime  time.Time                 // lastCheckTime is the moment the latest health check finished.
+	featureErrs    map[feature.Trigger]error // featureErrs are the feature self test errors of the latest health check.
+	mailpErr       error                     // mailpErr is the mail processor self test error of the latest health check.
+	lastAction     string                    // lastAction describes the outcome of the latest action.
+	lastActionTime time.Time
+}
+
+// runHealthCheck runs self test of features and mail processor, and remembers the result.
+func (dash *HandleDashboard) runHealthCheck() {
+	featureErrs := make(map[feature.Trigger]error)
+	if dash.FeaturesToCheck != nil {
+		featureErrs = dash.FeaturesToCheck.SelfTest()
+	}
+	var mailpErr error
+	if dash.MailpToCheck != nil {
+		mailpErr = dash.MailpToCheck.SelfTest()
+	}
+	dash.mutex.Lock()
+	dash.featureErrs = featureErrs
+	dash.mailpErr = mailpErr
+	dash.lastCheckTime = time.Now()
+	dash.mutex.Unlock()
+}
+
+/*
+csrfToken returns the token that must accompany actions of the visitor, so that other web sites cannot trick a signed-in
+browser into acting. The token is derived from visitor's credentials, hence it is useless to anybody else.
+*/
+func (dash *HandleDashboard) csrfToken(user, password string) string {
+	mac := hmac.New(sha256.New, dash.csrfSecret)
+	mac.Write([]byte(user + ":" + password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// act carries out the action and returns its outcome.
+func (dash *HandleDashboard) act(action, clientIP string) string {
+	switch action {
+	case DashboardActionHealthCheck:
+		dash.runHealthCheck()
+		return "Health check completed"
+	case DashboardActionBlockList:
+		if feature.RunningDNSD == nil {
+			return "DNS daemon is not running"
+		}
+		// Repeated clicks must not pile up downloads of the block lists
+		if !atomic.CompareAndSwapInt32(&dashboardUpdatingBlockList, 0, 1) {
+			return "Ad-block list is already being updated"
+		}
+		go func() {
+			defer atomic.StoreInt32(&dashboardUpdatingBlockList, 0)
+			feature.RunningDNSD.UpdatedAdBlockLists()
+		}()
+		return "Started updating ad-block list in background"
+	case DashboardActionLockDown:
+		dash.logger.Warningf("HandleDashboard", clientIP, nil, "triggering emergency lock down")
+		global.TriggerEmergencyLockDown()
+		return "Emergency lock down is now effective"
+	default:
+		return "Unknown action"
+	}
+}
+
+// writeActions writes the buttons of actions, each carries the visitor's token.
+func (dash *HandleDashboard) writeActions(page *strings.Builder, csrfToken string) {
+	csrf := html.EscapeString(csrfToken)
+	for _, action := range []struct{ name, label, extra string }{
+		{DashboardActionHealthCheck, "Re-run health check", ""},
+		{DashboardActionBlockList, "Refresh DNS block list", ""},
+		{DashboardActionLockDown, "Trigger emergency lock down", `<label><input type="checkbox" name="confirm" value="yes" required /> I understand only a restart lifts lock down</label> `},
+	} {
+		fmt.Fprintf(page, `<form method="post"><input type="hidden" name="csrf" value="%s" /><input type="hidden" name="action" value="%s" />%s<input type="submit" value="%s" /></form>`+"\n",
+			csrf, action.name, action.extra, action.label)
+	}
+}
+
+// writeHealth writes the result of the latest health check.
+func (dash *HandleDashboard) writeHealth(page *strings.Builder) {
+	dash.mutex.Lock()
+	lastCheckTime, featureErrs, mailpErr := dash.lastCheckTime, dash.featureErrs, dash.mailpErr
+	dash.mutex.Unlock()
+	if lastCheckTime.IsZero() {
+		page.WriteString("<p>Health check has not run yet.</p>\n")
+		return
+	}
+	fmt.Fprintf(page, "<p>Checked at %s</p>\n<table>\n<tr><th>Subject</th><th>Status</th></tr>\n", lastCheckTime.Format(time.RFC3339))
+	var triggers []string
+	if dash.FeaturesToCheck != nil {
+		triggers = dash.FeaturesToCheck.GetTriggers()
+	}
+	for _, trigger := range triggers {
+		writeHealthRow(page, "Feature "+trigger, featureErrs[feature.Trigger(trigger)])
+	}
+	if dash.MailpToCheck != nil {
+		writeHealthRow(page, "Mail processor", mailpErr)
+	}
+	page.WriteString("</table>\n")
+}
+
+// writeHealthRow writes a table row of the subject's self test result.
+func writeHealthRow(page *strings.Builder, subject string, err error) {
+	if err == nil {
+		fmt.Fprintf(page, "<tr><td>%s</td><td class=\"ok\">OK</td></tr>\n", html.EscapeString(subject))
+	} else {
+		fmt.Fprintf(page, "<tr><td>%s</td><td class=\"error\">%s</td></tr>\n", html.EscapeString(subject), html.EscapeString(err.Error()))
+	}
+}
+
+// writeDaemonStats writes a table of duration statistics of all daemons.
+func writeDaemonStats(page *strings.Builder) {
+	page.WriteString("<table>\n<tr><th>Daemon</th><th>Count</th><th>Low</th><th>Avg</th><th>High</th><th>P50</th><th>P90</th><th>P99</th>")
+	for _, period := range env.StatsWindows {
+		fmt.Fprintf(page, "<th>%s count</th><th>%s P99</th>", period, period)
+	}
+	page.WriteString("</tr>\n")
+	durationStats := GetDurationStatsByDaemon()
+	daemons := make([]string, 0, len(durationStats))
+	for daemon := range durationStats {
+		daemons = append(daemons, daemon)
+	}
+	sort.Strings(daemons)
+	for _, daemon := range daemons {
+		stats := durationStats[daemon]
+		lifetime := stats.GetSnapshot()
+		fmt.Fprintf(page, "<tr><td>%s</td><td>%d</td><td>%.2f</td><td>%.2f</td><td>%.2f</td><td>%.2f</td><td>%.2f</td><td>%.2f</td>",
+			daemon, lifetime.Count, lifetime.Lowest, lifetime.Average, lifetime.Highest, lifetime.P50, lifetime.P90, lifetime.P99)
+		for _, period := range env.StatsWindows {
+			window := stats.GetWindowSnapshot(period)
+			fmt.Fprintf(page, "<td>%d</td><td>%.2f</td>", window.Count, window.P99)
+		}
+		page.WriteString("</tr>\n")
+	}
+	page.WriteString("</table>\n")
+}
+
+// writeCounters writes the counters as lines of label values and count.
+func writeCounters(page *strings.Builder, counters *env.Counters) {
+	counters.Each(func(labelValues []string, count uint64) {
+		fmt.Fprintf(page, "%s: %d\n", html.EscapeString(strings.Join(labelValues, " ")), count)
+	})
+}
+
+// writeWarnings writes the latest warnings that contain the filter text (case insensitive).
+func writeWarnings(page *strings.Builder, filter string, limit int) {
+	filter = strings.ToLower(filter)
+	page.WriteString("<pre>")
+	global.LatestWarnings.Iterate(func(entry string) bool {
+		if filter != "" && !strings.Contains(strings.ToLower(entry), filter) {
+			return true
+		}
+		page.WriteString(html.EscapeString(entry))
+		page.WriteString("\n")
+		limit--
+		return limit > 0
+	})
+	page.WriteString("</pre>\n")
+}
+
+// render returns the dashboard page for the visitor who is identified by the token of actions.
+func (dash *HandleDashboard) render(filter string, numWarnings int, csrfToken string) string {
+	var page strings.Builder
+	refreshQuery := url.Values{"filter": {filter}, "warnings": {strconv.Itoa(numWarnings)}}.Encode()
+	fmt.Fprintf(&page, `<!doctype html>
+<html>
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
+    <meta http-equiv="refresh" content="%d; url=?%s" />
+    <title>laitos dashboard</title>
+    <style>%s</style>
+</head>
+<body>
+<h2>laitos dashboard</h2>
+`, dash.RefreshIntervalSec, html.EscapeString(refreshQuery), dashboardStyle)
+	fmt.Fprintf(&page, "<p>Refreshed at %s, every %d seconds.", time.Now().Format(time.RFC3339), dash.RefreshIntervalSec)
+	if global.EmergencyLockDown {
+		page.WriteString(` <strong class="error">Emergency lock down is effective.</strong>`)
+	}
+	page.WriteString("</p>\n")
+	dash.mutex.Lock()
+	if dash.lastAction != "" {
+		fmt.Fprintf(&page, "<p>Latest action at %s: %s</p>\n", dash.lastActionTime.Format(time.RFC3339), html.EscapeString(dash.lastAction))
+	}
+	dash.mutex.Unlock()
+	dash.writeActions(&page, csrfToken)
+
+	page.WriteString("<h3>Runtime</h3>\n<pre>")
+	page.WriteString(html.EscapeString(feature.GetRuntimeInfo()))
+	page.WriteString("</pre>\n<h3>Health</h3>\n")
+	dash.writeHealth(&page)
+	page.WriteString("<h3>Daemon statistics (milliseconds)</h3>\n")
+	writeDaemonStats(&page)
+
+	page.WriteString("<h3>DNS</h3>\n<pre>")
+	if feature.RunningDNSD != nil {
+		page.WriteString(html.EscapeString(feature.RunningDNSD.GetBlockListInfo()))
+	}
+	page.WriteString(html.EscapeString(dnsd.LatestQueries.GetStats(dnsd.QueryStatsTopN).String()))
+	page.WriteString("Queries since start-up:\n")
+	writeCounters(&page, dnsd.QueryCounts)
+	page.WriteString("</pre>\n<h3>Sockd</h3>\n<pre>Bytes relayed:\n")
+	writeCounters(&page, sockd.BytesRelayed)
+	page.WriteString("</pre>\n<h3>Commands and rate limits</h3>\n<pre>Commands by trigger and outcome:\n")
+	writeCounters(&page, common.CommandCounts)
+	page.WriteString("Rate limit rejections:\n")
+	writeCounters(&page, env.RateLimitRejections)
+	page.WriteString("Banned clients:\n")
+	for _, entry := range dash.bans.GetBans() {
+		fmt.Fprintf(&page, "%s until %s (ban #%d)\n", html.EscapeString(entry.ClientID), entry.BannedUntil.Format(time.RFC3339), entry.NumBans)
+	}
+
+	fmt.Fprintf(&page, `</pre>
+<h3>Latest warnings</h3>
+<form method="get">
+    Containing <input type="text" name="filter" value="%s" />
+    Show <input type="number" name="warnings" value="%d" min="1" max="%d" />
+    <input type="submit" value="Filter" />
+</form>
+`, html.EscapeString(filter), numWarnings, DashboardMaxNumWarnings)
+	writeWarnings(&page, filter, numWarnings)
+	page.WriteString("</body>\n</html>\n")
+	return page.String()
+}
+
+func (dash *HandleDashboard) MakeHandler(logger global.Logger, cmdProc *common.CommandProcessor) (http.HandlerFunc, error) {
+	if GetProcessorPIN(cmdProc) == "" {
+		return nil, errors.New("HandleDashboard.MakeHandler: command processor must have a PIN")
+	}
+	if dash.RefreshIntervalSec < 1 {
+		dash.RefreshIntervalSec = DashboardDefaultRefreshIntervalSec
+	}
+	dash.csrfSecret = make([]byte, 32)
+	if _, err := rand.Read(dash.csrfSecret); err != nil {
+		return nil, fmt.Errorf("HandleDashboard.MakeHandler: failed to generate random secret - %v", err)
+	}
+	dash.bans = cmdProc.Bans
+	dash.mutex = new(sync.Mutex)
+	dash.logger = logger
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		NoCache(w)
+		clientIP := GetRealClientIP(r)
+		// Browser asks for credentials only after the challenge, the absence of which must not count as failure.
+		user, password, ok := r.BasicAuth()
+		// PIN is read from command processor each time, as it may change when configuration is reloaded.
+		if !ok || !MatchProcessorPIN(dash.bans, GetProcessorPIN(cmdProc), clientIP, password) {
+			if ok {
+				logger.Warningf("HandleDashboard", clientIP, nil, "incorrect password or banned client")
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="Enter any user name and the password PIN"`)
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		csrfToken := dash.csrfToken(user, password)
+		if r.Method == http.MethodPost {
+			if subtle.ConstantTimeCompare([]byte(r.FormValue("csrf")), []byte(csrfToken)) != 1 {
+				http.Error(w, "The page has expired, please reload it and try again.", http.StatusForbidden)
+				return
+			}
+			action := r.FormValue("action")
+			if action == DashboardActionLockDown && r.FormValue("confirm") != "yes" {
+				http.Error(w, "Please confirm lock down.", http.StatusBadRequest)
+				return
+			}
+			outcome := dash.act(action, clientIP)
+			logger.Printf("HandleDashboard", clientIP, nil, "action %s: %s", action, outcome)
+			dash.mutex.Lock()
+			dash.lastAction = outcome
+			dash.lastActionTime = time.Now()
+			dash.mutex.Unlock()
+			// Redirect to the page so that reloading it does not repeat the action
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+		numWarnings, err := strconv.Atoi(r.FormValue("warnings"))
+		if err != nil || numWarnings < 1 {
+			numWarnings = DashboardDefaultNumWarnings
+		} else if numWarnings > DashboardMaxNumWarnings {
+			numWarnings = DashboardMaxNumWarnings
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(dash.render(r.FormValue("filter"), numWarnings, csrfToken)))
+	}
+	return fun, nil
+}
+
+func (_ *HandleDashboard) GetRateLimitFactor() int {
+	return 1
+}
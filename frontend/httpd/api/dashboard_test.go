@@ -0,0 +1,145 @@
+package api
+
+import (
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/feature"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingDNSD is a DNS daemon whose ad-block list update blocks until told to finish.
+type blockingDNSD struct {
+	updates chan struct{}
+	finish  chan struct{}
+}
+
+func (_ *blockingDNSD) ExplainBlock(name string) string { return "" }
+func (_ *blockingDNSD) SetRuntimeEntry(name string, allow bool, duration time.Duration) error {
+	return nil
+}
+func (_ *blockingDNSD) RemoveRuntimeEntry(name string) bool { return false }
+func (_ *blockingDNSD) GetBlockListInfo() string            { return "" }
+func (dnsd *blockingDNSD) UpdatedAdBlockLists() {
+	dnsd.updates <- struct{}{}
+	<-dnsd.finish
+}
+
+func TestHandleDashboard(t *testing.T) {
+	if _, err := (&HandleDashboard{}).MakeHandler(global.Logger{}, &common.CommandProcessor{}); err == nil {
+		t.Fatal("did not error")
+	}
+	features := common.GetTestCommandProcessor().Features
+	dash := &HandleDashboard{FeaturesToCheck: features}
+	cmdProc := common.GetTestCommandProcessor()
+	cmdProc.Bans = &env.BanManager{MaxFailures: 2}
+	if err := cmdProc.Bans.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	fun, err := dash.MakeHandler(global.Logger{}, cmdProc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dash.RefreshIntervalSec != DashboardDefaultRefreshIntervalSec {
+		t.Fatal(dash.RefreshIntervalSec)
+	}
+	serve := func(method, query, password string, form url.Values) *httptest.ResponseRecorder {
+		var req *http.Request
+		if form == nil {
+			req = httptest.NewRequest(method, "/dashboard"+query, nil)
+		} else {
+			req = httptest.NewRequest(method, "/dashboard"+query, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if password != "" {
+			req.SetBasicAuth("a", password)
+		}
+		recorder := httptest.NewRecorder()
+		fun(recorder, req)
+		return recorder
+	}
+
+	// Sign in, the challenge does not count as failure.
+	for i := 0; i < 3; i++ {
+		if resp := serve(http.MethodGet, "", "", nil); resp.Code != http.StatusUnauthorized || resp.Header().Get("WWW-Authenticate") == "" {
+			t.Fatal(resp.Code, resp.Body.String())
+		}
+	}
+	if resp := serve(http.MethodGet, "", "wrong", nil); resp.Code != http.StatusUnauthorized || resp.Header().Get("WWW-Authenticate") == "" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	resp := serve(http.MethodGet, "", "verysecret", nil)
+	page := resp.Body.String()
+	if resp.Code != http.StatusOK || !strings.Contains(page, `http-equiv="refresh" content="30`) ||
+		!strings.Contains(page, "Health check has not run yet") || !strings.Contains(page, `<td>httpd</td>`) {
+		t.Fatal(resp.Code, page)
+	}
+	csrf := regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`).FindStringSubmatch(page)
+	if len(csrf) != 2 || csrf[1] != dash.csrfToken("a", "verysecret") {
+		t.Fatal(page)
+	}
+	// Token belongs to the visitor's credentials only
+	if dash.csrfToken("b", "verysecret") == csrf[1] {
+		t.Fatal("token should differ")
+	}
+	if resp := serve(http.MethodPost, "", "verysecret", url.Values{"csrf": {dash.csrfToken("b", "verysecret")}, "action": {DashboardActionHealthCheck}}); resp.Code != http.StatusForbidden {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+
+	// Actions require the token from the page
+	if resp := serve(http.MethodPost, "", "verysecret", url.Values{"action": {DashboardActionHealthCheck}}); resp.Code != http.StatusForbidden {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := serve(http.MethodPost, "", "verysecret", url.Values{"csrf": {csrf[1]}, "action": {DashboardActionHealthCheck}}); resp.Code != http.StatusSeeOther {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	page = serve(http.MethodGet, "", "verysecret", nil).Body.String()
+	if !strings.Contains(page, "Health check completed") || !strings.Contains(page, "<td>Feature .s</td>") {
+		t.Fatal(page)
+	}
+	// Ad-block list is updated only once at a time
+	dnsd := &blockingDNSD{updates: make(chan struct{}, 2), finish: make(chan struct{})}
+	feature.RunningDNSD = dnsd
+	defer func() {
+		feature.RunningDNSD = nil
+	}()
+	for i := 0; i < 2; i++ {
+		if resp := serve(http.MethodPost, "", "verysecret", url.Values{"csrf": {csrf[1]}, "action": {DashboardActionBlockList}}); resp.Code != http.StatusSeeOther {
+			t.Fatal(resp.Code, resp.Body.String())
+		}
+	}
+	<-dnsd.updates
+	if page := serve(http.MethodGet, "", "verysecret", nil).Body.String(); !strings.Contains(page, "already being updated") {
+		t.Fatal(page)
+	}
+	close(dnsd.finish)
+	for atomic.LoadInt32(&dashboardUpdatingBlockList) != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp := serve(http.MethodPost, "", "verysecret", url.Values{"csrf": {csrf[1]}, "action": {DashboardActionBlockList}}); resp.Code != http.StatusSeeOther {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	<-dnsd.updates
+	if len(dnsd.updates) != 0 {
+		t.Fatal("updated more than once at a time")
+	}
+	// Lock down must be confirmed, it is not carried out here for it would affect other test cases.
+	if resp := serve(http.MethodPost, "", "verysecret", url.Values{"csrf": {csrf[1]}, "action": {DashboardActionLockDown}}); resp.Code != http.StatusBadRequest {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+
+	// Filter warnings
+	global.LatestWarnings.Push("TestHandleDashboard-needle")
+	global.LatestWarnings.Push("TestHandleDashboard-haystack")
+	page = serve(http.MethodGet, "?filter=NEEDLE&warnings=1", "verysecret", nil).Body.String()
+	if !strings.Contains(page, "TestHandleDashboard-needle") || strings.Contains(page, "TestHandleDashboard-haystack") {
+		t.Fatal(page)
+	}
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
+	"github.com/HouzuoGuo/laitos/global"
+	"net/http"
+	"strconv"
+)
+
+const MaxDNSQueryStatsLatest = 1000 // MaxDNSQueryStatsLatest is the maximum number of latest queries returned by DNS query statistics.
+
+// DNSQueryStatsResponse is the JSON response of DNS query statistics handler.
+type DNSQueryStatsResponse struct {
+	dnsd.QueryStats
+	Latest []dnsd.QueryLogEntry `json:"Latest"` // Latest are the latest queries if they are requested via "latest" parameter.
+}
+
+// Respond with statistics of the latest DNS queries (top queried and blocked names, top clients) in JSON.
+type HandleDNSQueryStats struct {
+}
+
+func (_ *HandleDNSQueryStats) MakeHandler(logger global.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		NoCache(w)
+		if !WarnIfNoHTTPS(r, w) {
+			return
+		}
+		resp := DNSQueryStatsResponse{
+			QueryStats: dnsd.LatestQueries.GetStats(dnsd.QueryStatsTopN),
+			Latest:     []dnsd.QueryLogEntry{},
+		}
+		// Optionally include the latest queries
+		if numLatest, err := strconv.Atoi(r.FormValue("latest")); err == nil && numLatest > 0 {
+			if numLatest > MaxDNSQueryStatsLatest {
+				numLatest = MaxDNSQueryStatsLatest
+			}
+			resp.Latest = dnsd.LatestQueries.GetLatest(numLatest)
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logger.Warningf("HandleDNSQueryStats", GetRealClientIP(r), err, "failed to write response")
+		}
+	}
+	return fun, nil
+}
+
+func (_ *HandleDNSQueryStats) GetRateLimitFactor() int {
+	return 1
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/HouzuoGuo/laitos/feature"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
+	"github.com/HouzuoGuo/laitos/global"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const DNSMessageContentType = "application/dns-message" // DNSMessageContentType is the content type of RFC 8484 request and response body.
+
+/*
+Answer DNS-over-HTTPS queries (RFC 8484) via ad-blocking DNS daemon. Client must present a secure token in URL path
+(e.g. /dns-query/mytoken), or a client certificate that is verified by HTTP daemon.
+*/
+type HandleDNSOverHTTPS struct {
+	MyEndpoint string     `json:"-"` // URL endpoint to the handler itself, including prefix and suffix forward-slash.
+	DNSDaemon  *dnsd.DNSD `json:"-"` // (Optional) DNS daemon that answers queries, by default it is the running DNS daemon.
+}
+
+/*
+GetDNSDaemon returns the assigned DNS daemon, or otherwise the running DNS daemon, so that DNS-over-HTTPS shares its
+black list, run-time entries, and ad-block list updater. Return nil if neither is available.
+*/
+func (doh *HandleDNSOverHTTPS) GetDNSDaemon() *dnsd.DNSD {
+	if doh.DNSDaemon != nil {
+		return doh.DNSDaemon
+	}
+	running, _ := feature.RunningDNSD.(*dnsd.DNSD)
+	return running
+}
+
+func (doh *HandleDNSOverHTTPS) MakeHandler(logger global.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	if doh.MyEndpoint == "" {
+		return nil, errors.New("HandleDNSOverHTTPS.MakeHandler: own endpoint is empty")
+	}
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		NoCache(w)
+		clientIP := GetRealClientIP(r)
+		// In case of authorisation failure, or the DNS daemon is not running, try to conceal this endpoint.
+		dnsDaemon := doh.GetDNSDaemon()
+		token := strings.Trim(strings.TrimPrefix(r.URL.Path, doh.MyEndpoint), "/")
+		if dnsDaemon == nil || !dnsDaemon.CheckSecureClient(token, r.TLS) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		// Query comes in base64 (URL encoding without padding) via GET, or in request body via POST.
+		var query []byte
+		var err error
+		if r.Method == http.MethodGet {
+			query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.FormValue("dns"), "="))
+		} else if r.Method == http.MethodPost {
+			if contentType := r.Header.Get("Content-Type"); contentType != DNSMessageContentType {
+				http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = ioutil.ReadAll(io.LimitReader(r.Body, dnsd.MaxPacketSize))
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil || len(query) < dnsd.MinNameQuerySize {
+			http.Error(w, "Bad query", http.StatusBadRequest)
+			return
+		}
+		response, err := dnsDaemon.ProcessQuery("HandleDNSOverHTTPS", clientIP, true, query)
+		if err != nil {
+			logger.Warningf("HandleDNSOverHTTPS", clientIP, err, "failed to forward query")
+			http.Error(w, "Failed to forward query", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", DNSMessageContentType)
+		w.Write(response)
+	}
+	return fun, nil
+}
+
+func (_ *HandleDNSOverHTTPS) GetRateLimitFactor() int {
+	// DNS queries are frequent and cheap to answer
+	return 20
+}
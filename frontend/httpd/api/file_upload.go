@@ -0,0 +1,574 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/email"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const HandleFileUploadPage = `<!doctype html>
+<html>
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
+    <title>File upload</title>
+</head>
+<body>
+    <form action="?action=upload" method="post" enctype="multipart/form-data">
+        <p>
+            Password: <input type="password" name="password" />
+            <br />
+            Files: <input type="file" name="file" multiple />
+            <input type="submit" value="Upload"/>
+        </p>
+    </form>
+    <form action="?action=share" method="post">
+        <p>
+            Password: <input type="password" name="password" />
+            <br />
+            Share a one-time link to <select name="mode"><option value="upload">upload a file</option><option value="download">download file</option></select>
+            <input type="text" name="name" placeholder="file name to download" />
+            <input type="submit" value="Make link"/>
+        </p>
+    </form>
+    <pre>%s</pre>
+</body>
+</html>
+` // File upload page
+
+const HandleFileUploadSharePage = `<!doctype html>
+<html>
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
+    <title>File upload</title>
+</head>
+<body>
+    <form action="?share=%s" method="post" enctype="multipart/form-data">
+        <p>
+            File: <input type="file" name="file" />
+            <input type="submit" value="Upload"/>
+        </p>
+    </form>
+    <pre>%s</pre>
+</body>
+</html>
+` // Upload page of one-time share link
+
+const (
+	FileUploadDefaultMaxFileSizeMB  = 100               // FileUploadDefaultMaxFileSizeMB is the default size limit of a single uploaded file.
+	FileUploadDefaultQuotaMB        = 1024              // FileUploadDefaultQuotaMB is the default size limit of all files in upload directory.
+	FileUploadDefaultShareExpirySec = 24 * 3600         // FileUploadDefaultShareExpirySec is the default validity of one-time share links.
+	FileUploadMaxFileNameLength     = 200               // FileUploadMaxFileNameLength is the maximum length of sanitised file name.
+	FileUploadPartialPrefix         = ".partial-"       // FileUploadPartialPrefix is the file name prefix of unfinished chunked uploads.
+	FileUploadShareModeUpload       = "upload"          // FileUploadShareModeUpload lets the holder of a share link upload a single file.
+	FileUploadShareModeDownload     = "download"        // FileUploadShareModeDownload lets the holder of a share link download a single file.
+	fileUploadMaxPasswordLength     = 1024              // fileUploadMaxPasswordLength is the maximum length of password form field.
+	fileUploadShareTokenBytes       = 16                // fileUploadShareTokenBytes is the number of random bytes in a share link token.
+	fileUploadNotificationPrefix    = "-file-transfer-" // fileUploadNotificationPrefix follows outgoing mail keyword in notification subject.
+)
+
+var (
+	ErrFileUploadTooLarge = errors.New("file is too large or upload directory is running out of quota")
+	ErrFileUploadNoFile   = errors.New("request does not carry a file")
+)
+
+// fileShare is a one-time link that lets its holder upload or download a single file.
+type fileShare struct {
+	mode     string    // mode is either upload or download
+	fileName string    // fileName is the name of file to download
+	expiry   time.Time // expiry is the moment at which the link stops working
+}
+
+/*
+Upload files into a directory from a web browser or script, after presenting the password PIN of command processor in
+"password" form field or as password of HTTP basic authentication. Large files may be uploaded in chunks and resumed
+after interruption: client posts each chunk to "?action=chunk&name=NAME&offset=OFFSET" and asks for the offset to
+resume from via "?action=status&name=NAME", both authenticated by HTTP basic authentication. The owner may also make one-time links that let somebody else upload or
+download a single file without knowing the password.
+*/
+type HandleFileUpload struct {
+	UploadDir          string   `json:"UploadDir"`          // Keep uploaded files in this directory
+	MaxFileSizeMB      int      `json:"MaxFileSizeMB"`      // (Optional) refuse to take a file larger than this size, by default 100MB.
+	QuotaMB            int      `json:"QuotaMB"`            // (Optional) refuse to take more files when upload directory grows to this size, by default 1024MB.
+	ShareLinkExpirySec int      `json:"ShareLinkExpirySec"` // (Optional) one-time share links stop working after this many seconds, by default 24 hours.
+	Recipients         []string `json:"Recipients"`         // (Optional) recipients of upload and download notification emails
+
+	Mailer email.Mailer `json:"-"` // MTA that delivers upload and download notification emails
+
+	cmdProc    *common.CommandProcessor // cmdProc provides the password PIN, which may change when configuration is reloaded.
+	bans       *env.BanManager          // bans is the brute-force protection of command processor
+	shares     map[string]*fileShare    // shares are the one-time links that have not been used, keyed by token.
+	shareMutex *sync.Mutex
+	logger     global.Logger
+}
+
+// SanitiseFileName returns a file name that is safe to store in upload directory. The name is never empty.
+func SanitiseFileName(name string) string {
+	// Browsers on Windows may send the full path
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	var sanitised strings.Builder
+	for _, r := range name {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			sanitised.WriteRune(r)
+		} else {
+			sanitised.WriteRune('_')
+		}
+	}
+	// Hidden files and partial uploads must not be overwritten
+	ret := strings.TrimLeft(sanitised.String(), ".")
+	if len(ret) > FileUploadMaxFileNameLength {
+		ret = ret[len(ret)-FileUploadMaxFileNameLength:]
+	}
+	if ret == "" {
+		ret = "upload"
+	}
+	return ret
+}
+
+// usedBytes returns the total size of files in upload directory, including unfinished uploads.
+func (upload *HandleFileUpload) usedBytes() int64 {
+	infos, err := ioutil.ReadDir(upload.UploadDir)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, info := range infos {
+		if !info.IsDir() {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// sizeLimit returns the maximum number of bytes a file may have on top of its existing size, according to file size limit and quota.
+func (upload *HandleFileUpload) sizeLimit(existingSize int64) int64 {
+	limit := int64(upload.MaxFileSizeMB)*1024*1024 - existingSize
+	if remaining := int64(upload.QuotaMB)*1024*1024 - upload.usedBytes(); remaining < limit {
+		limit = remaining
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+/*
+checkPassword compares the password against PIN, and counts a mismatch toward client's ban. Return false if the
+password is wrong or the client is banned.
+*/
+func (upload *HandleFileUpload) checkPassword(clientIP, password string) bool {
+	if !MatchProcessorPIN(upload.bans, GetProcessorPIN(upload.cmdProc), clientIP, password) {
+		upload.logger.Warningf("HandleFileUpload", clientIP, nil, "incorrect password or banned client")
+		return false
+	}
+	return true
+}
+
+/*
+requestPassword returns the password from form field of request body, or from HTTP basic authentication if the form
+field is absent. Password is never taken from URL query, which ends up in access log and browser history. If fromForm
+is false, only basic authentication is looked at, so that request body (e.g. a file chunk) is left intact.
+*/
+func requestPassword(r *http.Request, fromForm bool) string {
+	var password string
+	if fromForm {
+		password = r.PostFormValue("password")
+	}
+	if password != "" {
+		return password
+	}
+	_, password, _ = r.BasicAuth()
+	return password
+}
+
+// moveIntoPlace renames the temporary file into upload directory under the name, or a variant of the name if it is taken. Return the final name.
+func (upload *HandleFileUpload) moveIntoPlace(tmpPath, name string) (string, error) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		// Hard link fails if the name is taken, unlike rename, which overwrites.
+		err := os.Link(tmpPath, path.Join(upload.UploadDir, candidate))
+		if err == nil {
+			os.Remove(tmpPath)
+			return candidate, nil
+		} else if !os.IsExist(err) {
+			return "", err
+		}
+	}
+}
+
+// saveFile stores the content into upload directory under the sanitised name. Return the final name and size of the file.
+func (upload *HandleFileUpload) saveFile(name string, content io.Reader) (string, int64, error) {
+	tmpFile, err := ioutil.TempFile(upload.UploadDir, FileUploadPartialPrefix)
+	if err != nil {
+		return "", 0, err
+	}
+	limit := upload.sizeLimit(0)
+	size, err := io.Copy(tmpFile, io.LimitReader(content, limit+1))
+	tmpFile.Close()
+	if err == nil && size > limit {
+		err = ErrFileUploadTooLarge
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", 0, err
+	}
+	finalName, err := upload.moveIntoPlace(tmpFile.Name(), SanitiseFileName(name))
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return finalName, size, err
+}
+
+// notify sends a notification email about the file in background.
+func (upload *HandleFileUpload) notify(fileName, message string, values ...interface{}) {
+	if len(upload.Recipients) == 0 || !upload.Mailer.IsConfigured() {
+		return
+	}
+	go func() {
+		subject := email.OutgoingMailSubjectKeyword + fileUploadNotificationPrefix + fileName
+		if err := upload.Mailer.Send(subject, fmt.Sprintf(message, values...), upload.Recipients...); err != nil {
+			upload.logger.Warningf("HandleFileUpload", "", err, "failed to send notification for file \"%s\"", fileName)
+		}
+	}()
+}
+
+/*
+receiveMultipart saves files from multipart form. Password form field must precede file fields. If share link is
+given, only a single file is taken and the link is used up. Return names of saved files.
+*/
+func (upload *HandleFileUpload) receiveMultipart(r *http.Request, clientIP, shareToken string) (saved []string, err error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	var authorised bool
+	var password string
+	for {
+		var part *multipart.Part
+		if part, err = reader.NextPart(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		if part.FormName() == "password" {
+			content, _ := ioutil.ReadAll(io.LimitReader(part, fileUploadMaxPasswordLength))
+			password = string(content)
+			continue
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+		if !authorised {
+			if shareToken != "" {
+				if upload.useShare(shareToken, FileUploadShareModeUpload) == nil {
+					return nil, errors.New("the link has expired or has been used")
+				}
+			} else {
+				if password == "" {
+					_, password, _ = r.BasicAuth()
+				}
+				if !upload.checkPassword(clientIP, password) {
+					return nil, errors.New("incorrect password")
+				}
+			}
+			authorised = true
+		}
+		fileName, size, saveErr := upload.saveFile(part.FileName(), part)
+		if saveErr != nil {
+			return saved, saveErr
+		}
+		saved = append(saved, fileName)
+		upload.logger.Printf("HandleFileUpload", clientIP, nil, "saved file \"%s\" of %d bytes", fileName, size)
+		upload.notify(fileName, "File \"%s\" (%d bytes) has been uploaded by %s", fileName, size, clientIP)
+		if shareToken != "" {
+			// Share link is good for one file only
+			break
+		}
+	}
+	if len(saved) == 0 {
+		return nil, ErrFileUploadNoFile
+	}
+	return saved, nil
+}
+
+// receiveChunk appends a chunk of file to its unfinished upload, and optionally finishes the upload.
+func (upload *HandleFileUpload) receiveChunk(w http.ResponseWriter, r *http.Request, clientIP string) {
+	name := SanitiseFileName(r.URL.Query().Get("name"))
+	partialPath := path.Join(upload.UploadDir, FileUploadPartialPrefix+name)
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "offset must be an integer", http.StatusBadRequest)
+		return
+	}
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Client must continue from where the unfinished upload left off
+	if offset != info.Size() {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, info.Size())
+		return
+	}
+	limit := upload.sizeLimit(info.Size())
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	written, err := io.Copy(file, io.LimitReader(r.Body, limit+1))
+	if err == nil && written > limit {
+		err = ErrFileUploadTooLarge
+	}
+	if err != nil {
+		// Discard the incomplete chunk, so that client may retry it.
+		file.Truncate(offset)
+		status := http.StatusInternalServerError
+		if err == ErrFileUploadTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.URL.Query().Get("final") == "" {
+		fmt.Fprint(w, offset+written)
+		return
+	}
+	file.Close()
+	finalName, err := upload.moveIntoPlace(partialPath, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	upload.logger.Printf("HandleFileUpload", clientIP, nil, "saved file \"%s\" of %d bytes in chunks", finalName, offset+written)
+	upload.notify(finalName, "File \"%s\" (%d bytes) has been uploaded by %s", finalName, offset+written, clientIP)
+	fmt.Fprint(w, finalName)
+}
+
+// makeShare creates a one-time link and returns its token.
+func (upload *HandleFileUpload) makeShare(mode, fileName string) (string, error) {
+	switch mode {
+	case FileUploadShareModeUpload:
+		fileName = ""
+	case FileUploadShareModeDownload:
+		fileName = SanitiseFileName(fileName)
+		if info, err := os.Stat(path.Join(upload.UploadDir, fileName)); err != nil || info.IsDir() {
+			return "", fmt.Errorf("file \"%s\" does not exist", fileName)
+		}
+	default:
+		return "", errors.New("share mode must be upload or download")
+	}
+	tokenBytes := make([]byte, fileUploadShareTokenBytes)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	upload.shareMutex.Lock()
+	defer upload.shareMutex.Unlock()
+	now := time.Now()
+	for existingToken, share := range upload.shares {
+		if now.After(share.expiry) {
+			delete(upload.shares, existingToken)
+		}
+	}
+	upload.shares[token] = &fileShare{mode: mode, fileName: fileName, expiry: now.Add(time.Duration(upload.ShareLinkExpirySec) * time.Second)}
+	return token, nil
+}
+
+// findShare returns the share link of the mode that has not expired, or nil if there is none.
+func (upload *HandleFileUpload) findShare(token, mode string) *fileShare {
+	upload.shareMutex.Lock()
+	defer upload.shareMutex.Unlock()
+	share, found := upload.shares[token]
+	if !found || share.mode != mode || time.Now().After(share.expiry) {
+		return nil
+	}
+	return share
+}
+
+// useShare removes and returns the share link of the mode, or nil if the link does not exist or has expired.
+func (upload *HandleFileUpload) useShare(token, mode string) *fileShare {
+	upload.shareMutex.Lock()
+	defer upload.shareMutex.Unlock()
+	share, found := upload.shares[token]
+	if !found || share.mode != mode {
+		return nil
+	}
+	delete(upload.shares, token)
+	if time.Now().After(share.expiry) {
+		return nil
+	}
+	return share
+}
+
+// serveShare lets the holder of a one-time link upload or download a single file.
+func (upload *HandleFileUpload) serveShare(w http.ResponseWriter, r *http.Request, clientIP, token string) {
+	if r.Method == http.MethodPost {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		saved, err := upload.receiveMultipart(r, clientIP, token)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf(HandleFileUploadSharePage, html.EscapeString(url.QueryEscape(token)), html.EscapeString("Error: "+err.Error()))))
+			return
+		}
+		w.Write([]byte(fmt.Sprintf(HandleFileUploadSharePage, html.EscapeString(url.QueryEscape(token)), html.EscapeString("Uploaded "+strings.Join(saved, ", ")))))
+		return
+	}
+	if upload.findShare(token, FileUploadShareModeUpload) != nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(fmt.Sprintf(HandleFileUploadSharePage, html.EscapeString(url.QueryEscape(token)), "")))
+		return
+	}
+	share := upload.useShare(token, FileUploadShareModeDownload)
+	if share == nil {
+		http.Error(w, "The link has expired or has been used", http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(path.Join(upload.UploadDir, share.fileName))
+	if err != nil {
+		http.Error(w, "The file no longer exists", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	upload.logger.Printf("HandleFileUpload", clientIP, nil, "file \"%s\" is downloaded via share link", share.fileName)
+	upload.notify(share.fileName, "File \"%s\" has been downloaded via share link by %s", share.fileName, clientIP)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename="+share.fileName)
+	http.ServeContent(w, r, share.fileName, info.ModTime(), file)
+}
+
+func (upload *HandleFileUpload) MakeHandler(logger global.Logger, cmdProc *common.CommandProcessor) (http.HandlerFunc, error) {
+	if upload.UploadDir == "" {
+		return nil, errors.New("HandleFileUpload.MakeHandler: UploadDir must not be empty")
+	}
+	if err := os.MkdirAll(upload.UploadDir, 0700); err != nil {
+		return nil, fmt.Errorf("HandleFileUpload.MakeHandler: failed to create upload directory - %v", err)
+	}
+	if GetProcessorPIN(cmdProc) == "" {
+		return nil, errors.New("HandleFileUpload.MakeHandler: command processor must have a PIN")
+	}
+	if upload.MaxFileSizeMB < 1 {
+		upload.MaxFileSizeMB = FileUploadDefaultMaxFileSizeMB
+	}
+	if upload.QuotaMB < 1 {
+		upload.QuotaMB = FileUploadDefaultQuotaMB
+	}
+	if upload.ShareLinkExpirySec < 1 {
+		upload.ShareLinkExpirySec = FileUploadDefaultShareExpirySec
+	}
+	upload.cmdProc = cmdProc
+	upload.bans = cmdProc.Bans
+	upload.shares = make(map[string]*fileShare)
+	upload.shareMutex = new(sync.Mutex)
+	upload.logger = logger
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		NoCache(w)
+		if !WarnIfNoHTTPS(r, w) {
+			return
+		}
+		if global.EmergencyLockDown {
+			http.Error(w, global.ErrEmergencyLockDown.Error(), http.StatusForbidden)
+			return
+		}
+		clientIP := GetRealClientIP(r)
+		if token := r.URL.Query().Get("share"); token != "" {
+			upload.serveShare(w, r, clientIP, token)
+			return
+		}
+		action := r.URL.Query().Get("action")
+		switch {
+		case r.Method == http.MethodGet && action == "status":
+			if !upload.checkPassword(clientIP, requestPassword(r, false)) {
+				http.Error(w, "Incorrect password", http.StatusUnauthorized)
+				return
+			}
+			var offset int64
+			if info, err := os.Stat(path.Join(upload.UploadDir, FileUploadPartialPrefix+SanitiseFileName(r.URL.Query().Get("name")))); err == nil {
+				offset = info.Size()
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, offset)
+		case r.Method == http.MethodPost && action == "chunk":
+			if !upload.checkPassword(clientIP, requestPassword(r, false)) {
+				http.Error(w, "Incorrect password", http.StatusUnauthorized)
+				return
+			}
+			upload.receiveChunk(w, r, clientIP)
+		case r.Method == http.MethodPost && action == "share":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if !upload.checkPassword(clientIP, requestPassword(r, true)) {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(fmt.Sprintf(HandleFileUploadPage, "Incorrect password")))
+				return
+			}
+			token, err := upload.makeShare(r.FormValue("mode"), r.FormValue("name"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf(HandleFileUploadPage, html.EscapeString("Error: "+err.Error()))))
+				return
+			}
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+			link := fmt.Sprintf("%s://%s%s?share=%s", scheme, r.Host, r.URL.Path, token)
+			w.Write([]byte(fmt.Sprintf(HandleFileUploadPage, html.EscapeString(fmt.Sprintf("The link works once before %s:\n%s",
+				time.Now().Add(time.Duration(upload.ShareLinkExpirySec)*time.Second).Format(time.RFC3339), link)))))
+		case r.Method == http.MethodPost:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			saved, err := upload.receiveMultipart(r, clientIP, "")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				message := "Error: " + err.Error()
+				if len(saved) > 0 {
+					message = fmt.Sprintf("Uploaded %s\n%s", strings.Join(saved, ", "), message)
+				}
+				w.Write([]byte(fmt.Sprintf(HandleFileUploadPage, html.EscapeString(message))))
+				return
+			}
+			w.Write([]byte(fmt.Sprintf(HandleFileUploadPage, html.EscapeString("Uploaded "+strings.Join(saved, ", ")))))
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(fmt.Sprintf(HandleFileUploadPage, "")))
+		}
+	}
+	return fun, nil
+}
+
+func (_ *HandleFileUpload) GetRateLimitFactor() int {
+	return 2
+}
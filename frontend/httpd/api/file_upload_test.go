@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bytes"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSanitiseFileName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"":                                "upload",
+		"...":                             "upload",
+		"a.txt":                           "a.txt",
+		"../../etc/passwd":                "passwd",
+		`C:\Users\me\hello.doc`:           "hello.doc",
+		".partial-abc":                    "partial-abc",
+		"hello world?.txt":                "hello_world_.txt",
+		strings.Repeat("a", 300) + ".txt": strings.Repeat("a", 196) + ".txt",
+	} {
+		if sanitised := SanitiseFileName(name); sanitised != expected {
+			t.Fatal(name, sanitised)
+		}
+	}
+}
+
+func TestHandleFileUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestHandleFileUpload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upload := &HandleFileUpload{UploadDir: dir, MaxFileSizeMB: 1, QuotaMB: 2}
+	fun, err := upload.MakeHandler(global.Logger{}, common.GetTestCommandProcessor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.ShareLinkExpirySec != FileUploadDefaultShareExpirySec {
+		t.Fatal(upload.ShareLinkExpirySec)
+	}
+	serve := func(method, query, contentType, password string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/upload"+query, body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.SetBasicAuth("a", password)
+		recorder := httptest.NewRecorder()
+		fun(recorder, req)
+		return recorder
+	}
+	uploadFiles := func(query, password string, files map[string]string) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		if password != "" {
+			writer.WriteField("password", password)
+		}
+		for name, content := range files {
+			part, _ := writer.CreateFormFile("file", name)
+			part.Write([]byte(content))
+		}
+		writer.Close()
+		return serve(http.MethodPost, query, writer.FormDataContentType(), "b", body)
+	}
+	readFile := func(name string) string {
+		content, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	if resp := serve(http.MethodGet, "", "", "b", nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "Make link") {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	// Multipart upload
+	if resp := uploadFiles("?action=upload", "wrong", map[string]string{"a.txt": "a"}); resp.Code != http.StatusBadRequest ||
+		!strings.Contains(resp.Body.String(), "incorrect password") {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := uploadFiles("?action=upload", "verysecret", nil); resp.Code != http.StatusBadRequest {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := uploadFiles("?action=upload", "verysecret", map[string]string{"../a b.txt": "hello"}); resp.Code != http.StatusOK ||
+		!strings.Contains(resp.Body.String(), "Uploaded a_b.txt") || readFile("a_b.txt") != "hello" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	// Existing file is not overwritten
+	if resp := uploadFiles("?action=upload", "verysecret", map[string]string{"a b.txt": "again"}); resp.Code != http.StatusOK ||
+		readFile("a_b-1.txt") != "again" || readFile("a_b.txt") != "hello" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	// Size limit
+	if resp := uploadFiles("?action=upload", "verysecret", map[string]string{"big": strings.Repeat("a", 1024*1024+1)}); resp.Code != http.StatusBadRequest ||
+		!strings.Contains(resp.Body.String(), ErrFileUploadTooLarge.Error()) {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if _, err := os.Stat(path.Join(dir, "big")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	// Chunked upload is authenticated by basic authentication, never by password in URL query.
+	if resp := serve(http.MethodPost, "?action=chunk&name=c.bin&offset=0&password=verysecret", "", "b", strings.NewReader("0123")); resp.Code != http.StatusUnauthorized {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := serve(http.MethodPost, "?action=chunk&name=c.bin&offset=0", "", "wrong", strings.NewReader("0123")); resp.Code != http.StatusUnauthorized {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := serve(http.MethodPost, "?action=chunk&name=c.bin&offset=0", "", "verysecret", strings.NewReader("0123")); resp.Code != http.StatusOK || resp.Body.String() != "4" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	// Client resumes from the offset of unfinished upload
+	if resp := serve(http.MethodGet, "?action=status&name=c.bin", "", "verysecret", nil); resp.Code != http.StatusOK || resp.Body.String() != "4" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := serve(http.MethodPost, "?action=chunk&name=c.bin&offset=2", "", "verysecret", strings.NewReader("23")); resp.Code != http.StatusConflict || resp.Body.String() != "4" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := serve(http.MethodPost, "?action=chunk&name=c.bin&offset=4", "", "verysecret", strings.NewReader(strings.Repeat("a", 1024*1024))); resp.Code != http.StatusRequestEntityTooLarge {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := serve(http.MethodPost, "?action=chunk&name=c.bin&offset=4&final=1", "", "verysecret", strings.NewReader("4567")); resp.Code != http.StatusOK ||
+		resp.Body.String() != "c.bin" || readFile("c.bin") != "01234567" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if _, err := os.Stat(path.Join(dir, FileUploadPartialPrefix+"c.bin")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	// Quota
+	if err := ioutil.WriteFile(path.Join(dir, "filler"), bytes.Repeat([]byte{0}, 2*1024*1024-100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if resp := uploadFiles("?action=upload", "verysecret", map[string]string{"over": strings.Repeat("a", 200)}); resp.Code != http.StatusBadRequest {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	os.Remove(path.Join(dir, "filler"))
+
+	// One-time share links
+	makeShare := func(mode, name string) string {
+		resp := serve(http.MethodPost, "?action=share", "application/x-www-form-urlencoded", "b",
+			strings.NewReader(url.Values{"password": {"verysecret"}, "mode": {mode}, "name": {name}}.Encode()))
+		token := regexp.MustCompile(`share=([0-9a-f]+)`).FindStringSubmatch(resp.Body.String())
+		if resp.Code != http.StatusOK || len(token) != 2 {
+			t.Fatal(resp.Code, resp.Body.String())
+		}
+		return token[1]
+	}
+	if resp := serve(http.MethodPost, "?action=share", "application/x-www-form-urlencoded", "b",
+		strings.NewReader(url.Values{"password": {"verysecret"}, "mode": {"download"}, "name": {"does-not-exist"}}.Encode())); resp.Code != http.StatusBadRequest {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := serve(http.MethodPost, "?action=share&password=verysecret", "application/x-www-form-urlencoded", "b",
+		strings.NewReader(url.Values{"mode": {"download"}, "name": {"c.bin"}}.Encode())); resp.Code != http.StatusUnauthorized {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	downloadToken := makeShare(FileUploadShareModeDownload, "c.bin")
+	if resp := serve(http.MethodGet, "?share="+downloadToken, "", "b", nil); resp.Code != http.StatusOK || resp.Body.String() != "01234567" ||
+		!strings.Contains(resp.Header().Get("Content-Disposition"), "c.bin") {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := serve(http.MethodGet, "?share="+downloadToken, "", "b", nil); resp.Code != http.StatusNotFound {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	uploadToken := makeShare(FileUploadShareModeUpload, "")
+	if resp := serve(http.MethodGet, "?share="+uploadToken, "", "b", nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), uploadToken) {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	// Upload link does not need password, and takes one file only.
+	if resp := uploadFiles("?share="+uploadToken, "", map[string]string{"shared.txt": "shared"}); resp.Code != http.StatusOK || readFile("shared.txt") != "shared" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := uploadFiles("?share="+uploadToken, "", map[string]string{"again.txt": "again"}); resp.Code != http.StatusBadRequest {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	// Expired link does not work
+	expiredToken := makeShare(FileUploadShareModeUpload, "")
+	upload.shares[expiredToken].expiry = upload.shares[expiredToken].expiry.AddDate(-1, 0, 0)
+	if resp := uploadFiles("?share="+expiredToken, "", map[string]string{"expired.txt": "expired"}); resp.Code != http.StatusBadRequest {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
+	"github.com/HouzuoGuo/laitos/frontend/mailp"
+	"github.com/HouzuoGuo/laitos/frontend/plain"
+	"github.com/HouzuoGuo/laitos/frontend/smtpd"
+	"github.com/HouzuoGuo/laitos/frontend/sockd"
+	"github.com/HouzuoGuo/laitos/frontend/telegrambot"
+	"github.com/HouzuoGuo/laitos/global"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrometheusContentType is the content type of Prometheus text exposition format.
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// prometheusLabelEscape escapes backslash, double quote, and line feed in label values.
+var prometheusLabelEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// GetDurationStatsByDaemon returns duration statistics of all front-end daemons, keyed by daemon name.
+func GetDurationStatsByDaemon() map[string]*env.Stats {
+	return map[string]*env.Stats{
+		"cmdproc":     common.DurationStats,
+		"dnsd_tcp":    dnsd.TCPDurationStats,
+		"dnsd_udp":    dnsd.UDPDurationStats,
+		"dnsd_tls":    dnsd.TLSDurationStats,
+		"httpd":       DurationStats,
+		"mailp":       mailp.DurationStats,
+		"plain_tcp":   plain.TCPDurationStats,
+		"plain_udp":   plain.UDPDurationStats,
+		"smtpd":       smtpd.DurationStats,
+		"sockd_tcp":   sockd.TCPDurationStats,
+		"sockd_udp":   sockd.UDPDurationStats,
+		"telegrambot": telegrambot.DurationStats,
+	}
+}
+
+// prometheusWriter composes metrics in Prometheus text exposition format.
+type prometheusWriter struct {
+	bytes.Buffer
+}
+
+// family writes the help text and type of a metric family.
+func (out *prometheusWriter) family(name, metricType, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// sample writes a sample value of the metric, labels are given in pairs of name and value.
+func (out *prometheusWriter) sample(name string, value float64, labels ...string) {
+	out.WriteString(name)
+	if len(labels) > 0 {
+		out.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			fmt.Fprintf(out, `%s="%s"`, labels[i], prometheusLabelEscape.Replace(labels[i+1]))
+		}
+		out.WriteByte('}')
+	}
+	out.WriteByte(' ')
+	out.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	out.WriteByte('\n')
+}
+
+// counters writes a counter metric family from the counters, whose label values correspond to the label names.
+func (out *prometheusWriter) counters(name, help string, counters *env.Counters, labelNames ...string) {
+	out.family(name, "counter", help)
+	counters.Each(func(labelValues []string, count uint64) {
+		labels := make([]string, 0, 2*len(labelNames))
+		for i, labelName := range labelNames {
+			if i < len(labelValues) {
+				labels = append(labels, labelName, labelValues[i])
+			}
+		}
+		out.sample(name, float64(count), labels...)
+	})
+}
+
+// histogram writes a histogram metric of the stats.
+func (out *prometheusWriter) histogram(name string, stats *env.Stats, labels ...string) {
+	cumulativeCounts, total, count := stats.GetHistogram()
+	for i, bound := range env.StatsBucketBounds {
+		out.sample(name+"_bucket", float64(cumulativeCounts[i]), append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+	}
+	out.sample(name+"_bucket", float64(count), append(labels, "le", "+Inf")...)
+	out.sample(name+"_sum", total, labels...)
+	out.sample(name+"_count", float64(count), labels...)
+}
+
+/*
+GetPrometheusMetrics returns metrics of all front-end daemons, command processors, and Go runtime in Prometheus text
+exposition format. The ban manager is optional.
+*/
+func GetPrometheusMetrics(bans *env.BanManager) string {
+	var out prometheusWriter
+	// Latency of each daemon
+	out.family("laitos_duration_milliseconds", "histogram", "Duration of commands, conversations, and requests handled by daemons.")
+	durationStats := GetDurationStatsByDaemon()
+	daemons := make([]string, 0, len(durationStats))
+	for daemon := range durationStats {
+		daemons = append(daemons, daemon)
+	}
+	sort.Strings(daemons)
+	for _, daemon := range daemons {
+		out.histogram("laitos_duration_milliseconds", durationStats[daemon], "daemon", daemon)
+	}
+	// Counters
+	out.counters("laitos_commands_total", "Number of commands processed, by feature trigger and outcome.", common.CommandCounts, "trigger", "outcome")
+	out.counters("laitos_rate_limit_rejections_total", "Number of actions refused by rate limits, by daemon.", env.RateLimitRejections, "daemon")
+	out.counters("laitos_dns_queries_total", "Number of DNS queries handled, by result such as blocked and forwarded.", dnsd.QueryCounts, "result")
+	out.counters("laitos_sockd_relayed_bytes_total", "Number of bytes relayed by sockd, by protocol.", sockd.BytesRelayed, "protocol")
+	out.family("laitos_banned_clients", "gauge", "Number of clients currently banned for too many failures.")
+	out.sample("laitos_banned_clients", float64(len(bans.GetBans())))
+	// Go runtime
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	out.family("go_info", "gauge", "Version of Go runtime.")
+	out.sample("go_info", 1, "version", runtime.Version())
+	out.family("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	out.sample("go_goroutines", float64(runtime.NumGoroutine()))
+	out.family("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	out.sample("go_memstats_alloc_bytes", float64(memStats.Alloc))
+	out.family("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.")
+	out.sample("go_memstats_sys_bytes", float64(memStats.Sys))
+	out.family("go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.")
+	out.sample("go_memstats_heap_inuse_bytes", float64(memStats.HeapInuse))
+	out.family("go_memstats_heap_objects", "gauge", "Number of allocated objects.")
+	out.sample("go_memstats_heap_objects", float64(memStats.HeapObjects))
+	out.family("go_gc_cycles_total", "counter", "Number of completed garbage collection cycles.")
+	out.sample("go_gc_cycles_total", float64(memStats.NumGC))
+	out.family("go_gc_pause_seconds_total", "counter", "Total duration of garbage collection pauses.")
+	out.sample("go_gc_pause_seconds_total", float64(memStats.PauseTotalNs)/float64(time.Second))
+	out.family("process_start_time_seconds", "gauge", "Start time of the process since unix epoch in seconds.")
+	out.sample("process_start_time_seconds", float64(global.StartupTime.Unix()))
+	return out.String()
+}
+
+// Serve metrics of daemons, commands, and Go runtime to Prometheus.
+type HandlePrometheus struct {
+}
+
+func (_ *HandlePrometheus) MakeHandler(logger global.Logger, cmdProc *common.CommandProcessor) (http.HandlerFunc, error) {
+	var bans *env.BanManager
+	if cmdProc != nil {
+		bans = cmdProc.Bans
+	}
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", PrometheusContentType)
+		NoCache(w)
+		if !WarnIfNoHTTPS(r, w) {
+			return
+		}
+		if _, err := w.Write([]byte(GetPrometheusMetrics(bans))); err != nil {
+			logger.Warningf("HandlePrometheus", GetRealClientIP(r), err, "failed to write response")
+		}
+	}
+	return fun, nil
+}
+
+func (_ *HandlePrometheus) GetRateLimitFactor() int {
+	return 2
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/feature"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/sockd"
+	"github.com/HouzuoGuo/laitos/global"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlePrometheus(t *testing.T) {
+	proc := common.GetTestCommandProcessor()
+	fun, err := (&HandlePrometheus{}).MakeHandler(global.Logger{}, proc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc.Process(feature.Command{TimeoutSec: 10, Content: "verysecret.s echo hi"})
+	proc.Process(feature.Command{TimeoutSec: 10, Content: "wrongpin.s echo hi"})
+	sockd.BytesRelayed.Add(123, "tcp")
+	env.RateLimitRejections.Add(1, `quote"d`)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	recorder := httptest.NewRecorder()
+	fun(recorder, req)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatal(recorder.Code)
+	}
+	req.SetBasicAuth("a", "b")
+	recorder = httptest.NewRecorder()
+	fun(recorder, req)
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != PrometheusContentType {
+		t.Fatal(recorder.Code, recorder.Header())
+	}
+	for _, expected := range []string{
+		"# TYPE laitos_duration_milliseconds histogram\n",
+		`laitos_duration_milliseconds_bucket{daemon="cmdproc",le="+Inf"} `,
+		`laitos_duration_milliseconds_bucket{daemon="httpd",le="60000"} `,
+		`laitos_commands_total{trigger=".s",outcome="ok"} `,
+		`laitos_commands_total{trigger="",outcome="unauthorised"} `,
+		`laitos_sockd_relayed_bytes_total{protocol="tcp"} `,
+		`laitos_rate_limit_rejections_total{daemon="quote\"d"} 1` + "\n",
+		"laitos_banned_clients 0\n",
+		"go_goroutines ",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatal(expected, body)
+		}
+	}
+}
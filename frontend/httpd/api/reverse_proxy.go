@@ -0,0 +1,290 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ReverseProxyHealthCheckIntervalSec = 10 // ReverseProxyHealthCheckIntervalSec is the default interval between health checks of upstream servers.
+	ReverseProxyHealthCheckTimeoutSec  = 5  // ReverseProxyHealthCheckTimeoutSec is the timeout of a single health check.
+)
+
+// reverseProxyRequestKey is the request context key of the reverseProxyRequest made for the request.
+type reverseProxyRequestKey struct{}
+
+// reverseProxyRequest carries the upstream server chosen for a client request, and the client's address.
+type reverseProxyRequest struct {
+	upstream     *reverseProxyUpstream
+	clientIP     string
+	forwardedFor string
+}
+
+// reverseProxyUpstream is an upstream server and its health status.
+type reverseProxyUpstream struct {
+	url       *url.URL
+	unhealthy int32 // unhealthy is 1 if the latest health check or request failed
+}
+
+/*
+Forward requests under an endpoint prefix to a pool of upstream servers, such as internal web services that shall be
+protected by laitos' TLS and rate limit. Requests are distributed among healthy upstream servers in turns. WebSocket
+connections pass through as well.
+*/
+type HandleReverseProxy struct {
+	Upstreams              []string          `json:"Upstreams"`              // Base URLs of upstream servers, e.g. "http://10.0.0.5:3000".
+	StripPrefix            bool              `json:"StripPrefix"`            // (Optional) remove endpoint prefix from request path before forwarding it
+	PreserveHost           bool              `json:"PreserveHost"`           // (Optional) forward the Host header of client request instead of upstream's host name
+	InsecureSkipVerify     bool              `json:"InsecureSkipVerify"`     // (Optional) do not verify TLS certificate of upstream servers, e.g. self-signed certificates in internal network
+	HealthCheckPath        string            `json:"HealthCheckPath"`        // (Optional) periodically ask upstream servers for this path, and skip those that respond with an error.
+	HealthCheckIntervalSec int               `json:"HealthCheckIntervalSec"` // (Optional) interval between health checks, by default 10 seconds.
+	SetRequestHeaders      map[string]string `json:"SetRequestHeaders"`      // (Optional) set these headers in requests to upstream servers
+	RemoveRequestHeaders   []string          `json:"RemoveRequestHeaders"`   // (Optional) remove these headers from requests to upstream servers
+	SetResponseHeaders     map[string]string `json:"SetResponseHeaders"`     // (Optional) set these headers in responses to clients
+	RemoveResponseHeaders  []string          `json:"RemoveResponseHeaders"`  // (Optional) remove these headers from responses to clients
+
+	MyEndpoint string `json:"-"` // URL endpoint prefix of the reverse proxy itself, including prefix /.
+
+	upstreams       []*reverseProxyUpstream
+	nextUpstream    uint32
+	healthMutex     *sync.Mutex
+	stopHealthCheck chan struct{}
+	healthClient    *http.Client
+	logger          global.Logger
+}
+
+// nextHealthyUpstream returns the next upstream server in turns that is healthy, or nil if none is healthy.
+func (xy *HandleReverseProxy) nextHealthyUpstream() *reverseProxyUpstream {
+	for i := 0; i < len(xy.upstreams); i++ {
+		upstream := xy.upstreams[int(atomic.AddUint32(&xy.nextUpstream, 1)-1)%len(xy.upstreams)]
+		if atomic.LoadInt32(&upstream.unhealthy) == 0 {
+			return upstream
+		}
+	}
+	return nil
+}
+
+// checkHealthPeriodically checks health of upstream servers right away and then at regular interval, until told to stop.
+func (xy *HandleReverseProxy) checkHealthPeriodically(stop chan struct{}) {
+	ticker := time.NewTicker(time.Duration(xy.HealthCheckIntervalSec) * time.Second)
+	defer ticker.Stop()
+	for {
+		xy.CheckHealth()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// StopHandler stops the periodic health check of upstream servers.
+func (xy *HandleReverseProxy) StopHandler() {
+	if xy.healthMutex == nil {
+		return
+	}
+	xy.healthMutex.Lock()
+	defer xy.healthMutex.Unlock()
+	if xy.stopHealthCheck != nil {
+		close(xy.stopHealthCheck)
+		xy.stopHealthCheck = nil
+	}
+}
+
+// CheckHealth asks all upstream servers for the health check path, and remembers which of them respond successfully.
+func (xy *HandleReverseProxy) CheckHealth() {
+	wait := new(sync.WaitGroup)
+	wait.Add(len(xy.upstreams))
+	for _, upstream := range xy.upstreams {
+		go func(upstream *reverseProxyUpstream) {
+			defer wait.Done()
+			checkURL := *upstream.url
+			checkURL.Path = strings.TrimSuffix(checkURL.Path, "/") + "/" + strings.TrimPrefix(xy.HealthCheckPath, "/")
+			var unhealthy int32
+			resp, err := xy.healthClient.Get(checkURL.String())
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 400 {
+					err = fmt.Errorf("HTTP status %d", resp.StatusCode)
+				}
+			}
+			if err != nil {
+				unhealthy = 1
+			}
+			if previous := atomic.SwapInt32(&upstream.unhealthy, unhealthy); previous != unhealthy {
+				if unhealthy == 1 {
+					xy.logger.Warningf("CheckHealth", upstream.url.Host, err, "upstream server is now unhealthy")
+				} else {
+					xy.logger.Printf("CheckHealth", upstream.url.Host, nil, "upstream server is now healthy")
+				}
+			}
+		}(upstream)
+	}
+	wait.Wait()
+}
+
+// joinURLPath joins the base path of upstream server and the request path with exactly one slash in between.
+func joinURLPath(base, path string) string {
+	switch {
+	case strings.HasSuffix(base, "/") && strings.HasPrefix(path, "/"):
+		return base + path[1:]
+	case !strings.HasSuffix(base, "/") && !strings.HasPrefix(path, "/"):
+		return base + "/" + path
+	}
+	return base + path
+}
+
+// direct transforms client request into a request to the upstream server chosen by handler.
+func (xy *HandleReverseProxy) direct(req *http.Request) {
+	xyReq := req.Context().Value(reverseProxyRequestKey{}).(*reverseProxyRequest)
+	if xy.StripPrefix {
+		prefix := strings.TrimSuffix(xy.MyEndpoint, "/")
+		req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+		req.URL.RawPath = ""
+		req.Header.Set("X-Forwarded-Prefix", prefix)
+	}
+	upstreamURL := xyReq.upstream.url
+	req.URL.Scheme = upstreamURL.Scheme
+	req.URL.Host = upstreamURL.Host
+	if req.URL.RawPath != "" {
+		req.URL.RawPath = joinURLPath(upstreamURL.EscapedPath(), req.URL.RawPath)
+	}
+	req.URL.Path = joinURLPath(upstreamURL.Path, req.URL.Path)
+	if upstreamURL.RawQuery != "" && req.URL.RawQuery != "" {
+		req.URL.RawQuery = upstreamURL.RawQuery + "&" + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = upstreamURL.RawQuery + req.URL.RawQuery
+	}
+	forwardedHost := req.Host
+	if !xy.PreserveHost {
+		// Transport uses the upstream's host name
+		req.Host = ""
+	}
+	// Client's own forwarding headers must not reach upstream server
+	req.Header.Del("Forwarded")
+	req.Header.Set("X-Forwarded-For", xyReq.forwardedFor)
+	req.Header.Set("X-Real-Ip", xyReq.clientIP)
+	req.Header.Set("X-Forwarded-Host", forwardedHost)
+	if req.TLS == nil {
+		req.Header.Set("X-Forwarded-Proto", "http")
+	} else {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	}
+	for _, name := range xy.RemoveRequestHeaders {
+		req.Header.Del(name)
+	}
+	for name, value := range xy.SetRequestHeaders {
+		req.Header.Set(name, value)
+	}
+}
+
+// modifyResponse rewrites headers of upstream server's response.
+func (xy *HandleReverseProxy) modifyResponse(resp *http.Response) error {
+	// Redirection to the upstream's own path continues to go through the proxy
+	if location := resp.Header.Get("Location"); xy.StripPrefix && strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+		resp.Header.Set("Location", strings.TrimSuffix(xy.MyEndpoint, "/")+location)
+	}
+	for _, name := range xy.RemoveResponseHeaders {
+		resp.Header.Del(name)
+	}
+	for name, value := range xy.SetResponseHeaders {
+		resp.Header.Set(name, value)
+	}
+	return nil
+}
+
+func (xy *HandleReverseProxy) MakeHandler(logger global.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	if len(xy.Upstreams) == 0 {
+		return nil, errors.New("HandleReverseProxy.MakeHandler: there must be at least one upstream server")
+	}
+	if xy.MyEndpoint == "" {
+		return nil, errors.New("HandleReverseProxy.MakeHandler: MyEndpoint must not be empty")
+	}
+	if xy.HealthCheckIntervalSec < 1 {
+		xy.HealthCheckIntervalSec = ReverseProxyHealthCheckIntervalSec
+	}
+	xy.upstreams = make([]*reverseProxyUpstream, 0, len(xy.Upstreams))
+	for _, upstream := range xy.Upstreams {
+		upstreamURL, err := url.Parse(upstream)
+		if err != nil || (upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https") || upstreamURL.Host == "" {
+			return nil, fmt.Errorf("HandleReverseProxy.MakeHandler: upstream \"%s\" is not a valid HTTP(S) URL", upstream)
+		}
+		xy.upstreams = append(xy.upstreams, &reverseProxyUpstream{url: upstreamURL})
+	}
+	// Health check of a handler made earlier is superseded by the new one
+	xy.StopHandler()
+	xy.healthMutex = new(sync.Mutex)
+	xy.logger = logger
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if xy.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	xy.healthClient = &http.Client{Transport: transport, Timeout: ReverseProxyHealthCheckTimeoutSec * time.Second}
+	proxy := &httputil.ReverseProxy{
+		Director:       xy.direct,
+		Transport:      transport,
+		ModifyResponse: xy.modifyResponse,
+		// Stream server-sent events and such to client as soon as they arrive
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			upstream := r.Context().Value(reverseProxyRequestKey{}).(*reverseProxyRequest).upstream
+			if r.Context().Err() == nil {
+				// Skip the upstream server until it passes the next health check
+				if xy.HealthCheckPath != "" {
+					atomic.StoreInt32(&upstream.unhealthy, 1)
+				}
+				logger.Warningf("HandleReverseProxy", upstream.url.Host, err, "failed to forward request")
+			}
+			http.Error(w, "Upstream server is unavailable", http.StatusBadGateway)
+		},
+	}
+	if xy.HealthCheckPath != "" {
+		xy.stopHealthCheck = make(chan struct{})
+		go xy.checkHealthPeriodically(xy.stopHealthCheck)
+	}
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		upstream := xy.nextHealthyUpstream()
+		if upstream == nil {
+			http.Error(w, "No upstream server is available", http.StatusBadGateway)
+			return
+		}
+		if IsWebSocketUpgrade(r) {
+			// HTTP server's read and write timeouts would otherwise cut WebSocket connection short
+			if err := SetConnDeadline(r, time.Time{}); err != nil {
+				logger.Warningf("HandleReverseProxy", upstream.url.Host, err, "failed to clear connection deadline")
+			}
+		}
+		/*
+			Client address is determined the same way as all other handlers do, hence forwarded-for header from the
+			Internet cannot be used to disguise client's address.
+		*/
+		xyReq := &reverseProxyRequest{upstream: upstream, clientIP: GetRealClientIP(r)}
+		xyReq.forwardedFor = xyReq.clientIP
+		if strings.HasPrefix(r.RemoteAddr, "127.") {
+			if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+				xyReq.forwardedFor = prior + ", " + xyReq.clientIP
+			}
+		}
+		proxyReq := r.WithContext(context.WithValue(r.Context(), reverseProxyRequestKey{}, xyReq))
+		// Without the remote address, reverse proxy leaves the forwarded-for header just the way director sets it
+		proxyReq.RemoteAddr = ""
+		proxy.ServeHTTP(w, proxyReq)
+	}
+	return fun, nil
+}
+
+func (_ *HandleReverseProxy) GetRateLimitFactor() int {
+	// Web applications often load many resources at once
+	return 50
+}
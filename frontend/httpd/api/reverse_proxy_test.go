@@ -0,0 +1,165 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/global"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandleReverseProxy(t *testing.T) {
+	var healthy int32 = 1
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/health":
+				if name == "b" && atomic.LoadInt32(&healthy) == 0 {
+					http.Error(w, "sick", http.StatusInternalServerError)
+				}
+			case "/redirect":
+				http.Redirect(w, r, "/elsewhere", http.StatusFound)
+			case "/ws":
+				// Echo everything after switching protocol
+				conn, bufRW, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close()
+				bufRW.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+				bufRW.Flush()
+				io.Copy(conn, bufRW)
+			default:
+				w.Header().Set("X-Upstream-Secret", "secret")
+				fmt.Fprintf(w, "%s %s %s %s %s", name, r.URL.Path, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Prefix"), r.Header.Get("X-Custom"))
+			}
+		}))
+	}
+	upstreamA := newUpstream("a")
+	defer upstreamA.Close()
+	upstreamB := newUpstream("b")
+	defer upstreamB.Close()
+
+	if _, err := (&HandleReverseProxy{MyEndpoint: "/app/"}).MakeHandler(global.Logger{}, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := (&HandleReverseProxy{MyEndpoint: "/app/", Upstreams: []string{"ftp://a"}}).MakeHandler(global.Logger{}, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	xy := &HandleReverseProxy{
+		MyEndpoint:             "/app/",
+		Upstreams:              []string{upstreamA.URL, upstreamB.URL},
+		StripPrefix:            true,
+		HealthCheckPath:        "/health",
+		HealthCheckIntervalSec: 1,
+		SetRequestHeaders:      map[string]string{"X-Custom": "custom"},
+		RemoveResponseHeaders:  []string{"X-Upstream-Secret"},
+		SetResponseHeaders:     map[string]string{"X-Frame-Options": "DENY"},
+	}
+	fun, err := xy.MakeHandler(global.Logger{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/app/", fun)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string, header map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	// Requests are distributed in turns, prefix is stripped, and headers are rewritten
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		// Test client connects from 127.0.0.1, hence X-Real-Ip is trusted.
+		resp, body := get("/app/page", map[string]string{"X-Real-Ip": "1.2.3.4", "X-Forwarded-For": "5.6.7.8"})
+		fields := strings.Fields(body)
+		if resp.StatusCode != http.StatusOK || len(fields) != 6 || fields[1] != "/page" || fields[2] != "5.6.7.8," || fields[3] != "1.2.3.4" ||
+			fields[4] != "/app" || fields[5] != "custom" {
+			t.Fatal(resp.StatusCode, body)
+		}
+		if resp.Header.Get("X-Upstream-Secret") != "" || resp.Header.Get("X-Frame-Options") != "DENY" {
+			t.Fatal(resp.Header)
+		}
+		seen[fields[0]] = true
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Fatal(seen)
+	}
+	// Redirection stays under the prefix
+	if resp, _ := get("/app/redirect", nil); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/app/elsewhere" {
+		t.Fatal(resp.StatusCode, resp.Header)
+	}
+	// Unhealthy upstream is skipped
+	atomic.StoreInt32(&healthy, 0)
+	xy.CheckHealth()
+	for i := 0; i < 4; i++ {
+		if _, body := get("/app/page", nil); !strings.HasPrefix(body, "a ") {
+			t.Fatal(body)
+		}
+	}
+	// Upstream comes back after passing periodic health check, which runs without waiting for requests.
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(1500 * time.Millisecond)
+	seen = map[string]bool{}
+	for i := 0; i < 2; i++ {
+		_, body := get("/app/page", nil)
+		seen[strings.Fields(body)[0]] = true
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Fatal(seen)
+	}
+	// Stopped handler no longer checks health of upstream servers
+	xy.StopHandler()
+	xy.StopHandler()
+	atomic.StoreInt32(&healthy, 0)
+	time.Sleep(1500 * time.Millisecond)
+	seen = map[string]bool{}
+	for i := 0; i < 2; i++ {
+		_, body := get("/app/page", nil)
+		seen[strings.Fields(body)[0]] = true
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Fatal(seen)
+	}
+	// WebSocket passes through
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /app/ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal(err, resp)
+	}
+	conn.Write([]byte("hello\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatal(err, line)
+	}
+	// All upstream servers are down
+	upstreamA.Close()
+	upstreamB.Close()
+	if resp, _ := get("/app/page", nil); resp.StatusCode != http.StatusBadGateway {
+		t.Fatal(resp.StatusCode)
+	}
+}
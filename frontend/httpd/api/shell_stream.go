@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/feature"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ShellStreamDefaultTimeoutSec     = 600         // ShellStreamDefaultTimeoutSec is the default hard timeout of streamed shell commands.
+	ShellStreamDefaultMaxOutputBytes = 1024 * 1024 // ShellStreamDefaultMaxOutputBytes is the default limit of streamed output size.
+)
+
+// flushWriter flushes HTTP response after each write, so that client sees the output as soon as it arrives.
+type flushWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (flush *flushWriter) Write(p []byte) (int, error) {
+	n, err := flush.w.Write(p)
+	flush.flusher.Flush()
+	return n, err
+}
+
+/*
+Run a shell command and stream its output to client in chunked response as the output arrives. The command must pass
+PIN check of command processor, e.g. "PIN.s tail -f /var/log/messages". The command is killed when it runs past the
+timeout, when its output exceeds the size limit, or when client disconnects.
+*/
+type HandleShellStream struct {
+	TimeoutSec     int `json:"TimeoutSec"`     // (Optional) hard timeout of the command, by default 600 seconds. Client may ask for a shorter timeout.
+	MaxOutputBytes int `json:"MaxOutputBytes"` // (Optional) stop the command after its output exceeds this many bytes, by default 1MB.
+}
+
+func (stream *HandleShellStream) MakeHandler(logger global.Logger, cmdProc *common.CommandProcessor) (http.HandlerFunc, error) {
+	if stream.TimeoutSec < 1 {
+		stream.TimeoutSec = ShellStreamDefaultTimeoutSec
+	}
+	if stream.MaxOutputBytes < 1 {
+		stream.MaxOutputBytes = ShellStreamDefaultMaxOutputBytes
+	}
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		NoCache(w)
+		if !WarnIfNoHTTPS(r, w) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		clientIP := GetRealClientIP(r)
+		cmd := feature.Command{Content: r.FormValue("cmd"), TimeoutSec: stream.TimeoutSec, ClientID: clientIP}
+		if timeoutSec, err := strconv.Atoi(r.FormValue("timeout")); err == nil && timeoutSec > 0 && timeoutSec < cmd.TimeoutSec {
+			cmd.TimeoutSec = timeoutSec
+		}
+		var began bool
+		begin := func() {
+			began = true
+			// HTTP server's read and write timeouts would otherwise cut the stream short
+			if err := SetConnDeadline(r, time.Now().Add(time.Duration(cmd.TimeoutSec+10)*time.Second)); err != nil {
+				logger.Warningf("HandleShellStream", clientIP, err, "failed to extend connection deadline")
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(http.StatusOK)
+		}
+		result := cmdProc.ProcessStreaming(r.Context(), cmd, stream.MaxOutputBytes, begin, &flushWriter{w: w, flusher: flusher})
+		if !began {
+			// The command was rejected before it started
+			status := http.StatusUnauthorized
+			switch result.Error {
+			case env.ErrClientBanned, global.ErrEmergencyLockDown:
+				status = http.StatusForbidden
+			case common.ErrNotStreamable, feature.ErrEmptyCommand:
+				status = http.StatusBadRequest
+			}
+			logger.Warningf("HandleShellStream", clientIP, result.Error, "rejected command")
+			http.Error(w, result.Error.Error(), status)
+			return
+		}
+		if result.Error != nil && r.Context().Err() == nil {
+			// Response status has already been sent, so the error is told at the end of output.
+			fmt.Fprintf(w, "\n%v\n", result.Error)
+		}
+	}
+	return fun, nil
+}
+
+func (_ *HandleShellStream) GetRateLimitFactor() int {
+	return 1
+}
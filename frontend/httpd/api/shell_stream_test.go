@@ -0,0 +1,82 @@
+package api
+
+import (
+	"bufio"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleShellStream(t *testing.T) {
+	stream := &HandleShellStream{MaxOutputBytes: 20}
+	cmdProc := common.GetTestCommandProcessor()
+	fun, err := stream.MakeHandler(global.Logger{}, cmdProc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.TimeoutSec != ShellStreamDefaultTimeoutSec {
+		t.Fatal(stream.TimeoutSec)
+	}
+	server := httptest.NewServer(fun)
+	defer server.Close()
+	post := func(values url.Values) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("a", "b")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := post(url.Values{"cmd": {"wrongpin.s echo hi"}}); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal(resp)
+	}
+	if resp := post(url.Values{"cmd": {"verysecret.e info"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal(resp)
+	}
+	// Output arrives before the command completes
+	start := time.Now()
+	resp := post(url.Values{"cmd": {"verysecret.s echo a; sleep 2; echo b"}})
+	reader := bufio.NewReader(resp.Body)
+	if line, err := reader.ReadString('\n'); err != nil || line != "a\n" || time.Since(start) > 1500*time.Millisecond {
+		t.Fatal(err, line, time.Since(start))
+	}
+	if rest, err := ioutil.ReadAll(reader); err != nil || string(rest) != "b\n" {
+		t.Fatal(err, string(rest))
+	}
+	resp.Body.Close()
+	// Output is capped
+	resp = post(url.Values{"cmd": {"verysecret.s while true; do echo 0123456789; done"}})
+	if body, err := ioutil.ReadAll(resp.Body); err != nil || string(body) != "0123456789\n012345678\nProgram output exceeds the limit\n" {
+		t.Fatal(err, string(body))
+	}
+	resp.Body.Close()
+	// Client may shorten the timeout
+	resp = post(url.Values{"cmd": {"verysecret.s sleep 10"}, "timeout": {"1"}})
+	if body, err := ioutil.ReadAll(resp.Body); err != nil || string(body) != "\nProgram timed out\n" {
+		t.Fatal(err, string(body))
+	}
+	resp.Body.Close()
+	// Client is banned after failing PIN match too many times
+	cmdProc.Bans = &env.BanManager{MaxFailures: 2}
+	if err := cmdProc.Bans.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if resp := post(url.Values{"cmd": {"wrongpin.s echo hi"}}); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatal(resp)
+		}
+	}
+	if resp := post(url.Values{"cmd": {"verysecret.s echo hi"}}); resp.StatusCode != http.StatusForbidden {
+		t.Fatal(resp)
+	}
+}
@@ -22,6 +22,7 @@ func (hand *HandleTwilioSMSHook) MakeHandler(logger global.Logger, cmdProc *comm
 		ret := cmdProc.Process(feature.Command{
 			TimeoutSec: TwilioHandlerTimeoutSec,
 			Content:    r.FormValue("Body"),
+			ClientID:   "twilio:" + r.FormValue("From"),
 		})
 		// In case both PIN and shortcuts mismatch, try to conceal this endpoint.
 		if ret.Error == bridge.ErrPINAndShortcutNotFound {
@@ -88,6 +89,7 @@ func (hand *HandleTwilioCallCallback) MakeHandler(logger global.Logger, cmdProc
 		ret := cmdProc.Process(feature.Command{
 			TimeoutSec: TwilioHandlerTimeoutSec,
 			Content:    DTMFDecode(r.FormValue("Digits")),
+			ClientID:   "twilio:" + r.FormValue("From"),
 		})
 		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
 		NoCache(w)
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WebSocketGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // WebSocketGUID is appended to client key to compute handshake response (RFC 6455).
+	WebSocketMaxMessageSize = 64 * 1024                              // WebSocketMaxMessageSize is the maximum size of a message that client may send.
+
+	WebSocketOpContinuation = 0x0 // WebSocketOpContinuation frame carries the remainder of a fragmented message.
+	WebSocketOpText         = 0x1 // WebSocketOpText frame carries UTF-8 text.
+	WebSocketOpBinary       = 0x2 // WebSocketOpBinary frame carries binary data.
+	WebSocketOpClose        = 0x8 // WebSocketOpClose frame closes the connection.
+	WebSocketOpPing         = 0x9 // WebSocketOpPing frame asks the other side to respond with pong.
+	WebSocketOpPong         = 0xa // WebSocketOpPong frame responds to ping.
+)
+
+var ErrWebSocketMessageTooLarge = errors.New("WebSocket message is too large")
+
+// IsWebSocketUpgrade returns true if the HTTP request asks to open a WebSocket.
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// WebSocket is a server-side WebSocket connection (RFC 6455) that exchanges text messages.
+type WebSocket struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex *sync.Mutex
+}
+
+/*
+UpgradeWebSocket completes WebSocket handshake and takes over the HTTP connection. If the request is not a valid
+WebSocket handshake, the function responds with an HTTP error and returns an error.
+*/
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !IsWebSocketUpgrade(r) || r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "Bad WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("UpgradeWebSocket: bad handshake")
+	}
+	// Wrappers of response writer (e.g. access log) pass the connection through
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket is not supported", http.StatusInternalServerError)
+		return nil, errors.New("UpgradeWebSocket: connection cannot be taken over")
+	}
+	conn, bufRW, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket is not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("UpgradeWebSocket: connection cannot be taken over - %v", err)
+	}
+	// HTTP server's read and write timeouts no longer apply
+	conn.SetDeadline(time.Time{})
+	digest := sha1.Sum([]byte(key + WebSocketGUID))
+	handshake := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+		base64.StdEncoding.EncodeToString(digest[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocket{conn: conn, reader: bufRW.Reader, writeMutex: new(sync.Mutex)}, nil
+}
+
+// writeFrame writes a single unmasked frame, server frames are never masked.
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	if _, err := ws.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteText sends a text message to client. It is safe for concurrent use.
+func (ws *WebSocket) WriteText(text string) error {
+	return ws.writeFrame(WebSocketOpText, []byte(text))
+}
+
+// readFrame reads a single frame and unmasks its payload.
+func (ws *WebSocket) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(ws.reader, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if !masked {
+		err = errors.New("WebSocket client frame is not masked")
+		return
+	} else if length > WebSocketMaxMessageSize {
+		err = ErrWebSocketMessageTooLarge
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+/*
+ReadText waits up to the timeout for a complete text (or binary) message from client. It answers pings along the way,
+and returns io.EOF after client closes the connection.
+*/
+func (ws *WebSocket) ReadText(timeout time.Duration) (string, error) {
+	ws.conn.SetReadDeadline(time.Now().Add(timeout))
+	var message []byte
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return "", err
+		}
+		switch opcode {
+		case WebSocketOpPing:
+			if err := ws.writeFrame(WebSocketOpPong, payload); err != nil {
+				return "", err
+			}
+			continue
+		case WebSocketOpPong:
+			continue
+		case WebSocketOpClose:
+			ws.writeFrame(WebSocketOpClose, payload)
+			return "", io.EOF
+		}
+		if message = append(message, payload...); len(message) > WebSocketMaxMessageSize {
+			return "", ErrWebSocketMessageTooLarge
+		}
+		if fin {
+			return string(message), nil
+		}
+	}
+}
+
+// Close sends close frame with a normal closure status and then closes the connection.
+func (ws *WebSocket) Close() error {
+	ws.writeFrame(WebSocketOpClose, []byte{0x03, 0xe8})
+	return ws.conn.Close()
+}
@@ -1,12 +1,20 @@
 package httpd
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/HouzuoGuo/laitos/acme"
 	"github.com/HouzuoGuo/laitos/env"
 	"github.com/HouzuoGuo/laitos/frontend/common"
 	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
+	"github.com/HouzuoGuo/laitos/frontend/httpd/session"
 	"github.com/HouzuoGuo/laitos/global"
 	"github.com/HouzuoGuo/laitos/httpclient"
 	"github.com/HouzuoGuo/laitos/testingstub"
@@ -16,6 +24,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,18 +36,77 @@ const (
 
 // Generic HTTP daemon.
 type HTTPD struct {
-	Address          string            `json:"Address"`          // Network address to listen to, e.g. 0.0.0.0 for all network interfaces.
-	Port             int               `json:"Port"`             // Port number to listen on
-	TLSCertPath      string            `json:"TLSCertPath"`      // (Optional) serve HTTPS via this certificate
-	TLSKeyPath       string            `json:"TLSKeyPath"`       // (Optional) serve HTTPS via this certificate (key)
-	BaseRateLimit    int               `json:"BaseRateLimit"`    // How many times in 10 seconds interval the most expensive HTTP handler may be invoked by an IP
-	ServeDirectories map[string]string `json:"ServeDirectories"` // Serve directories (value) on prefix paths (key)
+	Address          string                      `json:"Address"`          // Network address to listen to, e.g. 0.0.0.0 for all network interfaces.
+	Port             int                         `json:"Port"`             // Port number to listen on
+	TLSCertPath      string                      `json:"TLSCertPath"`      // (Optional) serve HTTPS via this certificate
+	TLSKeyPath       string                      `json:"TLSKeyPath"`       // (Optional) serve HTTPS via this certificate (key)
+	TLSClientCAPath  string                      `json:"TLSClientCAPath"`  // (Optional) verify client certificates signed by this CA, handlers such as DNS-over-HTTPS use them to authorise clients.
+	BaseRateLimit    int                         `json:"BaseRateLimit"`    // How many times in 10 seconds interval the most expensive HTTP handler may be invoked by an IP
+	ServeDirectories map[string]string           `json:"ServeDirectories"` // Serve directories (value) on prefix paths (key)
+	DirectoryOptions map[string]DirectoryOptions `json:"DirectoryOptions"` // (Optional) listing, caching, compression, and access control of served directories, keyed by prefix path.
+	VirtualHosts     []VirtualHost               `json:"VirtualHosts"`     // (Optional) serve separate directories and handlers to visitors of these host names
+	AccessLog        AccessLog                   `json:"AccessLog"`        // (Optional) write all requests into a file in standard format
+	Sessions         session.Manager             `json:"Sessions"`         // (Optional) require visitors to sign in before using some of the specialised handlers
 
 	SpecialHandlers map[string]api.HandlerFactory `json:"-"` // Specialised handlers that implement api.HandlerFactory interface
 	AllRateLimits   map[string]*env.RateLimit     `json:"-"` // Aggregate all routes and their rate limit counters
 	Server          *http.Server                  `json:"-"` // Standard library HTTP server structure
 	Processor       *common.CommandProcessor      `json:"-"` // Feature command processor
+	CertManager     *acme.CertManager             `json:"-"` // (Optional) serve HTTPS via certificate obtained and renewed automatically via ACME
 	Logger          global.Logger                 `json:"-"` // Logger
+
+	mux       *http.ServeMux              // mux dispatches requests of the default host to directory and specialised handlers
+	hostMuxes map[string]*http.ServeMux   // hostMuxes dispatches requests of virtual hosts, keyed by host name.
+	hostCerts map[string]*tls.Certificate // hostCerts are TLS certificates of virtual hosts, keyed by host name.
+	muxMutex  *sync.RWMutex               // muxMutex protects handlers from being replaced while a request is being dispatched
+	handlers  map[string]builtHandler     // handlers are the specialised handler functions keyed by host name and path.
+	running   *HTTPD                      // running is the daemon that is going to be replaced by this one, while reinitialising.
+}
+
+// builtHandler is a specialised handler function, along with the handler factory that constructed it and its configuration.
+type builtHandler struct {
+	factory api.HandlerFactory
+	config  []byte
+	fun     http.HandlerFunc
+}
+
+// stopHandlers stops background work of the handlers, except those that carry on in the replacement handlers.
+func stopHandlers(handlers, replacement map[string]builtHandler) {
+	for key, built := range handlers {
+		if next, exists := replacement[key]; exists && next.factory == built.factory {
+			continue
+		}
+		if stoppable, ok := built.factory.(api.StoppableHandlerFactory); ok {
+			stoppable.StopHandler()
+		}
+	}
+}
+
+// sameConfig returns true only if both values serialise into identical JSON, i.e. they carry the same configuration.
+func sameConfig(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aJSON, bJSON)
+}
+
+/*
+handlerConfig serialises all exported fields of the handler factory into JSON, including those that do not come from
+configuration file, such as mailer and features to check. Return nil if the factory cannot be serialised.
+*/
+func handlerConfig(handler api.HandlerFactory) []byte {
+	val := reflect.Indirect(reflect.ValueOf(handler))
+	if val.Kind() != reflect.Struct {
+		ret, _ := json.Marshal(handler)
+		return ret
+	}
+	fields := make(map[string]interface{})
+	for i := 0; i < val.NumField(); i++ {
+		if field := val.Type().Field(i); field.PkgPath == "" {
+			fields[field.Name] = val.Field(i).Interface()
+		}
+	}
+	ret, _ := json.Marshal(fields)
+	return ret
 }
 
 // Return path to HandlerFactory among special handlers that matches the specified type. Primarily used by test case code.
@@ -66,7 +134,7 @@ func (httpd *HTTPD) Middleware(ratelimit *env.RateLimit, next http.HandlerFunc)
 				Hence the status code here is OK.
 			*/
 			w.Write([]byte(global.ErrEmergencyLockDown.Error()))
-			api.DurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+			api.DurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 			return
 		}
 		// Check client IP against rate limit
@@ -77,90 +145,387 @@ func (httpd *HTTPD) Middleware(ratelimit *env.RateLimit, next http.HandlerFunc)
 		} else {
 			http.Error(w, "", http.StatusTooManyRequests)
 		}
-		api.DurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+		api.DurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 	}
 }
 
-// Check configuration and initialise internal states.
-func (httpd *HTTPD) Initialise() error {
+// normaliseDirectoryLocation returns the prefix path of a served directory with leading and trailing slash.
+func normaliseDirectoryLocation(urlLocation string) string {
+	if urlLocation[0] != '/' {
+		urlLocation = "/" + urlLocation
+	}
+	if urlLocation[len(urlLocation)-1] != '/' {
+		urlLocation += "/"
+	}
+	return urlLocation
+}
+
+/*
+installDirectories serves the directories (value) on prefix paths (key) via the router. Directories that do not have
+options are served by Go's file server as-is.
+*/
+func (httpd *HTTPD) installDirectories(mux *http.ServeMux, routePrefix string, dirs map[string]string, options map[string]DirectoryOptions) error {
+	optionsByLocation := make(map[string]*DirectoryOptions)
+	for urlLocation := range options {
+		if urlLocation == "" {
+			continue
+		}
+		opts := options[urlLocation]
+		if err := opts.validate(); err != nil {
+			return fmt.Errorf("HTTPD.Initialise: bad options of directory %s - %v", urlLocation, err)
+		}
+		optionsByLocation[normaliseDirectoryLocation(urlLocation)] = &opts
+	}
+	for urlLocation, dirPath := range dirs {
+		if urlLocation == "" || dirPath == "" {
+			continue
+		}
+		urlLocation = normaliseDirectoryLocation(urlLocation)
+		var handler http.Handler = http.FileServer(http.Dir(dirPath))
+		if opts, exists := optionsByLocation[urlLocation]; exists {
+			handler = opts.makeHandler(dirPath)
+		}
+		rl := &env.RateLimit{
+			UnitSecs: RateLimitIntervalSec,
+			MaxCount: DirectoryHandlerRateLimitFactor * httpd.BaseRateLimit,
+			Logger:   httpd.Logger,
+		}
+		httpd.AllRateLimits[routePrefix+urlLocation] = rl
+		mux.HandleFunc(urlLocation, httpd.Middleware(rl, http.StripPrefix(urlLocation, handler).(http.HandlerFunc)))
+	}
+	return nil
+}
+
+/*
+makeHandler constructs the specialised handler function and wraps it in rate-limiting middleware. If session is
+required, only signed-in visitors may reach the handler. While reinitialising, the handler function of the running
+daemon is reused if the handler's configuration did not change, so that it keeps its run-time state.
+*/
+func (httpd *HTTPD) makeHandler(rateLimitKey string, handler api.HandlerFactory, requireSession bool) (http.HandlerFunc, error) {
+	// Remember the configuration before handler factory fills in the defaults
+	config := handlerConfig(handler)
+	var fun http.HandlerFunc
+	var err error
+	if httpd.running == nil {
+		fun, err = handler.MakeHandler(httpd.Logger, httpd.Processor)
+	} else if previous, exists := httpd.running.handlers[rateLimitKey]; exists && config != nil && bytes.Equal(previous.config, config) {
+		// The factory carries run-time state of the handler function
+		handler = previous.factory
+		fun = previous.fun
+	} else {
+		// The running daemon's command processor is going to take over the new features and bridges
+		fun, err = handler.MakeHandler(httpd.Logger, httpd.running.Processor)
+	}
+	if err != nil {
+		return nil, err
+	}
+	httpd.handlers[rateLimitKey] = builtHandler{factory: handler, config: config, fun: fun}
+	if requireSession {
+		fun = httpd.Sessions.Require(fun)
+	}
+	rl := &env.RateLimit{
+		UnitSecs: RateLimitIntervalSec,
+		MaxCount: handler.GetRateLimitFactor() * httpd.BaseRateLimit,
+		Logger:   httpd.Logger,
+	}
+	httpd.AllRateLimits[rateLimitKey] = rl
+	return httpd.Middleware(rl, fun), nil
+}
+
+// checkLoginEndpoint returns an error if sign-in endpoint of sessions is already used by a handler or directory of any host.
+func (httpd *HTTPD) checkLoginEndpoint(login string) error {
+	inUse := func(handlers map[string]api.HandlerFactory, indexEndpoints []string, dirs map[string]string) bool {
+		for location := range handlers {
+			if location == login || location == login+"/" {
+				return true
+			}
+		}
+		for _, location := range indexEndpoints {
+			if location == login || location == login+"/" {
+				return true
+			}
+		}
+		for location := range dirs {
+			if location != "" && normaliseDirectoryLocation(location) == login+"/" {
+				return true
+			}
+		}
+		return false
+	}
+	if inUse(httpd.SpecialHandlers, nil, httpd.ServeDirectories) {
+		return fmt.Errorf("HTTPD.Check: login endpoint %s is already in use", login)
+	}
+	for _, vhost := range httpd.VirtualHosts {
+		if inUse(vhost.SpecialHandlers, vhost.IndexEndpoints, vhost.ServeDirectories) {
+			return fmt.Errorf("HTTPD.Check: login endpoint %s is already in use by virtual host %v", login, vhost.HostNames)
+		}
+	}
+	return nil
+}
+
+/*
+Check validates configuration without constructing handlers or opening files, hence it does not disturb a running
+daemon that shares resources with this one, such as access log file and browser instances.
+*/
+func (httpd *HTTPD) Check() error {
 	httpd.Logger = global.Logger{ComponentName: "HTTPD", ComponentID: fmt.Sprintf("%s:%d", httpd.Address, httpd.Port)}
 	if httpd.Processor == nil {
 		httpd.Processor = common.GetEmptyCommandProcessor()
 	}
 	httpd.Processor.SetLogger(httpd.Logger)
 	if errs := httpd.Processor.IsSaneForInternet(); len(errs) > 0 {
-		return fmt.Errorf("HTTPD.Initialise: %+v", errs)
+		return fmt.Errorf("HTTPD.Check: %+v", errs)
 	}
 	if httpd.Address == "" {
-		return errors.New("HTTPD.Initialise: listen address is empty")
+		return errors.New("HTTPD.Check: listen address is empty")
 	}
 	if httpd.Port < 1 {
-		return errors.New("HTTPD.Initialise: listen port must be greater than 0")
+		return errors.New("HTTPD.Check: listen port must be greater than 0")
 	}
 	if httpd.BaseRateLimit < 1 {
-		return errors.New("HTTPD.Initialise: BaseRateLimit must be greater than 0")
+		return errors.New("HTTPD.Check: BaseRateLimit must be greater than 0")
 	}
 	if (httpd.TLSCertPath != "" || httpd.TLSKeyPath != "") && (httpd.TLSCertPath == "" || httpd.TLSKeyPath == "") {
-		return errors.New("HTTPD.Initialise: if TLS is to be enabled, both TLS certificate and key path must be present.")
+		return errors.New("HTTPD.Check: if TLS is to be enabled, both TLS certificate and key path must be present.")
+	}
+	if httpd.CertManager != nil && httpd.TLSCertPath != "" {
+		return errors.New("HTTPD.Check: TLS certificate files may not be used together with ACME")
+	}
+	if httpd.TLSClientCAPath != "" && httpd.TLSCertPath == "" && httpd.CertManager == nil {
+		return errors.New("HTTPD.Check: TLS client CA may only be used when TLS is enabled")
+	}
+	if httpd.TLSClientCAPath != "" {
+		if _, err := httpd.loadClientCAs(); err != nil {
+			return err
+		}
+	}
+	if err := httpd.AccessLog.Check(); err != nil {
+		return err
+	}
+	if httpd.Sessions.IsEnabled() {
+		// Session store is prepared by Initialise, check the configuration in a copy.
+		sessions := httpd.Sessions
+		if err := sessions.Initialise(httpd.Logger, httpd.Processor.Bans); err != nil {
+			return fmt.Errorf("HTTPD.Check: %v", err)
+		}
+		if err := httpd.checkLoginEndpoint(sessions.LoginEndpoint); err != nil {
+			return err
+		}
+	}
+	for urlLocation, opts := range httpd.DirectoryOptions {
+		if urlLocation == "" {
+			continue
+		}
+		if err := opts.validate(); err != nil {
+			return fmt.Errorf("HTTPD.Check: bad options of directory %s - %v", urlLocation, err)
+		}
+	}
+	return httpd.checkVirtualHosts()
+}
+
+// loadClientCAs reads the CA certificates that verify TLS clients.
+func (httpd *HTTPD) loadClientCAs() (*x509.CertPool, error) {
+	caPEM, err := ioutil.ReadFile(httpd.TLSClientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPD.Check: failed to read TLS client CA - %v", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("HTTPD.Check: TLS client CA file does not contain a PEM certificate")
+	}
+	return caPool, nil
+}
+
+// Check configuration and initialise internal states.
+func (httpd *HTTPD) Initialise() error {
+	if err := httpd.Check(); err != nil {
+		return err
+	}
+	return httpd.initialise()
+}
+
+/*
+Reinitialise initialises a daemon constructed from reloaded configuration, to replace the running daemon via
+ReplaceHandlers. Handlers and access log of the running daemon are reused if their configuration did not change, so
+that they keep their run-time state (e.g. file shares, upstream health, browser instances). Handlers that changed are
+constructed afresh using the running daemon's command processor, which takes over the new features and bridges upon
+replacement.
+*/
+func (httpd *HTTPD) Reinitialise(running *HTTPD) error {
+	if err := httpd.Check(); err != nil {
+		return err
+	}
+	httpd.running = running
+	defer func() {
+		httpd.running = nil
+	}()
+	return httpd.initialise()
+}
+
+/*
+DiscardHandlers stops background work of handlers constructed by Reinitialise, when the daemon is not going to replace
+the running daemon after all. Handlers reused from the running daemon carry on.
+*/
+func (httpd *HTTPD) DiscardHandlers(running *HTTPD) {
+	stopHandlers(httpd.handlers, running.handlers)
+}
+
+// initialise opens access log file, prepares session store, and constructs handlers, after configuration is checked.
+func (httpd *HTTPD) initialise() (err error) {
+	defer func() {
+		if err != nil {
+			// Handlers constructed so far will not be used, though those of the running daemon carry on.
+			var running map[string]builtHandler
+			if httpd.running != nil {
+				running = httpd.running.handlers
+			}
+			stopHandlers(httpd.handlers, running)
+		}
+	}()
+	if running := httpd.running; running != nil && sameConfig(httpd.AccessLog, running.AccessLog) {
+		httpd.AccessLog = running.AccessLog
+	} else if err := httpd.AccessLog.Initialise(); err != nil {
+		return err
+	}
+	if httpd.Sessions.IsEnabled() {
+		if err := httpd.Sessions.Initialise(httpd.Logger, httpd.Processor.Bans); err != nil {
+			return fmt.Errorf("HTTPD.Initialise: %v", err)
+		}
+		// Visitors carry on with the same session store, if its configuration did not change.
+		if running := httpd.running; running != nil && sameConfig(httpd.Sessions, running.Sessions) {
+			httpd.Sessions = running.Sessions
+		}
 	}
 	// Install handlers with rate-limiting middleware
 	mux := new(http.ServeMux)
 	httpd.AllRateLimits = map[string]*env.RateLimit{}
-	// Collect directory handlers
-	if httpd.ServeDirectories != nil {
-		for urlLocation, dirPath := range httpd.ServeDirectories {
-			if urlLocation == "" || dirPath == "" {
-				continue
-			}
-			if urlLocation[0] != '/' {
-				urlLocation = "/" + urlLocation
-			}
-			if urlLocation[len(urlLocation)-1] != '/' {
-				urlLocation += "/"
-			}
-			rl := &env.RateLimit{
-				UnitSecs: RateLimitIntervalSec,
-				MaxCount: DirectoryHandlerRateLimitFactor * httpd.BaseRateLimit,
-				Logger:   httpd.Logger,
-			}
-			httpd.AllRateLimits[urlLocation] = rl
-			mux.HandleFunc(urlLocation, httpd.Middleware(rl, http.StripPrefix(urlLocation, http.FileServer(http.Dir(dirPath))).(http.HandlerFunc)))
-		}
+	httpd.handlers = make(map[string]builtHandler)
+	if err := httpd.installDirectories(mux, "", httpd.ServeDirectories, httpd.DirectoryOptions); err != nil {
+		return err
 	}
 	// Collect specialised handlers
+	handlerFuns := make(map[string]http.HandlerFunc)
 	for urlLocation, handler := range httpd.SpecialHandlers {
-		fun, err := handler.MakeHandler(httpd.Logger, httpd.Processor)
+		fun, err := httpd.makeHandler(urlLocation, handler, httpd.Sessions.IsRequired(urlLocation))
 		if err != nil {
 			return err
 		}
-		rl := &env.RateLimit{
-			UnitSecs: RateLimitIntervalSec,
-			MaxCount: handler.GetRateLimitFactor() * httpd.BaseRateLimit,
-			Logger:   httpd.Logger,
+		handlerFuns[urlLocation] = fun
+	}
+	// Endpoints claimed by virtual hosts are not served on the default host
+	claimed, err := httpd.initialiseVirtualHosts(handlerFuns)
+	if err != nil {
+		return err
+	}
+	for urlLocation, fun := range handlerFuns {
+		if _, isClaimed := claimed[urlLocation]; !isClaimed {
+			mux.HandleFunc(urlLocation, fun)
+		}
+	}
+	// Visitors sign in on every host, as each host has its own cookies.
+	if httpd.Sessions.IsEnabled() {
+		loginFun, err := httpd.makeHandler(httpd.Sessions.LoginEndpoint, &httpd.Sessions, false)
+		if err != nil {
+			return err
+		}
+		allMuxes := map[*http.ServeMux]struct{}{mux: {}}
+		for _, hostMux := range httpd.hostMuxes {
+			allMuxes[hostMux] = struct{}{}
+		}
+		for eachMux := range allMuxes {
+			eachMux.HandleFunc(httpd.Sessions.LoginEndpoint, loginFun)
+			eachMux.HandleFunc(httpd.Sessions.LoginEndpoint+"/", loginFun)
 		}
-		httpd.AllRateLimits[urlLocation] = rl
-		mux.HandleFunc(urlLocation, httpd.Middleware(rl, fun))
 	}
 	// Initialise all rate limits
 	for _, limit := range httpd.AllRateLimits {
 		limit.Initialise()
 	}
+	httpd.mux = mux
+	httpd.muxMutex = new(sync.RWMutex)
 	// Configure server with rather generous and sane defaults
 	httpd.Server = &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", httpd.Address, httpd.Port),
-		Handler:      mux,
+		Handler:      httpd,
 		ReadTimeout:  IOTimeoutSec * time.Second,
 		WriteTimeout: IOTimeoutSec * time.Second,
+		// Let long-running handlers (e.g. shell stream) extend write deadline of their connection
+		ConnContext: api.WithConn,
+	}
+	if httpd.CertManager != nil {
+		httpd.Server.TLSConfig = httpd.CertManager.TLSConfig()
+	}
+	if httpd.TLSCertPath != "" || httpd.CertManager != nil {
+		// Virtual hosts may present their own certificates
+		if httpd.Server.TLSConfig == nil {
+			httpd.Server.TLSConfig = &tls.Config{}
+		}
+		httpd.wrapGetCertificate(httpd.Server.TLSConfig)
+	}
+	if httpd.TLSClientCAPath != "" {
+		caPool, err := httpd.loadClientCAs()
+		if err != nil {
+			return err
+		}
+		// Ordinary visitors do not have to present a certificate
+		if httpd.Server.TLSConfig == nil {
+			httpd.Server.TLSConfig = &tls.Config{}
+		}
+		httpd.Server.TLSConfig.ClientCAs = caPool
+		httpd.Server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
 	}
 	return nil
 }
 
+// ServeHTTP dispatches the request to a directory or specialised handler of the host that visitor asks for.
+func (httpd *HTTPD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	httpd.muxMutex.RLock()
+	mux, isVirtualHost := httpd.hostMuxes[hostWithoutPort(r.Host)]
+	if !isVirtualHost {
+		mux = httpd.mux
+	}
+	accessLog := httpd.AccessLog
+	httpd.muxMutex.RUnlock()
+	if accessLog.IsEnabled() {
+		serveAndLog(&accessLog, mux, w, r)
+	} else {
+		mux.ServeHTTP(w, r)
+	}
+}
+
+/*
+ReplaceHandlers atomically replaces directory and specialised handlers, along with their rate limits, by those of
+another daemon that has been reinitialised from a freshly loaded configuration. The command processor takes over the
+features and bridges of the other daemon. Requests that are already being served carry on with the old handlers.
+Virtual hosts and their certificates are replaced too, however, listener and other TLS settings remain unchanged.
+*/
+func (httpd *HTTPD) ReplaceHandlers(other *HTTPD) {
+	httpd.muxMutex.Lock()
+	defer httpd.muxMutex.Unlock()
+	httpd.ServeDirectories = other.ServeDirectories
+	httpd.DirectoryOptions = other.DirectoryOptions
+	httpd.BaseRateLimit = other.BaseRateLimit
+	httpd.VirtualHosts = other.VirtualHosts
+	httpd.AccessLog = other.AccessLog
+	// Visitors remain signed in, unless the new configuration no longer allows them.
+	other.Sessions.TakeOver(&httpd.Sessions)
+	httpd.Sessions = other.Sessions
+	httpd.SpecialHandlers = other.SpecialHandlers
+	httpd.AllRateLimits = other.AllRateLimits
+	httpd.Processor.ReplaceWith(other.Processor)
+	httpd.mux = other.mux
+	stopHandlers(httpd.handlers, other.handlers)
+	httpd.handlers = other.handlers
+	httpd.hostMuxes = other.hostMuxes
+	httpd.hostCerts = other.hostCerts
+}
+
 /*
 You may call this function only after having called Initialise()!
 Start HTTP daemon and block caller until Stop function is called.
 */
 func (httpd *HTTPD) StartAndBlock() error {
-	if httpd.TLSCertPath == "" {
+	if httpd.TLSCertPath == "" && httpd.CertManager == nil {
 		httpd.Logger.Printf("StartAndBlock", "", nil, "going to listen for HTTP connections")
 		if err := httpd.Server.ListenAndServe(); err != nil {
 			if strings.Contains(err.Error(), "closed") {
@@ -170,6 +535,7 @@ func (httpd *HTTPD) StartAndBlock() error {
 		}
 	} else {
 		httpd.Logger.Printf("StartAndBlock", "", nil, "going to listen for HTTPS connections")
+		// Certificate files are empty if ACME certificate manager supplies the certificate
 		if err := httpd.Server.ListenAndServeTLS(httpd.TLSCertPath, httpd.TLSKeyPath); err != nil {
 			if strings.Contains(err.Error(), "closed") {
 				return nil
@@ -180,8 +546,11 @@ func (httpd *HTTPD) StartAndBlock() error {
 	return nil
 }
 
-// Stop HTTP daemon.
+// Stop HTTP daemon and background work of its handlers.
 func (httpd *HTTPD) Stop() {
+	httpd.muxMutex.RLock()
+	stopHandlers(httpd.handlers, nil)
+	httpd.muxMutex.RUnlock()
 	constraints, _ := context.WithTimeout(context.Background(), time.Duration(IOTimeoutSec+2)*time.Second)
 	if err := httpd.Server.Shutdown(constraints); err != nil {
 		httpd.Logger.Warningf("Stop", "", err, "failed to shutdown")
@@ -215,6 +584,57 @@ func TestAPIHandlers(httpd *HTTPD, t testingstub.T) {
 	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "bin") {
 		t.Fatal(err, string(resp.Body))
 	}
+	// Command API - authorised by bearer token
+	cmdAPIPath := httpd.GetHandlerByFactoryType(&api.HandleCommandAPI{})
+	resp, err = httpclient.DoHTTP(httpclient.Request{
+		Method: http.MethodPost,
+		Header: map[string][]string{"Authorization": {"Bearer verysecrettoken"}},
+		Body:   strings.NewReader(`{"Command": ".s echo hi", "Length": 1}`),
+	}, addr+cmdAPIPath)
+	var cmdAPIResp api.CommandAPIResponse
+	if err != nil || resp.StatusCode != http.StatusOK || json.Unmarshal(resp.Body, &cmdAPIResp) != nil ||
+		cmdAPIResp.Trigger != ".s" || cmdAPIResp.Error != "" || cmdAPIResp.CombinedOutput != "h" {
+		t.Fatal(err, string(resp.Body))
+	}
+	resp, err = httpclient.DoHTTP(httpclient.Request{Method: http.MethodPost, Body: strings.NewReader(`{"Command": ".s echo hi"}`)}, addr+cmdAPIPath)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal(err, string(resp.Body))
+	}
+	// Command console - page is served to browsers
+	resp, err = httpclient.DoHTTP(httpclient.Request{Header: basicAuth}, addr+httpd.GetHandlerByFactoryType(&api.HandleCommandConsole{}))
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "new WebSocket") {
+		t.Fatal(err, string(resp.Body))
+	}
+	// Shell output stream
+	resp, err = httpclient.DoHTTP(httpclient.Request{
+		Method: http.MethodPost,
+		Header: basicAuth,
+		Body:   strings.NewReader(url.Values{"cmd": {"verysecret.s echo stream"}}.Encode()),
+	}, addr+httpd.GetHandlerByFactoryType(&api.HandleShellStream{}))
+	if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != "stream\n" {
+		t.Fatal(err, string(resp.Body))
+	}
+	// File upload in a single chunk
+	resp, err = httpclient.DoHTTP(httpclient.Request{
+		Method:      http.MethodPost,
+		Header:      map[string][]string{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("a:verysecret"))}},
+		ContentType: "application/octet-stream",
+		Body:        strings.NewReader("uploaded content"),
+	}, addr+httpd.GetHandlerByFactoryType(&api.HandleFileUpload{})+"?action=chunk&name=a.txt&offset=0&final=1")
+	if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != "a.txt" {
+		t.Fatal(err, string(resp.Body))
+	}
+	// Prometheus metrics
+	resp, err = httpclient.DoHTTP(httpclient.Request{Header: basicAuth}, addr+httpd.GetHandlerByFactoryType(&api.HandlePrometheus{}))
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `laitos_duration_milliseconds_count{daemon="httpd"}`) {
+		t.Fatal(err, string(resp.Body))
+	}
+	// Dashboard
+	resp, err = httpclient.DoHTTP(httpclient.Request{Header: map[string][]string{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("a:verysecret"))}}},
+		addr+httpd.GetHandlerByFactoryType(&api.HandleDashboard{}))
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "laitos dashboard") {
+		t.Fatal(err, string(resp.Body))
+	}
 	// Gitlab handle
 	resp, err = httpclient.DoHTTP(httpclient.Request{Header: basicAuth}, addr+"/gitlab")
 	if err != nil || resp.StatusCode != http.StatusOK || strings.Index(string(resp.Body), "Enter path to browse") == -1 {
@@ -226,6 +646,11 @@ func TestAPIHandlers(httpd *HTTPD, t testingstub.T) {
 	if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != expected {
 		t.Fatal(err, string(resp.Body), expected, resp)
 	}
+	// Reverse proxy handle forwards request to the daemon itself
+	resp, err = httpclient.DoHTTP(httpclient.Request{}, addr+httpd.GetHandlerByFactoryType(&api.HandleReverseProxy{})+"html")
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(resp.Body), "this is index") {
+		t.Fatal(err, string(resp.Body), resp)
+	}
 	// MailMe
 	resp, err = httpclient.DoHTTP(httpclient.Request{Header: basicAuth}, addr+"/mail_me")
 	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "submit") {
@@ -250,6 +675,44 @@ func TestAPIHandlers(httpd *HTTPD, t testingstub.T) {
 		t.Fatal(err, resp.StatusCode, string(resp.Body))
 	}
 
+	// DNS-over-HTTPS - client without a valid token does not get to see the endpoint
+	dohQuery, _ := hex.DecodeString("e575012000010000000000010667697468756203636f6d00000100010000291000000000000000")
+	dohPath := httpd.GetHandlerByFactoryType(&api.HandleDNSOverHTTPS{})
+	resp, err = httpclient.DoHTTP(httpclient.Request{}, addr+dohPath+"bad-token?dns="+base64.RawURLEncoding.EncodeToString(dohQuery))
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatal(err, resp)
+	}
+	// DNS-over-HTTPS - resolve github.com via GET and then POST, the answer must carry query's transaction ID.
+	dohToken := httpd.SpecialHandlers[dohPath].(*api.HandleDNSOverHTTPS).GetDNSDaemon().SecureTokens[0]
+	resp, err = httpclient.DoHTTP(httpclient.Request{}, addr+dohPath+dohToken+"?dns="+base64.RawURLEncoding.EncodeToString(dohQuery))
+	if err != nil || resp.StatusCode != http.StatusOK || len(resp.Body) <= len(dohQuery) || !bytes.Equal(resp.Body[:2], dohQuery[:2]) {
+		t.Fatal(err, resp)
+	}
+	resp, err = httpclient.DoHTTP(httpclient.Request{
+		Method:      http.MethodPost,
+		ContentType: api.DNSMessageContentType,
+		Body:        bytes.NewReader(dohQuery),
+	}, addr+dohPath+dohToken)
+	if err != nil || resp.StatusCode != http.StatusOK || len(resp.Body) <= len(dohQuery) || !bytes.Equal(resp.Body[:2], dohQuery[:2]) {
+		t.Fatal(err, resp)
+	}
+	// ACME HTTP challenge - unknown tokens are not found
+	if acmePath := httpd.GetHandlerByFactoryType(&api.HandleACMEChallenge{}); acmePath != "" {
+		resp, err = httpclient.DoHTTP(httpclient.Request{}, addr+acmePath+"no-such-token")
+		if err != nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatal(err, resp)
+		}
+	}
+	// DNS query statistics - the DNS-over-HTTPS queries are among the latest queries
+	resp, err = httpclient.DoHTTP(httpclient.Request{Header: basicAuth}, addr+"/dns_stats?latest=2")
+	var dnsStats api.DNSQueryStatsResponse
+	if err != nil || resp.StatusCode != http.StatusOK || json.Unmarshal(resp.Body, &dnsStats) != nil {
+		t.Fatal(err, resp)
+	}
+	if dnsStats.NumQueries < 2 || len(dnsStats.Latest) != 2 || dnsStats.Latest[0].Name != "github.com" || dnsStats.Latest[0].ClientIP != "127.0.0.1" {
+		t.Fatalf("%+v", dnsStats)
+	}
+
 	// Twilio - exchange SMS with bad PIN
 	resp, err = httpclient.DoHTTP(httpclient.Request{
 		Method: http.MethodPost,
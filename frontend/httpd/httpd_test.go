@@ -2,11 +2,18 @@ package httpd
 
 import (
 	"fmt"
+	"github.com/HouzuoGuo/laitos/acme"
 	"github.com/HouzuoGuo/laitos/email"
 	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
 	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
+	"github.com/HouzuoGuo/laitos/frontend/httpd/session"
+	"github.com/HouzuoGuo/laitos/global"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
@@ -56,6 +63,35 @@ func TestHTTPD_StartAndBlock(t *testing.T) {
 	daemon.Processor = common.GetTestCommandProcessor()
 	daemon.SpecialHandlers["/info"] = &api.HandleSystemInfo{FeaturesToCheck: daemon.Processor.Features}
 	daemon.SpecialHandlers["/cmd_form"] = &api.HandleCommandForm{}
+	daemon.SpecialHandlers["/console"] = &api.HandleCommandConsole{}
+	daemon.SpecialHandlers["/api/v1/cmd"] = &api.HandleCommandAPI{BearerTokens: []string{"verysecrettoken"}, HMACSecret: "verysecrethmac"}
+	dnsDaemon := &dnsd.DNSD{
+		Address:              "127.0.0.1",
+		UDPPort:              1024 + rand.Intn(65535-1024),
+		UDPForwarder:         "8.8.8.8:53",
+		TCPForwarder:         "8.8.8.8:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127.0"},
+		SecureTokens:         []string{"verysecrettoken"},
+	}
+	if err := dnsDaemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.SpecialHandlers["/dns-query/"] = &api.HandleDNSOverHTTPS{MyEndpoint: "/dns-query/", DNSDaemon: dnsDaemon}
+	daemon.SpecialHandlers["/dns_stats"] = &api.HandleDNSQueryStats{}
+	certManager := &acme.CertManager{Domains: []string{"example.com"}, CacheDir: "/tmp/test-laitos-httpd-acme"}
+	defer os.RemoveAll(certManager.CacheDir)
+	if err := certManager.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.SpecialHandlers[acme.HTTPChallengePath] = &api.HandleACMEChallenge{CertManager: certManager}
+	uploadDir, err := ioutil.TempDir("", "laitos-TestHTTPD_StartAndBlock-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(uploadDir)
+	daemon.SpecialHandlers["/dashboard"] = &api.HandleDashboard{}
+	daemon.SpecialHandlers["/upload"] = &api.HandleFileUpload{UploadDir: uploadDir}
 	daemon.SpecialHandlers["/gitlab"] = &api.HandleGitlabBrowser{PrivateToken: "token-does-not-matter-in-this-test"}
 	daemon.SpecialHandlers["/html"] = &api.HandleHTMLDocument{HTMLFilePath: indexFile}
 	daemon.SpecialHandlers["/mail_me"] = &api.HandleMailMe{
@@ -66,7 +102,14 @@ func TestHTTPD_StartAndBlock(t *testing.T) {
 			MTAPort:  25,
 		},
 	}
+	daemon.SpecialHandlers["/metrics"] = &api.HandlePrometheus{}
 	daemon.SpecialHandlers["/proxy"] = &api.HandleWebProxy{MyEndpoint: "/proxy"}
+	daemon.SpecialHandlers["/reverse_proxy/"] = &api.HandleReverseProxy{
+		MyEndpoint:  "/reverse_proxy/",
+		Upstreams:   []string{fmt.Sprintf("http://127.0.0.1:%d", daemon.Port)},
+		StripPrefix: true,
+	}
+	daemon.SpecialHandlers["/shell_stream"] = &api.HandleShellStream{}
 	daemon.SpecialHandlers["/sms"] = &api.HandleTwilioSMSHook{}
 	daemon.SpecialHandlers["/call_greeting"] = &api.HandleTwilioCallHook{CallGreeting: "Hi there", CallbackEndpoint: "/test"}
 	daemon.SpecialHandlers["/call_command"] = &api.HandleTwilioCallCallback{MyEndpoint: "/endpoint-does-not-matter-in-this-test"}
@@ -99,3 +142,171 @@ func TestHTTPD_StartAndBlock(t *testing.T) {
 	daemon.Stop()
 	daemon.Stop()
 }
+
+func TestHTTPD_Sessions(t *testing.T) {
+	daemon := HTTPD{
+		Address:       "127.0.0.1",
+		Port:          12346,
+		BaseRateLimit: 10,
+		Processor:     common.GetTestCommandProcessor(),
+		SpecialHandlers: map[string]api.HandlerFactory{
+			"/cmd_form":  &api.HandleCommandForm{},
+			"/dns_stats": &api.HandleDNSQueryStats{},
+		},
+		VirtualHosts: []VirtualHost{{HostNames: []string{"site.example"}, Endpoints: []string{"/cmd_form"}}},
+		Sessions: session.Manager{
+			Endpoints: []string{"/cmd_form"},
+			Accounts:  map[string]session.LocalAccount{"alice": {Password: "alice-pass"}},
+		},
+	}
+	// Sign-in page may not take the place of another handler
+	daemon.Sessions.LoginEndpoint = "/dns_stats"
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	daemon.Sessions.LoginEndpoint = ""
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, host, path string, cookies []*http.Cookie, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Host = host
+		if form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		if cookies == nil {
+			req.SetBasicAuth("", "")
+		}
+		recorder := httptest.NewRecorder()
+		daemon.ServeHTTP(recorder, req)
+		return recorder
+	}
+	// Handlers that do not require session are unaffected
+	if resp := serve(http.MethodGet, "127.0.0.1", "/dns_stats", nil, nil); resp.Code != http.StatusOK {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	// Protected handler asks visitor to sign in on the virtual host that serves it
+	if resp := serve(http.MethodGet, "site.example", "/cmd_form", nil, nil); resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != "/login?next=%2Fcmd_form" {
+		t.Fatal(resp.Code, resp.Header())
+	}
+	if resp := serve(http.MethodGet, "site.example", "/login", nil, nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "Password") {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	resp := serve(http.MethodPost, "site.example", "/login", nil, url.Values{"user": {"alice"}, "password": {"alice-pass"}, "next": {"/cmd_form"}})
+	if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != "/cmd_form" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	cookies := resp.Result().Cookies()
+	// Signed-in visitor is not asked for the dummy basic authentication over plain HTTP
+	if resp := serve(http.MethodGet, "site.example", "/cmd_form", cookies, nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "<form") {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+
+	// Visitor stays signed in after configuration is reloaded
+	fresh := daemon
+	fresh.Sessions = session.Manager{
+		Endpoints: []string{"/cmd_form"},
+		Accounts:  map[string]session.LocalAccount{"alice": {Password: "new-pass"}},
+	}
+	if err := fresh.Reinitialise(&daemon); err != nil {
+		t.Fatal(err)
+	}
+	daemon.ReplaceHandlers(&fresh)
+	if resp := serve(http.MethodGet, "site.example", "/cmd_form", cookies, nil); resp.Code != http.StatusOK {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	// Unless the account is gone
+	fresh = daemon
+	fresh.Sessions = session.Manager{
+		Endpoints: []string{"/cmd_form"},
+		Accounts:  map[string]session.LocalAccount{"bob": {Password: "bob-pass"}},
+	}
+	if err := fresh.Reinitialise(&daemon); err != nil {
+		t.Fatal(err)
+	}
+	daemon.ReplaceHandlers(&fresh)
+	if resp := serve(http.MethodGet, "site.example", "/cmd_form", cookies, nil); resp.Code != http.StatusSeeOther {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+}
+
+// countingHandler greets visitors, and counts how many times its handler function has been constructed and stopped.
+type countingHandler struct {
+	Greeting string
+	made     *int
+	stopped  *int
+}
+
+func (counting *countingHandler) MakeHandler(_ global.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	*counting.made++
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(counting.Greeting))
+	}, nil
+}
+
+func (_ *countingHandler) GetRateLimitFactor() int {
+	return 1
+}
+
+func (counting *countingHandler) StopHandler() {
+	*counting.stopped++
+}
+
+func TestHTTPD_Reinitialise(t *testing.T) {
+	var made, stopped int
+	daemon := HTTPD{
+		Address:         "127.0.0.1",
+		Port:            12347,
+		BaseRateLimit:   10,
+		Processor:       common.GetTestCommandProcessor(),
+		SpecialHandlers: map[string]api.HandlerFactory{"/greet": &countingHandler{Greeting: "hi", made: &made, stopped: &stopped}},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	greet := func() string {
+		recorder := httptest.NewRecorder()
+		daemon.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/greet", nil))
+		return recorder.Body.String()
+	}
+	reload := func(greeting string, baseRateLimit int) error {
+		fresh := HTTPD{
+			Address:         "127.0.0.1",
+			Port:            12347,
+			BaseRateLimit:   baseRateLimit,
+			Processor:       common.GetTestCommandProcessor(),
+			SpecialHandlers: map[string]api.HandlerFactory{"/greet": &countingHandler{Greeting: greeting, made: &made, stopped: &stopped}},
+		}
+		if err := fresh.Reinitialise(&daemon); err != nil {
+			return err
+		}
+		daemon.ReplaceHandlers(&fresh)
+		return nil
+	}
+	if made != 1 || greet() != "hi" {
+		t.Fatal(made, greet())
+	}
+	// Handler of invalid configuration is not constructed
+	if err := reload("hello", 0); err == nil || made != 1 {
+		t.Fatal(err, made)
+	}
+	// Handler keeps running if its configuration did not change
+	if err := reload("hi", 20); err != nil || made != 1 || stopped != 0 || greet() != "hi" {
+		t.Fatal(err, made, stopped, greet())
+	}
+	if daemon.AllRateLimits["/greet"].MaxCount != 20 {
+		t.Fatal(daemon.AllRateLimits["/greet"].MaxCount)
+	}
+	// Handler is constructed again if its configuration changed, and the replaced handler is stopped.
+	if err := reload("hello", 20); err != nil || made != 2 || stopped != 1 || greet() != "hello" {
+		t.Fatal(err, made, stopped, greet())
+	}
+	// Stopping daemon stops its handlers
+	daemon.Stop()
+	if stopped != 2 {
+		t.Fatal(stopped)
+	}
+}
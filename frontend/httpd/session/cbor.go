@@ -0,0 +1,122 @@
+package session
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// cborMaxDepth limits nesting of arrays and maps, so that malicious input cannot exhaust the stack.
+const cborMaxDepth = 16
+
+// errCBORTruncated is returned when input ends before a data item is complete.
+var errCBORTruncated = errors.New("CBOR data is truncated")
+
+/*
+decodeCBOR decodes the first CBOR (RFC 7049) data item and returns the remainder of input. It understands only what
+WebAuthn uses: integers become int64, byte strings become []byte, text strings become string, arrays become
+[]interface{}, maps become map[interface{}]interface{}, and simple values become bool or nil. Floating point numbers,
+tags, and indefinite length items are not supported.
+*/
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+// decodeCBORItem decodes a data item at the nesting depth.
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("CBOR data is nested too deeply")
+	}
+	if len(data) < 1 {
+		return nil, nil, errCBORTruncated
+	}
+	majorType, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	// Decode the argument that follows initial byte
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(data) >= 1:
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	case info < 28:
+		return nil, nil, errCBORTruncated
+	default:
+		return nil, nil, errors.New("CBOR indefinite length item is not supported")
+	}
+	switch majorType {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, nil, errors.New("CBOR integer is too large")
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, nil, errors.New("CBOR integer is too large")
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		if majorType == 2 {
+			return data[:arg], data[arg:], nil
+		}
+		return string(data[:arg]), data[arg:], nil
+	case 4:
+		// Every item takes at least a byte, which bounds the length before allocating memory.
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		array := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var elem interface{}
+			var err error
+			if elem, data, err = decodeCBORItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			array = append(array, elem)
+		}
+		return array, data, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		dict := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			var err error
+			if key, data, err = decodeCBORItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			if value, data, err = decodeCBORItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			// WebAuthn uses only integer and text keys, other kinds of key may not even be usable in a Go map.
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("CBOR map key must be an integer or text")
+			}
+			dict[key] = value
+		}
+		return dict, data, nil
+	case 7:
+		switch arg {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		return nil, nil, errors.New("CBOR floating point number and simple value are not supported")
+	default:
+		return nil, nil, errors.New("CBOR tag is not supported")
+	}
+}
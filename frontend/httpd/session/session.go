@@ -0,0 +1,771 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
+	"github.com/HouzuoGuo/laitos/global"
+	"github.com/HouzuoGuo/laitos/oauth"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CookieName            = "laitos-session"    // CookieName is the name of cookie that carries session token.
+	OIDCStateCookieName   = "laitos-oidc-state" // OIDCStateCookieName is the name of cookie that binds a pending OIDC sign-in to the browser that began it.
+	DefaultLoginEndpoint  = "/login"            // DefaultLoginEndpoint is the default path of sign-in page and its sub-paths.
+	DefaultIdleTimeoutSec = 30 * 60             // DefaultIdleTimeoutSec is the default duration of inactivity after which a session ends.
+	DefaultMaxAgeSec      = 24 * 3600           // DefaultMaxAgeSec is the default duration after which a session ends regardless of activity.
+	ChallengeExpirySec    = 5 * 60              // ChallengeExpirySec is the duration in which a pending OIDC sign-in or security key challenge must complete.
+	MaxPendingChallenges  = 1000                // MaxPendingChallenges limits the number of sign-ins in progress, to protect memory from being exhausted.
+	MaxRequestBodyBytes   = 64 * 1024           // MaxRequestBodyBytes limits the size of security key requests.
+
+	MethodPassword = "password" // MethodPassword signs in a local account by password and optional TOTP code.
+	MethodWebAuthn = "webauthn" // MethodWebAuthn signs in a local account by a registered security key.
+	MethodOIDC     = "oidc"     // MethodOIDC signs in a user whose verified email is allowed, via external OpenID Connect provider.
+
+	challengeOIDC             = "oidc"              // challengeOIDC is a pending OIDC sign-in, keyed by state.
+	challengeWebAuthnLogin    = "webauthn-login"    // challengeWebAuthnLogin is a pending security key sign-in.
+	challengeWebAuthnRegister = "webauthn-register" // challengeWebAuthnRegister is a pending security key registration.
+)
+
+// ErrSignInFailed is the generic sign-in failure shown to visitor, which deliberately reveals no detail.
+var ErrSignInFailed = errors.New("incorrect user name, password, code, or security key")
+
+// LocalAccount is a user who signs in by password (and TOTP code) or security key, without an external provider.
+type LocalAccount struct {
+	Password            string               `json:"Password"`            // (Optional) sign in by this password, along with a TOTP code if TOTPSecret is present.
+	TOTPSecret          string               `json:"TOTPSecret"`          // (Optional) base32 secret shared with authenticator app, such as Google Authenticator.
+	WebAuthnCredentials []WebAuthnCredential `json:"WebAuthnCredentials"` // (Optional) sign in by these security keys, which are registered on the sign-in page.
+}
+
+// session is a signed-in visitor.
+type session struct {
+	user     string // user is the local account name, or verified email of OIDC user.
+	method   string // method is the way user signed in.
+	created  time.Time
+	lastSeen time.Time
+}
+
+// challenge is a sign-in or security key registration that is in progress.
+type challenge struct {
+	kind   string
+	user   string // user is the local account name, OIDC sign-in does not know it in advance.
+	secret []byte // secret is the OIDC nonce or security key challenge.
+	next   string // next is the path to visit after signing in.
+	expiry time.Time
+}
+
+/*
+Manager is the session-based authentication layer of HTTP daemon. Visitors sign in via local accounts with optional
+TOTP, security keys (WebAuthn), or an external OpenID Connect provider, and receive a cookie bound to a session kept in
+memory. Specialised handlers listed in Endpoints may only be visited by signed-in visitors.
+*/
+type Manager struct {
+	Endpoints         []string                `json:"Endpoints"`         // Paths of specialised handlers that require visitor to sign in
+	LoginEndpoint     string                  `json:"LoginEndpoint"`     // (Optional) path of sign-in page, by default "/login".
+	PublicURL         string                  `json:"PublicURL"`         // (Optional) URL of the server as visitors see it, e.g. "https://example.com", it is mandatory for OIDC and security keys.
+	IdleTimeoutSec    int                     `json:"IdleTimeoutSec"`    // (Optional) session ends after this many seconds of inactivity, by default 30 minutes.
+	MaxAgeSec         int                     `json:"MaxAgeSec"`         // (Optional) session ends after this many seconds regardless of activity, by default 24 hours.
+	Accounts          map[string]LocalAccount `json:"Accounts"`          // (Optional) local accounts keyed by user name
+	OIDC              oauth.OIDCProvider      `json:"OIDC"`              // (Optional) sign in via this OpenID Connect provider
+	OIDCAllowedEmails []string                `json:"OIDCAllowedEmails"` // (Optional) verified email addresses that may sign in via OIDC provider
+
+	Bans   *env.BanManager `json:"-"` // (Optional) ban clients who fail to sign in too many times
+	logger global.Logger
+
+	endpoints     map[string]struct{}             // endpoints is the set of Endpoints.
+	sessions      map[string]*session             // sessions are the signed-in visitors keyed by cookie token.
+	challenges    map[string]*challenge           // challenges are the sign-ins in progress keyed by random ID.
+	totpSteps     map[string]int64                // totpSteps are the latest TOTP steps used by each account, a code may not be used twice.
+	signCounts    map[string]uint32               // signCounts are the latest signature counters of security keys, keyed by credential ID.
+	registrations map[string][]WebAuthnCredential // registrations are the security keys registered since start-up, keyed by account name.
+	rpID          string                          // rpID is the host name of PublicURL, WebAuthn uses it as relying party ID.
+	origin        string                          // origin is the scheme and host of PublicURL.
+	mutex         *sync.Mutex
+}
+
+// IsEnabled returns true if any endpoint requires visitors to sign in.
+func (mgr *Manager) IsEnabled() bool {
+	return len(mgr.Endpoints) > 0
+}
+
+// Initialise checks configuration, prepares session store, and discovers OIDC provider configuration.
+func (mgr *Manager) Initialise(logger global.Logger, bans *env.BanManager) error {
+	mgr.logger = logger
+	mgr.Bans = bans
+	if mgr.LoginEndpoint == "" {
+		mgr.LoginEndpoint = DefaultLoginEndpoint
+	}
+	mgr.LoginEndpoint = "/" + strings.Trim(mgr.LoginEndpoint, "/")
+	if mgr.IdleTimeoutSec < 1 {
+		mgr.IdleTimeoutSec = DefaultIdleTimeoutSec
+	}
+	if mgr.MaxAgeSec < 1 {
+		mgr.MaxAgeSec = DefaultMaxAgeSec
+	}
+	mgr.endpoints = make(map[string]struct{})
+	for _, endpoint := range mgr.Endpoints {
+		if endpoint == mgr.LoginEndpoint {
+			return errors.New("Manager.Initialise: login endpoint may not require signing in")
+		}
+		mgr.endpoints[endpoint] = struct{}{}
+	}
+	if mgr.PublicURL != "" {
+		publicURL, err := url.Parse(mgr.PublicURL)
+		if err != nil || publicURL.Host == "" || (publicURL.Scheme != "https" && publicURL.Scheme != "http") {
+			return fmt.Errorf("Manager.Initialise: PublicURL \"%s\" must be an http(s) URL", mgr.PublicURL)
+		}
+		mgr.PublicURL = strings.TrimSuffix(mgr.PublicURL, "/")
+		mgr.rpID = publicURL.Hostname()
+		mgr.origin = publicURL.Scheme + "://" + publicURL.Host
+	}
+	if len(mgr.Accounts) == 0 && mgr.OIDC.Issuer == "" {
+		return errors.New("Manager.Initialise: there must be a local account or an OIDC provider")
+	}
+	for name, account := range mgr.Accounts {
+		if name == "" || (account.Password == "" && len(account.WebAuthnCredentials) == 0) {
+			return fmt.Errorf("Manager.Initialise: account \"%s\" must have a name, and a password or security key", name)
+		}
+		if account.TOTPSecret != "" {
+			if _, err := decodeTOTPSecret(account.TOTPSecret); err != nil {
+				return fmt.Errorf("Manager.Initialise: TOTP secret of account \"%s\" is not base32 - %v", name, err)
+			}
+		}
+		if len(account.WebAuthnCredentials) > 0 && mgr.PublicURL == "" {
+			return errors.New("Manager.Initialise: PublicURL is mandatory for security keys")
+		}
+	}
+	if mgr.OIDC.Issuer != "" {
+		if mgr.PublicURL == "" || len(mgr.OIDCAllowedEmails) == 0 {
+			return errors.New("Manager.Initialise: PublicURL and OIDCAllowedEmails are mandatory for OIDC provider")
+		}
+		if err := mgr.OIDC.Initialise(); err != nil {
+			return fmt.Errorf("Manager.Initialise: %v", err)
+		}
+	}
+	mgr.sessions = make(map[string]*session)
+	mgr.challenges = make(map[string]*challenge)
+	mgr.totpSteps = make(map[string]int64)
+	mgr.signCounts = make(map[string]uint32)
+	mgr.registrations = make(map[string][]WebAuthnCredential)
+	mgr.mutex = new(sync.Mutex)
+	return nil
+}
+
+// IsRequired returns true if visitors must sign in to visit the specialised handler at the path.
+func (mgr *Manager) IsRequired(urlLocation string) bool {
+	_, required := mgr.endpoints[urlLocation]
+	return required
+}
+
+/*
+TakeOver carries signed-in sessions, registered security keys, and used one-time passwords over from the manager of
+previous configuration, so that visitors stay signed in after configuration is reloaded. Sessions of users who are no
+longer allowed to sign in are dropped.
+*/
+func (mgr *Manager) TakeOver(old *Manager) {
+	if mgr.mutex == nil || old.mutex == nil || mgr.mutex == old.mutex {
+		return
+	}
+	old.mutex.Lock()
+	defer old.mutex.Unlock()
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	for token, sess := range old.sessions {
+		if mgr.isAllowed(sess.user, sess.method) {
+			mgr.sessions[token] = sess
+		}
+	}
+	for name, creds := range old.registrations {
+		if _, exists := mgr.Accounts[name]; exists {
+			mgr.registrations[name] = creds
+		}
+	}
+	for name, step := range old.totpSteps {
+		mgr.totpSteps[name] = step
+	}
+	for id, count := range old.signCounts {
+		mgr.signCounts[id] = count
+	}
+}
+
+// isAllowed returns true if the user may sign in via the method under current configuration.
+func (mgr *Manager) isAllowed(user, method string) bool {
+	switch method {
+	case MethodPassword, MethodWebAuthn:
+		_, exists := mgr.Accounts[user]
+		return exists
+	case MethodOIDC:
+		if mgr.OIDC.Issuer == "" {
+			return false
+		}
+		for _, email := range mgr.OIDCAllowedEmails {
+			if strings.EqualFold(email, user) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// randomID returns a random hex string that is impossible to guess.
+func randomID() string {
+	idBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(idBytes)
+}
+
+// getSession returns the valid session of the request and refreshes its activity time, or nil if there is none.
+func (mgr *Manager) getSession(r *http.Request) (token string, sess *session) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil || cookie.Value == "" {
+		return "", nil
+	}
+	now := time.Now()
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	sess, found := mgr.sessions[cookie.Value]
+	if !found {
+		return "", nil
+	}
+	if now.Sub(sess.lastSeen) > time.Duration(mgr.IdleTimeoutSec)*time.Second || now.Sub(sess.created) > time.Duration(mgr.MaxAgeSec)*time.Second {
+		delete(mgr.sessions, cookie.Value)
+		return "", nil
+	}
+	sess.lastSeen = now
+	return cookie.Value, sess
+}
+
+// forgetExpired removes expired sessions and challenges. Caller must hold the mutex.
+func (mgr *Manager) forgetExpired(now time.Time) {
+	for token, sess := range mgr.sessions {
+		if now.Sub(sess.lastSeen) > time.Duration(mgr.IdleTimeoutSec)*time.Second || now.Sub(sess.created) > time.Duration(mgr.MaxAgeSec)*time.Second {
+			delete(mgr.sessions, token)
+		}
+	}
+	for id, chal := range mgr.challenges {
+		if now.After(chal.expiry) {
+			delete(mgr.challenges, id)
+		}
+	}
+}
+
+// isSecure returns true if cookies should only travel over HTTPS.
+func (mgr *Manager) isSecure(r *http.Request) bool {
+	return r.TLS != nil || strings.HasPrefix(mgr.PublicURL, "https://")
+}
+
+// startSession signs the user in, replacing the request's previous session, and sets the session cookie.
+func (mgr *Manager) startSession(w http.ResponseWriter, r *http.Request, user, method string) {
+	now := time.Now()
+	token := randomID()
+	oldToken, _ := mgr.getSession(r)
+	mgr.mutex.Lock()
+	mgr.forgetExpired(now)
+	delete(mgr.sessions, oldToken)
+	mgr.sessions[token] = &session{user: user, method: method, created: now, lastSeen: now}
+	mgr.mutex.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   mgr.MaxAgeSec,
+		Secure:   mgr.isSecure(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	mgr.logger.Printf("startSession", api.GetRealClientIP(r), nil, "%s signed in via %s", user, method)
+}
+
+// addChallenge remembers a sign-in in progress under the ID, it fails if too many sign-ins are in progress.
+func (mgr *Manager) addChallenge(id string, chal *challenge) error {
+	now := time.Now()
+	chal.expiry = now.Add(ChallengeExpirySec * time.Second)
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	if len(mgr.challenges) >= MaxPendingChallenges {
+		mgr.forgetExpired(now)
+		if len(mgr.challenges) >= MaxPendingChallenges {
+			return errors.New("too many sign-ins are in progress, please try again later")
+		}
+	}
+	mgr.challenges[id] = chal
+	return nil
+}
+
+// takeChallenge removes and returns the unexpired challenge of the ID and kind, or nil if there is none.
+func (mgr *Manager) takeChallenge(id, kind string) *challenge {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	chal, found := mgr.challenges[id]
+	if !found {
+		return nil
+	}
+	delete(mgr.challenges, id)
+	if chal.kind != kind || time.Now().After(chal.expiry) {
+		return nil
+	}
+	return chal
+}
+
+// Require wraps the handler so that only signed-in visitors may reach it, others are asked to sign in.
+func (mgr *Manager) Require(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, sess := mgr.getSession(r); sess != nil {
+			next(w, api.WithSessionUser(r, sess.user))
+			return
+		}
+		api.NoCache(w)
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			http.Redirect(w, r, mgr.LoginEndpoint+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		} else {
+			http.Error(w, "Please sign in at "+mgr.LoginEndpoint, http.StatusUnauthorized)
+		}
+	}
+}
+
+// safeNext returns the path to visit after signing in, only paths on this server are allowed.
+func (mgr *Manager) safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return mgr.LoginEndpoint
+	}
+	return next
+}
+
+// getCredentials returns the configured and newly registered security keys of the account.
+func (mgr *Manager) getCredentials(user string) []WebAuthnCredential {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	return append(append([]WebAuthnCredential{}, mgr.Accounts[user].WebAuthnCredentials...), mgr.registrations[user]...)
+}
+
+// signInFailed counts the failure toward client's ban and logs the reason, which is not revealed to visitor.
+func (mgr *Manager) signInFailed(clientIP, user string, reason error) {
+	mgr.Bans.AddFailure(clientIP)
+	mgr.logger.Warningf("SignIn", clientIP, reason, "failed to sign in as \"%s\"", user)
+}
+
+// signInByPassword checks the account password and TOTP code.
+func (mgr *Manager) signInByPassword(user, password, code string) error {
+	account, exists := mgr.Accounts[user]
+	if !exists || account.Password == "" || subtle.ConstantTimeCompare([]byte(password), []byte(account.Password)) != 1 {
+		return errors.New("incorrect user name or password")
+	}
+	if account.TOTPSecret == "" {
+		return nil
+	}
+	step := VerifyTOTP(account.TOTPSecret, strings.TrimSpace(code), time.Now())
+	if step == 0 {
+		return errors.New("incorrect TOTP code")
+	}
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	if step <= mgr.totpSteps[user] {
+		return errors.New("TOTP code has been used already")
+	}
+	mgr.totpSteps[user] = step
+	return nil
+}
+
+// webAuthnRequest is the JSON request body sent by sign-in page scripts.
+type webAuthnRequest struct {
+	User              string `json:"User"`
+	Next              string `json:"Next"`
+	ChallengeID       string `json:"ChallengeID"`
+	CredentialID      string `json:"CredentialID"`
+	ClientDataJSON    string `json:"ClientDataJSON"`
+	AuthenticatorData string `json:"AuthenticatorData"`
+	Signature         string `json:"Signature"`
+	AttestationObject string `json:"AttestationObject"`
+}
+
+// webAuthnOptions is the JSON response that tells sign-in page scripts how to call the security key.
+type webAuthnOptions struct {
+	ChallengeID   string   `json:"ChallengeID"`
+	Challenge     string   `json:"Challenge"`
+	RPID          string   `json:"RPID"`
+	User          string   `json:"User,omitempty"`
+	UserID        string   `json:"UserID,omitempty"`
+	CredentialIDs []string `json:"CredentialIDs"`
+	Redirect      string   `json:"Redirect,omitempty"`
+}
+
+// writeJSON responds with the status code and JSON value.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// beginWebAuthn creates a security key challenge for signing in or registration.
+func (mgr *Manager) beginWebAuthn(kind, user, next string) (webAuthnOptions, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return webAuthnOptions{}, err
+	}
+	opts := webAuthnOptions{ChallengeID: randomID(), Challenge: base64.RawURLEncoding.EncodeToString(secret), RPID: mgr.rpID, CredentialIDs: []string{}}
+	for _, cred := range mgr.getCredentials(user) {
+		opts.CredentialIDs = append(opts.CredentialIDs, cred.ID)
+	}
+	if kind == challengeWebAuthnRegister {
+		userID := sha256.Sum256([]byte(user))
+		opts.User = user
+		opts.UserID = base64.RawURLEncoding.EncodeToString(userID[:16])
+	}
+	return opts, mgr.addChallenge(opts.ChallengeID, &challenge{kind: kind, user: user, secret: secret, next: next})
+}
+
+// finishWebAuthnLogin verifies the security key assertion and returns the account name and path to visit.
+func (mgr *Manager) finishWebAuthnLogin(req webAuthnRequest) (user, next string, err error) {
+	chal := mgr.takeChallenge(req.ChallengeID, challengeWebAuthnLogin)
+	if chal == nil {
+		return "", "", errors.New("security key challenge has expired")
+	}
+	clientDataJSON, err1 := base64.RawURLEncoding.DecodeString(req.ClientDataJSON)
+	authData, err2 := base64.RawURLEncoding.DecodeString(req.AuthenticatorData)
+	signature, err3 := base64.RawURLEncoding.DecodeString(req.Signature)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return chal.user, "", errors.New("malformed security key response")
+	}
+	for _, cred := range mgr.getCredentials(chal.user) {
+		if cred.ID != req.CredentialID {
+			continue
+		}
+		signCount, err := verifyWebAuthnAssertion(cred, clientDataJSON, authData, signature, chal.secret, mgr.rpID, mgr.origin)
+		if err != nil {
+			return chal.user, "", err
+		}
+		// A counter that does not increase suggests the security key has been cloned
+		mgr.mutex.Lock()
+		defer mgr.mutex.Unlock()
+		if signCount != 0 && signCount <= mgr.signCounts[cred.ID] {
+			return chal.user, "", errors.New("signature counter did not increase")
+		}
+		mgr.signCounts[cred.ID] = signCount
+		return chal.user, chal.next, nil
+	}
+	return chal.user, "", errors.New("security key is not registered to the account")
+}
+
+// finishWebAuthnRegistration verifies the new security key and registers it to the account until restart.
+func (mgr *Manager) finishWebAuthnRegistration(req webAuthnRequest, user string) (WebAuthnCredential, error) {
+	chal := mgr.takeChallenge(req.ChallengeID, challengeWebAuthnRegister)
+	if chal == nil || chal.user != user {
+		return WebAuthnCredential{}, errors.New("security key challenge has expired")
+	}
+	clientDataJSON, err1 := base64.RawURLEncoding.DecodeString(req.ClientDataJSON)
+	attestationObject, err2 := base64.RawURLEncoding.DecodeString(req.AttestationObject)
+	if err1 != nil || err2 != nil {
+		return WebAuthnCredential{}, errors.New("malformed security key response")
+	}
+	cred, err := verifyWebAuthnRegistration(clientDataJSON, attestationObject, chal.secret, mgr.rpID, mgr.origin)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	mgr.mutex.Lock()
+	mgr.registrations[user] = append(mgr.registrations[user], cred)
+	mgr.mutex.Unlock()
+	return cred, nil
+}
+
+// oidcRedirectURL is the URL that OIDC provider returns visitor to, it must be registered with the provider.
+func (mgr *Manager) oidcRedirectURL() string {
+	return mgr.PublicURL + mgr.LoginEndpoint + "/oidc/callback"
+}
+
+// beginOIDC redirects visitor to OIDC provider, and binds the pending sign-in to the browser via a cookie.
+func (mgr *Manager) beginOIDC(w http.ResponseWriter, r *http.Request) {
+	state, nonce := randomID(), randomID()
+	if err := mgr.addChallenge(state, &challenge{kind: challengeOIDC, secret: []byte(nonce), next: mgr.safeNext(r.FormValue("next"))}); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCStateCookieName,
+		Value:    state,
+		Path:     mgr.LoginEndpoint,
+		MaxAge:   ChallengeExpirySec,
+		Secure:   mgr.isSecure(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, mgr.OIDC.AuthCodeURL(mgr.oidcRedirectURL(), state, nonce), http.StatusFound)
+}
+
+// finishOIDC redeems the authorization code and returns the verified email and path to visit.
+func (mgr *Manager) finishOIDC(r *http.Request) (email, next string, err error) {
+	if errCode := r.FormValue("error"); errCode != "" {
+		return "", "", fmt.Errorf("provider refused to sign in - %s", errCode)
+	}
+	state := r.FormValue("state")
+	cookie, cookieErr := r.Cookie(OIDCStateCookieName)
+	if cookieErr != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return "", "", errors.New("state does not match the browser that began signing in")
+	}
+	chal := mgr.takeChallenge(state, challengeOIDC)
+	if chal == nil {
+		return "", "", errors.New("sign-in has expired")
+	}
+	idToken, err := mgr.OIDC.Exchange(mgr.oidcRedirectURL(), r.FormValue("code"), string(chal.secret))
+	if err != nil {
+		return "", "", err
+	}
+	if !idToken.EmailVerified || !mgr.isAllowed(idToken.Email, MethodOIDC) {
+		return idToken.Email, "", fmt.Errorf("email \"%s\" of subject %s is not verified or not allowed", idToken.Email, idToken.Subject)
+	}
+	return strings.ToLower(idToken.Email), chal.next, nil
+}
+
+func (mgr *Manager) MakeHandler(logger global.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	if mgr.mutex == nil {
+		return nil, errors.New("Manager.MakeHandler: manager must be initialised first")
+	}
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		api.NoCache(w)
+		clientIP := api.GetRealClientIP(r)
+		action := strings.Trim(strings.TrimPrefix(r.URL.Path, mgr.LoginEndpoint), "/")
+		// Security key requests carry JSON
+		var req webAuthnRequest
+		if strings.HasPrefix(action, "webauthn/") {
+			if r.Method != http.MethodPost || mgr.PublicURL == "" {
+				http.Error(w, "", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodyBytes)).Decode(&req); err != nil {
+				http.Error(w, "malformed request", http.StatusBadRequest)
+				return
+			}
+		}
+		_, sess := mgr.getSession(r)
+		switch action {
+		case "":
+			if r.Method != http.MethodPost {
+				mgr.writePage(w, r, sess, "")
+				return
+			}
+			user := r.FormValue("user")
+			if mgr.Bans.IsBanned(clientIP) {
+				mgr.writePage(w, r, sess, ErrSignInFailed.Error())
+				return
+			}
+			if err := mgr.signInByPassword(user, r.FormValue("password"), r.FormValue("code")); err != nil {
+				mgr.signInFailed(clientIP, user, err)
+				mgr.writePage(w, r, sess, ErrSignInFailed.Error())
+				return
+			}
+			mgr.startSession(w, r, user, MethodPassword)
+			http.Redirect(w, r, mgr.safeNext(r.FormValue("next")), http.StatusSeeOther)
+		case "logout":
+			if token, _ := mgr.getSession(r); token != "" {
+				mgr.mutex.Lock()
+				delete(mgr.sessions, token)
+				mgr.mutex.Unlock()
+			}
+			http.SetCookie(w, &http.Cookie{Name: CookieName, Value: "", Path: "/", MaxAge: -1, Secure: mgr.isSecure(r), HttpOnly: true})
+			http.Redirect(w, r, mgr.LoginEndpoint, http.StatusSeeOther)
+		case "oidc":
+			if mgr.OIDC.Issuer == "" || mgr.Bans.IsBanned(clientIP) {
+				http.Error(w, "", http.StatusNotFound)
+				return
+			}
+			mgr.beginOIDC(w, r)
+		case "oidc/callback":
+			if mgr.OIDC.Issuer == "" {
+				http.Error(w, "", http.StatusNotFound)
+				return
+			}
+			email, next, err := mgr.finishOIDC(r)
+			if err != nil {
+				mgr.signInFailed(clientIP, email, err)
+				mgr.writePage(w, r, sess, ErrSignInFailed.Error())
+				return
+			}
+			mgr.startSession(w, r, email, MethodOIDC)
+			http.Redirect(w, r, next, http.StatusSeeOther)
+		case "webauthn/begin":
+			if mgr.Bans.IsBanned(clientIP) || len(mgr.getCredentials(req.User)) == 0 {
+				http.Error(w, ErrSignInFailed.Error(), http.StatusUnauthorized)
+				return
+			}
+			opts, err := mgr.beginWebAuthn(challengeWebAuthnLogin, req.User, mgr.safeNext(req.Next))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			writeJSON(w, http.StatusOK, opts)
+		case "webauthn/finish":
+			user, next, err := mgr.finishWebAuthnLogin(req)
+			if err != nil {
+				mgr.signInFailed(clientIP, user, err)
+				http.Error(w, ErrSignInFailed.Error(), http.StatusUnauthorized)
+				return
+			}
+			mgr.startSession(w, r, user, MethodWebAuthn)
+			writeJSON(w, http.StatusOK, webAuthnOptions{Redirect: next})
+		case "webauthn/register-begin", "webauthn/register-finish":
+			// Only a local account that has signed in may register a security key for itself
+			if sess == nil || sess.method == MethodOIDC {
+				http.Error(w, "Please sign in to a local account first", http.StatusUnauthorized)
+				return
+			}
+			if action == "webauthn/register-begin" {
+				opts, err := mgr.beginWebAuthn(challengeWebAuthnRegister, sess.user, "")
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					return
+				}
+				writeJSON(w, http.StatusOK, opts)
+				return
+			}
+			cred, err := mgr.finishWebAuthnRegistration(req, sess.user)
+			if err != nil {
+				mgr.logger.Warningf("RegisterSecurityKey", clientIP, err, "failed to register security key of \"%s\"", sess.user)
+				http.Error(w, "Failed to register security key", http.StatusBadRequest)
+				return
+			}
+			mgr.logger.Printf("RegisterSecurityKey", clientIP, nil, "registered security key %s of \"%s\"", cred.ID, sess.user)
+			writeJSON(w, http.StatusOK, cred)
+		default:
+			http.Error(w, "", http.StatusNotFound)
+		}
+	}
+	return fun, nil
+}
+
+func (_ *Manager) GetRateLimitFactor() int {
+	return 1
+}
+
+// loginPage is the sign-in page. It uses script only for security keys, which are not usable without script anyway.
+const loginPage = `<!doctype html>
+<html>
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1" />
+    <title>Sign in</title>
+    <script type="text/javascript">
+    var loginEndpoint = %s, nextPath = %s;
+    function b64u(buf) {
+        return btoa(String.fromCharCode.apply(null, new Uint8Array(buf))).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    }
+    function unb64u(str) {
+        str = str.replace(/-/g, '+').replace(/_/g, '/');
+        while (str.length %% 4) {
+            str += '=';
+        }
+        return Uint8Array.from(atob(str), function (c) { return c.charCodeAt(0); });
+    }
+    function post(action, body) {
+        return fetch(loginEndpoint + '/' + action, {method: 'POST', credentials: 'same-origin', headers: {'Content-Type': 'application/json'}, body: JSON.stringify(body)}).then(function (resp) {
+            if (!resp.ok) {
+                return resp.text().then(function (text) { throw new Error(text); });
+            }
+            return resp.json();
+        });
+    }
+    function showMessage(msg) {
+        document.getElementById('message').textContent = msg;
+    }
+    function signInByKey() {
+        post('webauthn/begin', {User: document.getElementById('user').value, Next: nextPath}).then(function (opts) {
+            return navigator.credentials.get({publicKey: {
+                challenge: unb64u(opts.Challenge),
+                rpId: opts.RPID,
+                allowCredentials: opts.CredentialIDs.map(function (id) { return {type: 'public-key', id: unb64u(id)}; }),
+                userVerification: 'discouraged',
+                timeout: 60000
+            }}).then(function (cred) {
+                return post('webauthn/finish', {
+                    ChallengeID: opts.ChallengeID,
+                    CredentialID: b64u(cred.rawId),
+                    ClientDataJSON: b64u(cred.response.clientDataJSON),
+                    AuthenticatorData: b64u(cred.response.authenticatorData),
+                    Signature: b64u(cred.response.signature)
+                });
+            });
+        }).then(function (result) { location.href = result.Redirect; }).catch(function (err) { showMessage(err.message); });
+    }
+    function registerKey() {
+        post('webauthn/register-begin', {}).then(function (opts) {
+            return navigator.credentials.create({publicKey: {
+                challenge: unb64u(opts.Challenge),
+                rp: {id: opts.RPID, name: 'laitos'},
+                user: {id: unb64u(opts.UserID), name: opts.User, displayName: opts.User},
+                pubKeyCredParams: [{type: 'public-key', alg: -7}],
+                excludeCredentials: opts.CredentialIDs.map(function (id) { return {type: 'public-key', id: unb64u(id)}; }),
+                attestation: 'none',
+                timeout: 60000
+            }}).then(function (cred) {
+                return post('webauthn/register-finish', {
+                    ChallengeID: opts.ChallengeID,
+                    ClientDataJSON: b64u(cred.response.clientDataJSON),
+                    AttestationObject: b64u(cred.response.attestationObject)
+                });
+            });
+        }).then(function (cred) {
+            showMessage('The security key works until restart. To keep it, add this to WebAuthnCredentials of your account: ' + JSON.stringify(cred));
+        }).catch(function (err) { showMessage(err.message); });
+    }
+    </script>
+</head>
+<body>
+<p id="message">%s</p>
+%s
+</body>
+</html>
+`
+
+// writePage writes the sign-in page, or the signed-in status if visitor has a session.
+func (mgr *Manager) writePage(w http.ResponseWriter, r *http.Request, sess *session, message string) {
+	next := mgr.safeNext(r.FormValue("next"))
+	var body string
+	escapedNext := html.EscapeString(next)
+	if sess != nil {
+		body = fmt.Sprintf(`<p>Signed in as %s.</p>
+<form action="%s/logout" method="post"><input type="submit" value="Sign out" /></form>
+`, html.EscapeString(sess.user), html.EscapeString(mgr.LoginEndpoint))
+		if sess.method != MethodOIDC && mgr.PublicURL != "" {
+			body += `<p><button type="button" onclick="registerKey()">Register a security key</button></p>` + "\n"
+		}
+	} else {
+		if len(mgr.Accounts) > 0 {
+			body = fmt.Sprintf(`<form action="%s" method="post">
+    <input type="hidden" name="next" value="%s" />
+    <p>User: <input type="text" id="user" name="user" autocomplete="username" /></p>
+    <p>Password: <input type="password" name="password" autocomplete="current-password" /></p>
+    <p>Code (if enabled): <input type="text" name="code" inputmode="numeric" autocomplete="one-time-code" /></p>
+    <p><input type="submit" value="Sign in" />`, html.EscapeString(mgr.LoginEndpoint), escapedNext)
+			if mgr.PublicURL != "" {
+				body += ` <button type="button" onclick="signInByKey()">Sign in with security key</button>`
+			}
+			body += "</p>\n</form>\n"
+		}
+		if mgr.OIDC.Issuer != "" {
+			body += fmt.Sprintf(`<p><a href="%s/oidc?next=%s">Sign in via %s</a></p>`+"\n",
+				html.EscapeString(mgr.LoginEndpoint), html.EscapeString(url.QueryEscape(next)), html.EscapeString(mgr.OIDC.Issuer))
+		}
+	}
+	// JSON encoder escapes HTML special characters, which makes the strings safe to be placed in script.
+	jsLoginEndpoint, _ := json.Marshal(mgr.LoginEndpoint)
+	jsNext, _ := json.Marshal(next)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if message != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	w.Write([]byte(fmt.Sprintf(loginPage, jsLoginEndpoint, jsNext, html.EscapeString(message), body)))
+}
@@ -0,0 +1,479 @@
+package session
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
+	"github.com/HouzuoGuo/laitos/global"
+	"github.com/HouzuoGuo/laitos/oauth"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the base32 encoding of the SHA-1 secret used in test vectors of RFC 6238.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTP(t *testing.T) {
+	for unixSec, expected := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if code, err := TOTPCode(rfc6238Secret, time.Unix(unixSec, 0)); err != nil || code != expected {
+			t.Fatal(unixSec, code, err)
+		}
+	}
+	if _, err := TOTPCode("not base32!", time.Now()); err == nil {
+		t.Fatal("did not error")
+	}
+	// Lower case, spaces, and padding are tolerated
+	if code, _ := TOTPCode("gezd gnbv gy3t qojq gezd gnbv gy3t qojq====", time.Unix(59, 0)); code != "287082" {
+		t.Fatal(code)
+	}
+	// Codes of adjacent steps are accepted
+	at := time.Unix(1234567890, 0)
+	if step := VerifyTOTP(rfc6238Secret, "005924", at); step != 1234567890/TOTPStepSec {
+		t.Fatal(step)
+	}
+	if step := VerifyTOTP(rfc6238Secret, "005924", at.Add(TOTPStepSec*time.Second)); step != 1234567890/TOTPStepSec {
+		t.Fatal(step)
+	}
+	if step := VerifyTOTP(rfc6238Secret, "005924", at.Add(3*TOTPStepSec*time.Second)); step != 0 {
+		t.Fatal(step)
+	}
+	if step := VerifyTOTP(rfc6238Secret, "5924", at); step != 0 {
+		t.Fatal(step)
+	}
+}
+
+// cborHead encodes the initial byte and argument of a CBOR data item.
+func cborHead(majorType byte, arg int) []byte {
+	if arg < 24 {
+		return []byte{majorType<<5 | byte(arg)}
+	}
+	ret := []byte{majorType<<5 | 25, 0, 0}
+	binary.BigEndian.PutUint16(ret[1:], uint16(arg))
+	return ret
+}
+
+// encodeCBOR encodes integers, byte strings, text, and maps (given as alternating keys and values) into CBOR.
+func encodeCBOR(value interface{}) []byte {
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, -1-v)
+		}
+		return cborHead(0, v)
+	case []byte:
+		return append(cborHead(2, len(v)), v...)
+	case string:
+		return append(cborHead(3, len(v)), v...)
+	case []interface{}:
+		ret := cborHead(5, len(v)/2)
+		for _, elem := range v {
+			ret = append(ret, encodeCBOR(elem)...)
+		}
+		return ret
+	}
+	panic(fmt.Sprintf("cannot encode %v", value))
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	for _, data := range []string{"", "18", "19ff", "43aabb", "62", "a1", "81", "a18101", "f97e00", "c0", "5f", "1bffffffffffffffff"} {
+		raw, _ := hex.DecodeString(data)
+		if value, _, err := decodeCBOR(raw); err == nil {
+			t.Fatal(data, value)
+		}
+	}
+	// Deeply nested array
+	if _, _, err := decodeCBOR(bytes.Repeat([]byte{0x81}, 100)); err == nil {
+		t.Fatal("did not error")
+	}
+	encoded := encodeCBOR([]interface{}{1, 2, 3, -7, -1, []byte{9}, "name", "value"})
+	encoded = append(encoded, 0xf5)
+	value, rest, err := decodeCBOR(encoded)
+	if err != nil || !bytes.Equal(rest, []byte{0xf5}) {
+		t.Fatal(err, rest)
+	}
+	dict := value.(map[interface{}]interface{})
+	if dict[int64(1)] != int64(2) || dict[int64(3)] != int64(-7) || !bytes.Equal(dict[int64(-1)].([]byte), []byte{9}) || dict["name"] != "value" {
+		t.Fatal(dict)
+	}
+	if value, _, err := decodeCBOR([]byte{0x83, 0x01, 0xf4, 0x19, 0x01, 0x00}); err != nil || fmt.Sprint(value) != "[1 false 256]" {
+		t.Fatal(value, err)
+	}
+}
+
+// testServer serves sign-in pages and a protected page that greets the signed-in user.
+type testServer struct {
+	*httptest.Server
+	mgr    *Manager
+	client *http.Client
+}
+
+// newTestServer starts a server for the manager, its client keeps cookies but does not follow redirects.
+func newTestServer(t *testing.T, mgr *Manager) *testServer {
+	mux := http.NewServeMux()
+	server := &testServer{Server: httptest.NewServer(mux), mgr: mgr}
+	if mgr.PublicURL == "" {
+		mgr.PublicURL = server.URL
+	}
+	mgr.Endpoints = []string{"/secret"}
+	if err := mgr.Initialise(global.Logger{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	fun, err := mgr.MakeHandler(global.Logger{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.HandleFunc(mgr.LoginEndpoint, fun)
+	mux.HandleFunc(mgr.LoginEndpoint+"/", fun)
+	mux.HandleFunc("/secret", mgr.Require(func(w http.ResponseWriter, r *http.Request) {
+		if !api.WarnIfNoHTTPS(r, w) {
+			return
+		}
+		w.Write([]byte("hello " + api.GetSessionUser(r)))
+	}))
+	jar, _ := cookiejar.New(nil)
+	server.client = &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	return server
+}
+
+// do sends a request and returns the response status, location, and body.
+func (server *testServer) do(t *testing.T, method, path, contentType string, body string) (int, string, string) {
+	target := path
+	if strings.HasPrefix(path, "/") {
+		target = server.URL + path
+	}
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := server.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("Location"), string(respBody)
+}
+
+// signIn signs in by password and code, and returns the response status and location.
+func (server *testServer) signIn(t *testing.T, user, password, code, next string) (int, string) {
+	status, location, _ := server.do(t, http.MethodPost, "/login", "application/x-www-form-urlencoded",
+		url.Values{"user": {user}, "password": {password}, "code": {code}, "next": {next}}.Encode())
+	return status, location
+}
+
+func TestManager_Initialise(t *testing.T) {
+	for _, mgr := range []Manager{
+		{},
+		{Endpoints: []string{"/a"}, Accounts: map[string]LocalAccount{"a": {}}},
+		{Endpoints: []string{"/a"}, Accounts: map[string]LocalAccount{"a": {Password: "a", TOTPSecret: "!"}}},
+		{Endpoints: []string{"/a"}, Accounts: map[string]LocalAccount{"a": {WebAuthnCredentials: []WebAuthnCredential{{}}}}},
+		{Endpoints: []string{"/login"}, Accounts: map[string]LocalAccount{"a": {Password: "a"}}},
+		{Endpoints: []string{"/a"}, PublicURL: "example.com", Accounts: map[string]LocalAccount{"a": {Password: "a"}}},
+		{Endpoints: []string{"/a"}, OIDC: oauth.OIDCProvider{Issuer: "https://example.com", ClientID: "a"}},
+	} {
+		if err := mgr.Initialise(global.Logger{}, nil); err == nil {
+			t.Fatalf("did not error: %+v", mgr)
+		}
+	}
+	mgr := Manager{Endpoints: []string{"/a"}, LoginEndpoint: "sign-in/", Accounts: map[string]LocalAccount{"a": {Password: "a"}}}
+	if err := mgr.Initialise(global.Logger{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if mgr.LoginEndpoint != "/sign-in" || mgr.IdleTimeoutSec != DefaultIdleTimeoutSec || mgr.MaxAgeSec != DefaultMaxAgeSec ||
+		!mgr.IsRequired("/a") || mgr.IsRequired("/b") {
+		t.Fatalf("%+v", mgr)
+	}
+}
+
+func TestManager_Password(t *testing.T) {
+	server := newTestServer(t, &Manager{Accounts: map[string]LocalAccount{
+		"alice": {Password: "alice-pass"},
+		"bob":   {Password: "bob-pass", TOTPSecret: rfc6238Secret},
+	}})
+	defer server.Close()
+
+	// Visitor is asked to sign in first
+	if status, location, _ := server.do(t, http.MethodGet, "/secret?a=b", "", ""); status != http.StatusSeeOther || location != "/login?next=%2Fsecret%3Fa%3Db" {
+		t.Fatal(status, location)
+	}
+	if status, _, _ := server.do(t, http.MethodPost, "/secret", "", ""); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	if status, _, body := server.do(t, http.MethodGet, "/login?next=%2Fsecret", "", ""); status != http.StatusOK ||
+		!strings.Contains(body, `name="next" value="/secret"`) || !strings.Contains(body, "signInByKey") {
+		t.Fatal(status, body)
+	}
+	// Incorrect password
+	if status, _ := server.signIn(t, "alice", "wrong", "", "/secret"); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	if status, _ := server.signIn(t, "nobody", "", "", "/secret"); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	// Sign in and visit the page
+	if status, location := server.signIn(t, "alice", "alice-pass", "", "/secret"); status != http.StatusSeeOther || location != "/secret" {
+		t.Fatal(status, location)
+	}
+	if status, _, body := server.do(t, http.MethodGet, "/secret", "", ""); status != http.StatusOK || body != "hello alice" {
+		t.Fatal(status, body)
+	}
+	if status, _, body := server.do(t, http.MethodGet, "/login", "", ""); status != http.StatusOK || !strings.Contains(body, "Signed in as alice") {
+		t.Fatal(status, body)
+	}
+	// Sign out
+	if status, _, _ := server.do(t, http.MethodPost, "/login/logout", "", ""); status != http.StatusSeeOther {
+		t.Fatal(status)
+	}
+	if status, _, _ := server.do(t, http.MethodGet, "/secret", "", ""); status != http.StatusSeeOther {
+		t.Fatal(status)
+	}
+
+	// Password alone is not enough when TOTP is enabled, and a code may not be used twice.
+	code, _ := TOTPCode(rfc6238Secret, time.Now())
+	if status, _ := server.signIn(t, "bob", "bob-pass", "", "/secret"); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	if status, location := server.signIn(t, "bob", "bob-pass", code, "https://evil.example.com"); status != http.StatusSeeOther || location != "/login" {
+		t.Fatal(status, location)
+	}
+	if status, _ := server.signIn(t, "bob", "bob-pass", code, "/secret"); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	// The previous session remains
+	if status, _, body := server.do(t, http.MethodGet, "/secret", "", ""); status != http.StatusOK || body != "hello bob" {
+		t.Fatal(status, body)
+	}
+
+	// Idle session expires
+	server.mgr.mutex.Lock()
+	for _, sess := range server.mgr.sessions {
+		sess.lastSeen = sess.lastSeen.Add(-time.Duration(server.mgr.IdleTimeoutSec+1) * time.Second)
+	}
+	server.mgr.mutex.Unlock()
+	if status, _, _ := server.do(t, http.MethodGet, "/secret", "", ""); status != http.StatusSeeOther {
+		t.Fatal(status)
+	}
+}
+
+// testAuthenticator is a security key simulated by an ECDSA key.
+type testAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	origin, rpID string
+}
+
+// clientData returns client data JSON of the ceremony.
+func (auth *testAuthenticator) clientData(ceremonyType, challenge string) []byte {
+	ret, _ := json.Marshal(webAuthnClientData{Type: ceremonyType, Challenge: challenge, Origin: auth.origin})
+	return ret
+}
+
+// authData returns authenticator data, with attested credential if it is for registration.
+func (auth *testAuthenticator) authData(register bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(auth.rpID))
+	ret := append([]byte{}, rpIDHash[:]...)
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, auth.signCount)
+	if !register {
+		return append(append(ret, webAuthnFlagUserPresent), counter...)
+	}
+	ret = append(append(ret, webAuthnFlagUserPresent|webAuthnFlagAttestedData), counter...)
+	ret = append(ret, make([]byte, 16)...)
+	idLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(idLen, uint16(len(auth.credentialID)))
+	ret = append(append(ret, idLen...), auth.credentialID...)
+	return append(ret, encodeCBOR([]interface{}{
+		1, 2, 3, webAuthnAlgES256, -1, 1,
+		-2, auth.key.X.FillBytes(make([]byte, 32)),
+		-3, auth.key.Y.FillBytes(make([]byte, 32)),
+	})...)
+}
+
+// register responds to registration options.
+func (auth *testAuthenticator) register(opts webAuthnOptions) webAuthnRequest {
+	attestation := encodeCBOR([]interface{}{"fmt", "none", "attStmt", []interface{}{}, "authData", auth.authData(true)})
+	return webAuthnRequest{
+		ChallengeID:       opts.ChallengeID,
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(auth.clientData("webauthn.create", opts.Challenge)),
+		AttestationObject: base64.RawURLEncoding.EncodeToString(attestation),
+	}
+}
+
+// assert responds to sign-in options.
+func (auth *testAuthenticator) assert(opts webAuthnOptions) webAuthnRequest {
+	auth.signCount++
+	clientData := auth.clientData("webauthn.get", opts.Challenge)
+	authData := auth.authData(false)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, _ := ecdsa.SignASN1(rand.Reader, auth.key, digest[:])
+	return webAuthnRequest{
+		ChallengeID:       opts.ChallengeID,
+		CredentialID:      base64.RawURLEncoding.EncodeToString(auth.credentialID),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(signature),
+	}
+}
+
+// postJSON sends the JSON request to sign-in endpoint and decodes the JSON response.
+func (server *testServer) postJSON(t *testing.T, action string, req interface{}, resp interface{}) int {
+	reqBody, _ := json.Marshal(req)
+	status, _, body := server.do(t, http.MethodPost, "/login/"+action, "application/json", string(reqBody))
+	if status == http.StatusOK && resp != nil {
+		if err := json.Unmarshal([]byte(body), resp); err != nil {
+			t.Fatal(err, body)
+		}
+	}
+	return status
+}
+
+func TestManager_WebAuthn(t *testing.T) {
+	server := newTestServer(t, &Manager{Accounts: map[string]LocalAccount{"alice": {Password: "alice-pass"}}})
+	defer server.Close()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	auth := &testAuthenticator{key: key, credentialID: []byte("credential-1"), origin: server.mgr.origin, rpID: server.mgr.rpID}
+
+	// Registration requires a signed-in local account
+	if status := server.postJSON(t, "webauthn/register-begin", webAuthnRequest{}, nil); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	if status, _ := server.signIn(t, "alice", "alice-pass", "", ""); status != http.StatusSeeOther {
+		t.Fatal(status)
+	}
+	var opts webAuthnOptions
+	if status := server.postJSON(t, "webauthn/register-begin", webAuthnRequest{}, &opts); status != http.StatusOK || opts.RPID != "127.0.0.1" || opts.User != "alice" {
+		t.Fatal(status, opts)
+	}
+	// Response from another origin is rejected, and the challenge is used up.
+	auth.origin = "https://evil.example.com"
+	if status := server.postJSON(t, "webauthn/register-finish", auth.register(opts), nil); status != http.StatusBadRequest {
+		t.Fatal(status)
+	}
+	auth.origin = server.mgr.origin
+	if status := server.postJSON(t, "webauthn/register-finish", auth.register(opts), nil); status != http.StatusBadRequest {
+		t.Fatal(status)
+	}
+	server.postJSON(t, "webauthn/register-begin", webAuthnRequest{}, &opts)
+	var cred WebAuthnCredential
+	if status := server.postJSON(t, "webauthn/register-finish", auth.register(opts), &cred); status != http.StatusOK ||
+		cred.ID != base64.RawURLEncoding.EncodeToString(auth.credentialID) || cred.PublicKey == "" {
+		t.Fatal(status, cred)
+	}
+	server.do(t, http.MethodPost, "/login/logout", "", "")
+
+	// Sign in by the security key
+	if status := server.postJSON(t, "webauthn/begin", webAuthnRequest{User: "nobody"}, nil); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	if status := server.postJSON(t, "webauthn/begin", webAuthnRequest{User: "alice", Next: "/secret"}, &opts); status != http.StatusOK ||
+		len(opts.CredentialIDs) != 1 || opts.CredentialIDs[0] != cred.ID {
+		t.Fatal(status, opts)
+	}
+	var result webAuthnOptions
+	if status := server.postJSON(t, "webauthn/finish", auth.assert(opts), &result); status != http.StatusOK || result.Redirect != "/secret" {
+		t.Fatal(status, result)
+	}
+	if status, _, body := server.do(t, http.MethodGet, "/secret", "", ""); status != http.StatusOK || body != "hello alice" {
+		t.Fatal(status, body)
+	}
+	// Challenge may not be answered twice
+	if status := server.postJSON(t, "webauthn/finish", auth.assert(opts), nil); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	// Signature of another key is rejected
+	server.postJSON(t, "webauthn/begin", webAuthnRequest{User: "alice"}, &opts)
+	auth.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if status := server.postJSON(t, "webauthn/finish", auth.assert(opts), nil); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	// A counter that goes backwards suggests a cloned key
+	auth.key = key
+	auth.signCount = 0
+	server.postJSON(t, "webauthn/begin", webAuthnRequest{User: "alice"}, &opts)
+	if status := server.postJSON(t, "webauthn/finish", auth.assert(opts), nil); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	// Configured credential works after restart
+	restarted := newTestServer(t, &Manager{Accounts: map[string]LocalAccount{"alice": {WebAuthnCredentials: []WebAuthnCredential{cred}}}})
+	defer restarted.Close()
+	auth.origin, auth.rpID = restarted.mgr.origin, restarted.mgr.rpID
+	restarted.postJSON(t, "webauthn/begin", webAuthnRequest{User: "alice"}, &opts)
+	if status := restarted.postJSON(t, "webauthn/finish", auth.assert(opts), &result); status != http.StatusOK || result.Redirect != "/login" {
+		t.Fatal(status, result)
+	}
+}
+
+func TestManager_OIDC(t *testing.T) {
+	standIn, err := oauth.NewOIDCStandIn("laitos-client", "laitos-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standIn.Server.Close()
+	server := newTestServer(t, &Manager{
+		OIDC:              oauth.OIDCProvider{Issuer: standIn.Issuer(), ClientID: "laitos-client", ClientSecret: "laitos-secret"},
+		OIDCAllowedEmails: []string{"Stand-In@example.com"},
+	})
+	defer server.Close()
+	if status, _, body := server.do(t, http.MethodGet, "/login?next=/secret", "", ""); status != http.StatusOK ||
+		!strings.Contains(body, "/login/oidc?next=%2Fsecret") || strings.Contains(body, "password") {
+		t.Fatal(status, body)
+	}
+	// signInViaProvider follows the redirects from sign-in page to provider and back, and returns the final response.
+	signInViaProvider := func() (int, string) {
+		status, location, _ := server.do(t, http.MethodGet, "/login/oidc?next=/secret", "", "")
+		if status != http.StatusFound || !strings.HasPrefix(location, standIn.Issuer()+"/authorize?") {
+			t.Fatal(status, location)
+		}
+		status, location, _ = server.do(t, http.MethodGet, location, "", "")
+		if status != http.StatusFound || !strings.HasPrefix(location, server.URL+"/login/oidc/callback?") {
+			t.Fatal(status, location)
+		}
+		status, location, _ = server.do(t, http.MethodGet, location, "", "")
+		return status, location
+	}
+	if status, location := signInViaProvider(); status != http.StatusSeeOther || location != "/secret" {
+		t.Fatal(status, location)
+	}
+	if status, _, body := server.do(t, http.MethodGet, "/secret", "", ""); status != http.StatusOK || body != "hello stand-in@example.com" {
+		t.Fatal(status, body)
+	}
+	// OIDC user may not register security key
+	if status := server.postJSON(t, "webauthn/register-begin", webAuthnRequest{}, nil); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	// Callback without the state cookie of the browser that began signing in is rejected
+	status, location, _ := server.do(t, http.MethodGet, "/login/oidc", "", "")
+	_, location, _ = server.do(t, http.MethodGet, location, "", "")
+	jar, _ := cookiejar.New(nil)
+	server.client.Jar = jar
+	if status, _, _ = server.do(t, http.MethodGet, location, "", ""); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	// User whose email is not allowed cannot sign in
+	standIn.Email = "stranger@example.com"
+	if status, _ := signInViaProvider(); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	if status, _, _ := server.do(t, http.MethodGet, "/secret", "", ""); status != http.StatusSeeOther {
+		t.Fatal(status)
+	}
+}
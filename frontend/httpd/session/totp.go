@@ -0,0 +1,63 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	TOTPStepSec   = 30 // TOTPStepSec is the number of seconds each one-time password remains valid.
+	TOTPNumDigits = 6  // TOTPNumDigits is the length of one-time password.
+	TOTPSkewSteps = 1  // TOTPSkewSteps is the number of steps before and after current step that are also accepted, to tolerate clock drift.
+)
+
+// decodeTOTPSecret decodes the base32 secret that authenticator apps use, spaces and padding are optional.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(strings.TrimSpace(secret), " ", "", -1))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+}
+
+// totpAtStep returns the one-time password (RFC 4226) of the counter.
+func totpAtStep(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPNumDigits, code%1000000)
+}
+
+// TOTPCode returns the time-based one-time password (RFC 6238) of the base32 secret at the moment.
+func TOTPCode(secret string, at time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", fmt.Errorf("TOTPCode: bad base32 secret - %v", err)
+	}
+	return totpAtStep(key, at.Unix()/TOTPStepSec), nil
+}
+
+/*
+VerifyTOTP returns the step at which the one-time password is valid for the secret, or 0 if the password is incorrect.
+To stop a password from being used twice, caller should reject a step that is not greater than the previously used step.
+*/
+func VerifyTOTP(secret, code string, at time.Time) int64 {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != TOTPNumDigits {
+		return 0
+	}
+	current := at.Unix() / TOTPStepSec
+	for step := current - TOTPSkewSteps; step <= current+TOTPSkewSteps; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpAtStep(key, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
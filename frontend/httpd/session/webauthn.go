@@ -0,0 +1,193 @@
+package session
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	webAuthnFlagUserPresent  = 0x01 // webAuthnFlagUserPresent is set in authenticator data when user touched the security key.
+	webAuthnFlagAttestedData = 0x40 // webAuthnFlagAttestedData is set in authenticator data that carries a new credential.
+	webAuthnAlgES256         = -7   // webAuthnAlgES256 is the COSE algorithm identifier of ECDSA P-256 with SHA-256.
+)
+
+// WebAuthnCredential is a security key registered by a local account, its public key verifies sign-in assertions.
+type WebAuthnCredential struct {
+	ID        string `json:"ID"`        // Credential ID in base64url encoding
+	PublicKey string `json:"PublicKey"` // ECDSA P-256 public key in PKIX form, encoded in standard base64.
+}
+
+// webAuthnClientData is the client data that browser collects and authenticator signs.
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// verifyClientData checks the client data JSON against expected ceremony type, challenge, and origin.
+func verifyClientData(clientDataJSON []byte, ceremonyType string, challenge []byte, origin string) error {
+	var clientData webAuthnClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return fmt.Errorf("malformed client data - %v", err)
+	}
+	if clientData.Type != ceremonyType {
+		return fmt.Errorf("client data is of type \"%s\" instead of \"%s\"", clientData.Type, ceremonyType)
+	}
+	gotChallenge, err := base64.RawURLEncoding.DecodeString(clientData.Challenge)
+	if err != nil || !bytes.Equal(gotChallenge, challenge) {
+		return errors.New("challenge does not match")
+	}
+	if clientData.Origin != origin {
+		return fmt.Errorf("origin \"%s\" does not match \"%s\"", clientData.Origin, origin)
+	}
+	return nil
+}
+
+// webAuthnAuthData is the parsed authenticator data.
+type webAuthnAuthData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte           // credentialID is only present in registration.
+	publicKey    *ecdsa.PublicKey // publicKey is only present in registration.
+}
+
+// parseAuthData parses authenticator data and checks that it belongs to the relying party and user was present.
+func parseAuthData(authData []byte, rpID string) (ret webAuthnAuthData, err error) {
+	if len(authData) < 37 {
+		return ret, errors.New("authenticator data is too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(authData[:32], rpIDHash[:]) {
+		return ret, errors.New("authenticator data belongs to another relying party")
+	}
+	ret.flags = authData[32]
+	ret.signCount = binary.BigEndian.Uint32(authData[33:37])
+	if ret.flags&webAuthnFlagUserPresent == 0 {
+		return ret, errors.New("user was not present")
+	}
+	if ret.flags&webAuthnFlagAttestedData == 0 {
+		return ret, nil
+	}
+	// Attested credential data consists of AAGUID, credential ID length, credential ID, and COSE public key.
+	attested := authData[37:]
+	if len(attested) < 18 {
+		return ret, errors.New("attested credential data is too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(attested[16:18]))
+	if len(attested) < 18+idLen {
+		return ret, errors.New("credential ID is truncated")
+	}
+	ret.credentialID = attested[18 : 18+idLen]
+	coseKey, _, err := decodeCBOR(attested[18+idLen:])
+	if err != nil {
+		return ret, fmt.Errorf("malformed credential public key - %v", err)
+	}
+	ret.publicKey, err = parseCOSEKey(coseKey)
+	return
+}
+
+// parseCOSEKey converts a COSE EC2 key of algorithm ES256 into an ECDSA public key.
+func parseCOSEKey(coseKey interface{}) (*ecdsa.PublicKey, error) {
+	key, ok := coseKey.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("credential public key is not a map")
+	}
+	// Key type 2 is EC2, curve 1 is P-256.
+	if key[int64(1)] != int64(2) || key[int64(3)] != int64(webAuthnAlgES256) || key[int64(-1)] != int64(1) {
+		return nil, errors.New("only ES256 security keys are supported")
+	}
+	x, xOK := key[int64(-2)].([]byte)
+	y, yOK := key[int64(-3)].([]byte)
+	if !xOK || !yOK || len(x) != 32 || len(y) != 32 {
+		return nil, errors.New("malformed EC2 public key")
+	}
+	pubKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !pubKey.Curve.IsOnCurve(pubKey.X, pubKey.Y) {
+		return nil, errors.New("EC point is not on curve")
+	}
+	return pubKey, nil
+}
+
+/*
+verifyWebAuthnRegistration verifies the response of navigator.credentials.create and returns the new credential.
+Attestation statement is not verified, hence any make of security key may be registered.
+*/
+func verifyWebAuthnRegistration(clientDataJSON, attestationObject, challenge []byte, rpID, origin string) (WebAuthnCredential, error) {
+	if err := verifyClientData(clientDataJSON, "webauthn.create", challenge, origin); err != nil {
+		return WebAuthnCredential{}, err
+	}
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, fmt.Errorf("malformed attestation object - %v", err)
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return WebAuthnCredential{}, errors.New("attestation object is not a map")
+	}
+	authDataBytes, ok := attestation["authData"].([]byte)
+	if !ok {
+		return WebAuthnCredential{}, errors.New("attestation object lacks authenticator data")
+	}
+	authData, err := parseAuthData(authDataBytes, rpID)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if authData.publicKey == nil || len(authData.credentialID) == 0 {
+		return WebAuthnCredential{}, errors.New("authenticator data lacks a new credential")
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(authData.publicKey)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	return WebAuthnCredential{
+		ID:        base64.RawURLEncoding.EncodeToString(authData.credentialID),
+		PublicKey: base64.StdEncoding.EncodeToString(pkix),
+	}, nil
+}
+
+/*
+verifyWebAuthnAssertion verifies the response of navigator.credentials.get against the registered credential, and
+returns the signature counter of authenticator.
+*/
+func verifyWebAuthnAssertion(cred WebAuthnCredential, clientDataJSON, authDataBytes, signature, challenge []byte, rpID, origin string) (uint32, error) {
+	if err := verifyClientData(clientDataJSON, "webauthn.get", challenge, origin); err != nil {
+		return 0, err
+	}
+	authData, err := parseAuthData(authDataBytes, rpID)
+	if err != nil {
+		return 0, err
+	}
+	pkix, err := base64.StdEncoding.DecodeString(cred.PublicKey)
+	if err != nil {
+		return 0, fmt.Errorf("malformed public key of credential %s - %v", cred.ID, err)
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(pkix)
+	if err != nil {
+		return 0, fmt.Errorf("malformed public key of credential %s - %v", cred.ID, err)
+	}
+	ecKey, ok := pubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return 0, fmt.Errorf("public key of credential %s is not ECDSA", cred.ID)
+	}
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+		return 0, errors.New("malformed signature")
+	}
+	// Authenticator signs authenticator data followed by hash of client data
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authDataBytes...), clientDataHash[:]...))
+	if !ecdsa.Verify(ecKey, digest[:], sig.R, sig.S) {
+		return 0, errors.New("bad signature")
+	}
+	return authData.signCount, nil
+}
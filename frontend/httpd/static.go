@@ -0,0 +1,260 @@
+package httpd
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DirectoryListingBasic    = "basic"    // DirectoryListingBasic lists file names of a directory, the way Go's file server does.
+	DirectoryListingDetailed = "detailed" // DirectoryListingDetailed lists file names, sizes, and modification time of a directory in an HTML table.
+	DirectoryListingNone     = "none"     // DirectoryListingNone refuses to list directory content, only index.html of a directory is served.
+)
+
+// DirectoryOptions controls how a directory is served to visitors.
+type DirectoryOptions struct {
+	Listing       string            `json:"Listing"`       // (Optional) "basic", "detailed", or "none", by default "basic".
+	CacheControl  string            `json:"CacheControl"`  // (Optional) Cache-Control response header, e.g. "public, max-age=3600".
+	ETag          bool              `json:"ETag"`          // (Optional) tag files with their size and modification time, so that clients may skip downloading unchanged files.
+	Precompressed bool              `json:"Precompressed"` // (Optional) serve file.br or file.gz in place of file to clients that accept the encoding.
+	MIMETypes     map[string]string `json:"MIMETypes"`     // (Optional) content type (value) of files that have the extension name (key), e.g. ".mkv": "video/x-matroska".
+	BasicAuth     map[string]string `json:"BasicAuth"`     // (Optional) require visitors to log in via HTTP basic authentication by one of these user names (key) and passwords (value).
+	AccessTokens  []string          `json:"AccessTokens"`  // (Optional) alternatively let visitors present one of these tokens in "token" query parameter or as bearer token.
+}
+
+// precompressedEncodings are the encodings of precompressed files in the order of preference, and their file name suffix.
+var precompressedEncodings = []struct{ encoding, suffix string }{{"br", ".br"}, {"gzip", ".gz"}}
+
+// validate checks that the options are sane.
+func (opts *DirectoryOptions) validate() error {
+	switch opts.Listing {
+	case "", DirectoryListingBasic, DirectoryListingDetailed, DirectoryListingNone:
+	default:
+		return fmt.Errorf("unknown directory listing \"%s\"", opts.Listing)
+	}
+	for ext := range opts.MIMETypes {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("MIME type extension \"%s\" must begin with a dot", ext)
+		}
+	}
+	for _, token := range opts.AccessTokens {
+		if token == "" {
+			return fmt.Errorf("access token must not be empty")
+		}
+	}
+	return nil
+}
+
+// authorised returns true if the visitor presents the correct user name and password, or an access token.
+func (opts *DirectoryOptions) authorised(r *http.Request) bool {
+	if len(opts.BasicAuth) == 0 && len(opts.AccessTokens) == 0 {
+		return true
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		if expected, exists := opts.BasicAuth[user]; exists && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 {
+			return true
+		}
+	}
+	token := r.URL.Query().Get("token")
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		token = strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	if token != "" {
+		for _, expected := range opts.AccessTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contentType returns the content type of the file name according to MIME overrides, or an empty string if there is none.
+func (opts *DirectoryOptions) contentType(name string) string {
+	return opts.MIMETypes[strings.ToLower(path.Ext(name))]
+}
+
+// makeETag returns a weak entity tag derived from size and modification time of a file.
+func makeETag(info os.FileInfo, suffix string) string {
+	return fmt.Sprintf(`W/"%x-%x%s"`, info.Size(), info.ModTime().UnixNano(), suffix)
+}
+
+/*
+makeHandler returns a handler that serves the directory according to the options. Request path must have had the URL
+prefix stripped.
+*/
+func (opts *DirectoryOptions) makeHandler(dirPath string) http.HandlerFunc {
+	fileServer := http.FileServer(http.Dir(dirPath))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !opts.authorised(r) {
+			if len(opts.BasicAuth) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="Please log in to continue"`)
+			}
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if opts.CacheControl != "" {
+			w.Header().Set("Cache-Control", opts.CacheControl)
+		}
+		if opts.Precompressed {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		name := path.Clean("/" + r.URL.Path)
+		info, err := os.Stat(path.Join(dirPath, name))
+		if err != nil {
+			// Let file server produce the appropriate error response
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+		if info.IsDir() {
+			// Directory index document takes precedence over listing
+			if _, err := os.Stat(path.Join(dirPath, name, "index.html")); err == nil || opts.Listing == "" || opts.Listing == DirectoryListingBasic {
+				fileServer.ServeHTTP(w, r)
+				return
+			}
+			if opts.Listing == DirectoryListingNone {
+				http.Error(w, "404 page not found", http.StatusNotFound)
+				return
+			}
+			if r.URL.Path != "" && !strings.HasSuffix(r.URL.Path, "/") {
+				// Let file server redirect to the path with trailing slash, so that relative links in the listing work.
+				fileServer.ServeHTTP(w, r)
+				return
+			}
+			opts.serveListing(w, r, path.Join(dirPath, name))
+			return
+		}
+		contentType := opts.contentType(name)
+		if opts.Precompressed && opts.servePrecompressed(w, r, dirPath, name, contentType) {
+			return
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if opts.ETag {
+			w.Header().Set("ETag", makeETag(info, ""))
+		}
+		// File server takes care of byte ranges, modification time, and conditional requests
+		fileServer.ServeHTTP(w, r)
+	}
+}
+
+/*
+servePrecompressed serves the precompressed variant of the file if the client accepts its encoding. Return false if
+there is no suitable variant, in which case nothing has been written to the response.
+*/
+func (opts *DirectoryOptions) servePrecompressed(w http.ResponseWriter, r *http.Request, dirPath, name, contentType string) bool {
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+	for _, variant := range precompressedEncodings {
+		if !acceptsEncoding(acceptEncoding, variant.encoding) {
+			continue
+		}
+		file, err := os.Open(path.Join(dirPath, name+variant.suffix))
+		if err != nil {
+			continue
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			continue
+		}
+		// Content type describes the original file rather than the compressed one
+		if contentType == "" {
+			if contentType = mime.TypeByExtension(path.Ext(name)); contentType == "" {
+				contentType = "application/octet-stream"
+			}
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Encoding", variant.encoding)
+		if opts.ETag {
+			w.Header().Set("ETag", makeETag(info, "-"+variant.encoding))
+		}
+		http.ServeContent(w, r, name, info.ModTime(), file)
+		return true
+	}
+	return false
+}
+
+// acceptsEncoding returns true if Accept-Encoding header value accepts the encoding.
+func acceptsEncoding(acceptEncoding, encoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != encoding {
+			continue
+		}
+		// Quality value of zero means the encoding is not acceptable
+		for _, param := range fields[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if quality, err := strconv.ParseFloat(param[2:], 64); err == nil && quality == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serveListing writes an HTML table of names, sizes, and modification time of files in the directory.
+func (opts *DirectoryOptions) serveListing(w http.ResponseWriter, r *http.Request, dirPath string) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		http.Error(w, "500 failed to read directory", http.StatusInternalServerError)
+		return
+	}
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		http.Error(w, "500 failed to read directory", http.StatusInternalServerError)
+		return
+	}
+	// Directories come first, then files, each sorted by name.
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].IsDir() != infos[j].IsDir() {
+			return infos[i].IsDir()
+		}
+		return infos[i].Name() < infos[j].Name()
+	})
+	// Links carry the access token along if the visitor presented it in query parameter
+	var linkQuery string
+	if token := r.URL.Query().Get("token"); token != "" {
+		linkQuery = "?" + url.Values{"token": {token}}.Encode()
+	}
+	var rows strings.Builder
+	for _, info := range infos {
+		name, size := info.Name(), fmt.Sprint(info.Size())
+		if info.IsDir() {
+			name += "/"
+			size = "-"
+		}
+		link := url.URL{Path: name}
+		rows.WriteString(fmt.Sprintf("<tr><td><a href=\"%s%s\">%s</a></td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(link.String()), html.EscapeString(linkQuery), html.EscapeString(name), size, info.ModTime().UTC().Format(time.RFC3339)))
+	}
+	title := html.EscapeString(r.URL.Path)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!doctype html>
+<html>
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
+    <title>%s</title>
+</head>
+<body>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+<tr><td><a href="../%s">../</a></td><td>-</td><td></td></tr>
+%s</table>
+</body>
+</html>
+`, title, html.EscapeString(linkQuery), rows.String())
+}
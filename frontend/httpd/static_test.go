@@ -0,0 +1,159 @@
+package httpd
+
+import (
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestHTTPD_DirectoryOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestHTTPD_DirectoryOptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a.js":            "original js",
+		"a.js.gz":         "gzip js",
+		"a.js.br":         "brotli js",
+		"movie.mkv":       "0123456789",
+		"sub/index.html":  "sub index",
+		"empty/.keep":     "",
+		"secret/file.txt": "secret",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(path.Dir(path.Join(dir, name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	daemon := HTTPD{
+		Address:          "127.0.0.1",
+		Port:             12345,
+		BaseRateLimit:    100,
+		Processor:        common.GetTestCommandProcessor(),
+		ServeDirectories: map[string]string{"/plain": dir, "/detailed": dir, "/none": dir, "/secret": path.Join(dir, "secret")},
+		DirectoryOptions: map[string]DirectoryOptions{
+			"/detailed": {Listing: "bad"},
+		},
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "listing") {
+		t.Fatal(err)
+	}
+	daemon.DirectoryOptions = map[string]DirectoryOptions{
+		"detailed/": {
+			Listing:       DirectoryListingDetailed,
+			CacheControl:  "public, max-age=60",
+			ETag:          true,
+			Precompressed: true,
+			MIMETypes:     map[string]string{".mkv": "video/x-matroska"},
+		},
+		"/none": {Listing: DirectoryListingNone},
+		"/secret": {
+			BasicAuth:    map[string]string{"user": "pass"},
+			AccessTokens: []string{"token123"},
+			Listing:      DirectoryListingDetailed,
+		},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		daemon.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Directory without options behaves as before
+	if resp := get("/plain/a.js", map[string]string{"Accept-Encoding": "gzip"}); resp.Code != http.StatusOK || resp.Body.String() != "original js" ||
+		resp.Header().Get("Content-Encoding") != "" || resp.Header().Get("ETag") != "" || resp.Header().Get("Cache-Control") != "" {
+		t.Fatal(resp.Code, resp.Body.String(), resp.Header())
+	}
+	// Detailed listing of directory shows sub-directories first
+	resp := get("/detailed/", nil)
+	body := resp.Body.String()
+	if resp.Code != http.StatusOK || !strings.Contains(body, `<a href="empty/">empty/</a></td><td>-</td>`) ||
+		!strings.Contains(body, `<a href="movie.mkv">movie.mkv</a></td><td>10</td>`) ||
+		strings.Index(body, "sub/") > strings.Index(body, "a.js") || resp.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Fatal(resp.Code, body)
+	}
+	// Index document takes precedence over listing
+	if resp := get("/detailed/sub/", nil); resp.Code != http.StatusOK || resp.Body.String() != "sub index" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := get("/detailed/empty", nil); resp.Code != http.StatusMovedPermanently {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	// Precompressed files in the order of preference
+	if resp := get("/detailed/a.js", map[string]string{"Accept-Encoding": "gzip, br"}); resp.Body.String() != "brotli js" ||
+		resp.Header().Get("Content-Encoding") != "br" || !strings.Contains(resp.Header().Get("Content-Type"), "javascript") ||
+		resp.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatal(resp.Body.String(), resp.Header())
+	}
+	if resp := get("/detailed/a.js", map[string]string{"Accept-Encoding": "gzip, br;q=0"}); resp.Body.String() != "gzip js" ||
+		resp.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal(resp.Body.String(), resp.Header())
+	}
+	resp = get("/detailed/a.js", nil)
+	if resp.Body.String() != "original js" || resp.Header().Get("Content-Encoding") != "" {
+		t.Fatal(resp.Body.String(), resp.Header())
+	}
+	// Unchanged file is not downloaded again
+	etag := resp.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatal(etag)
+	}
+	if resp := get("/detailed/a.js", map[string]string{"If-None-Match": etag}); resp.Code != http.StatusNotModified || resp.Body.Len() != 0 {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := get("/detailed/a.js", map[string]string{"If-None-Match": etag, "Accept-Encoding": "gzip"}); resp.Code != http.StatusOK {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	// Byte range and MIME type override
+	if resp := get("/detailed/movie.mkv", map[string]string{"Range": "bytes=2-4"}); resp.Code != http.StatusPartialContent || resp.Body.String() != "234" ||
+		resp.Header().Get("Content-Type") != "video/x-matroska" || resp.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatal(resp.Code, resp.Body.String(), resp.Header())
+	}
+	// Directory listing is refused, but files and index documents are served.
+	if resp := get("/none/", nil); resp.Code != http.StatusNotFound {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := get("/none/sub/", nil); resp.Code != http.StatusOK || resp.Body.String() != "sub index" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := get("/none/movie.mkv", nil); resp.Code != http.StatusOK || resp.Body.String() != "0123456789" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	// Protected directory requires password or token
+	if resp := get("/secret/file.txt", nil); resp.Code != http.StatusUnauthorized || resp.Header().Get("WWW-Authenticate") == "" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := get("/secret/file.txt", map[string]string{"Authorization": "Bearer wrong"}); resp.Code != http.StatusUnauthorized {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := get("/secret/file.txt", map[string]string{"Authorization": "Bearer token123"}); resp.Code != http.StatusOK || resp.Body.String() != "secret" {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	req := httptest.NewRequest(http.MethodGet, "/secret/file.txt", nil)
+	req.SetBasicAuth("user", "pass")
+	recorder := httptest.NewRecorder()
+	daemon.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "secret" {
+		t.Fatal(recorder.Code, recorder.Body.String())
+	}
+	// Links in listing carry the token along
+	if resp := get("/secret/?token=token123", nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `href="file.txt?token=token123"`) {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+}
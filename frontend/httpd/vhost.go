@@ -0,0 +1,176 @@
+package httpd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/acme"
+	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+VirtualHost serves its own directories and handlers to visitors who ask for any of its host names. Visitors who ask for
+an unknown host name, or for the server's IP address, are served by the HTTP daemon's own directories and handlers.
+*/
+type VirtualHost struct {
+	HostNames           []string                    `json:"HostNames"`           // Host names (without port number) served by the virtual host, e.g. "example.com".
+	TLSCertPath         string                      `json:"TLSCertPath"`         // (Optional) present this certificate to clients who ask for any of the host names via SNI
+	TLSKeyPath          string                      `json:"TLSKeyPath"`          // (Optional) present this certificate to clients who ask for any of the host names via SNI (key)
+	ServeDirectories    map[string]string           `json:"ServeDirectories"`    // (Optional) serve directories (value) on prefix paths (key)
+	DirectoryOptions    map[string]DirectoryOptions `json:"DirectoryOptions"`    // (Optional) listing, caching, compression, and access control of served directories, keyed by prefix path.
+	IndexEndpoints      []string                    `json:"IndexEndpoints"`      // (Optional) serve the index document on these paths
+	IndexEndpointConfig api.HandleHTMLDocument      `json:"IndexEndpointConfig"` // (Optional) index document of the virtual host
+	/*
+		Endpoints are paths of the HTTP daemon's specialised handlers that are served on this host. An endpoint claimed by
+		any virtual host is no longer served to visitors of the default host.
+	*/
+	Endpoints []string `json:"Endpoints"`
+
+	SpecialHandlers map[string]api.HandlerFactory `json:"-"` // Specialised handlers that are served only on this host, such as index document.
+}
+
+// hostWithoutPort returns the lower case host name from HTTP Host header, without port number.
+func hostWithoutPort(hostHeader string) string {
+	if host, _, err := net.SplitHostPort(hostHeader); err == nil {
+		hostHeader = host
+	}
+	return strings.Trim(strings.ToLower(hostHeader), "[].")
+}
+
+// checkVirtualHosts validates configuration and certificates of virtual hosts, without constructing their handlers.
+func (httpd *HTTPD) checkVirtualHosts() error {
+	hostNames := make(map[string]struct{})
+	for _, vhost := range httpd.VirtualHosts {
+		if len(vhost.HostNames) == 0 {
+			return errors.New("HTTPD.Check: virtual host must have at least one host name")
+		}
+		if (vhost.TLSCertPath != "" || vhost.TLSKeyPath != "") && (vhost.TLSCertPath == "" || vhost.TLSKeyPath == "") {
+			return fmt.Errorf("HTTPD.Check: virtual host %s must have both TLS certificate and key path", vhost.HostNames[0])
+		}
+		if vhost.TLSCertPath != "" {
+			if httpd.TLSCertPath == "" && httpd.CertManager == nil {
+				return fmt.Errorf("HTTPD.Check: virtual host %s may only use TLS certificate when TLS is enabled", vhost.HostNames[0])
+			}
+			if _, err := tls.LoadX509KeyPair(vhost.TLSCertPath, vhost.TLSKeyPath); err != nil {
+				return fmt.Errorf("HTTPD.Check: failed to load TLS certificate of virtual host %s - %v", vhost.HostNames[0], err)
+			}
+		}
+		for urlLocation, opts := range vhost.DirectoryOptions {
+			if urlLocation == "" {
+				continue
+			}
+			if err := opts.validate(); err != nil {
+				return fmt.Errorf("HTTPD.Check: bad options of directory %s - %v", urlLocation, err)
+			}
+		}
+		for _, urlLocation := range vhost.Endpoints {
+			if _, exists := httpd.SpecialHandlers[urlLocation]; !exists {
+				return fmt.Errorf("HTTPD.Check: virtual host %s refers to endpoint %s that is not configured", vhost.HostNames[0], urlLocation)
+			}
+		}
+		for _, hostName := range vhost.HostNames {
+			hostName = hostWithoutPort(hostName)
+			if _, exists := hostNames[hostName]; exists {
+				return fmt.Errorf("HTTPD.Check: host name %s appears in more than one virtual host", hostName)
+			}
+			hostNames[hostName] = struct{}{}
+		}
+	}
+	return nil
+}
+
+/*
+initialiseVirtualHosts constructs a router for each virtual host, using specialised handler functions that have already
+been constructed for the default host. Return the set of endpoints claimed by virtual hosts.
+*/
+func (httpd *HTTPD) initialiseVirtualHosts(handlerFuns map[string]http.HandlerFunc) (claimed map[string]struct{}, err error) {
+	claimed = make(map[string]struct{})
+	httpd.hostMuxes = make(map[string]*http.ServeMux)
+	httpd.hostCerts = make(map[string]*tls.Certificate)
+	for i := range httpd.VirtualHosts {
+		vhost := &httpd.VirtualHosts[i]
+		var cert *tls.Certificate
+		if vhost.TLSCertPath != "" {
+			keyPair, err := tls.LoadX509KeyPair(vhost.TLSCertPath, vhost.TLSKeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("HTTPD.Initialise: failed to load TLS certificate of virtual host %s - %v", vhost.HostNames[0], err)
+			}
+			cert = &keyPair
+		}
+		mux := new(http.ServeMux)
+		routePrefix := hostWithoutPort(vhost.HostNames[0])
+		if err := httpd.installDirectories(mux, routePrefix, vhost.ServeDirectories, vhost.DirectoryOptions); err != nil {
+			return nil, err
+		}
+		// Index document and other handlers that belong only to this host
+		if vhost.SpecialHandlers == nil {
+			vhost.SpecialHandlers = make(map[string]api.HandlerFactory)
+		}
+		for _, location := range vhost.IndexEndpoints {
+			vhost.SpecialHandlers[location] = &vhost.IndexEndpointConfig
+		}
+		for urlLocation, handler := range vhost.SpecialHandlers {
+			fun, err := httpd.makeHandler(routePrefix+urlLocation, handler, false)
+			if err != nil {
+				return nil, err
+			}
+			mux.HandleFunc(urlLocation, fun)
+		}
+		// Handlers shared with the default host
+		for _, urlLocation := range vhost.Endpoints {
+			fun, exists := handlerFuns[urlLocation]
+			if !exists {
+				return nil, fmt.Errorf("HTTPD.Initialise: virtual host %s refers to endpoint %s that is not configured", vhost.HostNames[0], urlLocation)
+			}
+			claimed[urlLocation] = struct{}{}
+			mux.HandleFunc(urlLocation, fun)
+		}
+		// ACME challenges are answered on all hosts
+		for urlLocation, handler := range httpd.SpecialHandlers {
+			if _, isACME := handler.(*api.HandleACMEChallenge); isACME && urlLocation == acme.HTTPChallengePath {
+				mux.HandleFunc(urlLocation, handlerFuns[urlLocation])
+			}
+		}
+		for _, hostName := range vhost.HostNames {
+			hostName = hostWithoutPort(hostName)
+			httpd.hostMuxes[hostName] = mux
+			if cert != nil {
+				httpd.hostCerts[hostName] = cert
+			}
+		}
+	}
+	return
+}
+
+/*
+wrapGetCertificate makes TLS server present the certificate of virtual host that client asks for via SNI. For other
+host names, the server presents the certificate of HTTP daemon itself.
+*/
+func (httpd *HTTPD) wrapGetCertificate(tlsConfig *tls.Config) {
+	fallback := tlsConfig.GetCertificate
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// ACME TLS-ALPN challenge is answered by the certificate manager
+		isACMEChallenge := false
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				isACMEChallenge = true
+			}
+		}
+		if !isACMEChallenge {
+			httpd.muxMutex.RLock()
+			cert, exists := httpd.hostCerts[hostWithoutPort(hello.ServerName)]
+			httpd.muxMutex.RUnlock()
+			if exists {
+				return cert, nil
+			}
+		}
+		if fallback != nil {
+			return fallback(hello)
+		}
+		// Let TLS server use certificate of HTTP daemon itself
+		return nil, nil
+	}
+}
@@ -0,0 +1,168 @@
+package httpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key into the directory.
+func writeTestCertificate(t *testing.T, dir, hostName string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hostName},
+		DNSNames:     []string{hostName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = path.Join(dir, hostName+".crt")
+	keyPath = path.Join(dir, hostName+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestHTTPD_VirtualHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestHTTPD_VirtualHosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"default", "site"} {
+		if err := os.MkdirAll(path.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, name, "a.html"), []byte(name+" html"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	siteIndex := path.Join(dir, "site-index.html")
+	if err := ioutil.WriteFile(siteIndex, []byte("site index"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defaultCert, defaultKey := writeTestCertificate(t, dir, "default.example")
+	secretCert, secretKey := writeTestCertificate(t, dir, "secret.example")
+
+	daemon := HTTPD{
+		Address:          "127.0.0.1",
+		Port:             12345,
+		BaseRateLimit:    10,
+		TLSCertPath:      defaultCert,
+		TLSKeyPath:       defaultKey,
+		Processor:        common.GetTestCommandProcessor(),
+		ServeDirectories: map[string]string{"/dir": path.Join(dir, "default")},
+		SpecialHandlers: map[string]api.HandlerFactory{
+			"/cmd_form":  &api.HandleCommandForm{},
+			"/dns_stats": &api.HandleDNSQueryStats{},
+		},
+		VirtualHosts: []VirtualHost{
+			{
+				HostNames:           []string{"site.example", "www.site.example"},
+				ServeDirectories:    map[string]string{"/dir": path.Join(dir, "site")},
+				IndexEndpoints:      []string{"/"},
+				IndexEndpointConfig: api.HandleHTMLDocument{HTMLFilePath: siteIndex},
+				Endpoints:           []string{"/dns_stats"},
+			},
+			{
+				HostNames:   []string{"Secret.Example"},
+				TLSCertPath: secretCert,
+				TLSKeyPath:  secretKey,
+				Endpoints:   []string{"/cmd_form"},
+			},
+		},
+	}
+	// Endpoint must refer to a configured handler
+	daemon.VirtualHosts[0].Endpoints = []string{"/does_not_exist"}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "/does_not_exist") {
+		t.Fatal(err)
+	}
+	daemon.VirtualHosts[0].Endpoints = []string{"/dns_stats"}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(host, path string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		recorder := httptest.NewRecorder()
+		daemon.ServeHTTP(recorder, req)
+		return recorder.Code, recorder.Body.String()
+	}
+	// Each host serves its own directory
+	if status, body := get("127.0.0.1:12345", "/dir/a.html"); status != http.StatusOK || body != "default html" {
+		t.Fatal(status, body)
+	}
+	if status, body := get("www.site.example:12345", "/dir/a.html"); status != http.StatusOK || body != "site html" {
+		t.Fatal(status, body)
+	}
+	if status, body := get("site.example", "/"); status != http.StatusOK || body != "site index" {
+		t.Fatal(status, body)
+	}
+	// Endpoints claimed by virtual hosts are not served on the default host
+	if status, _ := get("unknown.example", "/cmd_form"); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+	if status, _ := get("unknown.example", "/dns_stats"); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+	// Index document of the virtual host catches all other paths
+	if status, body := get("site.example", "/cmd_form"); status != http.StatusOK || body != "site index" {
+		t.Fatal(status, body)
+	}
+	if status, _ := get("secret.example", "/cmd_form"); status == http.StatusNotFound {
+		t.Fatal(status)
+	}
+	if status, _ := get("secret.example", "/dir/a.html"); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+	// Certificate is chosen according to SNI
+	cert, err := daemon.Server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "secret.example"})
+	if err != nil || cert == nil {
+		t.Fatal(err, cert)
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err != nil || leaf.Subject.CommonName != "secret.example" {
+		t.Fatal(err, leaf)
+	}
+	// Other host names get the certificate of HTTP daemon itself
+	if cert, err := daemon.Server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "site.example"}); err != nil || cert != nil {
+		t.Fatal(err, cert)
+	}
+
+	// Virtual host certificate requires TLS to be enabled
+	daemon.TLSCertPath = ""
+	daemon.TLSKeyPath = ""
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "TLS is enabled") {
+		t.Fatal(err)
+	}
+}
@@ -84,10 +84,19 @@ Process only one command (if found) in the incoming mail. If reply addresses are
 to the specified addresses. If they are not specified, use the incoming mail sender's address as reply address.
 */
 func (mailproc *MailProcessor) Process(mailContent []byte, replyAddresses ...string) error {
+	return mailproc.ProcessFromClient("", mailContent, replyAddresses...)
+}
+
+/*
+ProcessFromClient works like Process, and additionally protects against brute-force guessing of PIN by the client
+(e.g. envelope sender and IP of SMTP client) that delivered the mail. The client may deliver plenty of ordinary mails,
+hence a mail counts as one failure only if it appears to attempt a command with an incorrect PIN.
+*/
+func (mailproc *MailProcessor) ProcessFromClient(clientID string, mailContent []byte, replyAddresses ...string) error {
 	// Put query duration (including IO time) into statistics
 	beginTimeNano := time.Now().UnixNano()
 	defer func() {
-		DurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+		DurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 	}()
 	if global.EmergencyLockDown {
 		return global.ErrEmergencyLockDown
@@ -100,7 +109,10 @@ func (mailproc *MailProcessor) Process(mailContent []byte, replyAddresses ...str
 	if errs := mailproc.Processor.IsSaneForInternet(); len(errs) > 0 {
 		return fmt.Errorf("MailProcessor.Process: %+v", errs)
 	}
-	var commandIsProcessed bool
+	if mailproc.Processor.Bans.IsBanned(clientID) {
+		return env.ErrClientBanned
+	}
+	var commandIsProcessed, pinIsAttempted bool
 	walkErr := email.WalkMessage(mailContent, func(prop email.BasicProperties, body []byte) (bool, error) {
 		// Avoid recursive processing
 		if strings.Contains(prop.Subject, email.OutgoingMailSubjectKeyword) {
@@ -114,6 +126,9 @@ func (mailproc *MailProcessor) Process(mailContent []byte, replyAddresses ...str
 		})
 		// If this part does not have a PIN/shortcut match, simply move on to the next part.
 		if result.Error == bridge.ErrPINAndShortcutNotFound {
+			if mailproc.looksLikeCommand(string(body)) {
+				pinIsAttempted = true
+			}
 			// Move on, do not return error.
 			return true, nil
 		} else if result.Error != nil {
@@ -152,11 +167,37 @@ func (mailproc *MailProcessor) Process(mailContent []byte, replyAddresses ...str
 	}
 	// If all parts have been visited but no command is found, return the PIN mismatch error.
 	if !commandIsProcessed {
+		if pinIsAttempted {
+			mailproc.Processor.Bans.AddFailure(clientID)
+		}
 		return bridge.ErrPINAndShortcutNotFound
 	}
 	return nil
 }
 
+/*
+looksLikeCommand returns true if a line of the text begins with a word that ends in a feature trigger, such as
+"wrongpin.s echo hi", which suggests that the mail is an attempt at running a command.
+*/
+func (mailproc *MailProcessor) looksLikeCommand(text string) bool {
+	if mailproc.Processor.Features == nil {
+		return false
+	}
+	triggers := mailproc.Processor.Features.GetTriggers()
+	for _, line := range strings.Split(text, "\n") {
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		for _, trigger := range triggers {
+			if len(words[0]) > len(trigger) && strings.HasSuffix(words[0], trigger) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 var TestUndocumented1Message = ""             // Content is set by init_mail_test.go
 var TestWolframAlpha = feature.WolframAlpha{} // Details are set by init_mail_test.go
 var TestUndocumented2Message = ""             // Content is set by init_mail_test.go
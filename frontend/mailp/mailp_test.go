@@ -1,7 +1,9 @@
 package mailp
 
 import (
+	"github.com/HouzuoGuo/laitos/bridge"
 	"github.com/HouzuoGuo/laitos/email"
+	"github.com/HouzuoGuo/laitos/env"
 	"github.com/HouzuoGuo/laitos/frontend/common"
 	"net"
 	"strings"
@@ -28,6 +30,32 @@ func TestMailProcessor_Process(t *testing.T) {
 	TestMailp(&mailproc, t)
 }
 
+func TestMailProcessor_ProcessFromClient_Bans(t *testing.T) {
+	mailproc := MailProcessor{Processor: common.GetTestCommandProcessor(), CommandTimeoutSec: 5}
+	mailproc.Processor.Bans = &env.BanManager{MaxFailures: 2}
+	if err := mailproc.Processor.Bans.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Ordinary mails delivered by a relay do not count as failures
+	for i := 0; i < 3; i++ {
+		if err := mailproc.ProcessFromClient("1.2.3.4", []byte("Subject: hi\r\nContent-Type: text/plain\r\n\r\nsee you at example.com"), "howard@localhost"); err != bridge.ErrPINAndShortcutNotFound {
+			t.Fatal(err)
+		}
+	}
+	if mailproc.Processor.Bans.IsBanned("1.2.3.4") {
+		t.Fatal("should not have banned the relay")
+	}
+	// Mails that attempt a command with incorrect PIN count as failures
+	for i := 0; i < 2; i++ {
+		if err := mailproc.ProcessFromClient("1.2.3.4", []byte("Subject: hi\r\nContent-Type: text/plain\r\n\r\nbadpin.s echo hi"), "howard@localhost"); err != bridge.ErrPINAndShortcutNotFound {
+			t.Fatal(err)
+		}
+	}
+	if err := mailproc.ProcessFromClient("1.2.3.4", []byte("Subject: hi\r\nContent-Type: text/plain\r\n\r\nbadpin.s echo hi"), "howard@localhost"); err != env.ErrClientBanned {
+		t.Fatal(err)
+	}
+}
+
 func TestMailProcessor_Process_Undocumented1Reply(t *testing.T) {
 	if TestUndocumented1Message == "" {
 		t.Skip()
@@ -7,14 +7,8 @@ import (
 	"github.com/HouzuoGuo/laitos/email"
 	"github.com/HouzuoGuo/laitos/env"
 	"github.com/HouzuoGuo/laitos/feature"
-	"github.com/HouzuoGuo/laitos/frontend/common"
-	"github.com/HouzuoGuo/laitos/frontend/dnsd"
 	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
 	"github.com/HouzuoGuo/laitos/frontend/mailp"
-	"github.com/HouzuoGuo/laitos/frontend/plain"
-	"github.com/HouzuoGuo/laitos/frontend/smtpd"
-	"github.com/HouzuoGuo/laitos/frontend/sockd"
-	"github.com/HouzuoGuo/laitos/frontend/telegrambot"
 	"github.com/HouzuoGuo/laitos/global"
 	"github.com/HouzuoGuo/laitos/testingstub"
 	"net"
@@ -52,30 +46,9 @@ type Maintenance struct {
 	stop            chan bool            // Signal health check loop to stop
 }
 
-/*
-GetLatestStats returns statistic information from all front-end daemons, each on their own line.
-Due to inevitable cyclic import, this function is defined twice, once in api.go of api package, the other in
-maintenance.go of maintenance package.
-*/
+// GetLatestStats returns statistic information from all front-end daemons, each on their own line.
 func GetLatestStats() string {
-	numDecimals := 2
-	return fmt.Sprintf(`CmdProc: %s
-DNSD TCP/UDP: %s/%s
-HTTPD: %s
-MAILP: %s
-PLAIN TCP/UDP: %s%s
-SMTPD: %s
-SOCKD TCP/UDP: %s/%s
-TELEGRAM BOT: %s
-`,
-		common.DurationStats.Format(numDecimals),
-		dnsd.TCPDurationStats.Format(numDecimals), dnsd.UDPDurationStats.Format(numDecimals),
-		api.DurationStats.Format(numDecimals),
-		mailp.DurationStats.Format(numDecimals),
-		plain.TCPDurationStats.Format(numDecimals), plain.UDPDurationStats.Format(numDecimals),
-		smtpd.DurationStats.Format(numDecimals),
-		sockd.TCPDurationStats.Format(numDecimals), sockd.UDPDurationStats.Format(numDecimals),
-		telegrambot.DurationStats.Format(numDecimals))
+	return api.GetLatestStats()
 }
 
 // Check TCP ports and features, return all-OK or not.
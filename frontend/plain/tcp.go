@@ -49,7 +49,7 @@ func (server *PlainTextDaemon) HandleTCPConnection(clientConn net.Conn) {
 	// Put processing duration (including IO time) into statistics
 	beginTimeNano := time.Now().UnixNano()
 	defer func() {
-		TCPDurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+		TCPDurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 	}()
 	defer clientConn.Close()
 	clientIP := clientConn.RemoteAddr().(*net.TCPAddr).IP.String()
@@ -74,7 +74,7 @@ func (server *PlainTextDaemon) HandleTCPConnection(clientConn net.Conn) {
 			return
 		}
 		// Process line of command and respond
-		result := server.Processor.Process(feature.Command{Content: string(line), TimeoutSec: CommandTimeoutSec})
+		result := server.Processor.Process(feature.Command{Content: string(line), TimeoutSec: CommandTimeoutSec, ClientID: clientIP})
 		clientConn.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
 		clientConn.Write([]byte(result.CombinedOutput))
 		clientConn.Write([]byte("\r\n"))
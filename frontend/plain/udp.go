@@ -73,7 +73,7 @@ func (server *PlainTextDaemon) HandleUDPConnection(clientIP string, clientAddr *
 	// Put processing duration (including IO time) into statistics
 	beginTimeNano := time.Now().UnixNano()
 	defer func() {
-		UDPDurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+		UDPDurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 	}()
 	// Unlike TCP, there's no point in checking against rate limit for the connection itself.
 	server.Logger.Printf("HandleUDPConnection", clientIP, nil, "working on the connection")
@@ -92,7 +92,7 @@ func (server *PlainTextDaemon) HandleUDPConnection(clientIP string, clientAddr *
 			return
 		}
 		// Process line of command and respond
-		result := server.Processor.Process(feature.Command{Content: string(line), TimeoutSec: CommandTimeoutSec})
+		result := server.Processor.Process(feature.Command{Content: string(line), TimeoutSec: CommandTimeoutSec, ClientID: clientIP})
 		server.UDPListener.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
 		if _, err := server.UDPListener.WriteToUDP([]byte(result.CombinedOutput), clientAddr); err != nil {
 			server.Logger.Warningf("HandleUDPConnection", clientIP, err, "failed to write response")
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/HouzuoGuo/laitos/acme"
 	"github.com/HouzuoGuo/laitos/email"
 	"github.com/HouzuoGuo/laitos/env"
 	"github.com/HouzuoGuo/laitos/frontend/mailp"
@@ -39,8 +40,9 @@ type SMTPD struct {
 	ForwardMailer email.Mailer        `json:"-"` // Use this mailer to forward arrived mails
 	SMTPConfig    smtp.Config         `json:"-"` // SMTP processor configuration
 
-	Listener       net.Listener    `json:"-"` // Once daemon is started, this is its TCP listener.
-	TLSCertificate tls.Certificate `json:"-"` // TLS certificate read from the certificate and key files
+	Listener       net.Listener      `json:"-"` // Once daemon is started, this is its TCP listener.
+	TLSCertificate tls.Certificate   `json:"-"` // TLS certificate read from the certificate and key files
+	CertManager    *acme.CertManager `json:"-"` // (Optional) serve StartTLS via certificate obtained and renewed automatically via ACME
 
 	MailProcessor *mailp.MailProcessor `json:"-"` // Process feature commands from incoming mails
 	RateLimit     *env.RateLimit       `json:"-"` // Rate limit counter per IP address
@@ -68,6 +70,9 @@ func (smtpd *SMTPD) Initialise() error {
 	if smtpd.MyDomains == nil || len(smtpd.MyDomains) == 0 {
 		return errors.New("SMTPD.Initialise: my domain names must be configured")
 	}
+	if smtpd.CertManager != nil && smtpd.TLSCertPath != "" {
+		return errors.New("SMTPD.Initialise: TLS certificate files may not be used together with ACME")
+	}
 	if smtpd.TLSCertPath != "" || smtpd.TLSKeyPath != "" {
 		if smtpd.TLSCertPath == "" || smtpd.TLSKeyPath == "" {
 			return errors.New("SMTPD.Initialise: if TLS is to be enabled, both TLS certificate and key path must be present.")
@@ -89,6 +94,8 @@ func (smtpd *SMTPD) Initialise() error {
 	}
 	if smtpd.TLSCertPath != "" {
 		smtpd.SMTPConfig.TLSConfig = &tls.Config{Certificates: []tls.Certificate{smtpd.TLSCertificate}}
+	} else if smtpd.CertManager != nil {
+		smtpd.SMTPConfig.TLSConfig = &tls.Config{GetCertificate: smtpd.CertManager.GetCertificate}
 	}
 	smtpd.RateLimit = &env.RateLimit{
 		MaxCount: smtpd.PerIPLimit,
@@ -125,8 +132,20 @@ func (smtpd *SMTPD) Initialise() error {
 	return nil
 }
 
-// Unconditionally forward the mail to forward addresses, then process feature commands if they are found.
-func (smtpd *SMTPD) ProcessMail(fromAddr, mailBody string) {
+/*
+mailClientID identifies the sender of a mail for protection against brute-force guessing of PIN. The SMTP client is
+often a mail relay of a large provider that delivers mails of plenty of senders, hence its IP alone must not be banned.
+*/
+func mailClientID(clientIP, fromAddr string) string {
+	return strings.ToLower(fromAddr) + " via " + clientIP
+}
+
+/*
+Unconditionally forward the mail to forward addresses, then process feature commands if they are found. Client IP
+is the address of SMTP client that delivered the mail, along with the envelope sender address it is used to protect
+against brute-force guessing of PIN.
+*/
+func (smtpd *SMTPD) ProcessMail(clientIP, fromAddr, mailBody string) {
 	bodyBytes := []byte(mailBody)
 	// Forward the mail
 	if err := smtpd.ForwardMailer.SendRaw(smtpd.ForwardMailer.MailFrom, bodyBytes, smtpd.ForwardTo...); err == nil {
@@ -135,7 +154,7 @@ func (smtpd *SMTPD) ProcessMail(fromAddr, mailBody string) {
 		smtpd.Logger.Warningf("ProcessMail", fromAddr, err, "failed to forward email")
 	}
 	// Run feature command from mail body
-	if err := smtpd.MailProcessor.Process(bodyBytes, smtpd.ForwardTo...); err != nil {
+	if err := smtpd.MailProcessor.ProcessFromClient(mailClientID(clientIP, fromAddr), bodyBytes, smtpd.ForwardTo...); err != nil {
 		smtpd.Logger.Warningf("ProcessMail", fromAddr, err, "failed to process feature command")
 	}
 }
@@ -145,7 +164,7 @@ func (smtpd *SMTPD) HandleConnection(clientConn net.Conn) {
 	// Put conversation duration (including IO time) into statistics
 	beginTimeNano := time.Now().UnixNano()
 	defer func() {
-		DurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+		DurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 	}()
 	defer clientConn.Close()
 	clientIP := clientConn.RemoteAddr().(*net.TCPAddr).IP.String()
@@ -212,7 +231,7 @@ done:
 	if finishedNormally {
 		smtpd.Logger.Printf("HandleConnection", clientIP, nil, "received mail from \"%s\" addressed to %v", fromAddr, toAddrs)
 		// Forward the mail to forward-recipients, hence the original To-Addresses are not relevant.
-		smtpd.ProcessMail(fromAddr, mailBody)
+		smtpd.ProcessMail(clientIP, fromAddr, mailBody)
 		smtpd.Logger.Printf("HandleConnection", clientIP, nil, "%s after %d conversations, last of which is %s", finishReason, numConversations, lastConversation)
 	} else {
 		smtpd.Logger.Warningf("HandleConnection", clientIP, nil, "%s after %d conversations, last of which is %s", finishReason, numConversations, lastConversation)
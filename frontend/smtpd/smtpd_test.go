@@ -2,12 +2,32 @@ package smtpd
 
 import (
 	"github.com/HouzuoGuo/laitos/email"
+	"github.com/HouzuoGuo/laitos/env"
 	"github.com/HouzuoGuo/laitos/frontend/common"
 	"github.com/HouzuoGuo/laitos/frontend/mailp"
 	"strings"
 	"testing"
 )
 
+func TestSMTPD_ProcessMail_Bans(t *testing.T) {
+	daemon := SMTPD{MailProcessor: &mailp.MailProcessor{CommandTimeoutSec: 10, Processor: common.GetTestCommandProcessor()}}
+	daemon.MailProcessor.Processor.Bans = &env.BanManager{MaxFailures: 2}
+	if err := daemon.MailProcessor.Processor.Bans.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	badPIN := "Subject: hi\r\nContent-Type: text/plain\r\n\r\nbadpin.s echo hi"
+	for i := 0; i < 2; i++ {
+		daemon.ProcessMail("1.2.3.4", "Guesser@example.com", badPIN)
+	}
+	// The sender is banned, however other senders of the same mail relay are not.
+	if !daemon.MailProcessor.Processor.Bans.IsBanned(mailClientID("1.2.3.4", "guesser@example.com")) {
+		t.Fatal("did not ban the sender")
+	}
+	if daemon.MailProcessor.Processor.Bans.IsBanned("1.2.3.4") || daemon.MailProcessor.Processor.Bans.IsBanned(mailClientID("1.2.3.4", "howard@example.com")) {
+		t.Fatal("should not have banned the relay")
+	}
+}
+
 func TestSMTPD_StartAndBlock(t *testing.T) {
 	goodMailer := email.Mailer{
 		MailFrom: "howard@localhost",
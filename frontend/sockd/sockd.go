@@ -25,6 +25,9 @@ const (
 	MaxPacketSize        = 9038
 )
 
+// BytesRelayed counts the bytes piped between clients and their destinations, keyed by protocol "tcp" or "udp".
+var BytesRelayed = env.NewCounters()
+
 // Sockd is intentionally undocumented magic ^____^
 type Sockd struct {
 	Address    string `json:"Address"`
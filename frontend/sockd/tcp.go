@@ -201,7 +201,7 @@ func (conn *TCPCipherConnection) WriteRand() {
 func (conn *TCPCipherConnection) HandleTCPConnection() {
 	beginTimeNano := time.Now().UnixNano()
 	defer func() {
-		TCPDurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+		TCPDurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 	}()
 	defer conn.Close()
 	remoteAddr := conn.RemoteAddr().String()
@@ -244,6 +244,7 @@ func PipeTCPConnection(fromConn, toConn net.Conn) {
 			if _, err := toConn.Write(buf[:length]); err != nil {
 				return
 			}
+			BytesRelayed.Add(uint64(length), "tcp")
 		}
 		if err != nil {
 			return
@@ -236,7 +236,7 @@ func (sock *Sockd) StartAndBlockUDP() error {
 func (sock *Sockd) HandleUDPConnection(server *UDPCipherConnection, n int, clientAddr *net.UDPAddr, packet []byte) {
 	beginTimeNano := time.Now().UnixNano()
 	defer func() {
-		UDPDurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+		UDPDurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 	}()
 	var destIP net.IP
 	var packetLen int
@@ -313,7 +313,9 @@ func (sock *Sockd) HandleUDPConnection(server *UDPCipherConnection, n int, clien
 		if conn := sock.UDPTable.Delete(clientAddr.String()); conn != nil {
 			conn.Close()
 		}
+		return
 	}
+	BytesRelayed.Add(uint64(n-packetLen), "udp")
 	return
 }
 
@@ -332,5 +334,6 @@ func (sock *Sockd) PipeUDPConnection(server net.PacketConn, clientAddr *net.UDPA
 			header, headerLength := MakeUDPRequestHeader(addr)
 			server.WriteTo(append(header[:headerLength], packet[:length]...), clientAddr)
 		}
+		BytesRelayed.Add(uint64(length), "udp")
 	}
 }
@@ -155,11 +155,15 @@ func (bot *TelegramBot) ProcessMessages(updates APIUpdates) {
 		}
 		// Find and run command in background
 		go func(ding APIUpdate, beginTimeNano int64) {
-			result := bot.Processor.Process(feature.Command{TimeoutSec: CommandTimeoutSec, Content: ding.Message.Text})
+			result := bot.Processor.Process(feature.Command{
+				TimeoutSec: CommandTimeoutSec,
+				Content:    ding.Message.Text,
+				ClientID:   fmt.Sprintf("telegram:%d", ding.Message.Chat.ID),
+			})
 			if err := bot.ReplyTo(ding.Message.Chat.ID, result.CombinedOutput); err != nil {
 				bot.Logger.Warningf("ProcessMessages", ding.Message.Chat.UserName, err, "failed to send message reply")
 			}
-			DurationStats.Trigger(float64((time.Now().UnixNano() - beginTimeNano) / 1000000))
+			DurationStats.Trigger(float64(time.Now().UnixNano()-beginTimeNano) / 1000000)
 		}(ding, beginTimeNano)
 	}
 }
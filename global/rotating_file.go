@@ -0,0 +1,114 @@
+package global
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+RotatingFile appends to a file, and renames the file into numbered backups (e.g. "file.1", "file.2") when it grows too
+large or gets too old. If the file cannot be opened or rotated, the next write tries again. It is safe for concurrent use.
+*/
+type RotatingFile struct {
+	mutex       *sync.Mutex
+	filePath    string
+	file        *os.File
+	fileSize    int64
+	openedAt    time.Time
+	maxFileSize int64
+	maxAge      time.Duration
+	numBackups  int
+}
+
+/*
+OpenRotatingFile opens the file for appending. The file is rotated when it grows beyond the maximum size, or when it
+has been open for longer than maximum age (zero means the file is rotated only by size). Only the specified number of
+backups are kept.
+*/
+func OpenRotatingFile(filePath string, maxFileSize int64, maxAge time.Duration, numBackups int) (*RotatingFile, error) {
+	file := &RotatingFile{mutex: new(sync.Mutex), filePath: filePath}
+	file.SetRotation(maxFileSize, maxAge, numBackups)
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// SetRotation changes the maximum size, maximum age, and number of backups of the file.
+func (file *RotatingFile) SetRotation(maxFileSize int64, maxAge time.Duration, numBackups int) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	file.maxFileSize = maxFileSize
+	file.maxAge = maxAge
+	file.numBackups = numBackups
+}
+
+// open opens the file for appending. Caller must hold the mutex unless the file is not yet shared.
+func (file *RotatingFile) open() error {
+	f, err := os.OpenFile(file.filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	file.file = f
+	file.fileSize = info.Size()
+	file.openedAt = time.Now()
+	return nil
+}
+
+// rotate renames the file into a backup and opens a new file. Caller must hold the mutex.
+func (file *RotatingFile) rotate() error {
+	file.file.Close()
+	file.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", file.filePath, file.numBackups))
+	for i := file.numBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", file.filePath, i), fmt.Sprintf("%s.%d", file.filePath, i+1))
+	}
+	if err := os.Rename(file.filePath, file.filePath+".1"); err != nil {
+		return err
+	}
+	return file.open()
+}
+
+// Write appends the content to the file, and rotates the file beforehand if it is due.
+func (file *RotatingFile) Write(content []byte) (int, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.filePath == "" {
+		return 0, errors.New("RotatingFile.Write: file is closed")
+	}
+	if file.file == nil {
+		// Open the file again after a failed rotation
+		if err := file.open(); err != nil {
+			return 0, err
+		}
+	}
+	if file.fileSize > 0 && (file.fileSize+int64(len(content)) > file.maxFileSize || (file.maxAge > 0 && time.Since(file.openedAt) > file.maxAge)) {
+		if err := file.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := file.file.Write(content)
+	file.fileSize += int64(n)
+	return n, err
+}
+
+// Close closes the file, and the file will no longer be written.
+func (file *RotatingFile) Close() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	file.filePath = ""
+	if file.file == nil {
+		return nil
+	}
+	err := file.file.Close()
+	file.file = nil
+	return err
+}
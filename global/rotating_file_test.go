@@ -0,0 +1,73 @@
+package global
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-test-rotating-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "file.log")
+	if _, err := OpenRotatingFile(path.Join(dir, "nonexistent", "file.log"), 10, 0, 2); err == nil {
+		t.Fatal("did not error")
+	}
+	file, err := OpenRotatingFile(filePath, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContent := func(suffix, expected string) {
+		t.Helper()
+		if content, err := ioutil.ReadFile(filePath + suffix); err != nil || string(content) != expected {
+			t.Fatal(suffix, string(content), err)
+		}
+	}
+	// Rotate by size and keep only the configured number of backups
+	for _, line := range []string{"a\n", "bbbbbbbbb\n", "c\n", "d\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectContent("", "c\nd\n")
+	expectContent(".1", "bbbbbbbbb\n")
+	expectContent(".2", "a\n")
+	file.Write([]byte("eeeeeeee\n"))
+	expectContent("", "eeeeeeee\n")
+	expectContent(".1", "c\nd\n")
+	expectContent(".2", "bbbbbbbbb\n")
+	if _, err := os.Stat(filePath + ".3"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Rotate by age
+	file.SetRotation(100, time.Millisecond, 2)
+	time.Sleep(10 * time.Millisecond)
+	file.Write([]byte("f\n"))
+	expectContent("", "f\n")
+	expectContent(".1", "eeeeeeee\n")
+	// A failed rotation is retried by the next write
+	file.SetRotation(1, 0, 2)
+	if err := os.Remove(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("g\n")); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := file.Write([]byte("h\n")); err != nil {
+		t.Fatal(err)
+	}
+	expectContent("", "h\n")
+	// Closed file is no longer written
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("i\n")); err == nil {
+		t.Fatal("did not error")
+	}
+	expectContent("", "h\n")
+}
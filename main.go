@@ -195,18 +195,26 @@ func main() {
 		logger.Warningf("main", "", nil, "System tuning result is: \n%s", feature.TuneLinux())
 	}
 
+	// All daemons share the same brute-force protection, which may be inspected and lifted via ".e bans" and ".e unban"
+	feature.Bans = config.GetBanManager()
+
 	// Finally laitos daemon start
 	waitGroup := &sync.WaitGroup{}
 	var numDaemons int32
+	reloader := NewConfigReloader(configFile, config)
+	startDaemon := func(frontendName string, daemon Daemon) {
+		reloader.Track(frontendName, daemon)
+		StartDaemon(&numDaemons, waitGroup, frontendName, daemon)
+	}
 	for _, frontendName := range frontends {
 		// Daemons are started all at once, the order of startup does not matter.
 		switch frontendName {
 		case "dnsd":
-			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetDNSD())
+			startDaemon(frontendName, config.GetDNSD())
 		case "httpd":
-			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetHTTPD())
+			startDaemon(frontendName, config.GetHTTPD())
 		case "insecurehttpd":
-			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetInsecureHTTPD())
+			startDaemon(frontendName, config.GetInsecureHTTPD())
 		case "mailp":
 			mailContent, err := ioutil.ReadAll(os.Stdin)
 			if err != nil {
@@ -217,21 +225,28 @@ func main() {
 				logger.Fatalf("main", "", err, "failed to process mail")
 			}
 		case "maintenance":
-			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetMaintenance())
+			startDaemon(frontendName, config.GetMaintenance())
 		case "plaintext":
-			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetPlainTextDaemon())
+			startDaemon(frontendName, config.GetPlainTextDaemon())
 		case "smtpd":
-			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetMailDaemon())
+			startDaemon(frontendName, config.GetMailDaemon())
 		case "sockd":
-			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetSockDaemon())
+			startDaemon(frontendName, config.GetSockDaemon())
 		case "telegram":
-			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetTelegramBot())
+			startDaemon(frontendName, config.GetTelegramBot())
 		default:
 			logger.Fatalf("main", "", err, "unknown frontend name \"%s\"", frontendName)
 		}
 	}
 	if numDaemons > 0 {
 		logger.Printf("main", "", nil, "started %d daemons", numDaemons)
+		// Daemons are already using the cached certificate (if any), obtain or renew it in the background.
+		if certManager := config.GetCertManager(); certManager != nil {
+			go certManager.KeepRenewed(nil)
+		}
+		// Features, bridges, and handlers of running daemons may be reloaded via SIGHUP or ".e reload" command
+		feature.ReloadConfig = reloader.Reload
+		reloader.ReloadUponSIGHUP()
 	}
 	// Daemons are not really supposed to quit
 	waitGroup.Wait()
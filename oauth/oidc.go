@@ -0,0 +1,338 @@
+package oauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/httpclient"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OIDCDiscoveryPath         = "/.well-known/openid-configuration" // OIDCDiscoveryPath is appended to issuer URL to find provider configuration.
+	OIDCKeyRefreshIntervalSec = 60                                  // OIDCKeyRefreshIntervalSec is the minimum interval between retrievals of provider's signing keys.
+	OIDCClockSkewSec          = 60                                  // OIDCClockSkewSec is the tolerance of clock difference when checking token expiry.
+	OIDCRequestTimeoutSec     = 30                                  // OIDCRequestTimeoutSec is the timeout in seconds of requests made to provider.
+)
+
+// ErrOIDCBadToken is returned when ID token is malformed, expired, or not meant for this client.
+var ErrOIDCBadToken = errors.New("invalid ID token")
+
+// oidcDiscovery is the subset of provider configuration (OpenID Connect Discovery 1.0) used by the relying party.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcJWK is a public signing key in JSON Web Key format, only RSA and P-256 EC keys are understood.
+type oidcJWK struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// IDToken carries the verified identity claims of an OpenID Connect ID token.
+type IDToken struct {
+	Subject       string    // Subject is the provider's unique and permanent identifier of the user.
+	Email         string    // Email is the email address of the user, it is empty if the provider did not reveal one.
+	EmailVerified bool      // EmailVerified is true only if the provider has verified that the user owns the email address.
+	Name          string    // Name is the display name of the user.
+	Expiry        time.Time // Expiry is the moment the token expires.
+}
+
+/*
+OIDCProvider is an OpenID Connect relying party that signs users in via an external identity provider such as Google,
+GitLab, or a self-hosted Keycloak, using authorization code flow. ID tokens signed by RS256 and ES256 are supported.
+*/
+type OIDCProvider struct {
+	Issuer       string   `json:"Issuer"`       // Issuer URL, e.g. "https://accounts.google.com", provider configuration is discovered from it.
+	ClientID     string   `json:"ClientID"`     // Client ID registered with the provider
+	ClientSecret string   `json:"ClientSecret"` // Client secret registered with the provider
+	Scopes       []string `json:"Scopes"`       // (Optional) scopes to request, by default "openid email profile".
+
+	discovery     oidcDiscovery
+	keys          map[string]crypto.PublicKey // keys are the provider's signing keys, keyed by key ID.
+	keysRefreshed time.Time                   // keysRefreshed is the moment keys were retrieved the last time.
+	keysMutex     *sync.Mutex
+}
+
+// Initialise discovers provider configuration and retrieves its signing keys.
+func (prov *OIDCProvider) Initialise() error {
+	if prov.Issuer == "" || prov.ClientID == "" {
+		return errors.New("OIDCProvider.Initialise: Issuer and ClientID must not be empty")
+	}
+	prov.Issuer = strings.TrimSuffix(prov.Issuer, "/")
+	if len(prov.Scopes) == 0 {
+		prov.Scopes = []string{"openid", "email", "profile"}
+	}
+	prov.keysMutex = new(sync.Mutex)
+	resp, err := httpclient.DoHTTP(httpclient.Request{TimeoutSec: OIDCRequestTimeoutSec}, prov.Issuer+OIDCDiscoveryPath)
+	if err == nil {
+		err = resp.Non2xxToError()
+	}
+	if err != nil {
+		return fmt.Errorf("OIDCProvider.Initialise: failed to retrieve configuration of %s - %v", prov.Issuer, err)
+	}
+	if err := json.Unmarshal(resp.Body, &prov.discovery); err != nil {
+		return fmt.Errorf("OIDCProvider.Initialise: failed to parse configuration of %s - %v", prov.Issuer, err)
+	}
+	if strings.TrimSuffix(prov.discovery.Issuer, "/") != prov.Issuer {
+		return fmt.Errorf("OIDCProvider.Initialise: provider claims to be issuer \"%s\" instead of \"%s\"", prov.discovery.Issuer, prov.Issuer)
+	}
+	if prov.discovery.AuthorizationEndpoint == "" || prov.discovery.TokenEndpoint == "" || prov.discovery.JWKSURI == "" {
+		return fmt.Errorf("OIDCProvider.Initialise: configuration of %s lacks an endpoint", prov.Issuer)
+	}
+	return prov.refreshKeys()
+}
+
+// refreshKeys retrieves the provider's signing keys.
+func (prov *OIDCProvider) refreshKeys() error {
+	resp, err := httpclient.DoHTTP(httpclient.Request{TimeoutSec: OIDCRequestTimeoutSec}, prov.discovery.JWKSURI)
+	if err == nil {
+		err = resp.Non2xxToError()
+	}
+	if err != nil {
+		return fmt.Errorf("OIDCProvider.refreshKeys: failed to retrieve keys - %v", err)
+	}
+	var keySet struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	if err := json.Unmarshal(resp.Body, &keySet); err != nil {
+		return fmt.Errorf("OIDCProvider.refreshKeys: failed to parse keys - %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+	prov.keysMutex.Lock()
+	prov.keys = keys
+	prov.keysRefreshed = time.Now()
+	prov.keysMutex.Unlock()
+	return nil
+}
+
+// publicKey decodes the RSA or EC P-256 public key.
+func (jwk oidcJWK) publicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve \"%s\"", jwk.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type \"%s\"", jwk.KeyType)
+	}
+}
+
+// getKey returns the signing key of the key ID, and retrieves keys again if the ID is unknown, as providers rotate keys.
+func (prov *OIDCProvider) getKey(keyID string) crypto.PublicKey {
+	prov.keysMutex.Lock()
+	key, found := prov.keys[keyID]
+	mayRefresh := time.Since(prov.keysRefreshed) > OIDCKeyRefreshIntervalSec*time.Second
+	prov.keysMutex.Unlock()
+	if found || !mayRefresh {
+		return key
+	}
+	if err := prov.refreshKeys(); err != nil {
+		return nil
+	}
+	prov.keysMutex.Lock()
+	defer prov.keysMutex.Unlock()
+	return prov.keys[keyID]
+}
+
+// AuthCodeURL returns the provider URL that asks user to sign in and then returns to redirect URL with an authorization code.
+func (prov *OIDCProvider) AuthCodeURL(redirectURL, state, nonce string) string {
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {prov.ClientID},
+		"redirect_uri":  {redirectURL},
+		"scope":         {strings.Join(prov.Scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	separator := "?"
+	if strings.Contains(prov.discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return prov.discovery.AuthorizationEndpoint + separator + query.Encode()
+}
+
+/*
+Exchange redeems the authorization code for an ID token, and returns the identity after verifying the token. The
+redirect URL must be identical to the one given to AuthCodeURL.
+*/
+func (prov *OIDCProvider) Exchange(redirectURL, code, nonce string) (*IDToken, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURL},
+	}
+	resp, err := httpclient.DoHTTP(httpclient.Request{
+		TimeoutSec: OIDCRequestTimeoutSec,
+		Method:     http.MethodPost,
+		Body:       strings.NewReader(form.Encode()),
+		RequestFunc: func(req *http.Request) error {
+			// Client secret basic authentication is the default method of token endpoint
+			req.SetBasicAuth(url.QueryEscape(prov.ClientID), url.QueryEscape(prov.ClientSecret))
+			req.Header.Set("Accept", "application/json")
+			return nil
+		},
+	}, prov.discovery.TokenEndpoint)
+	if err == nil {
+		err = resp.Non2xxToError()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("OIDCProvider.Exchange: failed to redeem authorization code - %v", err)
+	}
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(resp.Body, &tokenResp); err != nil || tokenResp.IDToken == "" {
+		return nil, fmt.Errorf("OIDCProvider.Exchange: token response does not carry an ID token - %v", err)
+	}
+	return prov.VerifyIDToken(tokenResp.IDToken, nonce)
+}
+
+// VerifyIDToken checks signature, issuer, audience, expiry, and nonce of the ID token, and returns its identity claims.
+func (prov *OIDCProvider) VerifyIDToken(rawToken, nonce string) (*IDToken, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrOIDCBadToken
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, ErrOIDCBadToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrOIDCBadToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	key := prov.getKey(header.KeyID)
+	switch header.Algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return nil, fmt.Errorf("OIDCProvider.VerifyIDToken: %v - bad RS256 signature", ErrOIDCBadToken)
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 ||
+			!ecdsa.Verify(ecKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return nil, fmt.Errorf("OIDCProvider.VerifyIDToken: %v - bad ES256 signature", ErrOIDCBadToken)
+		}
+	default:
+		return nil, fmt.Errorf("OIDCProvider.VerifyIDToken: %v - unsupported algorithm \"%s\"", ErrOIDCBadToken, header.Algorithm)
+	}
+	var claims struct {
+		Issuer        string          `json:"iss"`
+		Subject       string          `json:"sub"`
+		Audience      json.RawMessage `json:"aud"`
+		Expiry        int64           `json:"exp"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified interface{}     `json:"email_verified"`
+		Name          string          `json:"name"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, ErrOIDCBadToken
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != prov.Issuer {
+		return nil, fmt.Errorf("OIDCProvider.VerifyIDToken: %v - unexpected issuer \"%s\"", ErrOIDCBadToken, claims.Issuer)
+	}
+	// Audience is either a single string or an array of strings
+	var audiences []string
+	var audience string
+	if err := json.Unmarshal(claims.Audience, &audience); err == nil {
+		audiences = []string{audience}
+	} else if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+		return nil, ErrOIDCBadToken
+	}
+	audienceMatched := false
+	for _, aud := range audiences {
+		if aud == prov.ClientID {
+			audienceMatched = true
+		}
+	}
+	if !audienceMatched {
+		return nil, fmt.Errorf("OIDCProvider.VerifyIDToken: %v - token is not meant for this client", ErrOIDCBadToken)
+	}
+	expiry := time.Unix(claims.Expiry, 0)
+	if time.Now().After(expiry.Add(OIDCClockSkewSec * time.Second)) {
+		return nil, fmt.Errorf("OIDCProvider.VerifyIDToken: %v - token expired at %s", ErrOIDCBadToken, expiry.Format(time.RFC3339))
+	}
+	if claims.Subject == "" || claims.Nonce != nonce {
+		return nil, fmt.Errorf("OIDCProvider.VerifyIDToken: %v - subject is missing or nonce does not match", ErrOIDCBadToken)
+	}
+	// Some providers present email_verified as a string
+	emailVerified := claims.EmailVerified == true || claims.EmailVerified == "true"
+	return &IDToken{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: emailVerified,
+		Name:          claims.Name,
+		Expiry:        expiry,
+	}, nil
+}
+
+// decodeJWTPart decodes a base64url-encoded JSON part of JSON Web Token.
+func decodeJWTPart(part string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
@@ -0,0 +1,152 @@
+package oauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/*
+OIDCStandIn is a minimal OpenID Connect provider running on a local HTTP server, test cases use it in place of a real
+provider. It signs in the configured user without asking, and signs ID tokens with a freshly generated RSA key.
+*/
+type OIDCStandIn struct {
+	Server       *httptest.Server
+	ClientID     string
+	ClientSecret string
+	Subject      string // Subject is the identifier of the user who signs in.
+	Email        string // Email is the verified email address of the user who signs in.
+
+	key   *rsa.PrivateKey
+	codes map[string]string // codes are the authorization codes yet to be redeemed and their nonce.
+	mutex *sync.Mutex
+}
+
+// NewOIDCStandIn starts a stand-in provider that accepts the client ID and secret. Caller should close its server.
+func NewOIDCStandIn(clientID, clientSecret string) (*OIDCStandIn, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	standIn := &OIDCStandIn{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Subject:      "stand-in-subject",
+		Email:        "stand-in@example.com",
+		key:          key,
+		codes:        make(map[string]string),
+		mutex:        new(sync.Mutex),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(OIDCDiscoveryPath, standIn.handleDiscovery)
+	mux.HandleFunc("/authorize", standIn.handleAuthorize)
+	mux.HandleFunc("/token", standIn.handleToken)
+	mux.HandleFunc("/jwks", standIn.handleJWKS)
+	standIn.Server = httptest.NewServer(mux)
+	return standIn, nil
+}
+
+// Issuer returns the issuer URL of the stand-in provider.
+func (standIn *OIDCStandIn) Issuer() string {
+	return standIn.Server.URL
+}
+
+// SignToken returns an ID token carrying the claims, signed by RS256.
+func (standIn *OIDCStandIn) SignToken(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "stand-in", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, standIn.key, crypto.SHA256, digest[:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Claims returns valid ID token claims of the user, meant for the client.
+func (standIn *OIDCStandIn) Claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            standIn.Issuer(),
+		"sub":            standIn.Subject,
+		"aud":            standIn.ClientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          standIn.Email,
+		"email_verified": true,
+	}
+}
+
+func (standIn *OIDCStandIn) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(oidcDiscovery{
+		Issuer:                standIn.Issuer(),
+		AuthorizationEndpoint: standIn.Issuer() + "/authorize",
+		TokenEndpoint:         standIn.Issuer() + "/token",
+		JWKSURI:               standIn.Issuer() + "/jwks",
+	})
+}
+
+func (standIn *OIDCStandIn) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string][]oidcJWK{"keys": {{
+		KeyType: "RSA",
+		KeyID:   "stand-in",
+		Use:     "sig",
+		N:       base64.RawURLEncoding.EncodeToString(standIn.key.N.Bytes()),
+		E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(standIn.key.E)).Bytes()),
+	}}})
+}
+
+// handleAuthorize signs the user in right away and redirects to client with an authorization code.
+func (standIn *OIDCStandIn) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	redirectURL, err := url.Parse(r.FormValue("redirect_uri"))
+	if err != nil || r.FormValue("client_id") != standIn.ClientID || r.FormValue("response_type") != "code" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	codeBytes := make([]byte, 16)
+	rand.Read(codeBytes)
+	code := hex.EncodeToString(codeBytes)
+	standIn.mutex.Lock()
+	standIn.codes[code] = r.FormValue("nonce")
+	standIn.mutex.Unlock()
+	query := redirectURL.Query()
+	query.Set("code", code)
+	query.Set("state", r.FormValue("state"))
+	redirectURL.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+}
+
+// handleToken redeems an authorization code for an ID token.
+func (standIn *OIDCStandIn) handleToken(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, _ := r.BasicAuth()
+	clientID, _ = url.QueryUnescape(clientID)
+	clientSecret, _ = url.QueryUnescape(clientSecret)
+	if clientID != standIn.ClientID || clientSecret != standIn.ClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	code := r.FormValue("code")
+	standIn.mutex.Lock()
+	nonce, found := standIn.codes[code]
+	delete(standIn.codes, code)
+	standIn.mutex.Unlock()
+	if !found || r.FormValue("grant_type") != "authorization_code" {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "stand-in-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     standIn.SignToken(standIn.Claims(nonce)),
+	})
+}
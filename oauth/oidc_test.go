@@ -0,0 +1,51 @@
+package oauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOIDCProvider_VerifyIDToken(t *testing.T) {
+	standIn, err := NewOIDCStandIn("laitos-client", "laitos-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standIn.Server.Close()
+	prov := OIDCProvider{Issuer: standIn.Issuer(), ClientID: "laitos-client", ClientSecret: "laitos-secret"}
+	if err := prov.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := prov.VerifyIDToken(standIn.SignToken(standIn.Claims("nonce")), "nonce"); err != nil ||
+		token.Subject != standIn.Subject || token.Email != standIn.Email || !token.EmailVerified {
+		t.Fatal(token, err)
+	}
+	for claim, value := range map[string]interface{}{
+		"iss":   "https://another.example.com",
+		"aud":   []string{"another-client"},
+		"exp":   time.Now().Add(-time.Hour).Unix(),
+		"nonce": "another-nonce",
+		"sub":   "",
+	} {
+		claims := standIn.Claims("nonce")
+		claims[claim] = value
+		if _, err := prov.VerifyIDToken(standIn.SignToken(claims), "nonce"); err == nil {
+			t.Fatal("did not error", claim)
+		}
+	}
+	// Audience may be an array
+	claims := standIn.Claims("nonce")
+	claims["aud"] = []string{"another-client", "laitos-client"}
+	if _, err := prov.VerifyIDToken(standIn.SignToken(claims), "nonce"); err != nil {
+		t.Fatal(err)
+	}
+	// Tampered payload
+	parts := strings.Split(standIn.SignToken(standIn.Claims("nonce")), ".")
+	claims["sub"] = "someone-else"
+	payload, _ := json.Marshal(claims)
+	if _, err := prov.VerifyIDToken(parts[0]+"."+base64.RawURLEncoding.EncodeToString(payload)+"."+parts[2], "nonce"); err == nil {
+		t.Fatal("did not error")
+	}
+}
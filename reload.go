@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
+	"github.com/HouzuoGuo/laitos/frontend/httpd"
+	"github.com/HouzuoGuo/laitos/frontend/plain"
+	"github.com/HouzuoGuo/laitos/frontend/smtpd"
+	"github.com/HouzuoGuo/laitos/frontend/telegrambot"
+	"github.com/HouzuoGuo/laitos/global"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+/*
+ConfigReloader re-reads configuration file and applies features, bridges, rate limits, and HTTP handlers of the new
+configuration to running daemons, without restarting them. Settings such as listen address, port, TLS certificate, and
+DNS forward rules only take effect after a restart.
+*/
+type ConfigReloader struct {
+	ConfigFilePath string                 // ConfigFilePath is the path to JSON configuration file.
+	Config         Config                 // Config is the configuration currently in effect.
+	Daemons        map[string]interface{} // Daemons are the running daemons keyed by frontend name.
+	Logger         global.Logger          // Logger
+
+	mutex *sync.Mutex // mutex prevents concurrent reloads
+}
+
+// NewConfigReloader returns a reloader for daemons constructed from the configuration file.
+func NewConfigReloader(configFilePath string, config Config) *ConfigReloader {
+	return &ConfigReloader{
+		ConfigFilePath: configFilePath,
+		Config:         config,
+		Daemons:        make(map[string]interface{}),
+		Logger:         global.Logger{ComponentName: "ConfigReloader", ComponentID: configFilePath},
+		mutex:          new(sync.Mutex),
+	}
+}
+
+// Track remembers a daemon that has been started for the frontend, so that reload will apply to the daemon.
+func (reloader *ConfigReloader) Track(frontendName string, daemon interface{}) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	reloader.Daemons[frontendName] = daemon
+}
+
+/*
+Reload reads and validates configuration file, and then replaces features, bridges, rate limits, and handlers of the
+running daemons by those from the new configuration. If the new configuration fails to validate, the running daemons
+carry on with the old configuration, and an error is returned.
+*/
+func (reloader *ConfigReloader) Reload() error {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	content, err := ioutil.ReadFile(reloader.ConfigFilePath)
+	if err != nil {
+		return fmt.Errorf("ConfigReloader.Reload: failed to read config file - %v", err)
+	}
+	var newConfig Config
+	if err := newConfig.DeserialiseFromJSON(content); err != nil {
+		return fmt.Errorf("ConfigReloader.Reload: failed to deserialise config file - %v", err)
+	}
+	// Certificate manager is busy renewing the certificate in use, it carries on with the old configuration.
+	newConfig.ACME = reloader.Config.ACME
+	// Bans and failure counters of brute-force protection outlive the reload as well.
+	newConfig.BruteForceProtection = reloader.Config.BruteForceProtection
+	frontends := make([]string, 0, len(reloader.Daemons))
+	for frontendName := range reloader.Daemons {
+		frontends = append(frontends, frontendName)
+	}
+	fresh, err := newConfig.Validate(frontends)
+	if err != nil {
+		reloader.Logger.Warningf("Reload", "", err, "new configuration is invalid, keep using the old configuration")
+		return err
+	}
+	// Construct handlers of HTTP daemons only after the configuration is found valid, and before anything is replaced.
+	reinitialised := make([]string, 0, len(reloader.Daemons))
+	for frontendName, daemon := range reloader.Daemons {
+		if running, isHTTPD := daemon.(*httpd.HTTPD); isHTTPD {
+			if err := fresh[frontendName].(*httpd.HTTPD).Reinitialise(running); err != nil {
+				reloader.Logger.Warningf("Reload", frontendName, err, "failed to construct handlers, keep using the old configuration")
+				// Handlers already constructed for other daemons will not be used
+				for _, name := range reinitialised {
+					fresh[name].(*httpd.HTTPD).DiscardHandlers(reloader.Daemons[name].(*httpd.HTTPD))
+				}
+				return err
+			}
+			reinitialised = append(reinitialised, frontendName)
+		}
+	}
+	for frontendName, daemon := range reloader.Daemons {
+		switch running := daemon.(type) {
+		case *dnsd.DNSD:
+			newDaemon := fresh[frontendName].(*dnsd.DNSD)
+			running.ReplaceAllowQueryIPPrefixes(newDaemon.AllowQueryIPPrefixes)
+			running.RateLimit.SetMaxCount(newDaemon.PerIPLimit)
+			running.ResponseRateLimit.SetMaxBytes(newDaemon.PerNetblockResponseBytes)
+			if running.Processor != nil && newDaemon.Processor != nil {
+				running.Processor.ReplaceWith(newDaemon.Processor)
+			} else if running.Processor != nil || newDaemon.Processor != nil {
+				reloader.Logger.Warningf("Reload", frontendName, nil, "change of command subdomain takes effect after a restart")
+			}
+			oldDNSD, newDNSD := reloader.Config.DNSDaemon, newConfig.DNSDaemon
+			reloader.warnIfChanged(frontendName, "forward rules", oldDNSD.ForwardRules, newDNSD.ForwardRules)
+			reloader.warnIfChanged(frontendName, "authoritative zones", oldDNSD.AuthoritativeZones, newDNSD.AuthoritativeZones)
+			reloader.warnIfChanged(frontendName, "local records", oldDNSD.LocalRecords, newDNSD.LocalRecords)
+			reloader.warnIfChanged(frontendName, "allow and deny lists", [][]string{oldDNSD.AllowList, oldDNSD.DenyList}, [][]string{newDNSD.AllowList, newDNSD.DenyList})
+			reloader.warnIfChanged(frontendName, "block list sources", oldDNSD.BlockListSources, newDNSD.BlockListSources)
+			reloader.warnIfChanged(frontendName, "run-time entry file", oldDNSD.RuntimeEntryPath, newDNSD.RuntimeEntryPath)
+			reloader.warnIfChanged(frontendName, "rebinding protection", []interface{}{oldDNSD.RebindingProtection, oldDNSD.RebindingAllowList}, []interface{}{newDNSD.RebindingProtection, newDNSD.RebindingAllowList})
+			reloader.warnIfChanged(frontendName, "DNSSEC validation", []interface{}{oldDNSD.DNSSECValidation, oldDNSD.DNSSECTrustAnchors}, []interface{}{newDNSD.DNSSECValidation, newDNSD.DNSSECTrustAnchors})
+			reloader.warnIfChanged(frontendName, "secure tokens", oldDNSD.SecureTokens, newDNSD.SecureTokens)
+		case *httpd.HTTPD:
+			running.ReplaceHandlers(fresh[frontendName].(*httpd.HTTPD))
+		case *smtpd.SMTPD:
+			newDaemon := fresh[frontendName].(*smtpd.SMTPD)
+			running.MailProcessor.Processor.ReplaceWith(newDaemon.MailProcessor.Processor)
+			running.RateLimit.SetMaxCount(newDaemon.PerIPLimit)
+		case *plain.PlainTextDaemon:
+			newDaemon := fresh[frontendName].(*plain.PlainTextDaemon)
+			running.Processor.ReplaceWith(newDaemon.Processor)
+			running.RateLimit.SetMaxCount(newDaemon.PerIPLimit)
+		case *telegrambot.TelegramBot:
+			running.Processor.ReplaceWith(fresh[frontendName].(*telegrambot.TelegramBot).Processor)
+		default:
+			reloader.Logger.Warningf("Reload", frontendName, nil, "new configuration takes effect after a restart")
+			continue
+		}
+		reloader.Logger.Printf("Reload", frontendName, nil, "new configuration is now in effect")
+	}
+	reloader.Config = newConfig
+	return nil
+}
+
+// warnIfChanged logs a warning if the setting differs between old and new configuration, as it is not applied by reload.
+func (reloader *ConfigReloader) warnIfChanged(frontendName, setting string, oldValue, newValue interface{}) {
+	if !reflect.DeepEqual(oldValue, newValue) {
+		reloader.Logger.Warningf("Reload", frontendName, nil, "change of %s takes effect after a restart", setting)
+	}
+}
+
+// ReloadUponSIGHUP reloads configuration each time the program receives SIGHUP.
+func (reloader *ConfigReloader) ReloadUponSIGHUP() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			reloader.Logger.Printf("ReloadUponSIGHUP", "", nil, "received SIGHUP, going to reload configuration")
+			if err := reloader.Reload(); err != nil {
+				reloader.Logger.Warningf("ReloadUponSIGHUP", "", err, "failed to reload configuration")
+			}
+		}
+	}()
+}
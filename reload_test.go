@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"github.com/HouzuoGuo/laitos/feature"
+	"github.com/HouzuoGuo/laitos/frontend/httpd"
+	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
+	"github.com/HouzuoGuo/laitos/frontend/plain"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestConfigReloader(t *testing.T) {
+	template := `
+{
+  "HTTPBridges": {
+    "LintText": {"MaxLength": 35, "TrimSpaces": true},
+    "PINAndShortcuts": {"PIN": "%s"}
+  },
+  "HTTPDaemon": {
+    "Address": "127.0.0.1",
+    "BaseRateLimit": %d,
+    "Port": 23487
+  },
+  "HTTPHandlers": {
+    "DashboardEndpoint": "/dashboard",
+    "FileUploadEndpoint": "/upload",
+    "FileUploadEndpointConfig": {"UploadDir": "%s"},
+    "InformationEndpoint": "%s"
+  },
+  "PlainTextBridges": {
+    "LintText": {"MaxLength": 35, "TrimSpaces": true},
+    "PINAndShortcuts": {"PIN": "%s"}
+  },
+  "PlainTextDaemon": {
+    "Address": "127.0.0.1",
+    "PerIPLimit": %d,
+    "TCPPort": 17012
+  }
+}`
+	configFile, err := ioutil.TempFile("", "laitos-TestConfigReloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configFile.Name())
+	uploadDir, err := ioutil.TempDir("", "laitos-TestConfigReloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(uploadDir)
+	writeConfig := func(pin string, baseRateLimit int, uploadDir, infoEndpoint string) {
+		if err := ioutil.WriteFile(configFile.Name(), []byte(fmt.Sprintf(template, pin, baseRateLimit, uploadDir, infoEndpoint, pin, baseRateLimit)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("verysecret", 10, uploadDir, "/info")
+	var config Config
+	content, _ := ioutil.ReadFile(configFile.Name())
+	if err := config.DeserialiseFromJSON(content); err != nil {
+		t.Fatal(err)
+	}
+	reloader := NewConfigReloader(configFile.Name(), config)
+	httpDaemon := config.GetHTTPD()
+	plainDaemon := config.GetPlainTextDaemon()
+	reloader.Track("httpd", httpDaemon)
+	reloader.Track("plaintext", plainDaemon)
+
+	getStatus := func(daemon *httpd.HTTPD, path string) int {
+		recorder := httptest.NewRecorder()
+		daemon.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+	runCommand := func(daemon *plain.PlainTextDaemon, content string) error {
+		return daemon.Processor.Process(feature.Command{Content: content, TimeoutSec: 10}).Error
+	}
+	if status := getStatus(httpDaemon, "/info"); status == http.StatusNotFound {
+		t.Fatal(status)
+	}
+	if err := runCommand(plainDaemon, "verysecret.s echo hi"); err != nil {
+		t.Fatal(err)
+	}
+	// Make a share link of file upload, it should survive reload.
+	serveUpload := func(method, query string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/upload?"+query, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("", "")
+		recorder := httptest.NewRecorder()
+		httpDaemon.ServeHTTP(recorder, req)
+		return recorder
+	}
+	shareResp := serveUpload(http.MethodPost, "action=share", url.Values{"mode": {"upload"}, "password": {"verysecret"}})
+	shareToken := regexp.MustCompile(`share=([0-9a-f]+)`).FindStringSubmatch(shareResp.Body.String())
+	if len(shareToken) != 2 {
+		t.Fatal(shareResp.Code, shareResp.Body.String())
+	}
+
+	// Invalid configuration does not take effect, nor does it construct handlers.
+	writeConfig("verysecret", 0, path.Join(uploadDir, "new"), "/new_info")
+	if err := reloader.Reload(); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := os.Stat(path.Join(uploadDir, "new")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if status := getStatus(httpDaemon, "/info"); status == http.StatusNotFound {
+		t.Fatal(status)
+	}
+	// Valid configuration replaces handlers and processors of running daemons
+	writeConfig("newsecret", 10, uploadDir, "/new_info")
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if status := getStatus(httpDaemon, "/info"); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+	if status := getStatus(httpDaemon, "/new_info"); status == http.StatusNotFound {
+		t.Fatal(status)
+	}
+	if path := httpDaemon.GetHandlerByFactoryType(&api.HandleSystemInfo{}); path != "/new_info" {
+		t.Fatal(path)
+	}
+	if err := runCommand(plainDaemon, "verysecret.s echo hi"); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := runCommand(plainDaemon, "newsecret.s echo hi"); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged handler carries on with its share links, and uses the new PIN.
+	if resp := serveUpload(http.MethodGet, "share="+shareToken[1], nil); resp.Code != http.StatusOK {
+		t.Fatal(resp.Code, resp.Body.String())
+	}
+	if resp := serveUpload(http.MethodPost, "action=share", url.Values{"mode": {"upload"}, "password": {"verysecret"}}); resp.Code != http.StatusUnauthorized {
+		t.Fatal(resp.Code)
+	}
+	if resp := serveUpload(http.MethodPost, "action=share", url.Values{"mode": {"upload"}, "password": {"newsecret"}}); resp.Code != http.StatusOK {
+		t.Fatal(resp.Code)
+	}
+	// Feature command triggers reload too
+	defaultReloadConfig := feature.ReloadConfig
+	feature.ReloadConfig = reloader.Reload
+	defer func() {
+		feature.ReloadConfig = defaultReloadConfig
+	}()
+	writeConfig("anothersecret", 20, uploadDir, "/new_info")
+	if err := runCommand(plainDaemon, "newsecret.e reload"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand(plainDaemon, "anothersecret.s echo hi"); err != nil {
+		t.Fatal(err)
+	}
+	// Rate limit is replaced too
+	if plainDaemon.RateLimit.MaxCount != 20 {
+		t.Fatal(plainDaemon.RateLimit.MaxCount)
+	}
+	// Dashboard keeps its token for actions if its configuration did not change
+	getDashboardToken := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+		req.SetBasicAuth("", "anothersecret")
+		recorder := httptest.NewRecorder()
+		httpDaemon.ServeHTTP(recorder, req)
+		if match := regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`).FindStringSubmatch(recorder.Body.String()); len(match) == 2 {
+			return match[1]
+		}
+		t.Fatal(recorder.Code, recorder.Body.String())
+		return ""
+	}
+	token := getDashboardToken()
+	writeConfig("anothersecret", 30, uploadDir, "/new_info")
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if newToken := getDashboardToken(); newToken != token {
+		t.Fatal(newToken, token)
+	}
+}